@@ -0,0 +1,157 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/pkg/syblockchainfs"
+)
+
+func init() {
+	commands["chain"] = chain
+}
+
+// chainCommands are the subcommands of 'syvalidate chain', which query the
+// chains of the local cache and print the result in JSON
+var chainCommands = map[string]command{
+	"namespaces": chainNamespaces,
+	"list":       chainList,
+	"get":        chainGet,
+	"find":       chainFind,
+}
+
+func chain(args []string) error {
+	if len(args) == 0 || chainCommands[args[0]] == nil {
+		var names []string
+		for name := range chainCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("usage: syvalidate chain <%s> [options]", strings.Join(names, "|"))
+	}
+	return chainCommands[args[0]](args[1:])
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printBlocks(blocks []*blockchain.Block) error {
+	if blocks == nil {
+		blocks = []*blockchain.Block{}
+	}
+	return printJSON(blocks)
+}
+
+// chainNamespaces prints the namespaces of the local cache
+func chainNamespaces(args []string) error {
+	flags := flag.NewFlagSet("chain namespaces", flag.ExitOnError)
+	flags.Parse(args)
+
+	namespaces, err := syblockchainfs.Namespaces()
+	if err != nil {
+		return err
+	}
+	if namespaces == nil {
+		namespaces = []string{}
+	}
+	return printJSON(namespaces)
+}
+
+// chainList prints the blocks of a namespace
+func chainList(args []string) error {
+	flags := flag.NewFlagSet("chain list", flag.ExitOnError)
+	namespace := flags.String("namespace", "", "Namespace of the chain")
+	from := flags.Uint64("from", 0, "Height of the first block")
+	count := flags.Uint64("count", 0, "Maximum number of blocks, all the blocks by default")
+	flags.Parse(args)
+	if *namespace == "" {
+		return fmt.Errorf("a namespace is required")
+	}
+
+	blocks, err := syblockchainfs.ListBlocks(*namespace, *from, *count)
+	if err != nil {
+		return err
+	}
+	return printBlocks(blocks)
+}
+
+// chainGet prints a block identified by its hash or height
+func chainGet(args []string) error {
+	flags := flag.NewFlagSet("chain get", flag.ExitOnError)
+	namespace := flags.String("namespace", "", "Namespace of the chain")
+	hash := flags.String("hash", "", "Hash of the block")
+	height := flags.Int64("height", -1, "Height of the block")
+	flags.Parse(args)
+	if *namespace == "" {
+		return fmt.Errorf("a namespace is required")
+	}
+	if (*hash == "") == (*height < 0) {
+		return fmt.Errorf("either a hash or a height is required")
+	}
+
+	var b *blockchain.Block
+	var err error
+	if *hash != "" {
+		b, err = syblockchainfs.GetBlock(*namespace, *hash)
+	} else {
+		b, err = syblockchainfs.GetBlockAt(*namespace, uint64(*height))
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
+
+func parseQueryTime(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s date %s, expected RFC 3339 format, e.g., 2019-12-16T22:18:15Z", name, value)
+	}
+	return t, nil
+}
+
+// chainFind prints the blocks matching a query
+func chainFind(args []string) error {
+	flags := flag.NewFlagSet("chain find", flag.ExitOnError)
+	namespace := flags.String("namespace", "", "Namespace of the chain, all the namespaces are searched by default")
+	var q blockchain.Query
+	flags.StringVar(&q.ManifestName, "manifest", "", "Name of a manifest of the blocks, e.g., openmpi-4.0.2")
+	flags.StringVar(&q.ManifestHash, "manifest-hash", "", "Hash of a manifest of the blocks")
+	flags.StringVar(&q.Resource, "resource", "", "Resource of a stamp of the blocks, i.e., the identity of the node that did the work: node ID, interface address, hostname or key fingerprint")
+	since := flags.String("since", "", "Only blocks committed at or after this date (RFC 3339)")
+	until := flags.String("until", "", "Only blocks committed before this date (RFC 3339)")
+	flags.Parse(args)
+
+	var err error
+	q.Since, err = parseQueryTime("since", *since)
+	if err != nil {
+		return err
+	}
+	q.Until, err = parseQueryTime("until", *until)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := syblockchainfs.FindBlocks(*namespace, q)
+	if err != nil {
+		return err
+	}
+	return printBlocks(blocks)
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+// command is a subcommand of syvalidate, e.g., 'syvalidate verify'; it gets
+// the arguments following its name
+type command func(args []string) error
+
+// commands are the subcommands of syvalidate. They are dispatched before the
+// configuration of the MPI experiments is loaded since they do not need it.
+var commands = make(map[string]command)
@@ -0,0 +1,240 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+	"github.com/sylabs/syvalidate/pkg/syblockchainfs"
+)
+
+const testNamespace = "test-commands"
+
+func setTestCacheDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "syvalidate-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	prev, isSet := os.LookupEnv(cache.CacheLocalationEnvDir)
+	os.Setenv(cache.CacheLocalationEnvDir, dir)
+
+	return dir, func() {
+		if isSet {
+			os.Setenv(cache.CacheLocalationEnvDir, prev)
+		} else {
+			os.Unsetenv(cache.CacheLocalationEnvDir)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// createTestChain commits a block with a manifest to the chain of the test
+// namespace of the local cache
+func createTestChain(t *testing.T, dir string) {
+	// A low difficulty keeps the minting of the stamp fast
+	_, err := blockchain.CreateNamespaceWithConfig(testNamespace, blockchain.NamespaceConfig{Difficulty: 8})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	fs, err := syblockchainfs.Init(&syblockchainfs.Info{
+		Namespace: testNamespace,
+		Identity:  identity.Config{NodeID: "node0"},
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize in isolated mode: %s", err)
+	}
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		t.Fatalf("failed to get the key of the node: %s", err)
+	}
+
+	path := filepath.Join(dir, "openmpi-4.0.2.MANIFEST")
+	err = ioutil.WriteFile(path, []byte("results of openmpi-4.0.2"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create manifest: %s", err)
+	}
+	stamp := fs.CreateStamp(fs.Resource())
+	err = stamp.AddManifest(path, hashcash.KindResult)
+	if err != nil {
+		t.Fatalf("failed to add manifest: %s", err)
+	}
+	stamp.Sign(kp.Private)
+	err = fs.CreateBlock(stamp, []string{path})
+	if err != nil {
+		t.Fatalf("failed to create block: %s", err)
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	dir, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	// An empty cache has nothing to verify
+	err := commands["verify"](nil)
+	if err != nil {
+		t.Fatalf("failed to verify an empty cache: %s", err)
+	}
+
+	createTestChain(t, dir)
+	err = commands["verify"](nil)
+	if err != nil {
+		t.Fatalf("failed to verify the local block store: %s", err)
+	}
+	err = commands["verify"]([]string{"-namespace", testNamespace})
+	if err != nil {
+		t.Fatalf("failed to verify %s: %s", testNamespace, err)
+	}
+	err = commands["verify"]([]string{"-chain", filepath.Join(dir, "missing")})
+	if err == nil {
+		t.Fatal("a missing chain file was verified")
+	}
+}
+
+func TestChainCommand(t *testing.T) {
+	dir, cleanup := setTestCacheDir(t)
+	defer cleanup()
+	createTestChain(t, dir)
+
+	valid := [][]string{
+		{"namespaces"},
+		{"list", "-namespace", testNamespace},
+		{"get", "-namespace", testNamespace, "-height", "1"},
+		{"find", "-resource", "node0", "-since", "2019-12-16T22:18:15Z"},
+	}
+	for _, args := range valid {
+		err := commands["chain"](args)
+		if err != nil {
+			t.Fatalf("chain %v failed: %s", args, err)
+		}
+	}
+
+	invalid := [][]string{
+		nil,
+		{"unknown"},
+		{"list"},
+		{"get", "-namespace", testNamespace},
+		{"get", "-namespace", testNamespace, "-height", "42"},
+		{"find", "-since", "yesterday"},
+	}
+	for _, args := range invalid {
+		err := commands["chain"](args)
+		if err == nil {
+			t.Fatalf("chain %v did not fail", args)
+		}
+	}
+}
+
+func TestKeysCommand(t *testing.T) {
+	dir, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	// Nothing to export before the key pair is generated
+	err := commands["keys"]([]string{"export"})
+	if err == nil {
+		t.Fatal("the key of the node was exported before it was generated")
+	}
+	for _, args := range [][]string{{"list"}, {"generate"}, {"list"}} {
+		err := commands["keys"](args)
+		if err != nil {
+			t.Fatalf("keys %v failed: %s", args, err)
+		}
+	}
+	err = commands["keys"]([]string{"generate"})
+	if err == nil {
+		t.Fatal("the key pair of the node was replaced without -force")
+	}
+
+	// The exported key of the node can be trusted by another node
+	path := filepath.Join(dir, "node.pub")
+	err = commands["keys"]([]string{"export", "-o", path})
+	if err != nil {
+		t.Fatalf("failed to export the key of the node: %s", err)
+	}
+	err = commands["keys"]([]string{"trust", "-name", "node1", "-file", path})
+	if err != nil {
+		t.Fatalf("failed to trust the exported key: %s", err)
+	}
+	kp, err := keys.Load(cache.GetBasedir())
+	if err != nil {
+		t.Fatalf("failed to load the key of the node: %s", err)
+	}
+	trusted, err := keys.ListTrusted(cache.GetBasedir())
+	if err != nil || len(trusted) != 1 || trusted[0].Name != "node1" || trusted[0].Fingerprint != keys.Fingerprint(kp.Public) {
+		t.Fatalf("trusted keys are %+v (%v)", trusted, err)
+	}
+
+	for _, args := range [][]string{nil, {"unknown"}, {"trust", "-file", path}, {"trust", "-name", "node2"}} {
+		err := commands["keys"](args)
+		if err == nil {
+			t.Fatalf("keys %v did not fail", args)
+		}
+	}
+}
+
+func TestNodeCommand(t *testing.T) {
+	_, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	for _, args := range [][]string{nil, {"unknown"}, {"run"}, {"status"}} {
+		err := commands["node"](args)
+		if err == nil {
+			t.Fatalf("node %v did not fail", args)
+		}
+	}
+	_, err := parsePeers([]string{"node1=10.0.0.1:4242", "node2"})
+	if err == nil {
+		t.Fatal("a peer without a URL was parsed")
+	}
+
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		t.Fatalf("failed to get the key of the node: %s", err)
+	}
+	peers, err := parsePeers([]string{"node1=10.0.0.1:4242"})
+	if err != nil {
+		t.Fatalf("failed to parse peers: %s", err)
+	}
+	_, err = peerKeys("node0", kp, peers)
+	if err == nil {
+		t.Fatal("a peer without a trusted key was accepted")
+	}
+
+	// The status of a running node can be queried
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to allocate port: %s", err)
+	}
+	url := l.Addr().String()
+	l.Close()
+	pubKeys, err := peerKeys("node0", kp, nil)
+	if err != nil {
+		t.Fatalf("failed to get the keys of the nodes: %s", err)
+	}
+	n, err := blockchain.StartNode(blockchain.NodeConfig{
+		ID:         "node0",
+		URL:        url,
+		Peers:      []blockchain.PeerRecord{{ID: "node0", URL: url}},
+		PrivateKey: kp.Private,
+		PublicKeys: pubKeys,
+	})
+	if err != nil {
+		t.Fatalf("failed to start node: %s", err)
+	}
+	defer n.Stop()
+	err = commands["node"]([]string{"status", url})
+	if err != nil {
+		t.Fatalf("failed to get the status of the node: %s", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+func init() {
+	commands["keys"] = keysCmd
+}
+
+// keysCommands are the subcommands of 'syvalidate keys', which manage the key
+// pair of the local node and the keys of the peers it trusts
+var keysCommands = map[string]command{
+	"generate": keysGenerate,
+	"list":     keysList,
+	"export":   keysExport,
+	"trust":    keysTrust,
+}
+
+func keysCmd(args []string) error {
+	if len(args) == 0 || keysCommands[args[0]] == nil {
+		var names []string
+		for name := range keysCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("usage: syvalidate keys <%s> [options]", strings.Join(names, "|"))
+	}
+	return keysCommands[args[0]](args[1:])
+}
+
+// nodeKey describes the public key of the local node
+type nodeKey struct {
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func describeKey(kp keys.KeyPair) nodeKey {
+	return nodeKey{
+		Key:         keys.EncodePublicKey(kp.Public),
+		Fingerprint: keys.Fingerprint(kp.Public),
+	}
+}
+
+// keysGenerate creates the key pair of the local node
+func keysGenerate(args []string) error {
+	flags := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	force := flags.Bool("force", false, "Replace the existing key pair; the blocks and stamps signed with it are not trusted by the peers anymore")
+	flags.Parse(args)
+
+	kp, err := keys.Generate(cache.GetBasedir(), *force)
+	if err != nil {
+		return err
+	}
+	return printJSON(describeKey(kp))
+}
+
+// keysList prints the public key of the local node and the keys of the
+// trusted peers
+func keysList(args []string) error {
+	flags := flag.NewFlagSet("keys list", flag.ExitOnError)
+	flags.Parse(args)
+
+	var list struct {
+		Node    *nodeKey          `json:"node"`
+		Trusted []keys.TrustedKey `json:"trusted"`
+	}
+	kp, err := keys.Load(cache.GetBasedir())
+	if err == nil {
+		k := describeKey(kp)
+		list.Node = &k
+	}
+	list.Trusted, err = keys.ListTrusted(cache.GetBasedir())
+	if err != nil {
+		return err
+	}
+	if list.Trusted == nil {
+		list.Trusted = []keys.TrustedKey{}
+	}
+	return printJSON(&list)
+}
+
+// keysExport prints the public key of the local node, e.g., to trust it on
+// the other nodes
+func keysExport(args []string) error {
+	flags := flag.NewFlagSet("keys export", flag.ExitOnError)
+	output := flags.String("o", "", "File where the public key is written, printed by default")
+	flags.Parse(args)
+
+	kp, err := keys.Load(cache.GetBasedir())
+	if err != nil {
+		return fmt.Errorf("%s, create one with 'syvalidate keys generate'", err)
+	}
+	key := keys.EncodePublicKey(kp.Public)
+	if *output == "" {
+		fmt.Println(key)
+		return nil
+	}
+	err = ioutil.WriteFile(*output, []byte(key+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", *output, err)
+	}
+	return nil
+}
+
+// keysTrust adds the public key of a peer to the trusted keys
+func keysTrust(args []string) error {
+	flags := flag.NewFlagSet("keys trust", flag.ExitOnError)
+	name := flags.String("name", "", "Name of the peer")
+	key := flags.String("key", "", "Public key of the peer, as exported by 'syvalidate keys export'")
+	file := flags.String("file", "", "File with the public key of the peer")
+	flags.Parse(args)
+	if *name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	if (*key == "") == (*file == "") {
+		return fmt.Errorf("either a key or a file is required")
+	}
+
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", *file, err)
+		}
+		*key = string(data)
+	}
+	pub, err := keys.ParsePublicKey(*key)
+	if err != nil {
+		return err
+	}
+	err = keys.Trust(cache.GetBasedir(), *name, pub)
+	if err != nil {
+		return err
+	}
+	return printJSON(&keys.TrustedKey{
+		Name:        *name,
+		Key:         keys.EncodePublicKey(pub),
+		Fingerprint: keys.Fingerprint(pub),
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+	"github.com/sylabs/syvalidate/pkg/syblockchainfs"
+)
+
+func init() {
+	commands["node"] = nodeCmd
+}
+
+// nodeCommands are the subcommands of 'syvalidate node', which runs a node of
+// a connected network
+var nodeCommands = map[string]command{
+	"run":    nodeRun,
+	"status": nodeStatus,
+}
+
+func nodeCmd(args []string) error {
+	if len(args) == 0 || nodeCommands[args[0]] == nil {
+		var names []string
+		for name := range nodeCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("usage: syvalidate node <%s> [options]", strings.Join(names, "|"))
+	}
+	return nodeCommands[args[0]](args[1:])
+}
+
+// listFlag is a flag that can be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parsePeers parses peers given as id=url
+func parsePeers(list []string) ([]blockchain.PeerRecord, error) {
+	var peers []blockchain.PeerRecord
+	for _, p := range list {
+		i := strings.Index(p, "=")
+		if i <= 0 || i == len(p)-1 {
+			return nil, fmt.Errorf("invalid peer %q, expected id=url", p)
+		}
+		peers = append(peers, blockchain.PeerRecord{ID: p[:i], URL: p[i+1:]})
+	}
+	return peers, nil
+}
+
+// peerKeys returns the public keys of the nodes, which are the keys of the
+// peers trusted under their identifiers and the key of the local node
+func peerKeys(id string, kp keys.KeyPair, peers []blockchain.PeerRecord) (map[string]ed25519.PublicKey, error) {
+	trusted, err := keys.ListTrusted(cache.GetBasedir())
+	if err != nil {
+		return nil, err
+	}
+	pubKeys := map[string]ed25519.PublicKey{id: kp.Public}
+	for _, t := range trusted {
+		key, err := keys.ParsePublicKey(t.Key)
+		if err != nil {
+			return nil, err
+		}
+		pubKeys[t.Name] = key
+	}
+	for _, p := range peers {
+		if pubKeys[p.ID] == nil {
+			return nil, fmt.Errorf("no trusted key for peer %s, see 'syvalidate keys trust'", p.ID)
+		}
+	}
+	return pubKeys, nil
+}
+
+// nodeRun runs a node of a connected network until it is interrupted
+func nodeRun(args []string) error {
+	flags := flag.NewFlagSet("node run", flag.ExitOnError)
+	id := flags.String("id", "", "Identifier of the node, the identity of the node by default (see SY_NODE_ID)")
+	listen := flags.String("listen", "", "Address the node listens on, e.g., 10.0.0.1:4242")
+	consensus := flags.String("consensus", "", "Consensus algorithm of the network: pbft (default) or raft")
+	timeout := flags.Duration("timeout", 0, "Time after which the leader is suspected, the default of the consensus algorithm if not set")
+	flush := flags.Duration("flush", time.Second, "Interval at which the leader forms blocks out of the pending stamps")
+	difficulty := flags.Int("difficulty", 0, "Initial difficulty of the namespaces created by the node")
+	lead := flags.Bool("lead", false, "Start an election when the node starts")
+	var peerList, namespaces listFlag
+	flags.Var(&peerList, "peer", "Other node of the network, as id=url; can be repeated")
+	flags.Var(&namespaces, "namespace", "Namespace the leader creates if it does not exist yet; can be repeated")
+	flags.Parse(args)
+
+	if *listen == "" {
+		return fmt.Errorf("the address to listen on is required")
+	}
+	fs, err := syblockchainfs.Init(&syblockchainfs.Info{
+		Connected: true,
+		Consensus: blockchain.ConsensusType(*consensus),
+		Identity:  identity.ConfigFromEnv(),
+	})
+	if err != nil {
+		return err
+	}
+	if *id == "" {
+		*id = fs.Resource()
+	}
+	peers, err := parsePeers(peerList)
+	if err != nil {
+		return err
+	}
+
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		return err
+	}
+	cfg := blockchain.NodeConfig{
+		ID:            *id,
+		URL:           *listen,
+		Peers:         append(peers, blockchain.PeerRecord{ID: *id, URL: *listen}),
+		Consensus:     fs.Consensus(),
+		PrivateKey:    kp.Private,
+		Timeout:       *timeout,
+		FlushInterval: *flush,
+		Namespaces:    make(map[string]blockchain.NamespaceConfig),
+		OnRoleChange: func(role blockchain.Role, leader string) {
+			mode := syblockchainfs.PeerMode
+			if role == blockchain.RoleLeader {
+				mode = syblockchainfs.LeaderMode
+			}
+			err := fs.Switch(mode)
+			if err != nil {
+				log.Printf("[ERROR] %s", err)
+			}
+		},
+	}
+	cfg.PublicKeys, err = peerKeys(*id, kp, peers)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		cfg.Namespaces[ns] = blockchain.NamespaceConfig{Difficulty: *difficulty}
+	}
+
+	n, err := blockchain.StartNode(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] node %s listening on %s", n.ID(), n.Addr())
+	if *lead {
+		n.StartElection()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	n.Stop()
+	return nil
+}
+
+// nodeStatus prints the role of a node and the heads of its chains
+func nodeStatus(args []string) error {
+	flags := flag.NewFlagSet("node status", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: syvalidate node status <url>")
+	}
+
+	peer := &comm.PeerInfo{URL: flags.Arg(0)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := peer.ConnectContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	status, err := blockchain.ReqNodeStatus(peer)
+	if err != nil {
+		return err
+	}
+	return printJSON(status)
+}
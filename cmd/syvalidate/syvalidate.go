@@ -253,6 +253,17 @@ func testMPI(mpiImplem string, experiments []exp.Config, sysCfg sys.Config, syCo
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			err := cmd(os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	sysCfg, _, _, err := launcher.Load()
 	if err != nil {
 		log.Fatalf("unable to load configuration: %s", err)
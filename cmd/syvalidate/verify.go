@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+func init() {
+	commands["verify"] = verify
+}
+
+// verify checks the chains of blocks of the local block store or exported to
+// a file
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	chainFile := flags.String("chain", "", "Path to a file with the blocks to verify, one JSON-encoded block per line; the local block store is verified by default")
+	namespace := flags.String("namespace", "", "Namespace of the chain to verify, all the namespaces are verified by default")
+	manifestDir := flags.String("manifests", "", "Directory where the manifests referenced by the blocks of the chain file are stored; manifests are not checked if not set")
+	flags.Parse(args)
+
+	var chain blockchain.ChainReader
+	var namespaces []string
+	var opts blockchain.VerifyOptions
+	if *chainFile != "" {
+		f, err := os.Open(*chainFile)
+		if err != nil {
+			return fmt.Errorf("unable to open %s: %s", *chainFile, err)
+		}
+		defer f.Close()
+		c, err := blockchain.ReadChain(f)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", *chainFile, err)
+		}
+		chain = c
+		namespaces = c.Namespaces()
+
+		if *manifestDir != "" {
+			opts.ManifestPath = func(name string, hash string) string {
+				// Names come from the chain file, they must not lead out of
+				// the directory of the manifests
+				file := filepath.Clean(name + ".MANIFEST")
+				if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+					return ""
+				}
+				path := filepath.Join(*manifestDir, file)
+				if _, err := os.Stat(path); err != nil {
+					return ""
+				}
+				return path
+			}
+		}
+	} else {
+		s, err := blockchain.LocalBlockStore()
+		if err != nil {
+			return fmt.Errorf("unable to open the local block store: %s", err)
+		}
+		defer s.Close()
+		chain = s
+		namespaces, err = cache.LoadNamespaces(cache.GetBasedir())
+		if err != nil {
+			return err
+		}
+
+		// Manifests are stored by content along with the blocks
+		opts.ManifestPath = s.ManifestPath
+	}
+
+	if *namespace != "" {
+		namespaces = []string{*namespace}
+	}
+	for _, ns := range namespaces {
+		n, err := chain.Len(ns)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// The namespace is known to the cache but none of its blocks
+			// was ever stored
+			fmt.Printf("%s: no chain\n", ns)
+			continue
+		}
+		err = blockchain.Verify(chain, ns, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d blocks verified\n", ns, n)
+	}
+
+	return nil
+}
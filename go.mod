@@ -1,10 +1,9 @@
 module github.com/sylabs/syvalidate
 
-go 1.12
+go 1.13
 
 require (
 	github.com/gvallee/go_util v1.0.0
 	github.com/gvallee/kv v1.0.0
-	github.com/gvallee/syserror v1.0.0
 	github.com/sylabs/singularity-mpi v1.2.2
 )
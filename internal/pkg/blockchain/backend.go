@@ -5,14 +5,38 @@
 
 package blockchain
 
+import (
+	"fmt"
+)
+
 // LocalStore stores the blockchain locally using our
 // BlockFS file system
 func (b *Block) LocalStore() error {
-	// Write all manifests to the FS
-	sz, err = fs.Write()
+	s, err := LocalBlockStore()
+	if err != nil {
+		return err
+	}
 
-	// Write the block itself
-	sz, err = fs.Write()
+	// Write all manifests to the FS; they are stored by content so the
+	// blocks only need their hash
+	manifests, err := b.stampManifests()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]bool)
+	for _, m := range manifests {
+		hashes[m.SHA256] = true
+	}
+	for _, path := range b.manifests {
+		hash, err := s.PutFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to store manifest %s: %s", path, err)
+		}
+		if !hashes[hash] {
+			return fmt.Errorf("manifest %s is not part of the stamps of the block", path)
+		}
+	}
 
-	return nil
+	// Write the block itself
+	return s.Append(b)
 }
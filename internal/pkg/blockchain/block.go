@@ -6,80 +6,408 @@
 package blockchain
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/sylabs/singularity-mpi/pkg/sys"
 	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
 )
 
+// blockFormatVersion is part of the hashed data so that a change of the
+// encoding can never produce the hash of a block in the previous format
+const blockFormatVersion = 2
+
 type Block struct {
-	h     string
-	stamp hashcash.Stamp
-	prev  string
+	namespace  string
+	height     uint64
+	timestamp  time.Time
+	prev       string
+	stamps     []hashcash.Stamp
+	merkleRoot string
+	h          string
+
+	// signer is the public key of the node that committed the block, which
+	// signed its hash
+	signer    ed25519.PublicKey
+	signature []byte
+
+	// genesis is only set for the first block of a chain, which describes
+	// the namespace instead of carrying stamps
+	genesis *NamespaceInfo
+
+	// manifests are the paths to the local copies of the manifests of the
+	// stamps, stored along with the block; they are not part of the block
+	manifests []string
+}
+
+// commitLock serializes the commit of local blocks, so that two blocks are
+// never chained to the same previous block. The head of the chain of every
+// namespace is tracked by the block store, which also rejects the blocks that
+// are not linked to it, e.g., when a synchronization got in the way.
+var commitLock sync.Mutex
+
+// Namespace returns the namespace of the chain the block belongs to
+func (b *Block) Namespace() string {
+	return b.namespace
+}
+
+// Height returns the position of the block in the chain, the first block
+// being at height 0
+func (b *Block) Height() uint64 {
+	return b.height
+}
+
+// Timestamp returns the time at which the block was committed
+func (b *Block) Timestamp() time.Time {
+	return b.timestamp
+}
+
+// Prev returns the hash of the previous block, empty for the first block
+// of a chain
+func (b *Block) Prev() string {
+	return b.prev
+}
+
+// Signer returns the public key of the node that committed the block
+func (b *Block) Signer() ed25519.PublicKey {
+	return b.signer
+}
+
+// Genesis returns the description of the namespace carried by the first
+// block of a chain, nil for the other blocks
+func (b *Block) Genesis() *NamespaceInfo {
+	return b.genesis
+}
+
+// serializedStamps returns the stamps as they are hashed and exchanged
+func (b *Block) serializedStamps() []string {
+	var stamps []string
+	for i := range b.stamps {
+		stamps = append(stamps, b.stamps[i].Serialize())
+	}
+	return stamps
+}
+
+// Stamps returns the stamps the block was created from, none for a genesis
+// block
+func (b *Block) Stamps() []hashcash.Stamp {
+	return b.stamps
+}
+
+// entries returns the manifest entries of all the stamps of the block, as
+// encoded in the stamps and in the order of the stamps
+func (b *Block) entries() []string {
+	var entries []string
+	for i := range b.stamps {
+		entries = append(entries, b.stamps[i].ManifestEntries()...)
+	}
+	return entries
+}
+
+// stampManifests returns the manifests of all the stamps of the block, in the
+// order of the stamps
+func (b *Block) stampManifests() ([]hashcash.Manifest, error) {
+	var manifests []hashcash.Manifest
+	for i := range b.stamps {
+		m, err := b.stamps[i].Manifests()
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m...)
+	}
+	return manifests, nil
+}
+
+// MerkleRoot returns the Merkle root of the manifests included in the block
+func (b *Block) MerkleRoot() string {
+	return b.merkleRoot
+}
+
+// Hash returns the hash of the block, empty until the block is committed
+func (b *Block) Hash() string {
+	return b.h
+}
+
+// writeField appends a length-prefixed field to a canonical encoding
+func writeField(buf *bytes.Buffer, data []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+	buf.Write(size[:])
+	buf.Write(data)
+}
+
+// canonical returns the encoding of the block that is hashed: all the fields
+// but the hash itself, in a fixed order, each of them prefixed by its size so
+// that no two different blocks have the same encoding
+func (b *Block) canonical() []byte {
+	var buf bytes.Buffer
+	var n [8]byte
+
+	binary.BigEndian.PutUint64(n[:], blockFormatVersion)
+	writeField(&buf, n[:])
+	writeField(&buf, []byte(b.namespace))
+	binary.BigEndian.PutUint64(n[:], b.height)
+	writeField(&buf, n[:])
+	binary.BigEndian.PutUint64(n[:], uint64(b.timestamp.UnixNano()))
+	writeField(&buf, n[:])
+	writeField(&buf, []byte(b.prev))
+	binary.BigEndian.PutUint64(n[:], uint64(len(b.stamps)))
+	writeField(&buf, n[:])
+	for _, stamp := range b.serializedStamps() {
+		writeField(&buf, []byte(stamp))
+	}
+	writeField(&buf, []byte(b.merkleRoot))
+	var genesis []byte
+	if b.genesis != nil {
+		// Encoding a struct without maps is deterministic
+		genesis, _ = json.Marshal(b.genesis)
+	}
+	writeField(&buf, genesis)
+
+	return buf.Bytes()
+}
+
+// computeHash returns the SHA-256 hash of the canonical encoding of the block
+func (b *Block) computeHash() string {
+	h := sha256.Sum256(b.canonical())
+	return hex.EncodeToString(h[:])
 }
 
 func (b *Block) hash() error {
-	// b.hash = prev + stamp
+	if b.timestamp.IsZero() {
+		return fmt.Errorf("block has no timestamp")
+	}
+
+	b.merkleRoot = MerkleRoot(b.entries())
+	b.h = b.computeHash()
 
 	return nil
 }
 
-func (b *Block) setPreviousHash() error {
-	// Return current previous
+// sign signs the hash of the block with the key of the node committing it
+func (b *Block) sign(kp keys.KeyPair) {
+	b.signer = kp.Public
+	b.signature = ed25519.Sign(kp.Private, []byte(b.h))
+}
+
+// verifySignature checks that the hash of the block is signed by its signer
+func (b *Block) verifySignature() error {
+	if len(b.signer) == 0 || len(b.signature) == 0 {
+		return fmt.Errorf("block is not signed")
+	}
+	if len(b.signer) != ed25519.PublicKeySize || !ed25519.Verify(b.signer, []byte(b.h), b.signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
 
-	// Update previous with the new hash
+// setPreviousHash links the block to the head of the chain of its namespace;
+// commitLock must be held
+func (b *Block) setPreviousHash(s *BlockStore) error {
+	head, err := s.Head(b.namespace)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		if b.genesis == nil {
+			return fmt.Errorf("namespace %s does not exist", b.namespace)
+		}
+		b.height = 0
+		b.prev = ""
+		return nil
+	}
+	if b.genesis != nil {
+		return fmt.Errorf("namespace %s already exists", b.namespace)
+	}
 
+	b.height = head.height + 1
+	b.prev = head.h
 	return nil
 }
 
-func updatePreviousHash(hash string) error {
+// seal links the block to the head of the chain of its namespace in a store,
+// hashes it to make it immutable and signs it with the key of the node
+func (b *Block) seal(s *BlockStore) error {
+	// Get previous hash
+	err := b.setPreviousHash(s)
+	if err != nil {
+		return fmt.Errorf("failed to link block to the chain: %s", err)
+	}
+
+	// Hash the block to make it immutable
+	b.timestamp = time.Now().UTC()
+	err = b.hash()
+	if err != nil {
+		return fmt.Errorf("failed to hash block: %s", err)
+	}
+	kp, err := keys.LoadOrGenerate(s.basedir)
+	if err != nil {
+		return fmt.Errorf("failed to get the key to sign block: %s", err)
+	}
+	b.sign(kp)
+
 	return nil
 }
 
 // commitBlock makes the block immutable; this is save it to the local
-// BlockFS for persistency but *not* publish it
+// BlockFS for persistency but *not* publish it. The stamps of the block must
+// not be spent yet and are recorded as spent once the block is stored.
 func (b *Block) commitBlock() error {
-	// Lock
-
-	// Get previous hash
-	b.setPreviousHash()
+	commitLock.Lock()
+	defer commitLock.Unlock()
 
-	// Hash the block to make it immutable
-	err := b.hash()
+	s, err := LocalBlockStore()
 	if err != nil {
-		return fmt.Errorf("failed to hash stamp")
+		return err
+	}
+	for i := range b.stamps {
+		spent, err := b.stamps[i].IsSpent()
+		if err != nil {
+			return fmt.Errorf("unable to check the spent database: %w", err)
+		}
+		if spent {
+			return fmt.Errorf("stamp %d: %w", i, hashcash.HashCashSpentErr)
+		}
 	}
 
-	// The previous hash becomes the hash of the new block
-	err = updatePreviousHash(b.h)
+	err = b.seal(s)
 	if err != nil {
-		return fmt.Errorf("unable to update the previous hash: %s", err)
+		return err
 	}
 
-	// Persist block (which includes all the manifest from the stamp)
+	// Persist block (which includes all the manifest from the stamp); the
+	// block becomes the head of the chain and its hash the previous hash of
+	// the next block
 	err = b.LocalStore()
 	if err != nil {
 		return fmt.Errorf("impossible to persist block: %s", err)
 	}
+	spendStamps(b.stamps)
+
+	return nil
+}
+
+// ChainHead returns the height and hash of the last block committed to the
+// chain of a namespace; ok is false when the chain is empty
+func ChainHead(namespace string) (height uint64, hash string, ok bool, err error) {
+	s, err := LocalBlockStore()
+	if err != nil {
+		return 0, "", false, err
+	}
+	head, err := s.Head(namespace)
+	if err != nil || head == nil {
+		return 0, "", false, err
+	}
+	return head.height, head.h, true, nil
+}
+
+// blockJSON is the exchange format of blocks; the stamps are in their
+// serialized form, which is what the hash of the block covers
+type blockJSON struct {
+	Namespace  string    `json:"namespace"`
+	Height     uint64    `json:"height"`
+	Timestamp  time.Time `json:"timestamp"`
+	Prev       string    `json:"prev"`
+	Stamps     []string  `json:"stamps,omitempty"`
+	MerkleRoot string    `json:"merkle_root"`
+	Hash       string    `json:"hash"`
+	Signer     string    `json:"signer,omitempty"`
+	Signature  string    `json:"signature,omitempty"`
+
+	Genesis *NamespaceInfo `json:"genesis,omitempty"`
+}
+
+// MarshalJSON encodes a block, including its hash
+func (b *Block) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&blockJSON{
+		Namespace:  b.namespace,
+		Height:     b.height,
+		Timestamp:  b.timestamp,
+		Prev:       b.prev,
+		Stamps:     b.serializedStamps(),
+		MerkleRoot: b.merkleRoot,
+		Hash:       b.h,
+		Signer:     hex.EncodeToString(b.signer),
+		Signature:  hex.EncodeToString(b.signature),
+		Genesis:    b.genesis,
+	})
+}
 
-	// Unlock
+// UnmarshalJSON decodes a block; the block is not verified
+func (b *Block) UnmarshalJSON(data []byte) error {
+	var bj blockJSON
+	err := json.Unmarshal(data, &bj)
+	if err != nil {
+		return err
+	}
+	var stamps []hashcash.Stamp
+	for _, str := range bj.Stamps {
+		stamp, err := hashcash.Parse(str)
+		if err != nil {
+			return fmt.Errorf("invalid stamp in block %s: %w", bj.Hash, err)
+		}
+		stamps = append(stamps, stamp)
+	}
+	signer, err := hex.DecodeString(bj.Signer)
+	if err != nil {
+		return fmt.Errorf("invalid signer of block %s: %s", bj.Hash, err)
+	}
+	signature, err := hex.DecodeString(bj.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature of block %s: %s", bj.Hash, err)
+	}
 
+	*b = Block{
+		namespace:  bj.Namespace,
+		height:     bj.Height,
+		timestamp:  bj.Timestamp,
+		prev:       bj.Prev,
+		stamps:     stamps,
+		merkleRoot: bj.MerkleRoot,
+		h:          bj.Hash,
+		signer:     signer,
+		signature:  signature,
+		genesis:    bj.Genesis,
+	}
 	return nil
 }
 
-// IsolatedCreate locally creates a new block from a stamp
-func IsolatedCreate(stamp hashcash.Stamp) (Block, error) {
+// IsolatedCreate locally creates a new block of a namespace from a stamp
+func IsolatedCreate(namespace string, stamp hashcash.Stamp) (Block, error) {
+	if namespace == "" {
+		return Block{}, fmt.Errorf("undefined namespace")
+	}
+	return BatchCreate(namespace, []hashcash.Stamp{stamp})
+}
+
+// BatchCreate locally creates a new block of a namespace from several stamps,
+// e.g., the stamps submitted to the leader since the last block
+func BatchCreate(namespace string, stamps []hashcash.Stamp) (Block, error) {
+	if namespace == "" {
+		return Block{}, fmt.Errorf("undefined namespace")
+	}
+	if len(stamps) == 0 {
+		return Block{}, fmt.Errorf("no stamp")
+	}
 	b := Block{
-		stamp: stamp,
+		namespace: namespace,
+		stamps:    append([]hashcash.Stamp(nil), stamps...),
 	}
 	return b, nil
 }
 
-// ConnectedCreate initiates a consensus operation to get a new block
-func ConnectedCreate(stamp hashcash.Stamp) error {
-	// Send the stamp (which will actually create a block and chain it)
-
-	return nil
+// AttachManifest adds the local copy of a manifest of a stamp, which is
+// stored along with the block when it is committed
+func (b *Block) AttachManifest(path string) {
+	b.manifests = append(b.manifests, path)
 }
 
 // Publish submit the block, which will link it to the previous block
@@ -87,7 +415,7 @@ func (b *Block) Publish(sysCfg *sys.Config) error {
 	// Commit the block which persists the data
 	err := b.commitBlock()
 	if err != nil {
-		return fmt.Errorf("failed to commit block %s: %s", b.h, err)
+		return fmt.Errorf("failed to commit block %s: %w", b.h, err)
 	}
 
 	return nil
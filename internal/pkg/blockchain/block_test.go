@@ -0,0 +1,240 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// setTestCacheDir makes the local cache a temporary directory
+func setTestCacheDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	prev, isSet := os.LookupEnv(cache.CacheLocalationEnvDir)
+	os.Setenv(cache.CacheLocalationEnvDir, dir)
+
+	return func() {
+		if isSet {
+			os.Setenv(cache.CacheLocalationEnvDir, prev)
+		} else {
+			os.Unsetenv(cache.CacheLocalationEnvDir)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func createTestStamp(t *testing.T, manifests ...string) hashcash.Stamp {
+	dir, err := ioutil.TempDir("", "block-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stamp := hashcash.Create("127.0.0.1")
+	for _, m := range manifests {
+		path := filepath.Join(dir, m+".MANIFEST")
+		err := ioutil.WriteFile(path, []byte("content of "+m), 0644)
+		if err != nil {
+			t.Fatalf("failed to create manifest: %s", err)
+		}
+		err = stamp.AddManifest(path, hashcash.KindResult)
+		if err != nil {
+			t.Fatalf("failed to add manifest: %s", err)
+		}
+	}
+	return stamp
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a := MerkleRoot([]string{"a=1", "b=2", "c=3"})
+	if a != MerkleRoot([]string{"a=1", "b=2", "c=3"}) {
+		t.Fatalf("Merkle root is not deterministic")
+	}
+	if a == MerkleRoot([]string{"a=1", "c=3", "b=2"}) {
+		t.Fatalf("Merkle root does not depend on the order of the manifests")
+	}
+	if a == MerkleRoot([]string{"a=1", "b=2", "c=4"}) {
+		t.Fatalf("Merkle root does not depend on the content of the manifests")
+	}
+	if MerkleRoot([]string{"a=1"}) == MerkleRoot(nil) {
+		t.Fatalf("Merkle root of a single manifest is the one of an empty list")
+	}
+}
+
+func TestBlockChaining(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-chaining"
+
+	_, err := IsolatedCreate("", createTestStamp(t, "openmpi-4.0.2"))
+	if err == nil {
+		t.Fatalf("block created without a namespace")
+	}
+	b := Block{namespace: namespace, stamps: []hashcash.Stamp{createTestStamp(t, "openmpi-4.0.2")}}
+	if b.Publish(nil) == nil {
+		t.Fatalf("block published in a namespace that does not exist")
+	}
+
+	ns, err := CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	if ns.Info.Difficulty != defaultDifficulty || ns.Info.Consensus != ConsensusPBFT || ns.Info.Creator == "" {
+		t.Fatalf("invalid namespace settings: %+v", ns.Info)
+	}
+	_, err = CreateNamespace(namespace)
+	if err == nil {
+		t.Fatalf("namespace created twice")
+	}
+	s, err := LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+	g, err := s.BlockAt(namespace, 0)
+	if err != nil || g.Genesis() == nil || *g.Genesis() != ns.Info {
+		t.Fatalf("genesis block was not stored: %v", err)
+	}
+
+	var blocks []Block
+	for i := 0; i < 3; i++ {
+		b, err := IsolatedCreate(namespace, createTestStamp(t, "openmpi-4.0.2", "mpich-3.3"))
+		if err != nil {
+			t.Fatalf("failed to create block: %s", err)
+		}
+		err = b.Publish(nil)
+		if err != nil {
+			t.Fatalf("failed to publish block: %s", err)
+		}
+		blocks = append(blocks, b)
+	}
+
+	for i, b := range blocks {
+		if b.Hash() == "" || b.Hash() != b.computeHash() {
+			t.Fatalf("block %d has an invalid hash", i)
+		}
+		if b.Height() != uint64(i+1) {
+			t.Fatalf("block %d has height %d", i, b.Height())
+		}
+		if b.MerkleRoot() != MerkleRoot(b.entries()) {
+			t.Fatalf("block %d has an invalid Merkle root", i)
+		}
+		if i == 0 && b.Prev() != g.Hash() {
+			t.Fatalf("first block is not linked to the genesis block")
+		}
+		if i > 0 && b.Prev() != blocks[i-1].Hash() {
+			t.Fatalf("block %d is not linked to block %d", i, i-1)
+		}
+	}
+
+	height, hash, ok, err := ChainHead(namespace)
+	if err != nil || !ok || height != 3 || hash != blocks[2].Hash() {
+		t.Fatalf("invalid head: %d %s %v", height, hash, err)
+	}
+	if _, _, ok, _ := ChainHead("unknown"); ok {
+		t.Fatalf("empty namespace has a head")
+	}
+
+	// Any change to the block changes its hash
+	tampered := blocks[1]
+	tampered.height++
+	if tampered.computeHash() == blocks[1].Hash() {
+		t.Fatalf("hash does not cover the height")
+	}
+	tampered = blocks[1]
+	tampered.prev = blocks[0].prev
+	if tampered.computeHash() == blocks[1].Hash() {
+		t.Fatalf("hash does not cover the previous hash")
+	}
+	tampered = blocks[1]
+	tampered.merkleRoot = MerkleRoot(nil)
+	if tampered.computeHash() == blocks[1].Hash() {
+		t.Fatalf("hash does not cover the Merkle root")
+	}
+}
+
+func TestCommitSpentStamp(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-spent"
+
+	_, err := CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	stamp := createTestStamp(t, "openmpi-4.0.2")
+	b, err := IsolatedCreate(namespace, stamp)
+	if err != nil {
+		t.Fatalf("failed to create block: %s", err)
+	}
+	err = b.Publish(nil)
+	if err != nil {
+		t.Fatalf("failed to publish block: %s", err)
+	}
+	spent, err := stamp.IsSpent()
+	if err != nil || !spent {
+		t.Fatalf("stamp of a committed block is not spent (%v)", err)
+	}
+
+	// The same stamp cannot be committed twice
+	b, err = IsolatedCreate(namespace, stamp)
+	if err != nil {
+		t.Fatalf("failed to create block: %s", err)
+	}
+	err = b.Publish(nil)
+	if !errors.Is(err, hashcash.HashCashSpentErr) {
+		t.Fatalf("block with a spent stamp was published: %v", err)
+	}
+	height, _, _, err := ChainHead(namespace)
+	if err != nil || height != 1 {
+		t.Fatalf("chain has height %d instead of 1 (%v)", height, err)
+	}
+}
+
+func TestLocalNamespaces(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	namespaces, err := LocalNamespaces()
+	if err != nil || len(namespaces) != 0 {
+		t.Fatalf("empty cache has namespaces: %v (%v)", namespaces, err)
+	}
+
+	for _, id := range []string{MPINamespace("openmpi"), MPINamespace("mpich"), SiteNamespace("lab")} {
+		_, err := CreateNamespaceWithConfig(id, NamespaceConfig{Creator: "node0", Consensus: ConsensusRaft, Difficulty: 8})
+		if err != nil {
+			t.Fatalf("failed to create namespace %s: %s", id, err)
+		}
+	}
+	_, err = CreateNamespaceWithConfig("bad", NamespaceConfig{Consensus: "paxos"})
+	if err == nil {
+		t.Fatalf("namespace created with an unknown consensus algorithm")
+	}
+
+	namespaces, err = LocalNamespaces()
+	if err != nil || len(namespaces) != 3 {
+		t.Fatalf("failed to load namespaces: %v (%v)", namespaces, err)
+	}
+	for _, ns := range namespaces {
+		expected := sha256.Sum256([]byte(ns.ID))
+		if !bytes.Equal(ns.Hash.Sum(nil), expected[:]) {
+			t.Fatalf("invalid hash for namespace %s", ns.ID)
+		}
+		if ns.Info.Creator != "node0" || ns.Info.Consensus != ConsensusRaft || ns.Info.Difficulty != 8 {
+			t.Fatalf("invalid settings for namespace %s: %+v", ns.ID, ns.Info)
+		}
+	}
+}
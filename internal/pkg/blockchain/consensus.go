@@ -5,62 +5,268 @@
 
 package blockchain
 
-import "github.com/sylabs/syvalidate/internal/pkg/comm"
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
 
-// This package implements a version of the Practical Byzantine Fault Tolerance algorithm (pBFT)
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+)
 
-type Leader struct {
-	PeerInfo comm.PeerInfo
+// This package implements a version of the Practical Byzantine Fault Tolerance algorithm (pBFT),
+// see pbft.go, and a Raft-style crash fault tolerant algorithm for trusted networks, see raft.go.
+// This file plugs them into the comm layer.
+
+const (
+	// PBFTMSG carries the messages of the pBFT protocol
+	PBFTMSG = "PBFT"
+
+	// RAFTMSG carries the messages of the Raft protocol
+	RAFTMSG = "RAFT"
+)
+
+func init() {
+	comm.RegisterMsgType(PBFTMSG)
+	comm.RegisterMsgType(RAFTMSG)
 }
 
-type Client struct {
+// ConsensusType identifies a consensus algorithm
+type ConsensusType string
+
+const (
+	// ConsensusPBFT tolerates byzantine nodes, it is the default
+	ConsensusPBFT ConsensusType = "pbft"
+
+	// ConsensusRaft only tolerates crashed nodes, for trusted networks
+	ConsensusRaft ConsensusType = "raft"
+)
+
+// Consensus orders the requests submitted by the nodes of a network so that
+// all the nodes apply them in the same order
+type Consensus interface {
+	// Propose submits a request and waits until it is committed
+	Propose(ctx context.Context, data []byte) error
+
+	// Leader returns the identifier of the node currently leading the
+	// network, if known
+	Leader() string
+
+	// StartElection asks the network to elect a new leader
+	StartElection()
+
+	// Stop stops the node
+	Stop()
 }
 
-func (l *Leader) HandleConsensusReq() error {
-	// Get the request from the incoming message
+var (
+	_ Consensus = (*PBFT)(nil)
+	_ Consensus = (*Raft)(nil)
+)
 
-	// Broadcasts the request to the all the nodes.
+// ConsensusConfig is the configuration of a node, whatever the algorithm
+type ConsensusConfig struct {
+	// ID is the identifier of the local node in the registry of peers
+	ID string
 
-	// Generate next block
+	// Nodes are the identifiers of all the nodes taking part in the consensus
+	Nodes []string
 
-	// Send the next block back to the initiator
+	// PrivateKey and PublicKeys are used to sign and verify messages (pBFT only)
+	PrivateKey ed25519.PrivateKey
+	PublicKeys map[string]ed25519.PublicKey
 
-	return nil
+	// Timeout is the time after which the leader is suspected; the default
+	// of the algorithm is used when not set
+	Timeout time.Duration
+
+	// StateDir is the directory where the node persists the state it must
+	// not forget across restarts (Raft only); it is kept in memory when not
+	// set
+	StateDir string
+
+	// Apply is invoked, in order, for every committed request
+	Apply func(index uint64, data []byte)
 }
 
-func (c *Client) HandleNewBlockResponse() error {
-	// This is one of N answers
+// ParseConsensusType checks the name of a consensus algorithm; an empty
+// name selects the default algorithm
+func ParseConsensusType(name string) (ConsensusType, error) {
+	switch ConsensusType(name) {
+	case "":
+		return ConsensusPBFT, nil
+	case ConsensusPBFT, ConsensusRaft:
+		return ConsensusType(name), nil
+	default:
+		return "", fmt.Errorf("unknown consensus algorithm %s", name)
+	}
+}
 
-	// Check for timeout
+// NewConsensus creates a node running the given consensus algorithm over
+// the connections of a pool; the handler for the messages of the algorithm
+// is registered in the mux
+func NewConsensus(t ConsensusType, cfg ConsensusConfig, pool *Pool, mux *comm.HandlerMux) (Consensus, error) {
+	transport := NewPoolTransport(pool, cfg.Nodes)
 
-	// If the message is from the leader, we know how many answers we expect
+	switch t {
+	case ConsensusPBFT, "":
+		n, err := NewPBFT(PBFTConfig{
+			ID:                cfg.ID,
+			Nodes:             cfg.Nodes,
+			PrivateKey:        cfg.PrivateKey,
+			PublicKeys:        cfg.PublicKeys,
+			ViewChangeTimeout: cfg.Timeout,
+			Apply:             cfg.Apply,
+		}, transport)
+		if err != nil {
+			return nil, err
+		}
+		err = mux.Handle(PBFTMSG, n.HandleMsg)
+		if err != nil {
+			n.Stop()
+			return nil, err
+		}
+		return n, nil
+	case ConsensusRaft:
+		r, err := NewRaft(RaftConfig{
+			ID:              cfg.ID,
+			Nodes:           cfg.Nodes,
+			ElectionTimeout: cfg.Timeout,
+			StateDir:        cfg.StateDir,
+			Apply:           cfg.Apply,
+		}, transport)
+		if err != nil {
+			return nil, err
+		}
+		err = mux.Handle(RAFTMSG, r.HandleMsg)
+		if err != nil {
+			r.Stop()
+			return nil, err
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown consensus algorithm %s", t)
+	}
+}
 
-	// Check the new block to see if it is consistent with what we already received
+type Leader struct {
+	PeerInfo comm.PeerInfo
+
+	// Verify tunes the checks of the blocks received from the leader
+	Verify VerifyOptions
+}
 
-	// Save the new block data
+// Client submits requests to the network through a local node
+type Client struct {
+	Node Consensus
+}
 
-	// If we receive all the expected answers we are all good
-	// (we need R+1 answers where R is the resilience factor, i.e., the maximum number of faulty nodes allowed)
+// Consensus submits a request and waits until the network committed it
+func (c *Client) Consensus(ctx context.Context, data []byte) error {
+	if c.Node == nil {
+		return fmt.Errorf("client is not attached to a node")
+	}
+	return c.Node.Propose(ctx, data)
+}
 
+// StartElection suspects the current leader and asks the network to elect
+// a new one
+func (c *Client) StartElection() error {
+	if c.Node == nil {
+		return fmt.Errorf("client is not attached to a node")
+	}
+	c.Node.StartElection()
 	return nil
 }
 
-func (c *Client) Consensus() error {
-	// Sends a request to the leader.
+// PoolTransport sends the messages of the consensus algorithms over the
+// connections of a pool
+type PoolTransport struct {
+	pool  *Pool
+	nodes []string
+}
+
+// NewPoolTransport returns a transport sending messages to the given nodes
+// of the registry of a pool
+func NewPoolTransport(pool *Pool, nodes []string) *PoolTransport {
+	return &PoolTransport{
+		pool:  pool,
+		nodes: nodes,
+	}
+}
 
-	// Start a go routine to receive results
+// send asynchronously sends a message to a node
+func (t *PoolTransport) send(id string, msgType string, payload []byte) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		peer, err := t.pool.Get(ctx, id)
+		if err != nil {
+			log.Printf("[WARN] unable to send %s message to %s: %s", msgType, id, err)
+			return
+		}
+		err = peer.SendMsg(msgType, payload)
+		if err != nil {
+			log.Printf("[WARN] unable to send %s message to %s: %s", msgType, id, err)
+		}
+	}()
+}
 
-	return nil
+// Broadcast sends a pBFT message to all the other nodes
+func (t *PoolTransport) Broadcast(m *PBFTMessage) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode %s message: %s", m.Type, err)
+		return
+	}
+
+	for _, id := range t.nodes {
+		if id != t.pool.Self().ID {
+			t.send(id, PBFTMSG, payload)
+		}
+	}
 }
 
-func StartElection() error {
-	// Prepare the request for new election
+// Send sends a Raft message to a node
+func (t *PoolTransport) Send(to string, m *RaftMessage) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode %s message: %s", m.Type, err)
+		return
+	}
+	t.send(to, RAFTMSG, payload)
+}
 
-	// Send request to all know peers
+// HandleMsg handles a PBFTMSG message received from a peer; it can be
+// registered in a comm.HandlerMux
+func (n *PBFT) HandleMsg(peer *comm.PeerInfo, msg comm.Message) {
+	var m PBFTMessage
+	err := json.Unmarshal(msg.Payload, &m)
+	if err != nil {
+		log.Printf("[ERROR] invalid pBFT message from %s: %s", peer.URL, err)
+		return
+	}
 
-	// Wait for results
+	err = n.HandleMessage(&m)
+	if err != nil {
+		log.Printf("[WARN] pBFT message from %s rejected: %s", peer.URL, err)
+	}
+}
 
-	// Check results
+// HandleMsg handles a RAFTMSG message received from a peer; it can be
+// registered in a comm.HandlerMux
+func (r *Raft) HandleMsg(peer *comm.PeerInfo, msg comm.Message) {
+	var m RaftMessage
+	err := json.Unmarshal(msg.Payload, &m)
+	if err != nil {
+		log.Printf("[ERROR] invalid Raft message from %s: %s", peer.URL, err)
+		return
+	}
 
-	return nil
+	err = r.HandleMessage(&m)
+	if err != nil {
+		log.Printf("[WARN] Raft message from %s rejected: %s", peer.URL, err)
+	}
 }
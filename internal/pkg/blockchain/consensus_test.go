@@ -0,0 +1,357 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+)
+
+// conformanceCluster is a cluster of nodes running one of the consensus
+// implementations, as seen by the conformance suite
+type conformanceCluster struct {
+	ids   []string
+	nodes map[string]Consensus
+
+	// faults is the number of faulty nodes the implementation tolerates
+	faults int
+
+	crash   func(id string)
+	applied func(id string) []string
+	stop    func()
+}
+
+type conformanceFactory func(t *testing.T, size int) *conformanceCluster
+
+func pbftConformanceCluster(t *testing.T, size int) *conformanceCluster {
+	c := createTestCluster(t, size, nil)
+	cc := &conformanceCluster{
+		ids:     c.ids,
+		nodes:   make(map[string]Consensus),
+		faults:  (size - 1) / 3,
+		crash:   c.crash,
+		applied: c.getApplied,
+		stop:    c.stop,
+	}
+	for id, n := range c.nodes {
+		cc.nodes[id] = n
+	}
+	return cc
+}
+
+func raftConformanceCluster(t *testing.T, size int) *conformanceCluster {
+	c := createRaftCluster(t, size)
+	cc := &conformanceCluster{
+		ids:     c.ids,
+		nodes:   make(map[string]Consensus),
+		faults:  (size - 1) / 2,
+		crash:   c.crash,
+		applied: c.getApplied,
+		stop:    c.stop,
+	}
+	for id, n := range c.nodes {
+		cc.nodes[id] = n
+	}
+	return cc
+}
+
+// waitLeader waits until a node knows the leader of the network
+func (c *conformanceCluster) waitLeader(t *testing.T, id string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		leader := c.nodes[id].Leader()
+		if leader != "" {
+			return leader
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s does not know the leader", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// propose submits requests through the given nodes, concurrently
+func (c *conformanceCluster) propose(t *testing.T, via []string, requests []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(requests))
+	for i, r := range requests {
+		wg.Add(1)
+		go func(id string, data string) {
+			defer wg.Done()
+			errs <- c.nodes[id].Propose(ctx, []byte(data))
+		}(via[i%len(via)], r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+	}
+}
+
+// checkAgreement waits until the given nodes applied the expected number of
+// requests and checks they applied the same ones in the same order
+func (c *conformanceCluster) checkAgreement(t *testing.T, ids []string, expected int) []string {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, id := range ids {
+		for len(c.applied(id)) < expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s applied %d requests instead of %d", id, len(c.applied(id)), expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ref := c.applied(ids[0])
+	if len(ref) != expected {
+		t.Fatalf("%s applied %d requests instead of %d", ids[0], len(ref), expected)
+	}
+	for _, id := range ids[1:] {
+		applied := c.applied(id)
+		if len(applied) != expected {
+			t.Fatalf("%s applied %d requests instead of %d", id, len(applied), expected)
+		}
+		for i := range ref {
+			if applied[i] != ref[i] {
+				t.Fatalf("%s and %s applied requests in a different order", id, ids[0])
+			}
+		}
+	}
+	return ref
+}
+
+func requests(prefix string, count int) []string {
+	var reqs []string
+	for i := 0; i < count; i++ {
+		reqs = append(reqs, fmt.Sprintf("%s %d", prefix, i))
+	}
+	return reqs
+}
+
+func testAgreement(t *testing.T, factory conformanceFactory) {
+	for _, size := range []int{4, 7} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			c := factory(t, size)
+			defer c.stop()
+
+			reqs := requests("request", 20)
+			c.propose(t, c.ids, reqs)
+			applied := c.checkAgreement(t, c.ids, len(reqs))
+
+			seen := make(map[string]bool)
+			for _, r := range applied {
+				seen[r] = true
+			}
+			for _, r := range reqs {
+				if !seen[r] {
+					t.Fatalf("%s was not applied", r)
+				}
+			}
+		})
+	}
+}
+
+func testLeaderCrash(t *testing.T, factory conformanceFactory) {
+	c := factory(t, 4)
+	defer c.stop()
+
+	c.propose(t, c.ids, requests("before", 3))
+	c.checkAgreement(t, c.ids, 3)
+
+	leader := c.waitLeader(t, c.ids[0])
+	c.crash(leader)
+	var alive []string
+	for _, id := range c.ids {
+		if id != leader {
+			alive = append(alive, id)
+		}
+	}
+
+	c.propose(t, alive, requests("after", 5))
+	c.checkAgreement(t, alive, 8)
+	if c.nodes[alive[0]].Leader() == leader {
+		t.Fatalf("crashed leader %s was not replaced", leader)
+	}
+}
+
+func testFaultyMinority(t *testing.T, factory conformanceFactory) {
+	c := factory(t, 7)
+	defer c.stop()
+
+	crashed := c.ids[len(c.ids)-c.faults:]
+	alive := c.ids[:len(c.ids)-c.faults]
+	for _, id := range crashed {
+		c.crash(id)
+	}
+
+	c.propose(t, alive, requests("request", 10))
+	c.checkAgreement(t, alive, 10)
+	for _, id := range crashed {
+		if len(c.applied(id)) != 0 {
+			t.Fatalf("crashed node %s applied requests", id)
+		}
+	}
+}
+
+func testDuplicates(t *testing.T, factory conformanceFactory) {
+	c := factory(t, 4)
+	defer c.stop()
+
+	// The same request submitted by several nodes and several times is
+	// applied only once
+	c.propose(t, c.ids, []string{"dup", "dup", "dup", "dup", "other"})
+	c.propose(t, c.ids[:1], []string{"dup"})
+	c.checkAgreement(t, c.ids, 2)
+}
+
+func testNoQuorum(t *testing.T, factory conformanceFactory) {
+	c := factory(t, 4)
+	defer c.stop()
+
+	for _, id := range c.ids[1:] {
+		c.crash(id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := c.nodes[c.ids[0]].Propose(ctx, []byte("lonely"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request committed without a quorum: %v", err)
+	}
+	if len(c.applied(c.ids[0])) != 0 {
+		t.Fatalf("request applied without a quorum")
+	}
+
+	err = c.nodes[c.ids[0]].Propose(context.Background(), nil)
+	if err == nil {
+		t.Fatalf("empty request was accepted")
+	}
+}
+
+// TestConsensusConformance checks that all the consensus implementations
+// behave the same when facing crashes
+func TestConsensusConformance(t *testing.T) {
+	impls := []struct {
+		name    string
+		factory conformanceFactory
+	}{
+		{name: "pbft", factory: pbftConformanceCluster},
+		{name: "raft", factory: raftConformanceCluster},
+	}
+	tests := []struct {
+		name string
+		fn   func(*testing.T, conformanceFactory)
+	}{
+		{name: "agreement", fn: testAgreement},
+		{name: "leader crash", fn: testLeaderCrash},
+		{name: "faulty minority", fn: testFaultyMinority},
+		{name: "duplicates", fn: testDuplicates},
+		{name: "no quorum", fn: testNoQuorum},
+	}
+
+	for _, impl := range impls {
+		for _, tt := range tests {
+			impl := impl
+			tt := tt
+			t.Run(impl.name+"/"+tt.name, func(t *testing.T) {
+				tt.fn(t, impl.factory)
+			})
+		}
+	}
+}
+
+func TestConsensusOverComm(t *testing.T) {
+	for _, ct := range []ConsensusType{ConsensusPBFT, ConsensusRaft} {
+		t.Run(string(ct), func(t *testing.T) {
+			network := comm.NewMemNetwork()
+
+			var ids []string
+			keys := make(map[string]ed25519.PrivateKey)
+			pubKeys := make(map[string]ed25519.PublicKey)
+			for i := 0; i < 4; i++ {
+				id := fmt.Sprintf("%s%d", ct, i)
+				pub, priv, err := ed25519.GenerateKey(nil)
+				if err != nil {
+					t.Fatalf("failed to generate key: %s", err)
+				}
+				ids = append(ids, id)
+				keys[id] = priv
+				pubKeys[id] = pub
+			}
+
+			var lock sync.Mutex
+			applied := make(map[string]int)
+			var nodes []Consensus
+			for _, id := range ids {
+				id := id
+				node := createTestNode(t, network, id)
+				defer node.cleanup()
+				for _, peer := range ids {
+					node.pool.Registry().Update(PeerRecord{ID: peer, URL: peer, LastSeen: time.Now()})
+				}
+
+				cfg := ConsensusConfig{
+					ID:         id,
+					Nodes:      ids,
+					PrivateKey: keys[id],
+					PublicKeys: pubKeys,
+					Timeout:    500 * time.Millisecond,
+					Apply: func(index uint64, data []byte) {
+						lock.Lock()
+						defer lock.Unlock()
+						applied[id]++
+					},
+				}
+				n, err := NewConsensus(ct, cfg, node.pool, node.mux)
+				if err != nil {
+					t.Fatalf("failed to create node: %s", err)
+				}
+				defer n.Stop()
+				nodes = append(nodes, n)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client := Client{Node: nodes[2]}
+			for i := 0; i < 3; i++ {
+				err := client.Consensus(ctx, []byte(fmt.Sprintf("block %d", i)))
+				if err != nil {
+					t.Fatalf("consensus failed: %s", err)
+				}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				lock.Lock()
+				done := true
+				for _, id := range ids {
+					if applied[id] != 3 {
+						done = false
+					}
+				}
+				lock.Unlock()
+				if done {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("not all the nodes executed the requests")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// The stamps of a block need as many leading bits equal to zero as the
+// difficulty of their namespace. The genesis block sets the initial
+// difficulty and the retargeting rule: every RetargetWindow blocks, the time
+// the last RetargetWindow blocks took is compared with the TargetInterval
+// between two blocks. The difficulty is increased by one bit when the blocks
+// came more than twice as fast as expected, and decreased by one bit, but
+// never below the initial difficulty, when they came more than twice as slow.
+// The rule only depends on the chain so all the nodes agree on it.
+
+const (
+	// defaultDifficulty is the number of leading bits equal to zero the
+	// stamps of a namespace need by default
+	defaultDifficulty = hashcash.DefaultDifficulty
+
+	// maxDifficulty is the number of bits of a SHA-1 hash
+	maxDifficulty = sha1.Size * 8
+
+	defaultTargetInterval = 10 * time.Minute
+	defaultRetargetWindow = 32
+)
+
+// retargets checks whether the difficulty of a namespace changes over time;
+// it does not for the namespaces created without a retargeting rule
+func (info *NamespaceInfo) retargets() bool {
+	return info.TargetInterval > 0 && info.RetargetWindow >= 2
+}
+
+// retarget returns the difficulty of the blocks following a window of blocks
+// that started with first and ended with last
+func (info *NamespaceInfo) retarget(difficulty int, first *Block, last *Block) int {
+	span := last.timestamp.Sub(first.timestamp)
+	expected := time.Duration(info.RetargetWindow-1) * info.TargetInterval
+	switch {
+	case span < expected/2 && difficulty < maxDifficulty:
+		return difficulty + 1
+	case span > 2*expected && difficulty > info.Difficulty:
+		return difficulty - 1
+	}
+	return difficulty
+}
+
+// difficultyTracker follows the difficulty of a chain whose blocks are walked
+// in order, e.g., during a verification
+type difficultyTracker struct {
+	r          ChainReader
+	namespace  string
+	info       *NamespaceInfo
+	height     uint64
+	difficulty int
+}
+
+func newDifficultyTracker(r ChainReader, namespace string) *difficultyTracker {
+	return &difficultyTracker{
+		r:         r,
+		namespace: namespace,
+	}
+}
+
+// at returns the difficulty of the block at a given height, which is not
+// lower than the one of the previous call; all the blocks before that height
+// must be available
+func (t *difficultyTracker) at(height uint64) (int, error) {
+	if height == 0 {
+		// The genesis block has no stamp
+		return 0, nil
+	}
+	if t.info == nil {
+		genesis, err := t.r.BlockAt(t.namespace, 0)
+		if err != nil {
+			return 0, fmt.Errorf("unable to read the genesis block of %s: %s", t.namespace, err)
+		}
+		if genesis.genesis == nil {
+			return 0, fmt.Errorf("first block of namespace %s is not a genesis block", t.namespace)
+		}
+		t.info = genesis.genesis
+		t.difficulty = t.info.Difficulty
+	}
+	if height < t.height {
+		return 0, fmt.Errorf("difficulty of block %d requested after block %d", height, t.height)
+	}
+	if !t.info.retargets() {
+		return t.difficulty, nil
+	}
+
+	window := uint64(t.info.RetargetWindow)
+	for t.height < height {
+		t.height++
+		if t.height%window != 0 {
+			continue
+		}
+		first, err := t.r.BlockAt(t.namespace, t.height-window)
+		if err != nil {
+			return 0, err
+		}
+		last, err := t.r.BlockAt(t.namespace, t.height-1)
+		if err != nil {
+			return 0, err
+		}
+		t.difficulty = t.info.retarget(t.difficulty, first, last)
+	}
+	return t.difficulty, nil
+}
+
+// Difficulty returns the number of leading bits equal to zero the stamps of
+// the block at a given height of the chain of a namespace need; the blocks
+// before that height must be available
+func Difficulty(r ChainReader, namespace string, height uint64) (int, error) {
+	return newDifficultyTracker(r, namespace).at(height)
+}
+
+// CurrentDifficulty returns the difficulty the stamps of the next block of a
+// namespace of the local cache need, i.e., the difficulty stamps must be
+// minted for
+func CurrentDifficulty(namespace string) (int, error) {
+	s, err := LocalBlockStore()
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.Len(namespace)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("namespace %s does not exist", namespace)
+	}
+	return Difficulty(s, namespace, n)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// createTimedChain creates a chain whose blocks are committed at given
+// intervals after the genesis block, signed with the test key; the stamps of
+// the blocks are minted for a given number of bits, or not minted when it is 0
+func createTimedChain(t *testing.T, info NamespaceInfo, gaps []time.Duration, bits int) *MemChain {
+	c := NewMemChain()
+	genesis := &Block{
+		namespace: info.ID,
+		timestamp: time.Now().UTC(),
+		genesis:   &info,
+	}
+	genesis.genesis.Created = genesis.timestamp
+	err := genesis.hash()
+	if err != nil {
+		t.Fatalf("failed to hash block: %s", err)
+	}
+	genesis.sign(testKeyPair)
+	c.Append(genesis)
+
+	prev := genesis
+	for _, gap := range gaps {
+		stamp := hashcash.Create("127.0.0.1")
+		stamp.Sign(testKeyPair.Private)
+		if bits > 0 {
+			err := stamp.Mint(context.Background(), bits)
+			if err != nil {
+				t.Fatalf("failed to mint stamp: %s", err)
+			}
+		}
+		b := &Block{
+			namespace: info.ID,
+			height:    prev.height + 1,
+			timestamp: prev.timestamp.Add(gap),
+			prev:      prev.h,
+			stamps:    []hashcash.Stamp{stamp},
+		}
+		err := b.hash()
+		if err != nil {
+			t.Fatalf("failed to hash block: %s", err)
+		}
+		b.sign(testKeyPair)
+		c.Append(b)
+		prev = b
+	}
+	return c
+}
+
+func repeatGap(gap time.Duration, n int) []time.Duration {
+	var gaps []time.Duration
+	for i := 0; i < n; i++ {
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+func TestDifficulty(t *testing.T) {
+	info := NamespaceInfo{
+		ID:             "test",
+		Difficulty:     8,
+		TargetInterval: time.Minute,
+		RetargetWindow: 4,
+	}
+
+	// Fast blocks, then slow blocks
+	gaps := append(repeatGap(time.Second, 8), repeatGap(10*time.Minute, 14)...)
+	c := createTimedChain(t, info, gaps, 0)
+	expected := map[uint64]int{
+		0: 0, 1: 8, 3: 8, 4: 9, 7: 9, 8: 10, 11: 10,
+		12: 9, 16: 8, 20: 8,
+	}
+	for height, difficulty := range expected {
+		d, err := Difficulty(c, "test", height)
+		if err != nil {
+			t.Fatalf("failed to get difficulty of block %d: %s", height, err)
+		}
+		if d != difficulty {
+			t.Fatalf("block %d has difficulty %d instead of %d", height, d, difficulty)
+		}
+	}
+
+	// Blocks at the expected rate do not change the difficulty
+	c = createTimedChain(t, info, repeatGap(time.Minute, 12), 0)
+	d, err := Difficulty(c, "test", 12)
+	if err != nil || d != 8 {
+		t.Fatalf("difficulty changed to %d (%v)", d, err)
+	}
+
+	// Namespaces without a retargeting rule keep their difficulty
+	info.TargetInterval = 0
+	c = createTimedChain(t, info, repeatGap(time.Second, 12), 0)
+	d, err = Difficulty(c, "test", 12)
+	if err != nil || d != 8 {
+		t.Fatalf("difficulty changed to %d without retargeting rule (%v)", d, err)
+	}
+}
+
+func TestVerifyDifficulty(t *testing.T) {
+	info := NamespaceInfo{
+		ID:             "test",
+		Difficulty:     4,
+		TargetInterval: time.Minute,
+		RetargetWindow: 4,
+	}
+	c := createTimedChain(t, info, repeatGap(time.Second, 6), 5)
+
+	var difficulties []int
+	opts := VerifyOptions{
+		CheckStamp: func(b *Block, difficulty int) error {
+			difficulties = append(difficulties, difficulty)
+			return nil
+		},
+		TrustedKey: trustTestKey,
+	}
+	err := Verify(c, "test", opts)
+	if err != nil {
+		t.Fatalf("failed to verify chain: %s", err)
+	}
+	if len(difficulties) != 6 || difficulties[0] != 4 || difficulties[3] != 5 || difficulties[5] != 5 {
+		t.Fatalf("stamps checked against invalid difficulties %v", difficulties)
+	}
+
+	// Stamps minted for the initial difficulty are too weak once it increased
+	c = createTimedChain(t, info, repeatGap(time.Second, 6), 4)
+	err = Verify(c, "test", VerifyOptions{TrustedKey: trustTestKey})
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 4 || !strings.Contains(verr.Reason, "invalid stamps") {
+		t.Fatalf("stamp below the difficulty was accepted: %v", err)
+	}
+}
+
+func TestCurrentDifficulty(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	_, err := CurrentDifficulty("test-difficulty")
+	if err == nil {
+		t.Fatalf("got the difficulty of a namespace that does not exist")
+	}
+	ns, err := CreateNamespaceWithConfig("test-difficulty", NamespaceConfig{Difficulty: 12})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	if ns.Info.TargetInterval != defaultTargetInterval || ns.Info.RetargetWindow != defaultRetargetWindow {
+		t.Fatalf("namespace was created without the default retargeting rule")
+	}
+	d, err := CurrentDifficulty("test-difficulty")
+	if err != nil || d != 12 {
+		t.Fatalf("current difficulty is %d instead of 12 (%v)", d, err)
+	}
+
+	_, err = CreateNamespaceWithConfig("test-invalid", NamespaceConfig{RetargetWindow: 1})
+	if err == nil {
+		t.Fatalf("namespace created with an invalid retargeting rule")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+)
+
+const (
+	// PEERSMSG is a gossip message used to exchange the list of known peers
+	PEERSMSG = "PEER"
+)
+
+func init() {
+	comm.RegisterMsgType(PEERSMSG)
+}
+
+// gossipMsg is the payload of a PEERSMSG message, both for the request and
+// the response
+type gossipMsg struct {
+	From  PeerRecord   `json:"from"`
+	Peers []PeerRecord `json:"peers"`
+}
+
+func (p *Pool) gossipPayload() ([]byte, error) {
+	self := p.cfg.Self
+	self.LastSeen = time.Now()
+	if p.cfg.PrivateKey != nil {
+		self.sign(p.cfg.PrivateKey)
+	}
+	msg := gossipMsg{
+		From:  self,
+		Peers: p.registry.List(),
+	}
+	return json.Marshal(&msg)
+}
+
+// merge adds the peers we learned about to the registry
+func (p *Pool) merge(data []byte) (PeerRecord, error) {
+	var msg gossipMsg
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return msg.From, fmt.Errorf("%w: invalid gossip message: %s", comm.ErrProtocol, err)
+	}
+
+	// We are directly talking to the sender so we know it is alive
+	msg.From.LastSeen = time.Now()
+	for _, rec := range append(msg.Peers, msg.From) {
+		if rec.ID == p.cfg.Self.ID {
+			continue
+		}
+		// We only learn the keys the peers signed their record with
+		if rec.verify(rec.PublicKey) != nil {
+			rec.PublicKey = ""
+			rec.SignedAt = time.Time{}
+			rec.Signature = ""
+		}
+		p.registry.Update(rec)
+	}
+
+	return msg.From, nil
+}
+
+// HandleGossip handles a PEERSMSG request from a peer: the peers it knows
+// are added to our registry and we reply with the peers we know
+func (p *Pool) HandleGossip(peer *comm.PeerInfo, msg comm.Message) {
+	_, err := p.merge(msg.Payload)
+	if err != nil {
+		log.Printf("[ERROR] gossip from %s: %s", peer.URL, err)
+		return
+	}
+
+	payload, err := p.gossipPayload()
+	if err != nil {
+		log.Printf("[ERROR] unable to create gossip message: %s", err)
+		return
+	}
+	err = peer.Reply(msg, PEERSMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to gossip from %s: %s", peer.URL, err)
+	}
+}
+
+func (p *Pool) gossip(ctx context.Context, url string) error {
+	peer, err := p.GetURL(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	payload, err := p.gossipPayload()
+	if err != nil {
+		return fmt.Errorf("unable to create gossip message: %s", err)
+	}
+	resp, err := peer.Request(PEERSMSG, payload, requestTimeout)
+	if err != nil {
+		return fmt.Errorf("gossip with %s failed: %w", url, err)
+	}
+
+	_, err = p.merge(resp.Payload)
+	return err
+}
+
+// Discover exchanges the list of known peers with the seeds and all the
+// peers already in the registry. The updated registry is saved in the
+// cache. An error is returned only if none of the peers can be reached.
+func (p *Pool) Discover(ctx context.Context, seeds []string) error {
+	urls := make(map[string]bool)
+	for _, s := range seeds {
+		urls[s] = true
+	}
+	for _, rec := range p.registry.List() {
+		if rec.ID != p.cfg.Self.ID && rec.URL != "" {
+			urls[rec.URL] = true
+		}
+	}
+	delete(urls, p.cfg.Self.URL)
+
+	var lastErr error
+	reached := 0
+	for url := range urls {
+		err := p.gossip(ctx, url)
+		if err != nil {
+			log.Printf("[WARN] %s", err)
+			lastErr = err
+			continue
+		}
+		reached++
+	}
+
+	err := p.registry.Save()
+	if err != nil {
+		return fmt.Errorf("failed to save registry: %s", err)
+	}
+
+	if reached == 0 && lastErr != nil {
+		return fmt.Errorf("no peer could be reached: %w", lastErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// In connected mode, peers create stamps and submit them to the leader with
+// STAMPMSG requests. The leader keeps the stamps in a mempool until it forms
+// a block, which includes a batch of the pending stamps of a namespace.
+
+const (
+	// STAMPMSG submits a stamp to the leader
+	STAMPMSG = "STMP"
+
+	defaultMempoolSize  = 1024
+	defaultMaxStampSize = 4096
+	defaultBatchSize    = 16
+)
+
+func init() {
+	comm.RegisterMsgType(STAMPMSG)
+}
+
+// ErrMempoolFull is returned when the mempool cannot accept more stamps
+var ErrMempoolFull = errors.New("mempool is full")
+
+// ErrDuplicateStamp is returned when a stamp is already pending
+var ErrDuplicateStamp = errors.New("stamp is already pending")
+
+// ErrStampTooLarge is returned when a stamp exceeds the maximum size
+var ErrStampTooLarge = errors.New("stamp is too large")
+
+// MempoolConfig limits the stamps kept by a mempool; the defaults are used
+// for the fields that are not set
+type MempoolConfig struct {
+	// MaxStamps is the maximum number of pending stamps, all namespaces
+	// included
+	MaxStamps int
+
+	// MaxStampSize is the maximum size of a serialized stamp
+	MaxStampSize int
+
+	// BatchSize is the maximum number of stamps included in a block
+	BatchSize int
+
+	// Validate checks a stamp of a namespace before it is accepted; by
+	// default, Stamp.IsValid checks it against the current difficulty of
+	// the namespace
+	Validate func(namespace string, s *hashcash.Stamp) error
+}
+
+// Mempool holds the stamps waiting to be included in a block, in their order
+// of arrival
+type Mempool struct {
+	cfg MempoolConfig
+
+	lock    sync.Mutex
+	pending map[string][]hashcash.Stamp
+	count   int
+
+	// known holds the pending stamps and the stamps taken for a block that
+	// is not committed yet, so that they cannot be submitted again in the
+	// meantime; the value is whether the stamp is pending
+	known map[string]bool
+}
+
+// stampSubmission is the payload of a STAMPMSG request
+type stampSubmission struct {
+	Namespace string `json:"namespace"`
+	Stamp     string `json:"stamp"`
+
+	// Forwarded is set when a peer forwards the stamp to the leader
+	Forwarded bool `json:"forwarded,omitempty"`
+}
+
+// submitResp is the response to a STAMPMSG request
+type submitResp struct {
+	Error string `json:"error,omitempty"`
+}
+
+func validateStamp(namespace string, s *hashcash.Stamp) error {
+	difficulty, err := CurrentDifficulty(namespace)
+	if err != nil {
+		return err
+	}
+	return s.IsValid(difficulty)
+}
+
+// NewMempool creates an empty mempool
+func NewMempool(cfg MempoolConfig) *Mempool {
+	if cfg.MaxStamps <= 0 {
+		cfg.MaxStamps = defaultMempoolSize
+	}
+	if cfg.MaxStampSize <= 0 {
+		cfg.MaxStampSize = defaultMaxStampSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Validate == nil {
+		cfg.Validate = validateStamp
+	}
+
+	return &Mempool{
+		cfg:     cfg,
+		pending: make(map[string][]hashcash.Stamp),
+		known:   make(map[string]bool),
+	}
+}
+
+// Add validates a stamp and adds it to the pending stamps of a namespace.
+// Only the stamps of the mempool are deduplicated, stamps already included in
+// a block are caught by the spent check of the validation.
+func (m *Mempool) Add(namespace string, stamp hashcash.Stamp) error {
+	err := cache.CheckNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	key := stamp.Serialize()
+	if len(key) > m.cfg.MaxStampSize {
+		return fmt.Errorf("%w: %d bytes", ErrStampTooLarge, len(key))
+	}
+	err = m.cfg.Validate(namespace, &stamp)
+	if err != nil {
+		return fmt.Errorf("invalid stamp: %w", err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.known[key]; ok {
+		return ErrDuplicateStamp
+	}
+	if m.count >= m.cfg.MaxStamps {
+		return ErrMempoolFull
+	}
+	m.pending[namespace] = append(m.pending[namespace], stamp)
+	m.known[key] = true
+	m.count++
+
+	return nil
+}
+
+// Len returns the number of pending stamps of a namespace
+func (m *Mempool) Len(namespace string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.pending[namespace])
+}
+
+// Namespaces returns the namespaces with pending stamps
+func (m *Mempool) Namespaces() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var namespaces []string
+	for ns := range m.pending {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Take removes the oldest pending stamps of a namespace, at most the batch
+// size, and returns them; they are still known to the mempool until they are
+// given to Requeue or Forget
+func (m *Mempool) Take(namespace string) []hashcash.Stamp {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pending := m.pending[namespace]
+	n := len(pending)
+	if n > m.cfg.BatchSize {
+		n = m.cfg.BatchSize
+	}
+	batch := append([]hashcash.Stamp(nil), pending[:n]...)
+	if n == len(pending) {
+		delete(m.pending, namespace)
+	} else {
+		m.pending[namespace] = pending[n:]
+	}
+	for i := range batch {
+		m.known[batch[i].Serialize()] = false
+	}
+	m.count -= n
+
+	return batch
+}
+
+// Requeue puts back stamps returned by Take, e.g., when the block could not
+// be committed; they are handled before the other pending stamps
+func (m *Mempool) Requeue(namespace string, stamps []hashcash.Stamp) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var requeued []hashcash.Stamp
+	for i := range stamps {
+		key := stamps[i].Serialize()
+		if m.known[key] {
+			// Already pending
+			continue
+		}
+		m.known[key] = true
+		requeued = append(requeued, stamps[i])
+	}
+	if len(requeued) == 0 {
+		return
+	}
+	m.pending[namespace] = append(requeued, m.pending[namespace]...)
+	m.count += len(requeued)
+}
+
+// Forget drops stamps returned by Take once they are spent or dropped, they
+// can be submitted again from then on
+func (m *Mempool) Forget(stamps []hashcash.Stamp) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := range stamps {
+		key := stamps[i].Serialize()
+		if pending, ok := m.known[key]; ok && !pending {
+			delete(m.known, key)
+		}
+	}
+}
+
+// batch takes a batch of the pending stamps of a namespace, dropping the
+// ones that do not meet the current difficulty of the namespace anymore
+func (m *Mempool) batch(namespace string) []hashcash.Stamp {
+	stamps := m.Take(namespace)
+	if len(stamps) == 0 {
+		return nil
+	}
+
+	// The difficulty may have increased since the stamps were accepted
+	difficulty, err := CurrentDifficulty(namespace)
+	if err != nil {
+		return stamps
+	}
+	var kept, dropped []hashcash.Stamp
+	for i := range stamps {
+		if stamps[i].Bits() < difficulty {
+			log.Printf("[WARN] dropping stamp with %d bits, namespace %s requires %d bits", stamps[i].Bits(), namespace, difficulty)
+			dropped = append(dropped, stamps[i])
+			continue
+		}
+		kept = append(kept, stamps[i])
+	}
+	m.Forget(dropped)
+	return kept
+}
+
+// spendStamps records the stamps of a block as spent, so that they cannot
+// be submitted again
+func spendStamps(stamps []hashcash.Stamp) {
+	for i := range stamps {
+		err := stamps[i].Spend()
+		if err != nil {
+			log.Printf("[WARN] failed to record stamp as spent: %s", err)
+		}
+	}
+}
+
+// Flush creates and commits a block from a batch of the pending stamps of a
+// namespace; it returns nil when no stamp is pending
+func (m *Mempool) Flush(namespace string) (*Block, error) {
+	stamps := m.batch(namespace)
+	if len(stamps) == 0 {
+		return nil, nil
+	}
+
+	b, err := BatchCreate(namespace, stamps)
+	if err == nil {
+		err = b.Publish(nil)
+	}
+	if err != nil {
+		m.Requeue(namespace, stamps)
+		return nil, fmt.Errorf("failed to create block from %d stamps: %s", len(stamps), err)
+	}
+	m.Forget(stamps)
+
+	return &b, nil
+}
+
+// Register registers the handler of stamp submissions in a mux
+func (m *Mempool) Register(mux *comm.HandlerMux) error {
+	return mux.Handle(STAMPMSG, m.HandleSubmit)
+}
+
+// HandleSubmit handles a STAMPMSG request from a peer
+func (m *Mempool) HandleSubmit(peer *comm.PeerInfo, msg comm.Message) {
+	serveSubmit(peer, msg, func(namespace string, stamp hashcash.Stamp, forwarded bool) error {
+		return m.Add(namespace, stamp)
+	})
+}
+
+// serveSubmit handles a STAMPMSG request from a peer, handing the stamp over
+// to a function that adds it to a mempool
+func serveSubmit(peer *comm.PeerInfo, msg comm.Message, add func(namespace string, stamp hashcash.Stamp, forwarded bool) error) {
+	var resp submitResp
+	var sub stampSubmission
+	err := json.Unmarshal(msg.Payload, &sub)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %s", err)
+	} else {
+		var stamp hashcash.Stamp
+		stamp, err = hashcash.Parse(sub.Stamp)
+		if err == nil {
+			err = add(sub.Namespace, stamp, sub.Forwarded)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	payload, err := json.Marshal(&resp)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode response: %s", err)
+		return
+	}
+	err = peer.Reply(msg, STAMPMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to %s: %s", peer.URL, err)
+	}
+}
+
+// SubmitStamp forwards a stamp to the leader, which adds it to its mempool
+func SubmitStamp(peer *comm.PeerInfo, namespace string, stamp hashcash.Stamp) error {
+	return submitStamp(peer, stampSubmission{
+		Namespace: namespace,
+		Stamp:     stamp.Serialize(),
+	})
+}
+
+func submitStamp(peer *comm.PeerInfo, sub stampSubmission) error {
+	payload, err := json.Marshal(&sub)
+	if err != nil {
+		return err
+	}
+	resp, err := peer.Request(STAMPMSG, payload, requestTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to submit stamp: %w", err)
+	}
+
+	var r submitResp
+	err = json.Unmarshal(resp.Payload, &r)
+	if err != nil {
+		return fmt.Errorf("%w: invalid response: %s", comm.ErrProtocol, err)
+	}
+	if r.Error != "" {
+		return fmt.Errorf("stamp rejected by %s: %s", peer.URL, r.Error)
+	}
+	return nil
+}
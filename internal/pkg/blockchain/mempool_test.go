@@ -0,0 +1,211 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// The test stamps are not minted
+func acceptStamp(string, *hashcash.Stamp) error {
+	return nil
+}
+
+func TestMempool(t *testing.T) {
+	m := NewMempool(MempoolConfig{
+		MaxStamps: 5,
+		BatchSize: 2,
+		Validate:  acceptStamp,
+	})
+
+	var stamps []hashcash.Stamp
+	for i := 0; i < 4; i++ {
+		s := createTestStamp(t, fmt.Sprintf("openmpi-%d", i))
+		err := m.Add("test", s)
+		if err != nil {
+			t.Fatalf("failed to add stamp: %s", err)
+		}
+		stamps = append(stamps, s)
+	}
+	if !errors.Is(m.Add("test", stamps[1]), ErrDuplicateStamp) {
+		t.Fatalf("duplicate stamp was accepted")
+	}
+	if m.Add("../test", createTestStamp(t)) == nil {
+		t.Fatalf("stamp accepted for an invalid namespace")
+	}
+	err := m.Add("other", createTestStamp(t))
+	if err != nil {
+		t.Fatalf("failed to add stamp: %s", err)
+	}
+	if !errors.Is(m.Add("other", createTestStamp(t)), ErrMempoolFull) {
+		t.Fatalf("stamp accepted by a full mempool")
+	}
+	if ns := m.Namespaces(); len(ns) != 2 || ns[0] != "other" || ns[1] != "test" {
+		t.Fatalf("invalid namespaces: %v", ns)
+	}
+
+	// Stamps are batched in their order of arrival
+	batch := m.Take("test")
+	if len(batch) != 2 || batch[0].Serialize() != stamps[0].Serialize() || batch[1].Serialize() != stamps[1].Serialize() {
+		t.Fatalf("invalid batch: %v", batch)
+	}
+	if m.Len("test") != 2 {
+		t.Fatalf("%d stamps pending instead of 2", m.Len("test"))
+	}
+	m.Requeue("test", batch)
+	batch = m.Take("test")
+	if len(batch) != 2 || batch[0].Serialize() != stamps[0].Serialize() {
+		t.Fatalf("requeued stamps are not taken first")
+	}
+	if len(m.Take("test")) != 2 || len(m.Take("test")) != 0 || m.Len("test") != 0 {
+		t.Fatalf("stamps were not all taken")
+	}
+
+	// Size and validity limits
+	small := NewMempool(MempoolConfig{MaxStampSize: 64, Validate: acceptStamp})
+	if !errors.Is(small.Add("test", createTestStamp(t, "openmpi-4.0.2")), ErrStampTooLarge) {
+		t.Fatalf("large stamp was accepted")
+	}
+	if NewMempool(MempoolConfig{}).Add("test", createTestStamp(t)) == nil {
+		t.Fatalf("stamp without proof of work was accepted")
+	}
+}
+
+func TestMempoolFlush(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-mempool"
+
+	m := NewMempool(MempoolConfig{BatchSize: 3, Validate: acceptStamp})
+	for i := 0; i < 4; i++ {
+		err := m.Add(namespace, createTestStamp(t, fmt.Sprintf("openmpi-%d", i)))
+		if err != nil {
+			t.Fatalf("failed to add stamp: %s", err)
+		}
+	}
+
+	// Stamps are kept when no block can be created
+	_, err := m.Flush(namespace)
+	if err == nil || m.Len(namespace) != 4 {
+		t.Fatalf("block created in a namespace that does not exist: %v", err)
+	}
+
+	_, err = CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	for _, expected := range []int{3, 1} {
+		b, err := m.Flush(namespace)
+		if err != nil {
+			t.Fatalf("failed to flush mempool: %s", err)
+		}
+		if len(b.Stamps()) != expected || len(b.entries()) != expected {
+			t.Fatalf("block has %d stamps instead of %d", len(b.Stamps()), expected)
+		}
+	}
+	b, err := m.Flush(namespace)
+	if b != nil || err != nil {
+		t.Fatalf("empty mempool created a block: %v", err)
+	}
+
+	s, err := LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+	err = Verify(s, namespace, VerifyOptions{CheckStamp: func(*Block, int) error { return nil }})
+	if err != nil {
+		t.Fatalf("chain of batched blocks is invalid: %s", err)
+	}
+}
+
+func TestMempoolResubmit(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-mempool"
+	_, err := CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+
+	m := NewMempool(MempoolConfig{Validate: acceptStamp})
+	stamp := createTestStamp(t, "openmpi-4.0.2")
+	err = m.Add(namespace, stamp)
+	if err != nil {
+		t.Fatalf("failed to add stamp: %s", err)
+	}
+
+	// The block is held until the stamp is resubmitted
+	commitLock.Lock()
+	type flushResult struct {
+		b   *Block
+		err error
+	}
+	done := make(chan flushResult)
+	go func() {
+		b, err := m.Flush(namespace)
+		done <- flushResult{b, err}
+	}()
+	for m.Len(namespace) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	err = m.Add(namespace, stamp)
+	commitLock.Unlock()
+	if !errors.Is(err, ErrDuplicateStamp) {
+		t.Fatalf("stamp of a block being committed was accepted: %v", err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("failed to flush mempool: %s", r.err)
+	}
+	if len(r.b.Stamps()) != 1 || m.Len(namespace) != 0 {
+		t.Fatalf("block has %d stamps and %d stamps are pending", len(r.b.Stamps()), m.Len(namespace))
+	}
+	if len(m.known) != 0 {
+		t.Fatalf("%d stamps are still known after the block is committed", len(m.known))
+	}
+}
+
+func TestSubmitStamp(t *testing.T) {
+	network := comm.NewMemNetwork()
+	leader := createTestNode(t, network, "leader")
+	defer leader.cleanup()
+	node := createTestNode(t, network, "node")
+	defer node.cleanup()
+
+	m := NewMempool(MempoolConfig{Validate: acceptStamp})
+	err := m.Register(leader.mux)
+	if err != nil {
+		t.Fatalf("failed to register mempool: %s", err)
+	}
+	peer, err := node.pool.GetURL(context.Background(), "leader")
+	if err != nil {
+		t.Fatalf("failed to connect to leader: %s", err)
+	}
+
+	stamp := createTestStamp(t, "openmpi-4.0.2")
+	err = SubmitStamp(peer, "test", stamp)
+	if err != nil {
+		t.Fatalf("failed to submit stamp: %s", err)
+	}
+	err = SubmitStamp(peer, "test", stamp)
+	if err == nil || !strings.Contains(err.Error(), ErrDuplicateStamp.Error()) {
+		t.Fatalf("duplicate stamp was accepted: %v", err)
+	}
+
+	batch := m.Take("test")
+	if len(batch) != 1 || batch[0].Serialize() != stamp.Serialize() {
+		t.Fatalf("submitted stamp is not in the mempool: %v", batch)
+	}
+}
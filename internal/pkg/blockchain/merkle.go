@@ -0,0 +1,50 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Leaves and inner nodes are hashed with a different prefix so that an inner
+// node can never be passed off as a manifest (see RFC 6962)
+const (
+	merkleLeafPrefix  = 0x00
+	merkleInnerPrefix = 0x01
+)
+
+// MerkleRoot computes the Merkle root of a list of manifest entries. When a
+// level has an odd number of nodes, the last one is promoted to the next
+// level as is. The root of an empty list is the hash of nothing.
+func MerkleRoot(entries []string) string {
+	if len(entries) == 0 {
+		h := sha256.Sum256(nil)
+		return hex.EncodeToString(h[:])
+	}
+
+	var level [][]byte
+	for _, e := range entries {
+		h := sha256.Sum256(append([]byte{merkleLeafPrefix}, e...))
+		level = append(level, h[:])
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i+1 < len(level); i += 2 {
+			data := append([]byte{merkleInnerPrefix}, level[i]...)
+			data = append(data, level[i+1]...)
+			h := sha256.Sum256(data)
+			next = append(next, h[:])
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
@@ -5,7 +5,18 @@
 
 package blockchain
 
-import "hash"
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+)
+
+// Every namespace has its own chain. Namespaces are typically used to keep
+// the results of different MPI implementations, or different sites, apart.
 
 type Namespace struct {
 	// ID is a human readable identifier for a given namespace
@@ -13,4 +24,190 @@ type Namespace struct {
 
 	// Hash is the hash of the namespace'ID
 	Hash hash.Hash
+
+	// Info is the description of the namespace from its genesis block
+	Info NamespaceInfo
+}
+
+// NamespaceInfo describes a namespace; it is carried by the genesis block of
+// its chain
+type NamespaceInfo struct {
+	ID         string        `json:"id"`
+	Creator    string        `json:"creator"`
+	Created    time.Time     `json:"created"`
+	Consensus  ConsensusType `json:"consensus"`
+	Difficulty int           `json:"difficulty"`
+
+	// TargetInterval and RetargetWindow define how the difficulty adapts to
+	// the rate of the blocks; it never changes when they are not set
+	TargetInterval time.Duration `json:"target_interval,omitempty"`
+	RetargetWindow int           `json:"retarget_window,omitempty"`
+}
+
+// NamespaceConfig are the settings of a new namespace; the defaults are used
+// for the fields that are not set
+type NamespaceConfig struct {
+	// Creator identifies the node creating the namespace, the identity of
+	// the local node by default
+	Creator string
+
+	// Consensus is the consensus algorithm of the nodes sharing the chain
+	Consensus ConsensusType
+
+	// Difficulty is the initial number of leading bits equal to zero a
+	// stamp needs
+	Difficulty int
+
+	// TargetInterval is the expected time between two blocks
+	TargetInterval time.Duration
+
+	// RetargetWindow is the number of blocks after which the difficulty is
+	// adjusted
+	RetargetWindow int
+}
+
+// MPINamespace returns the identifier of the namespace of an implementation
+// of MPI, e.g., openmpi
+func MPINamespace(mpiImplem string) string {
+	return "mpi-" + mpiImplem
+}
+
+// SiteNamespace returns the identifier of the namespace of a site
+func SiteNamespace(site string) string {
+	return "site-" + site
+}
+
+// NewNamespace returns the namespace with a given identifier
+func NewNamespace(id string) Namespace {
+	h := sha256.New()
+	h.Write([]byte(id))
+	return Namespace{
+		ID:   id,
+		Hash: h,
+	}
+}
+
+// CreateNamespace creates a namespace with the default settings, see
+// CreateNamespaceWithConfig
+func CreateNamespace(id string) (Namespace, error) {
+	return CreateNamespaceWithConfig(id, NamespaceConfig{})
+}
+
+// CreateNamespaceWithConfig creates a namespace by committing the genesis
+// block of its chain to the local cache
+func CreateNamespaceWithConfig(id string, cfg NamespaceConfig) (Namespace, error) {
+	b, err := newGenesisBlock(id, cfg)
+	if err != nil {
+		return Namespace{}, err
+	}
+	err = b.commitBlock()
+	if err != nil {
+		return Namespace{}, fmt.Errorf("failed to create namespace %s: %s", id, err)
+	}
+
+	ns := NewNamespace(id)
+	ns.Info = *b.genesis
+	return ns, nil
+}
+
+// newGenesisBlock returns the genesis block of a new namespace, which still
+// needs to be committed
+func newGenesisBlock(id string, cfg NamespaceConfig) (Block, error) {
+	err := cache.CheckNamespace(id)
+	if err != nil {
+		return Block{}, err
+	}
+
+	if cfg.Creator == "" {
+		id, err := identity.Local()
+		if err != nil {
+			return Block{}, fmt.Errorf("unable to get the identity of the node: %s", err)
+		}
+		cfg.Creator = id.Resource
+	}
+	cfg.Consensus, err = ParseConsensusType(string(cfg.Consensus))
+	if err != nil {
+		return Block{}, err
+	}
+	if cfg.Difficulty == 0 {
+		cfg.Difficulty = defaultDifficulty
+	}
+	if cfg.Difficulty < 0 || cfg.Difficulty > maxDifficulty {
+		return Block{}, fmt.Errorf("invalid difficulty %d", cfg.Difficulty)
+	}
+	if cfg.TargetInterval == 0 {
+		cfg.TargetInterval = defaultTargetInterval
+	}
+	if cfg.RetargetWindow == 0 {
+		cfg.RetargetWindow = defaultRetargetWindow
+	}
+	if cfg.TargetInterval < 0 || cfg.RetargetWindow < 2 {
+		return Block{}, fmt.Errorf("invalid retargeting rule: %d blocks every %s", cfg.RetargetWindow, cfg.TargetInterval)
+	}
+
+	b := Block{
+		namespace: id,
+		genesis: &NamespaceInfo{
+			ID:         id,
+			Creator:    cfg.Creator,
+			Created:    time.Now().UTC(),
+			Consensus:  cfg.Consensus,
+			Difficulty: cfg.Difficulty,
+
+			TargetInterval: cfg.TargetInterval,
+			RetargetWindow: cfg.RetargetWindow,
+		},
+	}
+	return b, nil
+}
+
+// LoadNamespace returns a namespace of the local cache
+func LoadNamespace(id string) (Namespace, error) {
+	s, err := LocalBlockStore()
+	if err != nil {
+		return Namespace{}, err
+	}
+	genesis, err := s.BlockAt(id, 0)
+	if err != nil {
+		return Namespace{}, fmt.Errorf("namespace %s does not exist: %s", id, err)
+	}
+	if genesis.genesis == nil || genesis.genesis.ID != id {
+		return Namespace{}, fmt.Errorf("first block of namespace %s is not a genesis block", id)
+	}
+
+	ns := NewNamespace(id)
+	ns.Info = *genesis.genesis
+	return ns, nil
+}
+
+// LocalNamespaces returns all the namespaces of the local cache, e.g., to
+// advertise them to peers
+func LocalNamespaces() ([]Namespace, error) {
+	s, err := LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := cache.LoadNamespaces(cache.GetBasedir())
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []Namespace
+	for _, id := range ids {
+		// Namespaces learnt from peers have no chain until they are
+		// synchronized
+		n, err := s.Len(id)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		ns, err := LoadNamespace(id)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
 }
@@ -0,0 +1,748 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// A node of a connected network runs until it is stopped. The nodes elect a
+// leader with the consensus algorithm of the network. The leader accepts the
+// stamps submitted to the network, forms blocks out of them and proposes the
+// blocks to the network; every node appends the committed blocks to its
+// chains once they are verified. The other nodes, the peers, forward the
+// stamps submitted to them to the leader and follow the chains, catching up
+// with the leader when they miss blocks. Roles change whenever a new leader
+// is elected.
+
+const (
+	// NODESTATUSMSG is a request for the status of a node
+	NODESTATUSMSG = "NDST"
+
+	defaultFlushInterval = time.Second
+
+	// roleCheckInterval is the interval at which a node checks whether the
+	// leader changed
+	roleCheckInterval = 100 * time.Millisecond
+)
+
+func init() {
+	comm.RegisterMsgType(NODESTATUSMSG)
+}
+
+// ErrNoLeader is returned when a stamp is submitted to a peer that does not
+// know the leader, e.g., during an election
+var ErrNoLeader = errors.New("no leader is known")
+
+// ErrNotLeader is returned when a peer gets a stamp forwarded by another
+// peer, which wrongly believes it is the leader
+var ErrNotLeader = errors.New("node is not the leader")
+
+// errNotAppended is returned when a block is committed by the network but is
+// not part of the local chain
+var errNotAppended = errors.New("committed block is not in the local chain")
+
+// NodeConfig is the configuration of a node of a connected network; the
+// defaults are used for the fields that are not set
+type NodeConfig struct {
+	// ID is the identifier of the node, it must be one of the peers
+	ID string
+
+	// URL is the address the node listens on
+	URL string
+
+	// Peers are all the nodes of the network, including the local node
+	Peers []PeerRecord
+
+	// Consensus is the consensus algorithm of the network
+	Consensus ConsensusType
+
+	// PrivateKey is the key of the node and PublicKeys the keys of all the
+	// nodes, by identifier (pBFT only)
+	PrivateKey ed25519.PrivateKey
+	PublicKeys map[string]ed25519.PublicKey
+
+	// Timeout is the time after which the leader is suspected; the default
+	// of the consensus algorithm is used when not set
+	Timeout time.Duration
+
+	// FlushInterval is the interval at which the leader forms blocks out of
+	// the pending stamps
+	FlushInterval time.Duration
+
+	// Namespaces are created by the leader when they do not exist yet
+	Namespaces map[string]NamespaceConfig
+
+	// Mempool limits the stamps pending at the leader
+	Mempool MempoolConfig
+
+	// Verify tunes the checks of the committed blocks
+	Verify VerifyOptions
+
+	// Transport is the transport used to connect to the peers, and to
+	// listen, TCP when not set
+	Transport comm.Transport
+
+	// OnRoleChange, when set, is invoked when the node becomes the leader or
+	// a peer
+	OnRoleChange func(role Role, leader string)
+}
+
+// NodeStatus is the response to a NODESTATUSMSG request
+type NodeStatus struct {
+	ID     string        `json:"id"`
+	Role   Role          `json:"role"`
+	Leader string        `json:"leader"`
+	Chains []ChainStatus `json:"chains"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Node is a node of a connected network
+type Node struct {
+	cfg       NodeConfig
+	store     *BlockStore
+	registry  *Registry
+	pool      *Pool
+	mux       *comm.HandlerMux
+	server    *comm.Server
+	consensus Consensus
+	mempool   *Mempool
+
+	lock    sync.Mutex
+	role    Role
+	leader  string
+	syncing map[string]bool
+
+	// unreachable is when the pBFT primary was found unreachable, zero if
+	// it is reachable; it is only used by watchLeader
+	unreachable time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartNode starts a node of a connected network, with the chains of the
+// local cache; the node runs until it is stopped
+func StartNode(cfg NodeConfig) (*Node, error) {
+	var ids []string
+	for _, p := range cfg.Peers {
+		ids = append(ids, p.ID)
+	}
+	sort.Strings(ids)
+	found := false
+	for _, id := range ids {
+		if id == cfg.ID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not part of the peers", cfg.ID)
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	var err error
+	cfg.Consensus, err = ParseConsensusType(string(cfg.Consensus))
+	if err != nil {
+		return nil, err
+	}
+
+	basedir := cache.GetBasedir()
+	err = cfg.Verify.setDefaults(basedir)
+	if err != nil {
+		return nil, err
+	}
+	store, err := sharedBlockStore(basedir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block store: %s", err)
+	}
+	registry, err := LoadRegistry(basedir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.Peers {
+		p.LastSeen = time.Now()
+		p.Role = RoleUnknown
+		if key := cfg.PublicKeys[p.ID]; key != nil {
+			p.PublicKey = hex.EncodeToString(key)
+		}
+		registry.Configure(p)
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		store:    store,
+		registry: registry,
+		mux:      comm.NewHandlerMux(),
+		mempool:  NewMempool(cfg.Mempool),
+		role:     RolePeer,
+		syncing:  make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	n.pool = NewPool(registry, PoolConfig{
+		Self: PeerRecord{
+			ID:   cfg.ID,
+			URL:  cfg.URL,
+			Role: RolePeer,
+		},
+		PrivateKey: cfg.PrivateKey,
+		Transport:  cfg.Transport,
+		Handler:    n.mux.ServeMsg,
+	})
+
+	err = n.mux.Handle(PEERSMSG, n.pool.HandleGossip)
+	if err == nil {
+		err = NewSyncServer(store).Register(n.mux)
+	}
+	if err == nil {
+		err = n.mux.Handle(STAMPMSG, n.HandleSubmit)
+	}
+	if err == nil {
+		err = n.mux.Handle(NODESTATUSMSG, n.HandleStatus)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := comm.PeerInfo{
+		URL:       cfg.URL,
+		Transport: cfg.Transport,
+		Handler:   n.mux.ServeMsg,
+	}
+	n.server, err = info.Listen()
+	if err != nil {
+		n.pool.Close()
+		return nil, err
+	}
+	go n.server.Serve()
+
+	n.consensus, err = NewConsensus(cfg.Consensus, ConsensusConfig{
+		ID:         cfg.ID,
+		Nodes:      ids,
+		PrivateKey: cfg.PrivateKey,
+		PublicKeys: cfg.PublicKeys,
+		Timeout:    cfg.Timeout,
+		StateDir:   cache.GetConsensusDir(basedir),
+		Apply:      n.apply,
+	}, n.pool, n.mux)
+	if err != nil {
+		n.server.Close()
+		n.pool.Close()
+		return nil, err
+	}
+
+	n.wg.Add(2)
+	go n.watchLeader()
+	go n.flushLoop()
+
+	return n, nil
+}
+
+// Stop stops the node and closes its connections
+func (n *Node) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+	n.consensus.Stop()
+	n.server.Close()
+	n.pool.Close()
+	err := n.registry.Save()
+	if err != nil {
+		log.Printf("[WARN] %s", err)
+	}
+}
+
+// ID returns the identifier of the node
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Addr returns the address the node is listening on
+func (n *Node) Addr() string {
+	return n.server.Addr()
+}
+
+// Role returns the current role of the node
+func (n *Node) Role() Role {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role
+}
+
+// Leader returns the identifier of the current leader, empty if unknown
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+// StartElection asks the network to elect a new leader
+func (n *Node) StartElection() {
+	n.consensus.StartElection()
+}
+
+/* Roles */
+
+func (n *Node) watchLeader() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(roleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.checkLeader()
+			n.checkPrimary()
+		}
+	}
+}
+
+// checkLeader updates the role of the node when a new leader is elected
+func (n *Node) checkLeader() {
+	leader := n.consensus.Leader()
+
+	n.lock.Lock()
+	if leader == n.leader {
+		n.lock.Unlock()
+		return
+	}
+	prev := n.leader
+	n.leader = leader
+	role := RolePeer
+	if leader == n.cfg.ID {
+		role = RoleLeader
+	}
+	changed := role != n.role
+	n.role = role
+	n.lock.Unlock()
+
+	if prev != "" {
+		n.registry.SetRole(prev, RolePeer)
+	}
+	if leader == "" {
+		return
+	}
+	n.registry.SetRole(leader, RoleLeader)
+	log.Printf("[INFO] node %s: %s is the leader", n.cfg.ID, leader)
+
+	if role == RoleLeader {
+		go n.createNamespaces()
+	} else {
+		// The stamps we got while leading belong to the new leader now
+		go n.handOver()
+		go n.syncAll()
+	}
+	if changed && n.cfg.OnRoleChange != nil {
+		n.cfg.OnRoleChange(role, leader)
+	}
+}
+
+// checkPrimary suspects the primary of a pBFT network when it cannot be
+// reached for the timeout: pBFT only suspects a primary that does not handle
+// pending requests, a primary crashing while the network is idle would
+// never be replaced
+func (n *Node) checkPrimary() {
+	leader := n.Leader()
+	pbft, ok := n.consensus.(*PBFT)
+	if !ok || leader == "" || leader == n.cfg.ID {
+		n.unreachable = time.Time{}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), roleCheckInterval)
+	defer cancel()
+	_, err := n.pool.Get(ctx, leader)
+	if err == nil {
+		n.unreachable = time.Time{}
+		return
+	}
+	if n.unreachable.IsZero() {
+		n.unreachable = time.Now()
+		return
+	}
+	timeout := n.cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultViewChangeTimeout
+	}
+	if time.Since(n.unreachable) >= timeout {
+		log.Printf("[WARN] node %s: leader %s is unreachable: %s", n.cfg.ID, leader, err)
+		n.unreachable = time.Time{}
+		// The other nodes may have moved to a new view already
+		pbft.Suspect(leader)
+	}
+}
+
+// handOver forwards the pending stamps to the leader
+func (n *Node) handOver() {
+	for _, ns := range n.mempool.Namespaces() {
+		for {
+			stamps := n.mempool.Take(ns)
+			if len(stamps) == 0 {
+				break
+			}
+			for i := range stamps {
+				err := n.Submit(ns, stamps[i])
+				if err != nil {
+					log.Printf("[WARN] failed to hand stamp of namespace %s over to the leader: %s", ns, err)
+				}
+			}
+			n.mempool.Forget(stamps)
+		}
+	}
+}
+
+/* Leader */
+
+func (n *Node) flushLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			if n.Role() != RoleLeader {
+				continue
+			}
+			for _, ns := range n.mempool.Namespaces() {
+				err := n.flush(ns)
+				if err != nil {
+					log.Printf("[ERROR] %s", err)
+				}
+			}
+		}
+	}
+}
+
+// flush forms a block out of a batch of the pending stamps of a namespace
+// and proposes it to the network
+func (n *Node) flush(namespace string) error {
+	stamps := n.mempool.batch(namespace)
+	if len(stamps) == 0 {
+		return nil
+	}
+	b, err := BatchCreate(namespace, stamps)
+	if err == nil {
+		err = n.propose(&b)
+	}
+	if errors.Is(err, errNotAppended) {
+		// The stamps are part of a committed block, they must not be
+		// included in another one
+		n.mempool.Forget(stamps)
+		return fmt.Errorf("block of namespace %s: %w", namespace, err)
+	}
+	if err != nil {
+		n.mempool.Requeue(namespace, stamps)
+		return fmt.Errorf("failed to create block of namespace %s from %d stamps: %s", namespace, len(stamps), err)
+	}
+	// The stamps were spent when the block was appended
+	n.mempool.Forget(stamps)
+	log.Printf("[INFO] block %d of namespace %s committed with %d stamps", b.height, namespace, len(stamps))
+	return nil
+}
+
+// createNamespaces creates the namespaces of the configuration that do not
+// exist yet
+func (n *Node) createNamespaces() {
+	var ids []string
+	for id := range n.cfg.Namespaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		l, err := n.store.Len(id)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			continue
+		}
+		if l > 0 {
+			continue
+		}
+		b, err := newGenesisBlock(id, n.cfg.Namespaces[id])
+		if err == nil {
+			err = n.propose(&b)
+		}
+		if err != nil {
+			log.Printf("[ERROR] failed to create namespace %s: %s", id, err)
+			continue
+		}
+		log.Printf("[INFO] namespace %s created", id)
+	}
+}
+
+// propose links a block to the head of its chain and proposes it to the
+// network; it returns once the block is appended to the local chain, or
+// errNotAppended if the block is committed but not appended
+func (n *Node) propose(b *Block) error {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+
+	err := b.seal(n.store)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err = n.consensus.Propose(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	// The block is committed, if it is not appended the local chain is
+	// missing blocks committed in the meantime, e.g., by a new leader
+	_, err = n.store.BlockByHash(b.namespace, b.h)
+	if err != nil {
+		go n.syncNamespace(b.namespace)
+		return fmt.Errorf("%w: block %s: %s", errNotAppended, b.h, err)
+	}
+	return nil
+}
+
+/* All nodes */
+
+// apply appends a block committed by the network to the local chain of its
+// namespace; it is invoked by the consensus algorithm
+func (n *Node) apply(index uint64, data []byte) {
+	var b Block
+	err := json.Unmarshal(data, &b)
+	if err != nil {
+		log.Printf("[ERROR] invalid block committed at index %d: %s", index, err)
+		return
+	}
+	err = n.appendBlock(&b)
+	if err != nil {
+		log.Printf("[WARN] block %d of namespace %s not appended: %s", b.height, b.namespace, err)
+		go n.syncNamespace(b.namespace)
+	}
+}
+
+// appendBlock verifies a block and appends it to the local chain of its
+// namespace, unless it is already there; its stamps must not be spent yet
+func (n *Node) appendBlock(b *Block) error {
+	if _, err := n.store.BlockByHash(b.namespace, b.h); err == nil {
+		return nil
+	}
+	height, err := n.store.Len(b.namespace)
+	if err != nil {
+		return err
+	}
+	var prev *Block
+	if height > 0 {
+		prev, err = n.store.BlockAt(b.namespace, height-1)
+		if err != nil {
+			return err
+		}
+	}
+	reason := verifyBlock(b, prev, height, b.namespace, newDifficultyTracker(n.store, b.namespace), &n.cfg.Verify)
+	for i := 0; reason == "" && i < len(b.stamps); i++ {
+		spent, err := b.stamps[i].IsSpent()
+		if err != nil {
+			return err
+		}
+		if spent {
+			reason = fmt.Sprintf("stamp %d: %s", i, hashcash.HashCashSpentErr)
+		}
+	}
+	if reason != "" {
+		return &VerifyError{
+			Namespace: b.namespace,
+			Height:    height,
+			Hash:      b.h,
+			Reason:    reason,
+		}
+	}
+	err = n.store.Append(b)
+	if err != nil {
+		return err
+	}
+	spendStamps(b.stamps)
+	return nil
+}
+
+// syncNamespace brings the local chain of a namespace up to date with the
+// chain of the leader
+func (n *Node) syncNamespace(namespace string) {
+	n.lock.Lock()
+	leader := n.leader
+	if n.syncing[namespace] || leader == "" || leader == n.cfg.ID {
+		n.lock.Unlock()
+		return
+	}
+	n.syncing[namespace] = true
+	n.lock.Unlock()
+	defer func() {
+		n.lock.Lock()
+		delete(n.syncing, namespace)
+		n.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	peer, err := n.pool.Get(ctx, leader)
+	if err != nil {
+		log.Printf("[WARN] unable to synchronize namespace %s: %s", namespace, err)
+		return
+	}
+	added, err := SyncNamespace(peer, n.store, namespace, n.cfg.Verify)
+	if err != nil {
+		log.Printf("[ERROR] synchronization of namespace %s failed after %d blocks: %s", namespace, added, err)
+		return
+	}
+	if added > 0 {
+		log.Printf("[INFO] namespace %s synchronized, %d new blocks", namespace, added)
+	}
+}
+
+// syncAll brings the local chains up to date with the chains of the leader,
+// including the chains of the namespaces we do not know yet, e.g., when we
+// join the network after they were created
+func (n *Node) syncAll() {
+	leader := n.Leader()
+	if leader == "" || leader == n.cfg.ID {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	peer, err := n.pool.Get(ctx, leader)
+	cancel()
+	if err == nil {
+		_, err = reqListNamespaces(n.store.basedir, peer)
+	}
+	if err != nil {
+		log.Printf("[WARN] unable to get the namespaces of the leader %s: %s", leader, err)
+	}
+
+	namespaces, err := cache.LoadNamespaces(n.store.basedir)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return
+	}
+	for _, ns := range namespaces {
+		n.syncNamespace(ns)
+	}
+}
+
+// Submit submits a stamp of a namespace to the network: the leader adds it
+// to its mempool, the peers forward it to the leader
+func (n *Node) Submit(namespace string, stamp hashcash.Stamp) error {
+	return n.submit(namespace, stamp, false)
+}
+
+func (n *Node) submit(namespace string, stamp hashcash.Stamp, forwarded bool) error {
+	n.lock.Lock()
+	role, leader := n.role, n.leader
+	n.lock.Unlock()
+
+	switch {
+	case role == RoleLeader:
+		return n.mempool.Add(namespace, stamp)
+	case forwarded:
+		return ErrNotLeader
+	case leader == "":
+		return ErrNoLeader
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	peer, err := n.pool.Get(ctx, leader)
+	if err != nil {
+		return fmt.Errorf("unable to reach the leader %s: %w", leader, err)
+	}
+	return submitStamp(peer, stampSubmission{
+		Namespace: namespace,
+		Stamp:     stamp.Serialize(),
+		Forwarded: true,
+	})
+}
+
+// HandleSubmit handles a STAMPMSG request from a client or a peer
+func (n *Node) HandleSubmit(peer *comm.PeerInfo, msg comm.Message) {
+	serveSubmit(peer, msg, n.submit)
+}
+
+// Status returns the status of the node and of its chains
+func (n *Node) Status() (NodeStatus, error) {
+	n.lock.Lock()
+	status := NodeStatus{
+		ID:     n.cfg.ID,
+		Role:   n.role,
+		Leader: n.leader,
+		Chains: []ChainStatus{},
+	}
+	n.lock.Unlock()
+
+	namespaces, err := cache.LoadNamespaces(n.store.basedir)
+	if err != nil {
+		return status, err
+	}
+	for _, ns := range namespaces {
+		head, err := n.store.Head(ns)
+		if err != nil {
+			return status, err
+		}
+		if head == nil {
+			continue
+		}
+		status.Chains = append(status.Chains, ChainStatus{
+			Namespace: ns,
+			Exists:    true,
+			Height:    head.height,
+			Hash:      head.h,
+		})
+	}
+	return status, nil
+}
+
+// HandleStatus handles a NODESTATUSMSG request
+func (n *Node) HandleStatus(peer *comm.PeerInfo, msg comm.Message) {
+	status, err := n.Status()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	payload, err := json.Marshal(&status)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode status of node %s: %s", n.cfg.ID, err)
+		return
+	}
+	err = peer.Reply(msg, NODESTATUSMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to %s: %s", peer.URL, err)
+	}
+}
+
+// ReqNodeStatus gets the status of a node
+func ReqNodeStatus(peer *comm.PeerInfo) (NodeStatus, error) {
+	resp, err := peer.Request(NODESTATUSMSG, nil, requestTimeout)
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	var status NodeStatus
+	err = json.Unmarshal(resp.Payload, &status)
+	if err != nil {
+		return status, fmt.Errorf("%w: invalid node status: %s", comm.ErrProtocol, err)
+	}
+	if status.Error != "" {
+		return status, fmt.Errorf("node %s failed to get its status: %s", status.ID, status.Error)
+	}
+	return status, nil
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// The nodes of the multi-process tests run TestNodeProcess in a copy of the
+// test binary, configured through nodeProcessEnv
+const nodeProcessEnv = "SY_TEST_NODE"
+
+const (
+	nodeTestNamespace  = "test-nodes"
+	nodeTestDifficulty = 8
+)
+
+type nodeProcessConfig struct {
+	ID         string                       `json:"id"`
+	URL        string                       `json:"url"`
+	Peers      []PeerRecord                 `json:"peers"`
+	Consensus  ConsensusType                `json:"consensus"`
+	PrivateKey ed25519.PrivateKey           `json:"private_key"`
+	PublicKeys map[string]ed25519.PublicKey `json:"public_keys"`
+}
+
+// TestNodeProcess runs a node until its standard input is closed; it is
+// only run as a child of the multi-process tests
+func TestNodeProcess(t *testing.T) {
+	env := os.Getenv(nodeProcessEnv)
+	if env == "" {
+		t.Skip("only run as a node of the multi-process tests")
+	}
+	var cfg nodeProcessConfig
+	err := json.Unmarshal([]byte(env), &cfg)
+	if err != nil {
+		t.Fatalf("invalid node configuration: %s", err)
+	}
+
+	n, err := StartNode(NodeConfig{
+		ID:            cfg.ID,
+		URL:           cfg.URL,
+		Peers:         cfg.Peers,
+		Consensus:     cfg.Consensus,
+		PrivateKey:    cfg.PrivateKey,
+		PublicKeys:    cfg.PublicKeys,
+		Timeout:       500 * time.Millisecond,
+		FlushInterval: 100 * time.Millisecond,
+		Namespaces: map[string]NamespaceConfig{
+			nodeTestNamespace: {Difficulty: nodeTestDifficulty},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start node: %s", err)
+	}
+	io.Copy(ioutil.Discard, os.Stdin)
+	n.Stop()
+}
+
+type nodeProcess struct {
+	id    string
+	url   string
+	dir   string
+	key   keys.KeyPair
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+type nodeCluster struct {
+	nodes     []*nodeProcess
+	key       keys.KeyPair
+	peers     []PeerRecord
+	pubKeys   map[string]ed25519.PublicKey
+	consensus ConsensusType
+}
+
+func freeLoopbackAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to allocate port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startNodeCluster starts nodes in separate processes, each with its own
+// cache; all the nodes trust each other and know the keys they sign the
+// messages of the consensus algorithm with
+func startNodeCluster(t *testing.T, size int, consensus ConsensusType) *nodeCluster {
+	c := newNodeCluster(t, size, consensus)
+	for _, n := range c.nodes {
+		c.start(t, n)
+	}
+	return c
+}
+
+// newNodeCluster configures the nodes of a cluster without starting them
+func newNodeCluster(t *testing.T, size int, consensus ConsensusType) *nodeCluster {
+	c := &nodeCluster{consensus: consensus}
+	var peers []PeerRecord
+	pubKeys := make(map[string]ed25519.PublicKey)
+	for i := 0; i < size; i++ {
+		dir, err := ioutil.TempDir("", "syvalidate-node-")
+		if err != nil {
+			t.Fatalf("failed to create temporary directory: %s", err)
+		}
+		n := &nodeProcess{
+			id:  fmt.Sprintf("node%d", i),
+			url: freeLoopbackAddr(t),
+			dir: dir,
+		}
+		c.nodes = append(c.nodes, n)
+		peers = append(peers, PeerRecord{ID: n.id, URL: n.url})
+	}
+	for i, n := range c.nodes {
+		kp, err := keys.Generate(n.dir, false)
+		if err != nil {
+			t.Fatalf("failed to generate key of %s: %s", n.id, err)
+		}
+		if i == 0 {
+			c.key = kp
+		}
+		n.key = kp
+		pubKeys[n.id] = kp.Public
+		for _, other := range c.nodes {
+			if other != n {
+				err = keys.Trust(other.dir, n.id, kp.Public)
+				if err != nil {
+					t.Fatalf("failed to trust key of %s: %s", n.id, err)
+				}
+			}
+		}
+	}
+
+	c.peers = peers
+	c.pubKeys = pubKeys
+	return c
+}
+
+// start starts a node of the cluster in a separate process
+func (c *nodeCluster) start(t *testing.T, n *nodeProcess) {
+	env, err := json.Marshal(&nodeProcessConfig{
+		ID:         n.id,
+		URL:        n.url,
+		Peers:      c.peers,
+		Consensus:  c.consensus,
+		PrivateKey: n.key.Private,
+		PublicKeys: c.pubKeys,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode configuration: %s", err)
+	}
+	logs, err := os.Create(filepath.Join(n.dir, "node.log"))
+	if err != nil {
+		t.Fatalf("failed to create log file: %s", err)
+	}
+	n.cmd = exec.Command(os.Args[0], "-test.run=^TestNodeProcess$")
+	n.cmd.Env = append(os.Environ(),
+		nodeProcessEnv+"="+string(env),
+		cache.CacheLocalationEnvDir+"="+n.dir,
+	)
+	n.cmd.Stdout = logs
+	n.cmd.Stderr = logs
+	n.stdin, err = n.cmd.StdinPipe()
+	if err == nil {
+		err = n.cmd.Start()
+	}
+	logs.Close()
+	if err != nil {
+		t.Fatalf("failed to start %s: %s", n.id, err)
+	}
+}
+
+func (c *nodeCluster) stop(t *testing.T) {
+	for _, n := range c.nodes {
+		if n.cmd != nil && n.cmd.ProcessState == nil {
+			n.stdin.Close()
+			n.cmd.Wait()
+		}
+		if t.Failed() {
+			logs, _ := ioutil.ReadFile(filepath.Join(n.dir, "node.log"))
+			t.Logf("logs of %s:\n%s", n.id, logs)
+		}
+		os.RemoveAll(n.dir)
+	}
+}
+
+func (c *nodeCluster) kill(n *nodeProcess) {
+	n.cmd.Process.Kill()
+	n.cmd.Wait()
+}
+
+func (c *nodeCluster) node(id string) *nodeProcess {
+	for _, n := range c.nodes {
+		if n.id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (c *nodeCluster) alive() []*nodeProcess {
+	var nodes []*nodeProcess
+	for _, n := range c.nodes {
+		if n.cmd != nil && n.cmd.ProcessState == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// connect connects to a node; the connection must be closed by the caller
+func (n *nodeProcess) connect() (*comm.PeerInfo, error) {
+	peer := &comm.PeerInfo{
+		URL:         n.url,
+		DialOptions: &comm.DialOptions{MaxRetries: 0},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := peer.ConnectContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func (n *nodeProcess) status() (NodeStatus, error) {
+	peer, err := n.connect()
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	defer peer.Close()
+	return ReqNodeStatus(peer)
+}
+
+func (n *nodeProcess) submit(namespace string, stamp hashcash.Stamp) error {
+	peer, err := n.connect()
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	return SubmitStamp(peer, namespace, stamp)
+}
+
+// waitFor polls a condition until it holds or the deadline expires
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s: %s", what, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitHeight waits until the chains of the live nodes all have a given
+// number of blocks, ending with the same block
+func (c *nodeCluster) waitHeight(t *testing.T, length uint64) {
+	waitFor(t, fmt.Sprintf("%d blocks", length), 20*time.Second, func() error {
+		hash := ""
+		for _, n := range c.alive() {
+			status, err := n.status()
+			if err != nil {
+				return err
+			}
+			var chain *ChainStatus
+			for i := range status.Chains {
+				if status.Chains[i].Namespace == nodeTestNamespace {
+					chain = &status.Chains[i]
+				}
+			}
+			if chain == nil || chain.Height+1 != length {
+				return fmt.Errorf("%s has %+v", n.id, chain)
+			}
+			if hash != "" && chain.Hash != hash {
+				return fmt.Errorf("%s ends with %s instead of %s", n.id, chain.Hash, hash)
+			}
+			hash = chain.Hash
+		}
+		return nil
+	})
+}
+
+// waitLeader waits until the live nodes agree on a leader
+func (c *nodeCluster) waitLeader(t *testing.T) *nodeProcess {
+	var leader string
+	waitFor(t, "a leader", 20*time.Second, func() error {
+		leader = ""
+		for _, n := range c.alive() {
+			status, err := n.status()
+			if err != nil {
+				return err
+			}
+			if status.Leader == "" || c.node(status.Leader).cmd == nil || c.node(status.Leader).cmd.ProcessState != nil {
+				return fmt.Errorf("%s has no live leader", n.id)
+			}
+			if leader != "" && status.Leader != leader {
+				return fmt.Errorf("%s follows %s instead of %s", n.id, status.Leader, leader)
+			}
+			if status.Leader == n.id && status.Role != RoleLeader || status.Leader != n.id && status.Role != RolePeer {
+				return fmt.Errorf("%s is %s while %s leads", n.id, status.Role, status.Leader)
+			}
+			leader = status.Leader
+		}
+		return nil
+	})
+	return c.node(leader)
+}
+
+func (c *nodeCluster) mintStamp(t *testing.T) hashcash.Stamp {
+	stamp := hashcash.Create("node0")
+	stamp.Sign(c.key.Private)
+	err := stamp.Mint(context.Background(), nodeTestDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	return stamp
+}
+
+func testNodeLeaderCrash(t *testing.T, consensus ConsensusType, size int) {
+	c := startNodeCluster(t, size, consensus)
+	defer c.stop(t)
+
+	// The leader creates the namespace
+	leader := c.waitLeader(t)
+	c.waitHeight(t, 1)
+
+	// Stamps submitted to a peer are forwarded to the leader
+	var peer *nodeProcess
+	for _, n := range c.nodes {
+		if n != leader {
+			peer = n
+		}
+	}
+	err := peer.submit(nodeTestNamespace, c.mintStamp(t))
+	if err != nil {
+		t.Fatalf("failed to submit stamp to %s: %s", peer.id, err)
+	}
+	c.waitHeight(t, 2)
+
+	// The chain grows once a new leader takes over
+	c.kill(leader)
+	leader = c.waitLeader(t)
+	err = c.alive()[0].submit(nodeTestNamespace, c.mintStamp(t))
+	if err != nil {
+		t.Fatalf("failed to submit stamp: %s", err)
+	}
+	c.waitHeight(t, 3)
+}
+
+func TestNodeLeaderCrash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("multi-process test")
+	}
+	if os.Getenv(nodeProcessEnv) != "" {
+		t.Skip("running as a node")
+	}
+	t.Run("raft", func(t *testing.T) { testNodeLeaderCrash(t, ConsensusRaft, 3) })
+	// PBFT tolerates a faulty node out of 3f+1
+	t.Run("pbft", func(t *testing.T) { testNodeLeaderCrash(t, ConsensusPBFT, 4) })
+}
+
+func TestNodeLateJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("multi-process test")
+	}
+	if os.Getenv(nodeProcessEnv) != "" {
+		t.Skip("running as a node")
+	}
+	c := startNodeCluster(t, 4, ConsensusPBFT)
+	defer c.stop(t)
+	c.waitLeader(t)
+	c.waitHeight(t, 1)
+
+	// A node joins with an empty cache after the namespace was created: no
+	// block is committed anymore, it must get the namespace from the leader
+	n := c.nodes[3]
+	c.kill(n)
+	for _, dir := range []string{filepath.Dir(cache.GetChainDir(n.dir, nodeTestNamespace)), cache.GetDataDir(n.dir), cache.GetSpentDBPath(n.dir)} {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("failed to remove %s: %s", dir, err)
+		}
+	}
+	c.start(t, n)
+	c.waitLeader(t)
+	c.waitHeight(t, 1)
+}
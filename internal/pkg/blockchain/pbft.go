@@ -0,0 +1,1137 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PBFTMsgType is the type of a pBFT message
+type PBFTMsgType string
+
+const (
+	// PBFTRequest is a request submitted by a node to be ordered
+	PBFTRequest PBFTMsgType = "request"
+
+	// PBFTPrePrepare is sent by the primary to assign a sequence number to a request
+	PBFTPrePrepare PBFTMsgType = "pre-prepare"
+
+	// PBFTPrepare is sent by the backups that accepted a pre-prepare
+	PBFTPrepare PBFTMsgType = "prepare"
+
+	// PBFTCommit is sent by the nodes once a request is prepared
+	PBFTCommit PBFTMsgType = "commit"
+
+	// PBFTCheckpoint advertises the state of a node after a given sequence number
+	PBFTCheckpoint PBFTMsgType = "checkpoint"
+
+	// PBFTViewChange is sent by a node that suspects the primary to be faulty
+	PBFTViewChange PBFTMsgType = "view-change"
+
+	// PBFTNewView is sent by the primary of a new view
+	PBFTNewView PBFTMsgType = "new-view"
+)
+
+const (
+	defaultCheckpointInterval = 10
+	defaultViewChangeTimeout  = 5 * time.Second
+
+	// maxViewChangeBackoff limits the growth of the view change timeout
+	maxViewChangeBackoff = 6
+
+	// maxPostponed is the maximum number of messages kept until they can
+	// be handled
+	maxPostponed = 1024
+)
+
+// nullDigest is the digest of the null request used to fill the gaps of
+// sequence numbers during a view change
+var nullDigest = digestOf(nil)
+
+// PBFTMessage is a message of the pBFT protocol. All messages are signed
+// by their sender.
+type PBFTMessage struct {
+	Type PBFTMsgType `json:"type"`
+	From string      `json:"from"`
+	View uint64      `json:"view"`
+	Seq  uint64      `json:"seq"`
+
+	// Digest is the digest of the request, or of the state for checkpoints
+	Digest string `json:"digest,omitempty"`
+
+	// Payload is the request itself (request and pre-prepare)
+	Payload []byte `json:"payload,omitempty"`
+
+	// StableSeq is the sequence number of the last stable checkpoint of
+	// the sender (view-change)
+	StableSeq uint64 `json:"stable_seq,omitempty"`
+
+	// Checkpoints are the 2f+1 checkpoint messages proving that StableSeq
+	// is stable (view-change)
+	Checkpoints []*PBFTMessage `json:"checkpoints,omitempty"`
+
+	// Prepared is the set of requests prepared by the sender after its
+	// last stable checkpoint (view-change)
+	Prepared []PreparedCert `json:"prepared,omitempty"`
+
+	// ViewChanges are the view-change messages justifying a new view (new-view)
+	ViewChanges []*PBFTMessage `json:"view_changes,omitempty"`
+
+	// PrePrepares are the requests re-proposed in the new view (new-view)
+	PrePrepares []*PBFTMessage `json:"pre_prepares,omitempty"`
+
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// PreparedCert proves that a request was prepared: a pre-prepare and 2f
+// matching prepares from different backups
+type PreparedCert struct {
+	PrePrepare *PBFTMessage   `json:"pre_prepare"`
+	Prepares   []*PBFTMessage `json:"prepares"`
+}
+
+// PBFTTransport delivers pBFT messages to the other nodes. Implementations
+// must not block.
+type PBFTTransport interface {
+	// Broadcast sends a message to all the other nodes
+	Broadcast(m *PBFTMessage)
+}
+
+// PBFTConfig is the configuration of a pBFT node
+type PBFTConfig struct {
+	// ID is the identifier of the local node, it must be one of Nodes
+	ID string
+
+	// Nodes is the list of the identifiers of all the nodes; the primary
+	// of view v is Nodes[v % len(Nodes)]
+	Nodes []string
+
+	// PrivateKey is the key used to sign our messages
+	PrivateKey ed25519.PrivateKey
+
+	// PublicKeys are the keys of all the nodes, including us
+	PublicKeys map[string]ed25519.PublicKey
+
+	// CheckpointInterval is the number of requests between two checkpoints
+	CheckpointInterval uint64
+
+	// ViewChangeTimeout is the time we wait for a request to be executed
+	// before suspecting the primary
+	ViewChangeTimeout time.Duration
+
+	// Apply is invoked, in order, for every request that is committed. It
+	// is called with the lock of the node held and therefore must not call
+	// back into the node.
+	Apply func(seq uint64, data []byte)
+}
+
+type pbftEntry struct {
+	prePrepare   *PBFTMessage
+	prepares     map[string]*PBFTMessage
+	commits      map[string]*PBFTMessage
+	preparedView uint64
+	prepared     bool
+	committed    bool
+
+	// digest and payload of the committed request
+	digest  string
+	payload []byte
+}
+
+// PBFT is a node of a pBFT network. It tolerates up to f faulty nodes out
+// of 3f+1.
+type PBFT struct {
+	cfg       PBFTConfig
+	transport PBFTTransport
+
+	lock sync.Mutex
+
+	view         uint64
+	viewChanging bool
+	seq          uint64
+	lastExec     uint64
+	stateDigest  string
+	log          map[uint64]*pbftEntry
+
+	stableSeq   uint64
+	stableProof []*PBFTMessage
+	checkpoints map[uint64]map[string]*PBFTMessage
+	// behind is set, with the last sequence number we executed, when a
+	// stable checkpoint shows we are far behind the other nodes
+	behind     bool
+	behindExec uint64
+	postponed  []*PBFTMessage
+
+	pending  map[string][]byte
+	assigned map[string]uint64
+	executed map[string]bool
+	waiters  map[string][]chan struct{}
+
+	viewChanges  map[uint64]map[string]*PBFTMessage
+	sentNewView  map[uint64]bool
+	timer        *time.Timer
+	timerGen     uint64
+	timerRunning bool
+	attempts     uint
+	stopped      bool
+}
+
+func digestOf(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func (m *PBFTMessage) signedData() []byte {
+	c := *m
+	c.Signature = nil
+	// Encoding a struct without maps is deterministic
+	data, _ := json.Marshal(&c)
+	return data
+}
+
+// NewPBFT creates a new pBFT node
+func NewPBFT(cfg PBFTConfig, transport PBFTTransport) (*PBFT, error) {
+	found := false
+	for _, id := range cfg.Nodes {
+		if id == cfg.ID {
+			found = true
+		}
+		if _, ok := cfg.PublicKeys[id]; !ok {
+			return nil, fmt.Errorf("no public key for node %s", id)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not part of the nodes", cfg.ID)
+	}
+	if len(cfg.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = defaultCheckpointInterval
+	}
+	if cfg.ViewChangeTimeout == 0 {
+		cfg.ViewChangeTimeout = defaultViewChangeTimeout
+	}
+
+	n := &PBFT{
+		cfg:         cfg,
+		transport:   transport,
+		log:         make(map[uint64]*pbftEntry),
+		checkpoints: make(map[uint64]map[string]*PBFTMessage),
+		pending:     make(map[string][]byte),
+		assigned:    make(map[string]uint64),
+		executed:    make(map[string]bool),
+		waiters:     make(map[string][]chan struct{}),
+		viewChanges: make(map[uint64]map[string]*PBFTMessage),
+		sentNewView: make(map[uint64]bool),
+	}
+	return n, nil
+}
+
+func (n *PBFT) f() int {
+	return (len(n.cfg.Nodes) - 1) / 3
+}
+
+func (n *PBFT) quorum() int {
+	return 2*n.f() + 1
+}
+
+func (n *PBFT) primary(view uint64) string {
+	return n.cfg.Nodes[view%uint64(len(n.cfg.Nodes))]
+}
+
+func (n *PBFT) isPrimary() bool {
+	return n.primary(n.view) == n.cfg.ID
+}
+
+// highWatermark is the highest sequence number we accept
+func (n *PBFT) highWatermark() uint64 {
+	return n.stableSeq + 2*n.cfg.CheckpointInterval
+}
+
+func (n *PBFT) sign(m *PBFTMessage) *PBFTMessage {
+	m.From = n.cfg.ID
+	m.Signature = ed25519.Sign(n.cfg.PrivateKey, m.signedData())
+	return m
+}
+
+func (n *PBFT) verify(m *PBFTMessage) bool {
+	if m == nil {
+		return false
+	}
+	key, ok := n.cfg.PublicKeys[m.From]
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(key, m.signedData(), m.Signature)
+}
+
+func (n *PBFT) broadcast(m *PBFTMessage) {
+	n.transport.Broadcast(m)
+}
+
+func (n *PBFT) entry(seq uint64) *pbftEntry {
+	e, ok := n.log[seq]
+	if !ok {
+		e = &pbftEntry{
+			prepares: make(map[string]*PBFTMessage),
+			commits:  make(map[string]*PBFTMessage),
+		}
+		n.log[seq] = e
+	}
+	return e
+}
+
+// View returns the current view and whether a view change is in progress
+func (n *PBFT) View() (uint64, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.view, n.viewChanging
+}
+
+// Leader returns the identifier of the primary of the current view
+func (n *PBFT) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.primary(n.view)
+}
+
+// LastExecuted returns the sequence number of the last executed request
+func (n *PBFT) LastExecuted() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.lastExec
+}
+
+// StableCheckpoint returns the sequence number of the last stable checkpoint
+func (n *PBFT) StableCheckpoint() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stableSeq
+}
+
+// Stop stops the timers of the node; messages are ignored afterward
+func (n *PBFT) Stop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.stopped = true
+	n.stopTimer()
+}
+
+// Propose submits a request and waits until it is executed locally. Since
+// a correct node only executes committed requests, the request is then
+// guaranteed to be executed by all the correct nodes in the same order.
+// Identical requests are executed only once.
+func (n *PBFT) Propose(ctx context.Context, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty request")
+	}
+	m := n.sign(&PBFTMessage{
+		Type:    PBFTRequest,
+		Digest:  digestOf(data),
+		Payload: data,
+	})
+
+	n.lock.Lock()
+	if n.executed[m.Digest] {
+		n.lock.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	n.waiters[m.Digest] = append(n.waiters[m.Digest], done)
+	n.handleRequest(m)
+	n.lock.Unlock()
+
+	// All the nodes learn about the request so that they can suspect the
+	// primary if it does not handle it
+	n.broadcast(m)
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("request %s not executed: %w", m.Digest, ctx.Err())
+	}
+}
+
+// StartElection suspects the current primary and starts a view change
+func (n *PBFT) StartElection() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.startViewChange(n.view + 1)
+}
+
+// Suspect starts a view change if a node is still the primary of the current
+// view, which is not being changed yet
+func (n *PBFT) Suspect(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped || n.viewChanging || n.primary(n.view) != id {
+		return
+	}
+	n.startViewChange(n.view + 1)
+}
+
+// HandleMessage handles a message received from another node
+func (n *PBFT) HandleMessage(m *PBFTMessage) error {
+	if !n.verify(m) {
+		return fmt.Errorf("invalid signature for %s message from %s", m.Type, m.From)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return nil
+	}
+
+	switch m.Type {
+	case PBFTRequest:
+		n.handleRequest(m)
+	case PBFTPrePrepare:
+		n.handlePrePrepare(m)
+	case PBFTPrepare:
+		n.handlePrepare(m)
+	case PBFTCommit:
+		n.handleCommit(m)
+	case PBFTCheckpoint:
+		n.handleCheckpoint(m)
+	case PBFTViewChange:
+		n.handleViewChange(m)
+	case PBFTNewView:
+		n.handleNewView(m)
+	default:
+		return fmt.Errorf("unknown message type %s", m.Type)
+	}
+
+	return nil
+}
+
+func (n *PBFT) handleRequest(m *PBFTMessage) {
+	if m.Digest != digestOf(m.Payload) || n.executed[m.Digest] {
+		return
+	}
+
+	if _, ok := n.pending[m.Digest]; !ok {
+		n.pending[m.Digest] = m.Payload
+		n.armTimer()
+	}
+
+	if n.isPrimary() && !n.viewChanging {
+		n.assign(m.Digest, m.Payload)
+	}
+}
+
+// assign makes the primary assign a sequence number to a request
+func (n *PBFT) assign(digest string, payload []byte) {
+	if _, ok := n.assigned[digest]; ok {
+		return
+	}
+	if n.seq+1 > n.highWatermark() {
+		// The request stays pending until the next stable checkpoint
+		return
+	}
+
+	n.seq++
+	n.assigned[digest] = n.seq
+	pp := n.sign(&PBFTMessage{
+		Type:    PBFTPrePrepare,
+		View:    n.view,
+		Seq:     n.seq,
+		Digest:  digest,
+		Payload: payload,
+	})
+	n.entry(n.seq).prePrepare = pp
+	n.broadcast(pp)
+	n.checkPrepared(n.seq)
+}
+
+// assignPending makes the primary assign sequence numbers to all the
+// requests that are waiting for one
+func (n *PBFT) assignPending() {
+	if !n.isPrimary() || n.viewChanging {
+		return
+	}
+
+	// Sort the requests so the order does not depend on the map
+	var digests []string
+	for d := range n.pending {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	for _, d := range digests {
+		n.assign(d, n.pending[d])
+	}
+}
+
+// lowWatermark is the highest sequence number we can forget about: it is
+// stable and we executed it
+func (n *PBFT) lowWatermark() uint64 {
+	if n.lastExec < n.stableSeq {
+		return n.lastExec
+	}
+	return n.stableSeq
+}
+
+func (n *PBFT) inWatermarks(seq uint64) bool {
+	return seq > n.lowWatermark() && seq <= n.highWatermark()
+}
+
+func (n *PBFT) collectGarbage() {
+	low := n.lowWatermark()
+	for seq := range n.log {
+		if seq <= low {
+			delete(n.log, seq)
+		}
+	}
+}
+
+// postpone keeps a message for a sequence number just above the high
+// watermark, it is handled again once the next checkpoint is stable
+func (n *PBFT) postpone(m *PBFTMessage) bool {
+	if m.Seq <= n.highWatermark() {
+		return false
+	}
+	if m.Seq <= n.highWatermark()+2*n.cfg.CheckpointInterval && len(n.postponed) < maxPostponed {
+		n.postponed = append(n.postponed, m)
+	}
+	return true
+}
+
+func (n *PBFT) replayPostponed() {
+	postponed := n.postponed
+	n.postponed = nil
+	for _, p := range postponed {
+		switch p.Type {
+		case PBFTPrePrepare:
+			n.handlePrePrepare(p)
+		case PBFTPrepare:
+			n.handlePrepare(p)
+		case PBFTCommit:
+			n.handleCommit(p)
+		}
+	}
+}
+
+func (n *PBFT) handlePrePrepare(m *PBFTMessage) {
+	if m.From != n.primary(m.View) || m.View < n.view {
+		return
+	}
+	if m.View > n.view || n.viewChanging {
+		// The new-view message may still be on its way
+		if m.View <= n.view+1 && len(n.postponed) < maxPostponed {
+			n.postponed = append(n.postponed, m)
+		}
+		return
+	}
+	if n.postpone(m) || !n.inWatermarks(m.Seq) {
+		return
+	}
+	if m.Digest != digestOf(m.Payload) {
+		return
+	}
+
+	e := n.entry(m.Seq)
+	if e.prePrepare != nil && e.prePrepare.View == m.View {
+		// The primary cannot assign the sequence number twice
+		return
+	}
+	e.prePrepare = m
+	n.sendPrepare(m)
+}
+
+func (n *PBFT) sendPrepare(pp *PBFTMessage) {
+	if n.primary(pp.View) == n.cfg.ID {
+		return
+	}
+	p := n.sign(&PBFTMessage{
+		Type:   PBFTPrepare,
+		View:   pp.View,
+		Seq:    pp.Seq,
+		Digest: pp.Digest,
+	})
+	n.entry(pp.Seq).prepares[n.cfg.ID] = p
+	n.broadcast(p)
+	n.checkPrepared(pp.Seq)
+}
+
+func (n *PBFT) handlePrepare(m *PBFTMessage) {
+	if m.From == n.primary(m.View) || m.View < n.view || n.postpone(m) || !n.inWatermarks(m.Seq) {
+		return
+	}
+	n.entry(m.Seq).prepares[m.From] = m
+	n.checkPrepared(m.Seq)
+}
+
+// matchingPrepares returns the prepares matching the pre-prepare of an entry
+func (e *pbftEntry) matchingPrepares() []*PBFTMessage {
+	var prepares []*PBFTMessage
+	for _, p := range e.prepares {
+		if p.View == e.prePrepare.View && p.Digest == e.prePrepare.Digest {
+			prepares = append(prepares, p)
+		}
+	}
+	sort.Slice(prepares, func(i, j int) bool {
+		return prepares[i].From < prepares[j].From
+	})
+	return prepares
+}
+
+func (n *PBFT) checkPrepared(seq uint64) {
+	e := n.entry(seq)
+	if e.prePrepare == nil || e.prePrepare.View != n.view || n.viewChanging {
+		return
+	}
+	if e.prepared && e.preparedView == n.view {
+		return
+	}
+	if len(e.matchingPrepares()) < 2*n.f() {
+		return
+	}
+
+	e.prepared = true
+	e.preparedView = n.view
+	c := n.sign(&PBFTMessage{
+		Type:   PBFTCommit,
+		View:   n.view,
+		Seq:    seq,
+		Digest: e.prePrepare.Digest,
+	})
+	e.commits[n.cfg.ID] = c
+	n.broadcast(c)
+	n.checkCommitted(seq)
+}
+
+func (n *PBFT) handleCommit(m *PBFTMessage) {
+	// Commits of previous views are still accepted: a commit certificate
+	// proves the request is committed whatever our current view is
+	if n.postpone(m) || !n.inWatermarks(m.Seq) {
+		return
+	}
+	n.entry(m.Seq).commits[m.From] = m
+	n.checkCommitted(m.Seq)
+}
+
+// checkCommitted checks if 2f+1 nodes committed the same request for a
+// sequence number. We do not need to have prepared the request ourselves,
+// only to know it.
+func (n *PBFT) checkCommitted(seq uint64) {
+	e := n.entry(seq)
+	if e.committed {
+		return
+	}
+
+	for _, c := range e.commits {
+		count := 0
+		for _, o := range e.commits {
+			if o.View == c.View && o.Digest == c.Digest {
+				count++
+			}
+		}
+		if count < n.quorum() {
+			continue
+		}
+
+		switch {
+		case c.Digest == nullDigest || n.executed[c.Digest]:
+		case e.prePrepare != nil && e.prePrepare.Digest == c.Digest:
+			e.payload = e.prePrepare.Payload
+		default:
+			payload, ok := n.pending[c.Digest]
+			if !ok {
+				// We do not know the request yet
+				return
+			}
+			e.payload = payload
+		}
+		e.committed = true
+		e.digest = c.Digest
+		n.execute()
+		return
+	}
+}
+
+// execute executes all the committed requests, in order
+func (n *PBFT) execute() {
+	progress := false
+	for {
+		e, ok := n.log[n.lastExec+1]
+		if !ok || !e.committed {
+			break
+		}
+		n.lastExec++
+		progress = true
+
+		d := e.digest
+		h := sha256.Sum256([]byte(n.stateDigest + d))
+		n.stateDigest = hex.EncodeToString(h[:])
+		if d != nullDigest && !n.executed[d] {
+			n.executed[d] = true
+			if n.cfg.Apply != nil {
+				n.cfg.Apply(n.lastExec, e.payload)
+			}
+		}
+		delete(n.pending, d)
+		for _, w := range n.waiters[d] {
+			close(w)
+		}
+		delete(n.waiters, d)
+
+		if n.lastExec%n.cfg.CheckpointInterval == 0 {
+			n.sendCheckpoint()
+		}
+	}
+
+	if progress {
+		// The view works, a future view change starts with the initial timeout
+		n.attempts = 0
+		n.collectGarbage()
+		n.restartTimer()
+	}
+}
+
+func (n *PBFT) sendCheckpoint() {
+	c := n.sign(&PBFTMessage{
+		Type:   PBFTCheckpoint,
+		Seq:    n.lastExec,
+		Digest: n.stateDigest,
+	})
+	n.broadcast(c)
+	n.handleCheckpoint(c)
+}
+
+// handleCheckpoint handles a checkpoint message; checkpoints above the high
+// watermark are dropped so that a faulty node cannot make us keep any number
+// of them
+func (n *PBFT) handleCheckpoint(m *PBFTMessage) {
+	if m.Seq > n.highWatermark() {
+		return
+	}
+	n.recordCheckpoint(m)
+}
+
+// recordCheckpoint records a checkpoint, which becomes stable with a quorum
+func (n *PBFT) recordCheckpoint(m *PBFTMessage) {
+	if m.Seq <= n.stableSeq {
+		return
+	}
+	if _, ok := n.checkpoints[m.Seq]; !ok {
+		n.checkpoints[m.Seq] = make(map[string]*PBFTMessage)
+	}
+	n.checkpoints[m.Seq][m.From] = m
+
+	var proof []*PBFTMessage
+	for _, c := range n.checkpoints[m.Seq] {
+		if c.Digest == m.Digest {
+			proof = append(proof, c)
+		}
+	}
+	if len(proof) < n.quorum() {
+		return
+	}
+
+	// The checkpoint is stable, we can forget everything before it; the
+	// checkpoint messages prove it in our view-change messages
+	sort.Slice(proof, func(i, j int) bool { return proof[i].From < proof[j].From })
+	n.stableSeq = m.Seq
+	n.stableProof = proof[:n.quorum()]
+	for seq := range n.checkpoints {
+		if seq <= m.Seq {
+			delete(n.checkpoints, seq)
+		}
+	}
+	if n.lastExec+2*n.cfg.CheckpointInterval >= m.Seq {
+		n.behind = false
+	} else if !n.behind || n.behindExec != n.lastExec {
+		// The messages we miss may only be late, we give them until the
+		// next stable checkpoint to arrive
+		n.behind = true
+		n.behindExec = n.lastExec
+	} else {
+		// We are too far behind to catch up with the protocol; the data
+		// we missed is recovered by the chain synchronization
+		n.behind = false
+		log.Printf("[WARN] pBFT node %s skipping to stable checkpoint %d", n.cfg.ID, m.Seq)
+		n.lastExec = m.Seq
+		n.stateDigest = m.Digest
+		// What we were waiting for was handled without us
+		n.pending = make(map[string][]byte)
+	}
+	n.collectGarbage()
+	if n.seq < n.stableSeq {
+		n.seq = n.stableSeq
+	}
+
+	// The watermarks moved, we can handle the messages we postponed and
+	// the primary may have requests to assign
+	n.replayPostponed()
+	n.assignPending()
+}
+
+/* Timers */
+
+func (n *PBFT) timeout() time.Duration {
+	a := n.attempts
+	if a > maxViewChangeBackoff {
+		a = maxViewChangeBackoff
+	}
+	return n.cfg.ViewChangeTimeout << a
+}
+
+func (n *PBFT) startTimer() {
+	n.stopTimer()
+	n.timerGen++
+	gen := n.timerGen
+	n.timerRunning = true
+	n.timer = time.AfterFunc(n.timeout(), func() {
+		n.onTimeout(gen)
+	})
+}
+
+func (n *PBFT) stopTimer() {
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	n.timerRunning = false
+}
+
+// armTimer starts the timer if it is not already running
+func (n *PBFT) armTimer() {
+	if !n.timerRunning && !n.stopped {
+		n.startTimer()
+	}
+}
+
+// restartTimer restarts the timer after progress, if requests are pending
+func (n *PBFT) restartTimer() {
+	if n.viewChanging {
+		return
+	}
+	if len(n.pending) == 0 {
+		n.stopTimer()
+		return
+	}
+	n.startTimer()
+}
+
+func (n *PBFT) onTimeout(gen uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped || gen != n.timerGen {
+		return
+	}
+	n.timerRunning = false
+	if n.viewChanging && len(n.pending) == 0 {
+		// Nothing is waiting anymore, we do not need to move further
+		return
+	}
+	log.Printf("[INFO] pBFT node %s suspects primary of view %d", n.cfg.ID, n.view)
+	n.startViewChange(n.view + 1)
+}
+
+/* View changes */
+
+func (n *PBFT) preparedCerts() []PreparedCert {
+	var seqs []uint64
+	for seq, e := range n.log {
+		if seq > n.stableSeq && e.prepared {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var certs []PreparedCert
+	for _, seq := range seqs {
+		e := n.log[seq]
+		if e.prePrepare.View != e.preparedView {
+			continue
+		}
+		// Prepares of later views may have replaced some of the votes,
+		// an incomplete certificate would invalidate our view-change
+		prepares := e.matchingPrepares()
+		if len(prepares) < 2*n.f() {
+			continue
+		}
+		certs = append(certs, PreparedCert{
+			PrePrepare: e.prePrepare,
+			Prepares:   prepares,
+		})
+	}
+	return certs
+}
+
+func (n *PBFT) startViewChange(view uint64) {
+	if view <= n.view && (view < n.view || n.viewChanging) {
+		return
+	}
+
+	n.view = view
+	n.viewChanging = true
+	n.attempts++
+	vc := n.sign(&PBFTMessage{
+		Type:        PBFTViewChange,
+		View:        view,
+		StableSeq:   n.stableSeq,
+		Checkpoints: n.stableProof,
+		Prepared:    n.preparedCerts(),
+	})
+	n.stopTimer()
+	n.recordViewChange(vc)
+	n.broadcast(vc)
+	n.checkNewView(view)
+}
+
+func (n *PBFT) recordViewChange(m *PBFTMessage) {
+	if _, ok := n.viewChanges[m.View]; !ok {
+		n.viewChanges[m.View] = make(map[string]*PBFTMessage)
+	}
+	n.viewChanges[m.View][m.From] = m
+
+	// The timer for the next view only starts once a quorum wants to move
+	// to this view, otherwise nodes would race each other to higher views
+	if m.View == n.view && n.viewChanging && len(n.viewChanges[m.View]) >= n.quorum() {
+		n.armTimer()
+	}
+}
+
+// validCert checks a certificate proving that a request was prepared
+func (n *PBFT) validCert(c PreparedCert) bool {
+	pp := c.PrePrepare
+	if pp == nil || pp.Type != PBFTPrePrepare || pp.From != n.primary(pp.View) || !n.verify(pp) {
+		return false
+	}
+	if pp.Digest != digestOf(pp.Payload) {
+		return false
+	}
+
+	senders := make(map[string]bool)
+	for _, p := range c.Prepares {
+		if p.Type != PBFTPrepare || p.View != pp.View || p.Seq != pp.Seq || p.Digest != pp.Digest {
+			return false
+		}
+		if p.From == pp.From || !n.verify(p) {
+			return false
+		}
+		senders[p.From] = true
+	}
+	return len(senders) >= 2*n.f()
+}
+
+// validStableProof checks the checkpoint messages proving that a sequence
+// number is stable; the initial state needs no proof
+func (n *PBFT) validStableProof(seq uint64, proof []*PBFTMessage) bool {
+	if seq == 0 {
+		return len(proof) == 0
+	}
+	senders := make(map[string]bool)
+	for _, c := range proof {
+		if c == nil || c.Type != PBFTCheckpoint || c.Seq != seq || c.Digest != proof[0].Digest || !n.verify(c) {
+			return false
+		}
+		senders[c.From] = true
+	}
+	return len(senders) >= n.quorum()
+}
+
+func (n *PBFT) validViewChange(m *PBFTMessage) bool {
+	if m.Type != PBFTViewChange || !n.verify(m) {
+		return false
+	}
+	if !n.validStableProof(m.StableSeq, m.Checkpoints) {
+		return false
+	}
+	for _, c := range m.Prepared {
+		if !n.validCert(c) || c.PrePrepare.Seq <= m.StableSeq || c.PrePrepare.View >= m.View {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *PBFT) handleViewChange(m *PBFTMessage) {
+	if m.View < n.view || (m.View == n.view && !n.viewChanging) {
+		return
+	}
+	if !n.validViewChange(m) {
+		return
+	}
+	n.recordViewChange(m)
+
+	// If f+1 nodes want to move to a higher view, at least one correct
+	// node suspects the primary so we join them
+	if m.View > n.view && len(n.viewChanges[m.View]) > n.f() {
+		n.startViewChange(m.View)
+	}
+
+	n.checkNewView(m.View)
+}
+
+// computeNewView computes the pre-prepares of a new view from the
+// view-change messages justifying it, along with the latest stable
+// checkpoint of these messages and its proof
+func (n *PBFT) computeNewView(view uint64, vcs []*PBFTMessage) (uint64, []*PBFTMessage, []*PBFTMessage) {
+	var minS, maxS uint64
+	var proof []*PBFTMessage
+	for _, vc := range vcs {
+		if vc.StableSeq > minS {
+			minS = vc.StableSeq
+			proof = vc.Checkpoints
+		}
+	}
+	maxS = minS
+
+	best := make(map[uint64]*PBFTMessage)
+	for _, vc := range vcs {
+		for _, c := range vc.Prepared {
+			pp := c.PrePrepare
+			if pp.Seq <= minS {
+				continue
+			}
+			if pp.Seq > maxS {
+				maxS = pp.Seq
+			}
+			if cur, ok := best[pp.Seq]; !ok || pp.View > cur.View {
+				best[pp.Seq] = pp
+			}
+		}
+	}
+
+	var pps []*PBFTMessage
+	for seq := minS + 1; seq <= maxS; seq++ {
+		pp := &PBFTMessage{
+			Type:   PBFTPrePrepare,
+			View:   view,
+			Seq:    seq,
+			Digest: nullDigest,
+		}
+		if prev, ok := best[seq]; ok {
+			pp.Digest = prev.Digest
+			pp.Payload = prev.Payload
+		}
+		pps = append(pps, pp)
+	}
+
+	return minS, proof, pps
+}
+
+func (n *PBFT) checkNewView(view uint64) {
+	if n.primary(view) != n.cfg.ID || n.view != view || !n.viewChanging || n.sentNewView[view] {
+		return
+	}
+	if len(n.viewChanges[view]) < n.quorum() {
+		return
+	}
+
+	var vcs []*PBFTMessage
+	for _, vc := range n.viewChanges[view] {
+		vcs = append(vcs, vc)
+	}
+	sort.Slice(vcs, func(i, j int) bool { return vcs[i].From < vcs[j].From })
+	vcs = vcs[:n.quorum()]
+
+	minS, proof, pps := n.computeNewView(view, vcs)
+	for _, pp := range pps {
+		n.sign(pp)
+	}
+	nv := n.sign(&PBFTMessage{
+		Type:        PBFTNewView,
+		View:        view,
+		ViewChanges: vcs,
+		PrePrepares: pps,
+	})
+	n.sentNewView[view] = true
+	n.broadcast(nv)
+	n.enterView(view, minS, proof, pps)
+}
+
+func (n *PBFT) handleNewView(m *PBFTMessage) {
+	if m.From != n.primary(m.View) || m.View < n.view || (m.View == n.view && !n.viewChanging) {
+		return
+	}
+
+	// Check that the new view is justified by 2f+1 view-change messages
+	senders := make(map[string]bool)
+	for _, vc := range m.ViewChanges {
+		if vc.View != m.View || !n.validViewChange(vc) {
+			return
+		}
+		senders[vc.From] = true
+	}
+	if len(senders) < n.quorum() {
+		return
+	}
+
+	// Check that the primary re-proposed the right requests
+	minS, proof, expected := n.computeNewView(m.View, m.ViewChanges)
+	if len(expected) != len(m.PrePrepares) {
+		return
+	}
+	for i, pp := range m.PrePrepares {
+		e := expected[i]
+		if pp.Type != PBFTPrePrepare || pp.From != m.From || pp.View != e.View || pp.Seq != e.Seq || pp.Digest != e.Digest || !n.verify(pp) {
+			return
+		}
+	}
+
+	n.enterView(m.View, minS, proof, m.PrePrepares)
+}
+
+func (n *PBFT) enterView(view uint64, minS uint64, proof []*PBFTMessage, pps []*PBFTMessage) {
+	// The new view starts after a checkpoint that may be more recent than
+	// ours, even above our high watermark; its proof makes it stable for us
+	// as well, which moves the watermarks past the sequence numbers of the
+	// new view
+	for _, c := range proof {
+		n.recordCheckpoint(c)
+	}
+
+	log.Printf("[INFO] pBFT node %s entering view %d (primary: %s)", n.cfg.ID, view, n.primary(view))
+	n.view = view
+	n.viewChanging = false
+	n.assigned = make(map[string]uint64)
+	for v := range n.viewChanges {
+		if v <= view {
+			delete(n.viewChanges, v)
+		}
+	}
+
+	// Sequence numbers we may have assigned in a previous view are gone,
+	// we restart right after the requests re-proposed in this view
+	n.seq = minS
+	if n.seq < n.lastExec {
+		n.seq = n.lastExec
+	}
+	for _, pp := range pps {
+		if pp.Seq > n.seq {
+			n.seq = pp.Seq
+		}
+		if pp.Digest != nullDigest {
+			n.assigned[pp.Digest] = pp.Seq
+		}
+		// Requests we already executed are prepared again as well, the
+		// nodes that did not execute them yet need our votes
+		if !n.inWatermarks(pp.Seq) {
+			continue
+		}
+		e := n.entry(pp.Seq)
+		e.prePrepare = pp
+		e.prepared = false
+		n.sendPrepare(pp)
+		n.checkPrepared(pp.Seq)
+	}
+
+	n.replayPostponed()
+	n.assignPending()
+	n.restartTimer()
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFilter can drop (by returning nil) or alter a message sent by a node
+// to another
+type testFilter func(from, to string, m *PBFTMessage) *PBFTMessage
+
+type testCluster struct {
+	ids    []string
+	keys   map[string]ed25519.PrivateKey
+	nodes  map[string]*PBFT
+	filter testFilter
+
+	lock    sync.Mutex
+	applied map[string][]string
+	crashed map[string]bool
+}
+
+func (c *testCluster) isCrashed(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.crashed[id]
+}
+
+func (c *testCluster) crash(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crashed[id] = true
+}
+
+func (c *testCluster) getApplied(id string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.applied[id]...)
+}
+
+type routerTransport struct {
+	c  *testCluster
+	id string
+}
+
+func (t *routerTransport) Broadcast(m *PBFTMessage) {
+	for _, id := range t.c.ids {
+		if id == t.id || t.c.isCrashed(t.id) || t.c.isCrashed(id) {
+			continue
+		}
+		msg := m
+		if t.c.filter != nil {
+			msg = t.c.filter(t.id, id, m)
+		}
+		if msg == nil {
+			continue
+		}
+		go t.c.nodes[id].HandleMessage(msg)
+	}
+}
+
+func createTestCluster(t *testing.T, size int, filter testFilter) *testCluster {
+	c := &testCluster{
+		keys:    make(map[string]ed25519.PrivateKey),
+		nodes:   make(map[string]*PBFT),
+		filter:  filter,
+		applied: make(map[string][]string),
+		crashed: make(map[string]bool),
+	}
+
+	pubKeys := make(map[string]ed25519.PublicKey)
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node%d", i)
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		c.ids = append(c.ids, id)
+		c.keys[id] = priv
+		pubKeys[id] = pub
+	}
+
+	for _, id := range c.ids {
+		id := id
+		cfg := PBFTConfig{
+			ID:                 id,
+			Nodes:              c.ids,
+			PrivateKey:         c.keys[id],
+			PublicKeys:         pubKeys,
+			CheckpointInterval: 4,
+			ViewChangeTimeout:  200 * time.Millisecond,
+			Apply: func(seq uint64, data []byte) {
+				c.lock.Lock()
+				defer c.lock.Unlock()
+				c.applied[id] = append(c.applied[id], string(data))
+			},
+		}
+		n, err := NewPBFT(cfg, &routerTransport{c: c, id: id})
+		if err != nil {
+			t.Fatalf("failed to create node: %s", err)
+		}
+		c.nodes[id] = n
+	}
+
+	return c
+}
+
+func (c *testCluster) stop() {
+	for _, n := range c.nodes {
+		n.Stop()
+	}
+}
+
+// resign re-signs a message altered on behalf of a byzantine node
+func (c *testCluster) resign(m *PBFTMessage) *PBFTMessage {
+	m.Signature = ed25519.Sign(c.keys[m.From], m.signedData())
+	return m
+}
+
+// propose submits requests through the given nodes and checks that all the
+// correct nodes executed them in the same order
+func (c *testCluster) propose(t *testing.T, via []string, correct []string, count int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := c.nodes[via[i%len(via)]]
+			errs <- node.Propose(ctx, []byte(fmt.Sprintf("request %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+	}
+
+	// The proposers executed the requests, the other correct nodes may
+	// still be catching up
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.lock.Lock()
+		done := true
+		for _, id := range correct {
+			if len(c.applied[id]) < count {
+				done = false
+			}
+		}
+		c.lock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("correct nodes did not execute all the requests")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ref := c.applied[correct[0]]
+	if len(ref) != count {
+		t.Fatalf("%s executed %d requests instead of %d", correct[0], len(ref), count)
+	}
+	for _, id := range correct[1:] {
+		if len(c.applied[id]) != len(ref) {
+			t.Fatalf("%s executed %d requests, %s executed %d", id, len(c.applied[id]), correct[0], len(ref))
+		}
+		for i := range ref {
+			if c.applied[id][i] != ref[i] {
+				t.Fatalf("%s and %s executed requests in a different order", id, correct[0])
+			}
+		}
+	}
+}
+
+// silence returns a filter dropping all the messages from and to some nodes
+func silence(silent ...string) testFilter {
+	s := make(map[string]bool)
+	for _, id := range silent {
+		s[id] = true
+	}
+	return func(from, to string, m *PBFTMessage) *PBFTMessage {
+		if s[from] || s[to] {
+			return nil
+		}
+		return m
+	}
+}
+
+func TestPBFT(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		silent []string
+	}{
+		{name: "4 nodes", size: 4},
+		{name: "7 nodes", size: 7},
+		{name: "4 nodes, silent backup", size: 4, silent: []string{"node3"}},
+		{name: "7 nodes, silent backups", size: 7, silent: []string{"node5", "node6"}},
+		{name: "4 nodes, silent primary", size: 4, silent: []string{"node0"}},
+		{name: "7 nodes, silent primary and backup", size: 7, silent: []string{"node0", "node4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := createTestCluster(t, tt.size, silence(tt.silent...))
+			defer c.stop()
+
+			var correct []string
+			for _, id := range c.ids {
+				isSilent := false
+				for _, s := range tt.silent {
+					if s == id {
+						isSilent = true
+					}
+				}
+				if !isSilent {
+					correct = append(correct, id)
+				}
+			}
+
+			c.propose(t, correct, correct, 10)
+
+			if len(tt.silent) > 0 && tt.silent[0] == "node0" {
+				view, _ := c.nodes[correct[0]].View()
+				if view == 0 {
+					t.Fatalf("no view change happened despite a silent primary")
+				}
+			}
+		})
+	}
+}
+
+func TestPBFTByzantineBackups(t *testing.T) {
+	for _, size := range []int{4, 7} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			f := (size - 1) / 3
+			faulty := make(map[string]bool)
+			for i := 0; i < f; i++ {
+				faulty[fmt.Sprintf("node%d", size-1-i)] = true
+			}
+
+			var c *testCluster
+			c = createTestCluster(t, size, func(from, to string, m *PBFTMessage) *PBFTMessage {
+				if !faulty[from] {
+					return m
+				}
+				// Faulty nodes vote for garbage, with valid signatures,
+				// and try to impersonate correct nodes
+				bad := *m
+				switch m.Type {
+				case PBFTPrepare, PBFTCommit, PBFTCheckpoint:
+					bad.Digest = digestOf([]byte("garbage"))
+					return c.resign(&bad)
+				default:
+					bad.From = "node0"
+					return &bad
+				}
+			})
+			defer c.stop()
+
+			var correct []string
+			for _, id := range c.ids {
+				if !faulty[id] {
+					correct = append(correct, id)
+				}
+			}
+			c.propose(t, correct, correct, 10)
+		})
+	}
+}
+
+func TestPBFTEquivocatingPrimary(t *testing.T) {
+	var c *testCluster
+	c = createTestCluster(t, 4, func(from, to string, m *PBFTMessage) *PBFTMessage {
+		if from != "node0" || m.Type != PBFTPrePrepare || m.View != 0 {
+			return m
+		}
+		// The primary assigns the same sequence number to different
+		// requests depending on the recipient
+		bad := *m
+		bad.Payload = []byte(fmt.Sprintf("%s for %s", m.Payload, to))
+		bad.Digest = digestOf(bad.Payload)
+		return c.resign(&bad)
+	})
+	defer c.stop()
+
+	correct := []string{"node1", "node2", "node3"}
+	c.propose(t, correct, correct, 3)
+
+	view, _ := c.nodes["node1"].View()
+	if view == 0 {
+		t.Fatalf("equivocating primary was not replaced")
+	}
+}
+
+func TestPBFTCheckpoint(t *testing.T) {
+	c := createTestCluster(t, 4, nil)
+	defer c.stop()
+
+	c.propose(t, c.ids, c.ids, 10)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range c.ids {
+		n := c.nodes[id]
+		for n.StableCheckpoint() != 8 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: stable checkpoint is %d instead of 8", id, n.StableCheckpoint())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		n.lock.Lock()
+		for seq := range n.log {
+			if seq <= 8 {
+				n.lock.Unlock()
+				t.Fatalf("%s: entry %d was not garbage collected", id, seq)
+			}
+		}
+		n.lock.Unlock()
+	}
+}
+
+func TestPBFTCheckpointAboveWatermark(t *testing.T) {
+	c := createTestCluster(t, 4, nil)
+	defer c.stop()
+
+	// A quorum of checkpoints above the high watermark is dropped, faulty
+	// nodes could otherwise make us keep any number of them
+	n := c.nodes["node0"]
+	n.lock.Lock()
+	seq := n.highWatermark() + n.cfg.CheckpointInterval
+	n.lock.Unlock()
+	for _, id := range c.ids[1:] {
+		err := n.HandleMessage(c.resign(&PBFTMessage{Type: PBFTCheckpoint, From: id, Seq: seq, Digest: digestOf([]byte("ahead"))}))
+		if err != nil {
+			t.Fatalf("failed to handle checkpoint of %s: %s", id, err)
+		}
+	}
+	n.lock.Lock()
+	kept := len(n.checkpoints)
+	n.lock.Unlock()
+	if kept != 0 || n.StableCheckpoint() != 0 {
+		t.Fatalf("checkpoint above the high watermark was kept")
+	}
+
+	// Checkpoints within the watermarks still become stable
+	seq = n.cfg.CheckpointInterval
+	for _, id := range c.ids[1:] {
+		err := n.HandleMessage(c.resign(&PBFTMessage{Type: PBFTCheckpoint, From: id, Seq: seq, Digest: digestOf([]byte("next"))}))
+		if err != nil {
+			t.Fatalf("failed to handle checkpoint of %s: %s", id, err)
+		}
+	}
+	if n.StableCheckpoint() != seq {
+		t.Fatalf("stable checkpoint is %d instead of %d", n.StableCheckpoint(), seq)
+	}
+}
+
+func TestPBFTForgedStableCheckpoint(t *testing.T) {
+	c := createTestCluster(t, 4, nil)
+	defer c.stop()
+	c.propose(t, c.ids, c.ids, 10)
+	for _, id := range c.ids {
+		deadline := time.Now().Add(5 * time.Second)
+		for c.nodes[id].StableCheckpoint() != 8 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: stable checkpoint is %d instead of 8", id, c.nodes[id].StableCheckpoint())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// viewChange builds the view-change message of a node for view 1
+	viewChange := func(id string) *PBFTMessage {
+		n := c.nodes[id]
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		return n.sign(&PBFTMessage{
+			Type:        PBFTViewChange,
+			View:        1,
+			StableSeq:   n.stableSeq,
+			Checkpoints: n.stableProof,
+			Prepared:    n.preparedCerts(),
+		})
+	}
+
+	// A byzantine node claims a stable checkpoint far ahead, which would
+	// discard the prepared requests and stall the new primary
+	forgedCheckpoint := func(from string) *PBFTMessage {
+		return c.resign(&PBFTMessage{Type: PBFTCheckpoint, From: from, Seq: 100, Digest: digestOf([]byte("forged"))})
+	}
+	impersonated := forgedCheckpoint("node3")
+	impersonated.From = "node1"
+	forged := []*PBFTMessage{
+		c.resign(&PBFTMessage{Type: PBFTViewChange, From: "node3", View: 1, StableSeq: 100}),
+		c.resign(&PBFTMessage{Type: PBFTViewChange, From: "node3", View: 1, StableSeq: 100, Checkpoints: []*PBFTMessage{
+			forgedCheckpoint("node3"), forgedCheckpoint("node3"), forgedCheckpoint("node3"),
+		}}),
+		c.resign(&PBFTMessage{Type: PBFTViewChange, From: "node3", View: 1, StableSeq: 100, Checkpoints: []*PBFTMessage{
+			forgedCheckpoint("node3"), impersonated, forgedCheckpoint("node2"),
+		}}),
+	}
+	// The proof of a genuine checkpoint does not prove another one
+	genuine := viewChange("node3")
+	forged = append(forged, c.resign(&PBFTMessage{Type: PBFTViewChange, From: "node3", View: 1, StableSeq: 100, Checkpoints: genuine.Checkpoints}))
+
+	n := c.nodes["node2"]
+	n.lock.Lock()
+	valid := n.validViewChange(genuine)
+	for i, vc := range forged {
+		if n.validViewChange(vc) {
+			n.lock.Unlock()
+			t.Fatalf("forged view-change %d is valid", i)
+		}
+	}
+	n.lock.Unlock()
+	if !valid {
+		t.Fatalf("genuine view-change is invalid")
+	}
+
+	// A new view justified by the forged view-change is rejected
+	vcs := []*PBFTMessage{viewChange("node1"), viewChange("node2"), forged[1]}
+	primary := c.nodes["node1"]
+	primary.lock.Lock()
+	_, _, pps := primary.computeNewView(1, vcs)
+	for _, pp := range pps {
+		primary.sign(pp)
+	}
+	nv := primary.sign(&PBFTMessage{
+		Type:        PBFTNewView,
+		View:        1,
+		ViewChanges: vcs,
+		PrePrepares: pps,
+	})
+	primary.lock.Unlock()
+	err := n.HandleMessage(nv)
+	if err != nil {
+		t.Fatalf("failed to handle new-view: %s", err)
+	}
+	if view, _ := n.View(); view != 0 {
+		t.Fatalf("node2 entered view %d justified by a forged checkpoint", view)
+	}
+}
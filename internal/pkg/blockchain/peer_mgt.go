@@ -6,94 +6,171 @@
 package blockchain
 
 import (
-	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
+	"time"
 
-	"github.com/gvallee/syserror/pkg/syserror"
 	"github.com/sylabs/syvalidate/internal/pkg/cache"
 	"github.com/sylabs/syvalidate/internal/pkg/comm"
 )
 
-func sendListNameSpaces(peer *comm.PeerInfo, namespaces []Namespace) error {
-	// Send the number of namespace
-	buff := make([]byte, 8)
-	binary.LittleEndian.PutUint64(buff, uint64(len(namespaces)))
-	err := peer.SendMsg(comm.DATAMSG, buff)
-	if err != syserror.NoErr {
-		return fmt.Errorf("failed to send the number of namespaces: %s", err.Error())
+const (
+	// NSUPDATEMSG is a request for the latest data of a namespace
+	NSUPDATEMSG = "NSUP"
+
+	// NSLISTMSG describes the namespaces of the leader, it is sent to a node
+	// right after the handshake or in response to a NSLISTMSG request
+	NSLISTMSG = "NSLS"
+
+	// requestTimeout is the maximum time we wait for the response to a request
+	requestTimeout = 30 * time.Second
+)
+
+func init() {
+	comm.RegisterMsgType(NSUPDATEMSG)
+	comm.RegisterMsgType(NSLISTMSG)
+}
+
+// NamespaceDescriptor describes a namespace a node has a chain for
+type NamespaceDescriptor struct {
+	// Hash is the hex-encoded SHA-256 hash of the identifier
+	Hash string `json:"hash"`
+
+	// ID is the human readable identifier of the namespace
+	ID string `json:"id"`
+
+	// Height is the height of the head of the chain
+	Height uint64 `json:"height"`
+}
+
+func namespaceHash(id string) string {
+	ns := NewNamespace(id)
+	return hex.EncodeToString(ns.Hash.Sum(nil))
+}
+
+// describeNamespaces returns the descriptors of all the namespaces with a
+// chain in a store
+func describeNamespaces(store *BlockStore) ([]NamespaceDescriptor, error) {
+	ids, err := cache.LoadNamespaces(store.basedir)
+	if err != nil {
+		return nil, err
 	}
 
-	// foreach namespace, send the hash of the name
-	for _, ns := range namespaces {
-		buffName := ns.Hash.Sum(nil)
-		err = peer.SendMsg(comm.DATAMSG, buffName)
-		if err != syserror.NoErr {
-			return fmt.Errorf("failed to send the namespace's hash: %s", err.Error())
+	var descs []NamespaceDescriptor
+	for _, id := range ids {
+		head, err := store.Head(id)
+		if err != nil {
+			return nil, err
+		}
+		if head == nil {
+			continue
 		}
+		descs = append(descs, NamespaceDescriptor{
+			Hash:   namespaceHash(id),
+			ID:     id,
+			Height: head.height,
+		})
 	}
-
-	return nil
+	return descs, nil
 }
 
-func unpackNamespace(data []byte) string {
-	return string(data)
+func sendListNamespaces(peer *comm.PeerInfo, store *BlockStore) error {
+	descs, err := describeNamespaces(store)
+	if err != nil {
+		return fmt.Errorf("failed to get the list of namespaces: %w", err)
+	}
+	payload, err := json.Marshal(descs)
+	if err != nil {
+		return err
+	}
+	err = peer.SendMsg(NSLISTMSG, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send the list of namespaces: %w", err)
+	}
+	return nil
 }
 
-func recvListNamespaces(cacheBasedir string, peer *comm.PeerInfo) error {
-	// The message is of the format | nb namespaces | name1 | name 2 | ... | name n |
-	// A name is a sha256 hash of a string, we therefore always know its length
-	msgType, size, buff, syserr := peer.RecvMsg()
-	if syserr != syserror.NoErr {
-		return fmt.Errorf("failed to receive the number of namespaces: %s", syserr.Error())
+// recvListNamespaces receives the namespaces of the leader, which are added
+// to the local cache
+func recvListNamespaces(cacheBasedir string, peer *comm.PeerInfo) ([]NamespaceDescriptor, error) {
+	msgType, _, buff, err := peer.RecvMsg()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive the list of namespaces: %w", err)
 	}
-
-	if msgType != comm.DATAMSG {
-		return fmt.Errorf("received wrong message type")
+	if msgType != NSLISTMSG {
+		return nil, fmt.Errorf("%w: expected list of namespaces but received %s", comm.ErrProtocol, msgType)
 	}
+	return addListNamespaces(cacheBasedir, buff)
+}
 
-	if size != 8 {
-		return fmt.Errorf("expected 8 bytes but received %d", int(size))
+// reqListNamespaces requests the namespaces of a peer, typically the leader,
+// which are added to the local cache
+func reqListNamespaces(cacheBasedir string, peer *comm.PeerInfo) ([]NamespaceDescriptor, error) {
+	resp, err := peer.Request(NSLISTMSG, nil, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the list of namespaces: %w", err)
 	}
+	return addListNamespaces(cacheBasedir, resp.Payload)
+}
 
+// addListNamespaces adds the namespaces of a list received from a peer to
+// the local cache, once checked
+func addListNamespaces(cacheBasedir string, payload []byte) ([]NamespaceDescriptor, error) {
+	var descs []NamespaceDescriptor
+	err := json.Unmarshal(payload, &descs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid list of namespaces: %s", comm.ErrProtocol, err)
+	}
 	var namespaces []string
-	numNamespaces := binary.LittleEndian.Uint64(buff)
-	var i uint64
-	for i = 0; i < numNamespaces; i++ {
-		msgType, size, buff, syserr := peer.RecvMsg()
-		if syserr != syserror.NoErr {
-			return fmt.Errorf("failed to receive the number of namespaces: %s", syserr.Error())
-		}
-
-		if msgType != comm.DATAMSG {
-			return fmt.Errorf("wrong message type received")
+	for _, d := range descs {
+		err := cache.CheckNamespace(d.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", comm.ErrProtocol, err)
 		}
-
-		if size != 32 {
-			return fmt.Errorf("expected 32 bytes but received %d", int(size))
+		if d.Hash != namespaceHash(d.ID) {
+			return nil, fmt.Errorf("%w: hash %s does not match namespace %s", comm.ErrProtocol, d.Hash, d.ID)
 		}
-
-		// Unpack the namespaces'id from the message data
-		ns := unpackNamespace(buff)
-		namespaces = append(namespaces, ns)
+		namespaces = append(namespaces, d.ID)
 	}
 
-	// todo: add namespace to local cache
-	err := cache.AddNamespaces(cacheBasedir, namespaces)
+	err = cache.AddNamespaces(cacheBasedir, namespaces)
 	if err != nil {
-		return fmt.Errorf("failed to update cache with list of namespaces: %s", err)
+		return nil, fmt.Errorf("failed to update cache with list of namespaces: %s", err)
 	}
 
-	return nil
+	return descs, nil
 }
 
-func (l *Leader) reqNamespaceUpdate(ns string) error {
-	return nil
+// reqNamespaceUpdate asynchronously requests the latest data of a namespace;
+// the response is delivered to the returned call by the read loop of the
+// connection
+func (l *Leader) reqNamespaceUpdate(ns string) *comm.Call {
+	return l.PeerInfo.Go(NSUPDATEMSG, []byte(ns), requestTimeout)
 }
 
-func (l *Leader) handleNamespaceUpdateResp(ns string) error {
+func (l *Leader) handleNamespaceUpdateResp(store *BlockStore, ns string, call *comm.Call) error {
 	// Post the receive
+	<-call.Done
+	if call.Err != nil {
+		log.Printf("[ERROR] update of namespace %s failed: %s", ns, call.Err)
+		return fmt.Errorf("failed to receive update for namespace %s: %w", ns, call.Err)
+	}
+	status, err := parseChainStatus(call.Response)
+	if err != nil {
+		log.Printf("[ERROR] update of namespace %s failed: %s", ns, err)
+		return err
+	}
 
-	// Mark cache as clean
+	// Get the missing blocks; the cache is marked as clean once the chain
+	// matches the one of the leader
+	n, err := syncFrom(&l.PeerInfo, store, status, l.Verify)
+	if err != nil {
+		log.Printf("[ERROR] synchronization of namespace %s failed after %d blocks: %s", ns, n, err)
+		return fmt.Errorf("failed to synchronize namespace %s: %w", ns, err)
+	}
+	log.Printf("[INFO] namespace %s synchronized, %d new blocks", ns, n)
 
 	return nil
 }
@@ -105,33 +182,44 @@ func (l *Leader) NodeInit(cacheBasedir string) error {
 	}
 
 	// Connect to leader
-	syserr := l.PeerInfo.Connect()
-	if syserr != syserror.NoErr {
-		return fmt.Errorf("failed to connect to peer %s: %s", l.PeerInfo.URL, syserr.Error())
+	err := l.PeerInfo.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to peer %s: %w", l.PeerInfo.URL, err)
 	}
 
-	// Load data from local cache
+	// Sync list of namespaces
+	_, err = recvListNamespaces(cacheBasedir, &l.PeerInfo)
+	if err != nil {
+		return fmt.Errorf("failed to receive list of namespaces: %s", err)
+	}
+
+	// Load data from local cache, which now includes the namespaces of the
+	// leader
+	store, err := sharedBlockStore(cacheBasedir)
+	if err != nil {
+		return fmt.Errorf("failed to open block store: %s", err)
+	}
 	namespaces, err := cache.LoadNamespaces(cacheBasedir)
 	if err != nil {
 		return fmt.Errorf("failed to load namespaces from cache: %s", err)
 	}
 
-	// Sync list of namespaces
-	err = recvListNamespaces(cacheBasedir, &l.PeerInfo)
+	// From now on, requests and responses are multiplexed on the
+	// connection so that several updates can be in flight
+	err = l.PeerInfo.StartReadLoop()
 	if err != nil {
-		return fmt.Errorf("failed to receive list of namespaces: %s", err)
+		return fmt.Errorf("failed to start read loop: %w", err)
 	}
 
 	// For all blockchain namespace, request the latest data from leader
 	for _, ns := range namespaces {
-		// todo: mark the cache for the namespace as dirty
-
-		err = l.reqNamespaceUpdate(ns)
+		err := cache.MarkDirty(cacheBasedir, ns)
 		if err != nil {
-			return fmt.Errorf("failed to request update for namespace: %s", err)
+			return fmt.Errorf("failed to mark namespace %s as dirty: %s", ns, err)
 		}
 
-		go l.handleNamespaceUpdateResp(ns)
+		call := l.reqNamespaceUpdate(ns)
+		go l.handleNamespaceUpdateResp(store, ns, call)
 
 		// We let the update happen in the background, moving on.
 		// The cache will be update as we receive the data and
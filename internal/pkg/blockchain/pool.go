@@ -0,0 +1,171 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+)
+
+// PoolConfig specifies how the connections of a pool are created
+type PoolConfig struct {
+	// Self is the record of the local node, advertised to other peers
+	Self PeerRecord
+
+	// PrivateKey is the key of the local node its record is signed with
+	// when advertised; the record is not signed if not set
+	PrivateKey ed25519.PrivateKey
+
+	// Transport is the transport used to connect to peers; TCP when not set
+	Transport comm.Transport
+
+	// DialOptions are the options used to connect to peers
+	DialOptions *comm.DialOptions
+
+	// ConnOptions are the options of the connections
+	ConnOptions *comm.ConnOptions
+
+	// Handler handles the requests that peers send us over the
+	// connections of the pool
+	Handler comm.Handler
+}
+
+type poolEntry struct {
+	ready chan struct{}
+	peer  *comm.PeerInfo
+	err   error
+}
+
+// Pool is a set of connections to peers, lazily established when first
+// needed and reused afterward
+type Pool struct {
+	cfg      PoolConfig
+	registry *Registry
+
+	lock  sync.Mutex
+	conns map[string]*poolEntry
+}
+
+// NewPool creates a new pool of connections for the peers of a registry
+func NewPool(registry *Registry, cfg PoolConfig) *Pool {
+	return &Pool{
+		cfg:      cfg,
+		registry: registry,
+		conns:    make(map[string]*poolEntry),
+	}
+}
+
+// Self returns the record of the local node
+func (p *Pool) Self() PeerRecord {
+	return p.cfg.Self
+}
+
+// Registry returns the registry of peers used by the pool
+func (p *Pool) Registry() *Registry {
+	return p.registry
+}
+
+func isClosed(peer *comm.PeerInfo) bool {
+	select {
+	case <-peer.Closed():
+		return true
+	default:
+		return false
+	}
+}
+
+// GetURL returns a connection to the peer at the given URL, connecting to
+// it if we do not have a usable connection yet
+func (p *Pool) GetURL(ctx context.Context, url string) (*comm.PeerInfo, error) {
+	p.lock.Lock()
+	e, ok := p.conns[url]
+	if ok {
+		p.lock.Unlock()
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if e.err == nil && !isClosed(e.peer) {
+			return e.peer, nil
+		}
+
+		// The connection failed or is now closed, we try again
+		p.lock.Lock()
+		if p.conns[url] == e {
+			delete(p.conns, url)
+		}
+		p.lock.Unlock()
+		return p.GetURL(ctx, url)
+	}
+
+	// We are the one in charge of connecting to the peer, other
+	// callers will wait for us
+	e = &poolEntry{ready: make(chan struct{})}
+	p.conns[url] = e
+	p.lock.Unlock()
+
+	peer := &comm.PeerInfo{
+		URL:         url,
+		Transport:   p.cfg.Transport,
+		DialOptions: p.cfg.DialOptions,
+		ConnOptions: p.cfg.ConnOptions,
+		Handler:     p.cfg.Handler,
+	}
+	err := peer.ConnectContext(ctx)
+	if err == nil {
+		err = peer.StartReadLoop()
+	}
+	if err != nil {
+		e.err = fmt.Errorf("failed to connect to %s: %w", url, err)
+		close(e.ready)
+		p.lock.Lock()
+		if p.conns[url] == e {
+			delete(p.conns, url)
+		}
+		p.lock.Unlock()
+		return nil, e.err
+	}
+	e.peer = peer
+	close(e.ready)
+
+	return peer, nil
+}
+
+// Get returns a connection to a peer of the registry
+func (p *Pool) Get(ctx context.Context, id string) (*comm.PeerInfo, error) {
+	rec, ok := p.registry.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %s", id)
+	}
+
+	peer, err := p.GetURL(ctx, rec.URL)
+	if err != nil {
+		return nil, err
+	}
+	p.registry.Touch(id)
+
+	return peer, nil
+}
+
+// Close closes all the connections of the pool
+func (p *Pool) Close() {
+	p.lock.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*poolEntry)
+	p.lock.Unlock()
+
+	for _, e := range conns {
+		<-e.ready
+		if e.peer != nil {
+			e.peer.Close()
+		}
+	}
+}
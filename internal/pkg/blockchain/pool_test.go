@@ -0,0 +1,263 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+)
+
+type testNode struct {
+	dir    string
+	mux    *comm.HandlerMux
+	pool   *Pool
+	server *comm.Server
+}
+
+func createTestNode(t *testing.T, network *comm.MemNetwork, id string) *testNode {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	registry, err := LoadRegistry(dir)
+	if err != nil {
+		t.Fatalf("failed to load registry: %s", err)
+	}
+
+	mux := comm.NewHandlerMux()
+	cfg := PoolConfig{
+		Self: PeerRecord{
+			ID:   id,
+			URL:  id,
+			Role: RolePeer,
+		},
+		Transport: network.Transport(id),
+		Handler:   mux.ServeMsg,
+	}
+	pool := NewPool(registry, cfg)
+	mux.Handle(PEERSMSG, pool.HandleGossip)
+
+	info := comm.PeerInfo{
+		URL:       id,
+		Transport: network.Transport(id),
+		Handler:   mux.ServeMsg,
+	}
+	server, err := info.Listen()
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	go server.Serve()
+
+	return &testNode{
+		dir:    dir,
+		mux:    mux,
+		pool:   pool,
+		server: server,
+	}
+}
+
+func (n *testNode) cleanup() {
+	n.server.Close()
+	n.pool.Close()
+	os.RemoveAll(n.dir)
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := LoadRegistry(dir)
+	if err != nil {
+		t.Fatalf("failed to load empty registry: %s", err)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	now := time.Now().Add(-time.Hour).Round(0)
+	rec := PeerRecord{
+		ID:       "node1",
+		URL:      "127.0.0.1:5555",
+		LastSeen: now,
+		Role:     RoleLeader,
+	}
+	rec.sign(key)
+	if !r.Update(rec) {
+		t.Fatal("adding a new peer did not change the registry")
+	}
+
+	// Older data is ignored, and only the peer can change its URL or key
+	if r.Update(PeerRecord{ID: "node1", LastSeen: now.Add(-time.Hour)}) {
+		t.Fatal("older record updated the registry")
+	}
+	r.Update(PeerRecord{ID: "node1", URL: "127.0.0.1:6666", LastSeen: now.Add(time.Second), Role: RolePeer, PublicKey: "ffff"})
+	forged := PeerRecord{ID: "node1", URL: "127.0.0.1:6666", LastSeen: now.Add(2 * time.Second), Role: RolePeer}
+	forged.sign(otherKey)
+	r.Update(forged)
+	got, _ := r.Get("node1")
+	if got.URL != "127.0.0.1:5555" || got.PublicKey != rec.PublicKey || got.Role != RolePeer {
+		t.Fatalf("record of another node changed the URL or key: %+v", got)
+	}
+	moved := PeerRecord{ID: "node1", URL: "127.0.0.1:5556", LastSeen: now.Add(3 * time.Second), Role: RolePeer}
+	moved.sign(key)
+	if !r.Update(moved) {
+		t.Fatal("signed record did not update the registry")
+	}
+	// A replayed record does not revert the change
+	rec.LastSeen = now.Add(4 * time.Second)
+	r.Update(rec)
+
+	// A record from the future does not stay the most recent one
+	r.Update(PeerRecord{ID: "node1", LastSeen: time.Now().Add(time.Hour), Role: RolePeer})
+	got, _ = r.Get("node1")
+	if got.LastSeen.After(time.Now()) {
+		t.Fatalf("last seen in the future: %s", got.LastSeen)
+	}
+	lastSeen := got.LastSeen
+
+	err = r.Save()
+	if err != nil {
+		t.Fatalf("failed to save registry: %s", err)
+	}
+
+	r2, err := LoadRegistry(dir)
+	if err != nil {
+		t.Fatalf("failed to load registry: %s", err)
+	}
+	got, ok := r2.Get("node1")
+	if !ok {
+		t.Fatal("peer is not in the loaded registry")
+	}
+	if got.URL != "127.0.0.1:5556" || got.Role != RolePeer || got.PublicKey != rec.PublicKey || !got.LastSeen.Equal(lastSeen) {
+		t.Fatalf("loaded record does not match expectation: %+v", got)
+	}
+	// The signature can still be checked by the peers the record is
+	// relayed to
+	err = got.verify(got.PublicKey)
+	if err != nil {
+		t.Fatalf("invalid signature of the loaded record: %s", err)
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	network := comm.NewMemNetwork()
+	n1 := createTestNode(t, network, "node1")
+	defer n1.cleanup()
+	n2 := createTestNode(t, network, "node2")
+	defer n2.cleanup()
+
+	n1.pool.Registry().Update(PeerRecord{ID: "node2", URL: "node2", LastSeen: time.Now()})
+	ctx := context.Background()
+	p1, err := n1.pool.Get(ctx, "node2")
+	if err != nil {
+		t.Fatalf("failed to get connection: %s", err)
+	}
+	p2, err := n1.pool.Get(ctx, "node2")
+	if err != nil {
+		t.Fatalf("failed to get connection: %s", err)
+	}
+	if p1 != p2 {
+		t.Fatal("connection was not reused")
+	}
+
+	// A closed connection is transparently replaced
+	p1.Close()
+	p3, err := n1.pool.Get(ctx, "node2")
+	if err != nil {
+		t.Fatalf("failed to get connection: %s", err)
+	}
+	if p3 == p1 {
+		t.Fatal("closed connection was returned")
+	}
+
+	_, err = n1.pool.Get(ctx, "unknown")
+	if err == nil {
+		t.Fatal("got a connection to an unknown peer")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	network := comm.NewMemNetwork()
+	seed := createTestNode(t, network, "seed")
+	defer seed.cleanup()
+	n1 := createTestNode(t, network, "node1")
+	defer n1.cleanup()
+	n2 := createTestNode(t, network, "node2")
+	defer n2.cleanup()
+
+	ctx := context.Background()
+	seeds := []string{"seed"}
+	err := n1.pool.Discover(ctx, seeds)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	// node2 learns about node1 through the seed
+	err = n2.pool.Discover(ctx, seeds)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	if _, ok := n2.pool.Registry().Get("node1"); !ok {
+		t.Fatal("node2 did not learn about node1")
+	}
+
+	// node1 learns about node2 from the seed, and node2 learns it is
+	// alive by talking to it directly
+	err = n1.pool.Discover(ctx, nil)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	for _, n := range []*testNode{seed, n1, n2} {
+		peers := n.pool.Registry().List()
+		if len(peers) != 2 {
+			t.Fatalf("%s knows %d peers instead of 2", n.pool.Self().ID, len(peers))
+		}
+	}
+
+	// The result of the discovery is persisted
+	r, err := LoadRegistry(n1.dir)
+	if err != nil {
+		t.Fatalf("failed to load registry: %s", err)
+	}
+	if len(r.List()) != 2 {
+		t.Fatalf("persisted registry has %d peers instead of 2", len(r.List()))
+	}
+
+	// A peer cannot redirect the traffic to another peer by gossiping a
+	// more recent record for it
+	known, _ := n2.pool.Registry().Get("node1")
+	payload, err := json.Marshal(&gossipMsg{
+		From: PeerRecord{ID: "evil", URL: "evil"},
+		Peers: []PeerRecord{
+			{ID: "node1", URL: "evil", LastSeen: time.Now().Add(24 * time.Hour), PublicKey: "abcd"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode gossip message: %s", err)
+	}
+	_, err = n2.pool.merge(payload)
+	if err != nil {
+		t.Fatalf("failed to merge gossip message: %s", err)
+	}
+	got, _ := n2.pool.Registry().Get("node1")
+	if got.URL != known.URL || got.PublicKey != "" || got.LastSeen.After(time.Now()) {
+		t.Fatalf("gossip of another peer changed the record of node1: %+v", got)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Query selects the blocks of a chain; a block must match all the criteria
+// that are set
+type Query struct {
+	// ManifestName is the name of a manifest of the stamps of the block,
+	// e.g., openmpi-4.0.2
+	ManifestName string
+
+	// ManifestHash is the hash of a manifest of the stamps of the block
+	ManifestHash string
+
+	// Resource is the resource of a stamp of the block, i.e., the identity
+	// of the node that did the work (node ID, interface address, hostname
+	// or key fingerprint)
+	Resource string
+
+	// Since and Until select the blocks committed in [Since, Until)
+	Since time.Time
+	Until time.Time
+}
+
+// Match checks whether a block matches the query
+func (q *Query) Match(b *Block) bool {
+	if !q.Since.IsZero() && b.timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !b.timestamp.Before(q.Until) {
+		return false
+	}
+
+	if q.Resource != "" {
+		found := false
+		for i := range b.stamps {
+			if b.stamps[i].Resource() == q.Resource {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.ManifestName != "" || q.ManifestHash != "" {
+		found := false
+		manifests, err := b.stampManifests()
+		if err != nil {
+			return false
+		}
+		for _, m := range manifests {
+			if (q.ManifestName == "" || m.Name == q.ManifestName) && (q.ManifestHash == "" || m.SHA256 == q.ManifestHash) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Blocks returns at most count blocks of the chain of a namespace, starting
+// at a given height; all the remaining blocks are returned when count is 0
+func Blocks(r ChainReader, namespace string, from uint64, count uint64) ([]*Block, error) {
+	n, err := r.Len(namespace)
+	if err != nil {
+		return nil, err
+	}
+	end := n
+	if count > 0 && from+count < n {
+		end = from + count
+	}
+
+	var blocks []*Block
+	for h := from; h < end; h++ {
+		b, err := r.BlockAt(namespace, h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// Find returns the blocks of the chain of a namespace matching a query, in
+// the order of the chain
+func Find(r ChainReader, namespace string, q Query) ([]*Block, error) {
+	n, err := r.Len(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks are committed in order so the first block of a time range can
+	// be looked up
+	var searchErr error
+	start := uint64(0)
+	if !q.Since.IsZero() {
+		start = uint64(sort.Search(int(n), func(i int) bool {
+			b, err := r.BlockAt(namespace, uint64(i))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return !b.timestamp.Before(q.Since)
+		}))
+		if searchErr != nil {
+			return nil, fmt.Errorf("failed to search the chain of namespace %s: %w", namespace, searchErr)
+		}
+	}
+
+	var blocks []*Block
+	for h := start; h < n; h++ {
+		b, err := r.BlockAt(namespace, h)
+		if err != nil {
+			return nil, err
+		}
+		if !q.Until.IsZero() && !b.timestamp.Before(q.Until) {
+			break
+		}
+		if q.Match(b) {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+func TestFind(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-query"
+
+	_, err := CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+
+	// Blocks 1 and 3 include Open MPI 4.0.2, block 2 comes from another host
+	other := createTestStamp(t, "mpich-3.3")
+	other, err = hashcash.Parse(strings.Replace(other.Serialize(), "127.0.0.1", "10.0.0.2", 1))
+	if err != nil {
+		t.Fatalf("failed to parse stamp: %s", err)
+	}
+	var blocks []Block
+	for _, stamps := range [][]hashcash.Stamp{
+		{createTestStamp(t, "openmpi-4.0.2", "mpich-3.3")},
+		{other},
+		{createTestStamp(t, "openmpi-3.1.5"), createTestStamp(t, "openmpi-4.0.2")},
+	} {
+		b, err := BatchCreate(namespace, stamps)
+		if err != nil {
+			t.Fatalf("failed to create block: %s", err)
+		}
+		err = b.Publish(nil)
+		if err != nil {
+			t.Fatalf("failed to publish block: %s", err)
+		}
+		blocks = append(blocks, b)
+		time.Sleep(10 * time.Millisecond)
+	}
+	s, err := LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+
+	all, err := Blocks(s, namespace, 0, 0)
+	if err != nil || len(all) != 4 || all[0].Genesis() == nil {
+		t.Fatalf("failed to list blocks: %d blocks (%v)", len(all), err)
+	}
+	page, err := Blocks(s, namespace, 1, 2)
+	if err != nil || len(page) != 2 || page[0].Hash() != blocks[0].Hash() || page[1].Hash() != blocks[1].Hash() {
+		t.Fatalf("failed to list a range of blocks (%v)", err)
+	}
+
+	hashOf := func(name string) string {
+		manifests, err := blocks[0].stampManifests()
+		if err != nil {
+			t.Fatalf("failed to get manifests: %s", err)
+		}
+		for _, m := range manifests {
+			if m.Name == name {
+				return m.SHA256
+			}
+		}
+		t.Fatalf("no manifest %s", name)
+		return ""
+	}
+	tests := []struct {
+		name     string
+		q        Query
+		expected []int
+	}{
+		{name: "all", q: Query{}, expected: []int{0, 1, 2, 3}},
+		{name: "manifest", q: Query{ManifestName: "openmpi-4.0.2"}, expected: []int{1, 3}},
+		{name: "hash", q: Query{ManifestHash: hashOf("mpich-3.3")}, expected: []int{1, 2}},
+		{name: "name and hash", q: Query{ManifestName: "openmpi-4.0.2", ManifestHash: hashOf("mpich-3.3")}, expected: nil},
+		{name: "resource", q: Query{Resource: "10.0.0.2"}, expected: []int{2}},
+		{name: "since", q: Query{Since: blocks[1].Timestamp()}, expected: []int{2, 3}},
+		{name: "until", q: Query{Until: blocks[1].Timestamp()}, expected: []int{0, 1}},
+		{name: "range", q: Query{Since: blocks[0].Timestamp(), Until: blocks[2].Timestamp(), Resource: "127.0.0.1"}, expected: []int{1}},
+		{name: "manifest and resource", q: Query{ManifestName: "openmpi-4.0.2", Resource: "127.0.0.1"}, expected: []int{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := Find(s, namespace, tt.q)
+			if err != nil {
+				t.Fatalf("query failed: %s", err)
+			}
+			var heights []int
+			for _, b := range found {
+				heights = append(heights, int(b.Height()))
+			}
+			if len(heights) != len(tt.expected) {
+				t.Fatalf("found blocks %v instead of %v", heights, tt.expected)
+			}
+			for i := range heights {
+				if heights[i] != tt.expected[i] {
+					t.Fatalf("found blocks %v instead of %v", heights, tt.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,721 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RaftMsgType is the type of a Raft message
+type RaftMsgType string
+
+const (
+	// RaftVoteReq is sent by a candidate to get elected
+	RaftVoteReq RaftMsgType = "vote-request"
+
+	// RaftVoteResp is the answer to a vote request
+	RaftVoteResp RaftMsgType = "vote-response"
+
+	// RaftAppendReq is sent by the leader to replicate its log, it is also
+	// used as heartbeat
+	RaftAppendReq RaftMsgType = "append-request"
+
+	// RaftAppendResp is the answer to an append request
+	RaftAppendResp RaftMsgType = "append-response"
+
+	// RaftForward is sent by a follower to forward a request to the leader
+	RaftForward RaftMsgType = "forward"
+)
+
+const (
+	defaultElectionTimeout = 2 * time.Second
+
+	// maxAppendEntries is the maximum number of entries sent in a single
+	// append request
+	maxAppendEntries = 64
+)
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+// RaftEntry is an entry of the replicated log; entries without data are
+// no-ops appended by new leaders
+type RaftEntry struct {
+	Term uint64 `json:"term"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// RaftMessage is a message of the Raft protocol
+type RaftMessage struct {
+	Type RaftMsgType `json:"type"`
+	From string      `json:"from"`
+	Term uint64      `json:"term"`
+
+	// LastLogIndex and LastLogTerm describe the log of a candidate (vote-request)
+	LastLogIndex uint64 `json:"last_log_index,omitempty"`
+	LastLogTerm  uint64 `json:"last_log_term,omitempty"`
+
+	// Granted is set when the vote is granted (vote-response)
+	Granted bool `json:"granted,omitempty"`
+
+	// PrevLogIndex and PrevLogTerm identify the entry preceding Entries,
+	// LeaderCommit is the commit index of the leader (append-request)
+	PrevLogIndex uint64      `json:"prev_log_index,omitempty"`
+	PrevLogTerm  uint64      `json:"prev_log_term,omitempty"`
+	Entries      []RaftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64      `json:"leader_commit,omitempty"`
+
+	// Success is set when the entries were appended and MatchIndex is the
+	// last index known to match the log of the leader (append-response)
+	Success    bool   `json:"success,omitempty"`
+	MatchIndex uint64 `json:"match_index,omitempty"`
+
+	// Data is a request forwarded to the leader (forward)
+	Data []byte `json:"data,omitempty"`
+}
+
+// RaftTransport delivers Raft messages to the other nodes. Implementations
+// must not block.
+type RaftTransport interface {
+	// Send sends a message to a given node
+	Send(to string, m *RaftMessage)
+}
+
+// RaftConfig is the configuration of a Raft node
+type RaftConfig struct {
+	// ID is the identifier of the local node, it must be one of Nodes
+	ID string
+
+	// Nodes is the list of the identifiers of all the nodes
+	Nodes []string
+
+	// ElectionTimeout is the minimum time without hearing from a leader
+	// before starting an election; the actual timeout is randomized
+	// between ElectionTimeout and twice its value
+	ElectionTimeout time.Duration
+
+	// HeartbeatInterval is the interval between two append requests from
+	// the leader, a third of the election timeout by default
+	HeartbeatInterval time.Duration
+
+	// StateDir is the directory where the term, the vote and the log are
+	// persisted; they are only kept in memory when not set
+	StateDir string
+
+	// Apply is invoked, in order, for every request that is committed. It
+	// is called with the lock of the node held and therefore must not call
+	// back into the node.
+	Apply func(index uint64, data []byte)
+}
+
+// Raft is a node of a Raft network. It tolerates up to f crashed nodes out
+// of 2f+1 but, unlike pBFT, does not tolerate byzantine nodes. The term,
+// the vote and the log are persisted before they are communicated, so that
+// a node can restart without breaking its promises.
+type Raft struct {
+	cfg       RaftConfig
+	transport RaftTransport
+	storage   *raftStorage
+
+	lock sync.Mutex
+
+	role     raftRole
+	term     uint64
+	votedFor string
+	leader   string
+	votes    map[string]bool
+
+	// log[0] is a sentinel so that log indexes start at 1
+	log         []RaftEntry
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inLog      map[string]bool
+
+	pending  map[string][]byte
+	executed map[string]bool
+	waiters  map[string][]chan struct{}
+
+	electionTimer  *time.Timer
+	heartbeatTimer *time.Timer
+	timerGen       uint64
+	rand           *rand.Rand
+	stopped        bool
+}
+
+// NewRaft creates a new Raft node and starts its election timer
+func NewRaft(cfg RaftConfig, transport RaftTransport) (*Raft, error) {
+	found := false
+	for _, id := range cfg.Nodes {
+		if id == cfg.ID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not part of the nodes", cfg.ID)
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 3
+	}
+
+	r := &Raft{
+		cfg:        cfg,
+		transport:  transport,
+		log:        []RaftEntry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inLog:      make(map[string]bool),
+		pending:    make(map[string][]byte),
+		executed:   make(map[string]bool),
+		waiters:    make(map[string][]chan struct{}),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if cfg.StateDir != "" {
+		storage, state, entries, err := openRaftStorage(cfg.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		r.storage = storage
+		r.term = state.Term
+		r.votedFor = state.VotedFor
+		r.log = append(r.log, entries...)
+	}
+
+	r.lock.Lock()
+	r.resetElectionTimer()
+	r.lock.Unlock()
+
+	return r, nil
+}
+
+func (r *Raft) majority() int {
+	return len(r.cfg.Nodes)/2 + 1
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return uint64(len(r.log) - 1)
+}
+
+func (r *Raft) send(to string, m *RaftMessage) {
+	if r.stopped {
+		return
+	}
+	m.From = r.cfg.ID
+	m.Term = r.term
+	r.transport.Send(to, m)
+}
+
+func (r *Raft) broadcast(m *RaftMessage) {
+	for _, id := range r.cfg.Nodes {
+		if id == r.cfg.ID {
+			continue
+		}
+		c := *m
+		r.send(id, &c)
+	}
+}
+
+// Leader returns the identifier of the current leader, empty if unknown
+func (r *Raft) Leader() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.leader
+}
+
+// Term returns the current term
+func (r *Raft) Term() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.term
+}
+
+// CommitIndex returns the index of the last committed entry
+func (r *Raft) CommitIndex() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.commitIndex
+}
+
+// Stop stops the timers of the node; messages are ignored afterward
+func (r *Raft) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopped = true
+	r.stopTimers()
+	if r.storage != nil {
+		r.storage.close()
+	}
+}
+
+/* Persistence */
+
+// halt stops a node that failed to persist its state: it cannot take part
+// in the protocol anymore without the risk of breaking its promises
+func (r *Raft) halt(err error) {
+	log.Printf("[ERROR] raft node %s stopping: %s", r.cfg.ID, err)
+	r.stopped = true
+	r.stopTimers()
+}
+
+// saveState persists the term and the vote
+func (r *Raft) saveState() error {
+	if r.storage == nil {
+		return nil
+	}
+	return r.storage.saveState(raftHardState{Term: r.term, VotedFor: r.votedFor})
+}
+
+// appendLog persists entries and appends them to the log
+func (r *Raft) appendLog(entries ...RaftEntry) error {
+	if r.storage != nil {
+		err := r.storage.append(entries)
+		if err != nil {
+			return err
+		}
+	}
+	r.log = append(r.log, entries...)
+	return nil
+}
+
+// truncateLog drops the entries of the log starting at a given index
+func (r *Raft) truncateLog(index uint64) error {
+	if r.storage != nil {
+		err := r.storage.truncate(index)
+		if err != nil {
+			return err
+		}
+	}
+	r.log = r.log[:index]
+	return nil
+}
+
+// StartElection makes the node start an election right away
+func (r *Raft) StartElection() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped || r.role == raftLeader {
+		return
+	}
+	r.startElection()
+}
+
+// Propose submits a request and waits until it is committed and applied
+// locally. Identical requests are executed only once.
+func (r *Raft) Propose(ctx context.Context, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty request")
+	}
+	d := digestOf(data)
+
+	r.lock.Lock()
+	if r.executed[d] {
+		r.lock.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	r.waiters[d] = append(r.waiters[d], done)
+	r.pending[d] = data
+	r.submit(d, data)
+	r.lock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("request %s not committed: %w", d, ctx.Err())
+	}
+}
+
+// submit appends a request to the log if we are the leader, or forwards it
+// to the leader otherwise
+func (r *Raft) submit(d string, data []byte) {
+	switch {
+	case r.role == raftLeader:
+		if r.inLog[d] {
+			return
+		}
+		err := r.appendLog(RaftEntry{Term: r.term, Data: data})
+		if err != nil {
+			r.halt(err)
+			return
+		}
+		r.inLog[d] = true
+		r.advanceCommit()
+		r.sendAppendAll()
+	case r.leader != "":
+		r.send(r.leader, &RaftMessage{Type: RaftForward, Data: data})
+	default:
+		// The request stays pending until we know the leader
+	}
+}
+
+// forwardPending submits again all our pending requests, typically after
+// a new leader has been elected
+func (r *Raft) forwardPending() {
+	var digests []string
+	for d := range r.pending {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	for _, d := range digests {
+		r.submit(d, r.pending[d])
+	}
+}
+
+// HandleMessage handles a message received from another node
+func (r *Raft) HandleMessage(m *RaftMessage) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return nil
+	}
+
+	if m.Term > r.term {
+		r.stepDown(m.Term)
+		if r.stopped {
+			return nil
+		}
+	}
+
+	switch m.Type {
+	case RaftVoteReq:
+		r.handleVoteReq(m)
+	case RaftVoteResp:
+		r.handleVoteResp(m)
+	case RaftAppendReq:
+		r.handleAppendReq(m)
+	case RaftAppendResp:
+		r.handleAppendResp(m)
+	case RaftForward:
+		if r.role == raftLeader {
+			r.submit(digestOf(m.Data), m.Data)
+		}
+	default:
+		return fmt.Errorf("unknown message type %s", m.Type)
+	}
+
+	return nil
+}
+
+/* Timers */
+
+func (r *Raft) stopTimers() {
+	r.timerGen++
+	if r.electionTimer != nil {
+		r.electionTimer.Stop()
+	}
+	if r.heartbeatTimer != nil {
+		r.heartbeatTimer.Stop()
+	}
+}
+
+func (r *Raft) resetElectionTimer() {
+	r.stopTimers()
+	gen := r.timerGen
+	timeout := r.cfg.ElectionTimeout + time.Duration(r.rand.Int63n(int64(r.cfg.ElectionTimeout)))
+	r.electionTimer = time.AfterFunc(timeout, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.stopped || gen != r.timerGen || r.role == raftLeader {
+			return
+		}
+		r.startElection()
+	})
+}
+
+func (r *Raft) startHeartbeat() {
+	r.stopTimers()
+	gen := r.timerGen
+	var beat func()
+	beat = func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.stopped || gen != r.timerGen || r.role != raftLeader {
+			return
+		}
+		r.sendAppendAll()
+		r.heartbeatTimer = time.AfterFunc(r.cfg.HeartbeatInterval, beat)
+	}
+	r.heartbeatTimer = time.AfterFunc(r.cfg.HeartbeatInterval, beat)
+}
+
+/* Elections */
+
+func (r *Raft) stepDown(term uint64) {
+	wasLeader := r.role == raftLeader
+	r.term = term
+	r.role = raftFollower
+	r.votedFor = ""
+	if wasLeader {
+		r.leader = ""
+	}
+	err := r.saveState()
+	if err != nil {
+		r.halt(err)
+		return
+	}
+	r.resetElectionTimer()
+}
+
+func (r *Raft) startElection() {
+	r.term++
+	r.role = raftCandidate
+	r.votedFor = r.cfg.ID
+	r.leader = ""
+	r.votes = map[string]bool{r.cfg.ID: true}
+	err := r.saveState()
+	if err != nil {
+		r.halt(err)
+		return
+	}
+	log.Printf("[INFO] raft node %s starting election for term %d", r.cfg.ID, r.term)
+
+	r.broadcast(&RaftMessage{
+		Type:         RaftVoteReq,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.log[r.lastIndex()].Term,
+	})
+	r.resetElectionTimer()
+
+	if len(r.votes) >= r.majority() {
+		r.becomeLeader()
+	}
+}
+
+func (r *Raft) handleVoteReq(m *RaftMessage) {
+	lastTerm := r.log[r.lastIndex()].Term
+	upToDate := m.LastLogTerm > lastTerm || (m.LastLogTerm == lastTerm && m.LastLogIndex >= r.lastIndex())
+	granted := m.Term == r.term && (r.votedFor == "" || r.votedFor == m.From) && upToDate
+	if granted && r.votedFor != m.From {
+		// The vote must survive a restart, otherwise we could vote for
+		// another candidate in the same term
+		r.votedFor = m.From
+		err := r.saveState()
+		if err != nil {
+			r.halt(err)
+			return
+		}
+	}
+	if granted {
+		r.resetElectionTimer()
+	}
+	r.send(m.From, &RaftMessage{Type: RaftVoteResp, Granted: granted})
+}
+
+func (r *Raft) handleVoteResp(m *RaftMessage) {
+	if r.role != raftCandidate || m.Term != r.term || !m.Granted {
+		return
+	}
+	r.votes[m.From] = true
+	if len(r.votes) >= r.majority() {
+		r.becomeLeader()
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	log.Printf("[INFO] raft node %s is the leader of term %d", r.cfg.ID, r.term)
+	r.role = raftLeader
+	r.leader = r.cfg.ID
+	r.inLog = make(map[string]bool)
+	for _, e := range r.log[1:] {
+		if e.Data != nil {
+			r.inLog[digestOf(e.Data)] = true
+		}
+	}
+	for _, id := range r.cfg.Nodes {
+		r.nextIndex[id] = r.lastIndex() + 1
+		r.matchIndex[id] = 0
+	}
+
+	// A leader can only commit entries of its own term, the no-op entry
+	// commits the entries of the previous terms
+	err := r.appendLog(RaftEntry{Term: r.term})
+	if err != nil {
+		r.halt(err)
+		return
+	}
+	r.startHeartbeat()
+	r.forwardPending()
+	r.advanceCommit()
+	r.sendAppendAll()
+}
+
+/* Log replication */
+
+func (r *Raft) sendAppend(to string) {
+	next := r.nextIndex[to]
+	if next < 1 {
+		next = 1
+	}
+	prev := next - 1
+	end := r.lastIndex() + 1
+	if end-next > maxAppendEntries {
+		end = next + maxAppendEntries
+	}
+	entries := make([]RaftEntry, end-next)
+	copy(entries, r.log[next:end])
+
+	r.send(to, &RaftMessage{
+		Type:         RaftAppendReq,
+		PrevLogIndex: prev,
+		PrevLogTerm:  r.log[prev].Term,
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+	})
+}
+
+func (r *Raft) sendAppendAll() {
+	for _, id := range r.cfg.Nodes {
+		if id != r.cfg.ID {
+			r.sendAppend(id)
+		}
+	}
+}
+
+func (r *Raft) handleAppendReq(m *RaftMessage) {
+	if m.Term < r.term {
+		r.send(m.From, &RaftMessage{Type: RaftAppendResp, Success: false, MatchIndex: r.lastIndex()})
+		return
+	}
+
+	// There is a leader for our term
+	if r.role != raftFollower {
+		r.role = raftFollower
+	}
+	newLeader := r.leader != m.From
+	r.leader = m.From
+	r.resetElectionTimer()
+	if newLeader {
+		r.forwardPending()
+	}
+
+	if m.PrevLogIndex > r.lastIndex() || r.log[m.PrevLogIndex].Term != m.PrevLogTerm {
+		// Our log does not match, the leader will retry with older entries
+		hint := r.lastIndex()
+		if m.PrevLogIndex <= hint {
+			hint = m.PrevLogIndex - 1
+		}
+		r.send(m.From, &RaftMessage{Type: RaftAppendResp, Success: false, MatchIndex: hint})
+		return
+	}
+
+	for i, e := range m.Entries {
+		idx := m.PrevLogIndex + 1 + uint64(i)
+		if idx <= r.lastIndex() {
+			if r.log[idx].Term == e.Term {
+				continue
+			}
+			// Conflicting entries are replaced by the ones of the leader
+			err := r.truncateLog(idx)
+			if err != nil {
+				r.halt(err)
+				return
+			}
+		}
+		err := r.appendLog(m.Entries[i:]...)
+		if err != nil {
+			r.halt(err)
+			return
+		}
+		break
+	}
+
+	lastNew := m.PrevLogIndex + uint64(len(m.Entries))
+	if m.LeaderCommit > r.commitIndex {
+		r.commitIndex = m.LeaderCommit
+		if r.commitIndex > lastNew {
+			r.commitIndex = lastNew
+		}
+		r.apply()
+	}
+
+	r.send(m.From, &RaftMessage{Type: RaftAppendResp, Success: true, MatchIndex: lastNew})
+}
+
+func (r *Raft) handleAppendResp(m *RaftMessage) {
+	if r.role != raftLeader || m.Term != r.term {
+		return
+	}
+
+	if m.Success {
+		if m.MatchIndex > r.matchIndex[m.From] {
+			r.matchIndex[m.From] = m.MatchIndex
+		}
+		r.nextIndex[m.From] = r.matchIndex[m.From] + 1
+		r.advanceCommit()
+		if r.nextIndex[m.From] <= r.lastIndex() {
+			r.sendAppend(m.From)
+		}
+		return
+	}
+
+	next := m.MatchIndex + 1
+	if next >= r.nextIndex[m.From] && r.nextIndex[m.From] > 1 {
+		next = r.nextIndex[m.From] - 1
+	}
+	r.nextIndex[m.From] = next
+	r.sendAppend(m.From)
+}
+
+// advanceCommit commits the entries replicated on a majority of the nodes
+func (r *Raft) advanceCommit() {
+	for idx := r.lastIndex(); idx > r.commitIndex; idx-- {
+		if r.log[idx].Term != r.term {
+			break
+		}
+		count := 1
+		for id, match := range r.matchIndex {
+			if id != r.cfg.ID && match >= idx {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commitIndex = idx
+			r.apply()
+			break
+		}
+	}
+}
+
+// apply applies the committed entries, in order
+func (r *Raft) apply() {
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		e := r.log[r.lastApplied]
+		if e.Data == nil {
+			continue
+		}
+
+		d := digestOf(e.Data)
+		if !r.executed[d] {
+			r.executed[d] = true
+			if r.cfg.Apply != nil {
+				r.cfg.Apply(r.lastApplied, e.Data)
+			}
+		}
+		delete(r.pending, d)
+		for _, w := range r.waiters[d] {
+			close(w)
+		}
+		delete(r.waiters, d)
+	}
+}
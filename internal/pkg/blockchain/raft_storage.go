@@ -0,0 +1,187 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A Raft node must not forget its term, its vote and its log when it
+// restarts, otherwise it could vote twice in the same term. The term and the
+// vote are rewritten atomically on every change, the log is a file of
+// JSON-encoded entries, one per line, which only grows except when entries
+// conflicting with the log of the leader are dropped.
+
+const (
+	raftStateFileName = "raft-state.json"
+	raftLogFileName   = "raft-log.jsonl"
+)
+
+type raftHardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+type raftStorage struct {
+	dir     string
+	logFile *os.File
+
+	// offsets[i] is the offset in the log file of the entry at index i+1
+	offsets []int64
+	size    int64
+}
+
+// openRaftStorage opens the storage of a directory and returns the state
+// and the entries it holds, starting at index 1
+func openRaftStorage(dir string) (*raftStorage, raftHardState, []RaftEntry, error) {
+	var state raftHardState
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, state, nil, fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+
+	statePath := filepath.Join(dir, raftStateFileName)
+	data, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return nil, state, nil, fmt.Errorf("invalid Raft state %s: %s", statePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, state, nil, err
+	}
+
+	logPath := filepath.Join(dir, raftLogFileName)
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, state, nil, err
+	}
+	s := &raftStorage{
+		dir:     dir,
+		logFile: f,
+	}
+
+	var entries []RaftEntry
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial entry is what is left of a crash while it was
+			// written, it was never acknowledged
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, state, nil, fmt.Errorf("failed to read %s: %s", logPath, err)
+		}
+		var e RaftEntry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			f.Close()
+			return nil, state, nil, fmt.Errorf("invalid entry %d in %s: %s", len(entries)+1, logPath, err)
+		}
+		entries = append(entries, e)
+		s.offsets = append(s.offsets, s.size)
+		s.size += int64(len(line))
+	}
+	err = f.Truncate(s.size)
+	if err == nil {
+		_, err = f.Seek(s.size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, state, nil, fmt.Errorf("failed to open %s: %s", logPath, err)
+	}
+
+	return s, state, entries, nil
+}
+
+func (s *raftStorage) close() error {
+	return s.logFile.Close()
+}
+
+// saveState atomically replaces the term and the vote
+func (s *raftStorage) saveState(state raftHardState) error {
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".raft-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, raftStateFileName))
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save Raft state: %s", err)
+	}
+	return nil
+}
+
+// truncate drops the entries starting at a given index
+func (s *raftStorage) truncate(index uint64) error {
+	if index > uint64(len(s.offsets)) {
+		return nil
+	}
+	size := s.offsets[index-1]
+	err := s.logFile.Truncate(size)
+	if err == nil {
+		_, err = s.logFile.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate Raft log: %s", err)
+	}
+	s.offsets = s.offsets[:index-1]
+	s.size = size
+	return nil
+}
+
+// append appends entries to the log, they are on disk when it returns
+func (s *raftStorage) append(entries []RaftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	var offsets []int64
+	for _, e := range entries {
+		line, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, s.size+int64(len(buf)))
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	_, err := s.logFile.Write(buf)
+	if err == nil {
+		err = s.logFile.Sync()
+	}
+	if err != nil {
+		// Drop what may have been written, the entries are not stored
+		s.logFile.Truncate(s.size)
+		s.logFile.Seek(s.size, io.SeekStart)
+		return fmt.Errorf("failed to append to Raft log: %s", err)
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(buf))
+	return nil
+}
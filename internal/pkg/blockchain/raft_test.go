@@ -0,0 +1,240 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type raftCluster struct {
+	ids   []string
+	nodes map[string]*Raft
+
+	lock    sync.Mutex
+	applied map[string][]string
+	crashed map[string]bool
+}
+
+type raftRouter struct {
+	c  *raftCluster
+	id string
+}
+
+func (t *raftRouter) Send(to string, m *RaftMessage) {
+	if t.c.isCrashed(t.id) || t.c.isCrashed(to) {
+		return
+	}
+	go t.c.nodes[to].HandleMessage(m)
+}
+
+func createRaftCluster(t *testing.T, size int) *raftCluster {
+	c := &raftCluster{
+		nodes:   make(map[string]*Raft),
+		applied: make(map[string][]string),
+		crashed: make(map[string]bool),
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node%d", i))
+	}
+
+	// Create all the nodes before any timer fires
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, id := range c.ids {
+		id := id
+		cfg := RaftConfig{
+			ID:              id,
+			Nodes:           c.ids,
+			ElectionTimeout: 150 * time.Millisecond,
+			Apply: func(index uint64, data []byte) {
+				c.lock.Lock()
+				defer c.lock.Unlock()
+				c.applied[id] = append(c.applied[id], string(data))
+			},
+		}
+		r, err := NewRaft(cfg, &raftRouter{c: c, id: id})
+		if err != nil {
+			t.Fatalf("failed to create node: %s", err)
+		}
+		c.nodes[id] = r
+	}
+
+	return c
+}
+
+func (c *raftCluster) isCrashed(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.crashed[id]
+}
+
+func (c *raftCluster) crash(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crashed[id] = true
+}
+
+func (c *raftCluster) restore(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.crashed, id)
+}
+
+func (c *raftCluster) getApplied(id string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.applied[id]...)
+}
+
+func (c *raftCluster) stop() {
+	for _, r := range c.nodes {
+		r.Stop()
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	c := createRaftCluster(t, 5)
+	defer c.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leaders := make(map[string]bool)
+		for _, id := range c.ids {
+			leaders[c.nodes[id].Leader()] = true
+		}
+		if len(leaders) == 1 && !leaders[""] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes did not agree on a leader: %v", leaders)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftLogRepair(t *testing.T) {
+	c := createRaftCluster(t, 5)
+	defer c.stop()
+
+	// node4 misses a few requests and must catch up once it is back
+	c.crash("node4")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		err := c.nodes["node0"].Propose(ctx, []byte(fmt.Sprintf("request %d", i)))
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+	}
+	if len(c.getApplied("node4")) != 0 {
+		t.Fatalf("crashed node applied requests")
+	}
+
+	c.restore("node4")
+	err := c.nodes["node1"].Propose(ctx, []byte("request 10"))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.getApplied("node4")) != 11 {
+		if time.Now().After(deadline) {
+			t.Fatalf("node4 applied %d requests instead of 11", len(c.getApplied("node4")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ref := c.getApplied("node0")
+	for i, data := range c.getApplied("node4") {
+		if data != ref[i] {
+			t.Fatalf("node4 applied %s instead of %s", data, ref[i])
+		}
+	}
+}
+
+// recordTransport keeps the messages sent by a node
+type recordTransport struct {
+	lock sync.Mutex
+	sent []*RaftMessage
+}
+
+func (t *recordTransport) Send(to string, m *RaftMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent = append(t.sent, m)
+}
+
+func (t *recordTransport) last() *RaftMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.sent) == 0 {
+		return nil
+	}
+	return t.sent[len(t.sent)-1]
+}
+
+func TestRaftRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := RaftConfig{
+		ID:              "node0",
+		Nodes:           []string{"node0", "node1", "node2"},
+		ElectionTimeout: time.Hour,
+		StateDir:        dir,
+	}
+	transport := &recordTransport{}
+	r, err := NewRaft(cfg, transport)
+	if err != nil {
+		t.Fatalf("failed to create node: %s", err)
+	}
+	r.HandleMessage(&RaftMessage{Type: RaftVoteReq, From: "node1", Term: 5})
+	if m := transport.last(); m == nil || !m.Granted {
+		t.Fatalf("vote not granted to node1")
+	}
+	entries := []RaftEntry{{Term: 5, Data: []byte("a")}, {Term: 5, Data: []byte("b")}, {Term: 5, Data: []byte("c")}}
+	r.HandleMessage(&RaftMessage{Type: RaftAppendReq, From: "node1", Term: 5, Entries: entries})
+	// A new leader replaces the last entry
+	r.HandleMessage(&RaftMessage{Type: RaftAppendReq, From: "node2", Term: 6, PrevLogIndex: 2, PrevLogTerm: 5, Entries: []RaftEntry{{Term: 6, Data: []byte("d")}}})
+	r.HandleMessage(&RaftMessage{Type: RaftVoteReq, From: "node2", Term: 6, LastLogIndex: 3, LastLogTerm: 6})
+	if m := transport.last(); m == nil || !m.Granted {
+		t.Fatalf("vote not granted to node2")
+	}
+	r.Stop()
+
+	// The restarted node remembers its term, its vote and its log
+	transport = &recordTransport{}
+	r, err = NewRaft(cfg, transport)
+	if err != nil {
+		t.Fatalf("failed to restart node: %s", err)
+	}
+	defer r.Stop()
+	if r.Term() != 6 {
+		t.Fatalf("term is %d instead of 6 after restart", r.Term())
+	}
+	r.HandleMessage(&RaftMessage{Type: RaftVoteReq, From: "node1", Term: 6, LastLogIndex: 10, LastLogTerm: 6})
+	if m := transport.last(); m == nil || m.Granted {
+		t.Fatalf("vote granted twice in term 6")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var data []string
+	for _, e := range r.log[1:] {
+		data = append(data, string(e.Data))
+	}
+	if strings.Join(data, "") != "abd" {
+		t.Fatalf("log is %v after restart", data)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+// Role is the role of a peer in the network
+type Role string
+
+const (
+	// RoleUnknown is the role of a peer we did not hear from yet
+	RoleUnknown Role = "unknown"
+
+	// RoleLeader is the role of the current leader of the network
+	RoleLeader Role = "leader"
+
+	// RolePeer is the role of all the nodes that are not the leader
+	RolePeer Role = "peer"
+)
+
+// PeerRecord gathers everything we know about a peer
+type PeerRecord struct {
+	// ID is the unique identifier of the node
+	ID string `json:"id"`
+
+	// URL is the address to use to connect to the peer
+	URL string `json:"url"`
+
+	// LastSeen is the last time we heard from or about the peer
+	LastSeen time.Time `json:"last_seen"`
+
+	// Role is the last known role of the peer
+	Role Role `json:"role"`
+
+	// PublicKey is the hex-encoded public key of the peer, if known
+	PublicKey string `json:"public_key,omitempty"`
+
+	// SignedAt is the time the peer signed its record
+	SignedAt time.Time `json:"signed_at,omitempty"`
+
+	// Signature is the hex-encoded signature of the ID, URL, public key and
+	// signing time by the key of the peer; only signed records can change
+	// where a known peer is reached and its key
+	Signature string `json:"signature,omitempty"`
+}
+
+// signedData returns the fields of a record its signature covers
+func (rec *PeerRecord) signedData() []byte {
+	data, _ := json.Marshal([]string{rec.ID, rec.URL, rec.PublicKey, rec.SignedAt.UTC().Format(time.RFC3339Nano)})
+	return data
+}
+
+// sign signs the record with the key of the peer, which becomes the public
+// key of the record
+func (rec *PeerRecord) sign(key ed25519.PrivateKey) {
+	rec.PublicKey = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	rec.SignedAt = time.Now().UTC()
+	rec.Signature = hex.EncodeToString(ed25519.Sign(key, rec.signedData()))
+}
+
+// verify checks that the record is signed with a hex-encoded public key
+func (rec *PeerRecord) verify(key string) error {
+	if rec.Signature == "" {
+		return fmt.Errorf("record of %s is not signed", rec.ID)
+	}
+	pub, err := hex.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key for %s", rec.ID)
+	}
+	sig, err := hex.DecodeString(rec.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), rec.signedData(), sig) {
+		return fmt.Errorf("invalid signature of the record of %s", rec.ID)
+	}
+	return nil
+}
+
+// Registry is the set of peers known to the local node, persisted in
+// the cache
+type Registry struct {
+	lock  sync.RWMutex
+	path  string
+	peers map[string]PeerRecord
+}
+
+// LoadRegistry loads the registry of peers from the cache; an empty
+// registry is returned when the cache does not have one yet
+func LoadRegistry(cacheBasedir string) (*Registry, error) {
+	r := &Registry{
+		path:  cache.GetPeersFile(cacheBasedir),
+		peers: make(map[string]PeerRecord),
+	}
+
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", r.path, err)
+	}
+
+	var records []PeerRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", r.path, err)
+	}
+	for _, rec := range records {
+		r.peers[rec.ID] = rec
+	}
+
+	return r, nil
+}
+
+// Save persists the registry to the cache
+func (r *Registry) Save() error {
+	data, err := json.MarshalIndent(r.List(), "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode registry: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(r.path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", filepath.Dir(r.path), err)
+	}
+
+	// Write to a temporary file first so the registry is never left
+	// half-written
+	tmpPath := r.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %s", tmpPath, err)
+	}
+	err = os.Rename(tmpPath, r.path)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s: %s", tmpPath, err)
+	}
+
+	return nil
+}
+
+// Update adds a peer to the registry or merges the record with what we
+// already know about the peer. It returns true if the registry changed.
+//
+// Only the peer itself can change its URL or its public key once known: the
+// record must be signed with the known key, or with the key of the record when
+// none is known yet, after the known record was. Times of the future are
+// taken as the current time so that a record cannot stay the most recent.
+func (r *Registry) Update(rec PeerRecord) bool {
+	if rec.ID == "" {
+		return false
+	}
+	if rec.Role == "" {
+		rec.Role = RoleUnknown
+	}
+	if now := time.Now(); rec.LastSeen.After(now) {
+		rec.LastSeen = now
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cur, ok := r.peers[rec.ID]
+	if !ok {
+		r.peers[rec.ID] = rec
+		return true
+	}
+
+	// Older information never overwrites more recent one
+	if !rec.LastSeen.After(cur.LastSeen) {
+		return false
+	}
+	key := cur.PublicKey
+	if key == "" {
+		key = rec.PublicKey
+	}
+	if !rec.SignedAt.After(cur.SignedAt) || rec.verify(key) != nil {
+		if cur.URL != "" || rec.URL == "" {
+			rec.URL = cur.URL
+		}
+		rec.PublicKey = cur.PublicKey
+		rec.SignedAt = cur.SignedAt
+		rec.Signature = cur.Signature
+	}
+	r.peers[rec.ID] = rec
+	return true
+}
+
+// Configure adds a peer of the local configuration to the registry, which is
+// trusted: its URL and public key replace the ones we know
+func (r *Registry) Configure(rec PeerRecord) {
+	if rec.ID == "" {
+		return
+	}
+	if rec.Role == "" {
+		rec.Role = RoleUnknown
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cur, ok := r.peers[rec.ID]
+	if ok && cur.URL == rec.URL && (rec.PublicKey == "" || cur.PublicKey == rec.PublicKey) {
+		// Keep the signature of the peer, which it may relay
+		rec.PublicKey = cur.PublicKey
+		rec.SignedAt = cur.SignedAt
+		rec.Signature = cur.Signature
+	}
+	r.peers[rec.ID] = rec
+}
+
+// Touch records that we just heard from a peer
+func (r *Registry) Touch(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rec, ok := r.peers[id]
+	if !ok {
+		return
+	}
+	rec.LastSeen = time.Now()
+	r.peers[id] = rec
+}
+
+// SetRole updates the role of a known peer
+func (r *Registry) SetRole(id string, role Role) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rec, ok := r.peers[id]
+	if !ok {
+		return
+	}
+	rec.Role = role
+	r.peers[id] = rec
+}
+
+// Get returns the record of a peer
+func (r *Registry) Get(id string) (PeerRecord, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	rec, ok := r.peers[id]
+	return rec, ok
+}
+
+// Remove removes a peer from the registry
+func (r *Registry) Remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.peers, id)
+}
+
+// List returns all the known peers, sorted by ID
+func (r *Registry) List() []PeerRecord {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var records []PeerRecord
+	for _, rec := range r.peers {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
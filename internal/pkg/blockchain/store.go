@@ -0,0 +1,733 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+// The blocks of a namespace are appended to segment files; every block is a
+// record made of a header, i.e., the size of the encoded block and its CRC32
+// (big endian), followed by the JSON encoding of the block. A new segment is
+// started once the current one reaches the maximum size.
+const (
+	segmentPrefix      = "blocks-"
+	segmentSuffix      = ".seg"
+	recordHeaderSize   = 8
+	defaultSegmentSize = 16 * 1024 * 1024
+)
+
+// The position of the blocks is kept in an index file next to the segments so
+// that opening a chain does not read all its blocks. An entry is made of the
+// segment, offset and size of a record, the hash of its block and the CRC32 of
+// the entry (big endian). The index is not synced: the entries that were lost
+// or torn are rebuilt from the records after the last indexed one.
+const (
+	indexName      = "blocks.idx"
+	indexHashSize  = 64
+	indexEntrySize = 4 + 8 + 4 + indexHashSize + 4
+)
+
+// recordPos locates a block in the segments of a chain
+type recordPos struct {
+	segment int
+	offset  int64
+	size    uint32
+}
+
+// end returns the offset following the record in its segment
+func (p recordPos) end() int64 {
+	return p.offset + recordHeaderSize + int64(p.size)
+}
+
+// chainStore is the on-disk chain of a namespace
+type chainStore struct {
+	dir       string
+	segments  int
+	current   *os.File
+	size      int64
+	indexFile *os.File
+
+	// index gives the position of the blocks by height, byHash their height
+	index  []recordPos
+	byHash map[string]uint64
+	head   *Block
+}
+
+// BlockStore is an append-only store of the chains of blocks of all the
+// namespaces, along with the content the blocks reference
+type BlockStore struct {
+	basedir     string
+	segmentSize int64
+
+	lock   sync.Mutex
+	chains map[string]*chainStore
+}
+
+var (
+	storesLock sync.Mutex
+	stores     = make(map[string]*BlockStore)
+)
+
+// OpenBlockStore opens the block store of a cache directory
+func OpenBlockStore(basedir string) (*BlockStore, error) {
+	err := os.MkdirAll(cache.GetDataDir(basedir), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", cache.GetDataDir(basedir), err)
+	}
+
+	return &BlockStore{
+		basedir:     basedir,
+		segmentSize: defaultSegmentSize,
+		chains:      make(map[string]*chainStore),
+	}, nil
+}
+
+// LocalBlockStore returns the block store of the local cache, see
+// cache.GetBasedir
+func LocalBlockStore() (*BlockStore, error) {
+	return sharedBlockStore(cache.GetBasedir())
+}
+
+// sharedBlockStore returns the block store of a cache directory, which is
+// opened only once
+func sharedBlockStore(basedir string) (*BlockStore, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	s, ok := stores[basedir]
+	if ok {
+		return s, nil
+	}
+	s, err := OpenBlockStore(basedir)
+	if err != nil {
+		return nil, err
+	}
+	stores[basedir] = s
+	return s, nil
+}
+
+// Close closes the files of the store
+func (s *BlockStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	for ns, c := range s.chains {
+		if c.current != nil {
+			cerr := c.current.Close()
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		if c.indexFile != nil {
+			cerr := c.indexFile.Close()
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		delete(s.chains, ns)
+	}
+	return err
+}
+
+func segmentPath(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+// syncDir makes the creation of a file in a directory persistent
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// chain returns the chain of a namespace, loading it from disk the first
+// time; s.lock must be held
+func (s *BlockStore) chain(namespace string) (*chainStore, error) {
+	c, ok := s.chains[namespace]
+	if ok {
+		return c, nil
+	}
+
+	err := cache.CheckNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	c = &chainStore{
+		dir:    cache.GetChainDir(s.basedir, namespace),
+		byHash: make(map[string]uint64),
+	}
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the chain of %s: %s", namespace, err)
+	}
+	s.chains[namespace] = c
+	return c, nil
+}
+
+// load indexes the segments of the chain; only the records after the last
+// entry of the index file are read, and a record that was only partially
+// written when the node crashed is truncated
+func (c *chainStore) load() error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var sizes []int64
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), segmentPrefix) && strings.HasSuffix(e.Name(), segmentSuffix) {
+			if e.Name() != filepath.Base(segmentPath(c.dir, len(sizes))) {
+				return fmt.Errorf("segment %d is missing", len(sizes))
+			}
+			sizes = append(sizes, e.Size())
+		}
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+	c.segments = len(sizes)
+
+	err = c.loadIndex(sizes)
+	if err != nil {
+		return err
+	}
+
+	var segment int
+	var offset int64
+	if n := len(c.index); n > 0 {
+		segment, offset = c.index[n-1].segment, c.index[n-1].end()
+	}
+	for i := segment; i < len(sizes); i++ {
+		if i > segment {
+			offset = 0
+		}
+		size, err := c.loadSegment(i, offset, i == len(sizes)-1)
+		if err != nil {
+			return err
+		}
+		c.size = size
+	}
+
+	return nil
+}
+
+// loadIndex loads the entries of the index file that match the segments,
+// given their sizes; the entries from the first one that does not are dropped
+func (c *chainStore) loadIndex(sizes []int64) error {
+	err := c.openIndex()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, indexName))
+	if err != nil {
+		return fmt.Errorf("failed to read the index: %s", err)
+	}
+
+	var hashes []string
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		pos, hash, ok := decodeIndexEntry(data[i : i+indexEntrySize])
+		if !ok || !c.follows(pos, sizes) {
+			break
+		}
+		c.index = append(c.index, pos)
+		hashes = append(hashes, hash)
+	}
+
+	// The entries cannot tell a stale index from the chain it is stored
+	// with, the last indexed block can
+	if n := len(c.index); n > 0 {
+		b, err := c.blockAt(uint64(n - 1))
+		if err != nil || b.h != hashes[n-1] || b.height != uint64(n-1) {
+			log.Printf("[WARN] rebuilding the index of %s, it does not match the segments", c.dir)
+			c.index = nil
+			hashes = nil
+		} else {
+			c.head = b
+		}
+	}
+	for height, hash := range hashes {
+		c.byHash[hash] = uint64(height)
+	}
+
+	if len(data) != len(c.index)*indexEntrySize {
+		err = c.indexFile.Truncate(int64(len(c.index)) * indexEntrySize)
+		if err != nil {
+			return fmt.Errorf("failed to truncate the index: %s", err)
+		}
+	}
+	return nil
+}
+
+// follows checks whether a record directly follows the last indexed one and
+// lies within the segments, given their sizes
+func (c *chainStore) follows(pos recordPos, sizes []int64) bool {
+	if pos.segment >= len(sizes) || pos.end() > sizes[pos.segment] {
+		return false
+	}
+	if len(c.index) == 0 {
+		return pos.segment == 0 && pos.offset == 0
+	}
+	last := c.index[len(c.index)-1]
+	if pos.segment == last.segment {
+		return pos.offset == last.end()
+	}
+	// A new segment is only started once the previous one is full
+	return pos.segment == last.segment+1 && pos.offset == 0 && last.end() == sizes[last.segment]
+}
+
+// loadSegment indexes the records of a segment from a given offset and
+// returns the size of its valid part
+func (c *chainStore) loadSegment(segment int, offset int64, last bool) (int64, error) {
+	path := segmentPath(c.dir, segment)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	for {
+		b, size, err := readRecord(f, offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, fmt.Errorf("segment %s is corrupted at offset %d: %s", path, offset, err)
+			}
+			// The node crashed while appending the last block, which was
+			// never committed
+			log.Printf("[WARN] truncating torn block at offset %d of %s: %s", offset, path, err)
+			err = os.Truncate(path, offset)
+			if err != nil {
+				return 0, fmt.Errorf("failed to truncate %s: %s", path, err)
+			}
+			return offset, nil
+		}
+
+		height := uint64(len(c.index))
+		if b.height != height {
+			return 0, fmt.Errorf("block %s at offset %d of %s has height %d instead of %d", b.h, offset, path, b.height, height)
+		}
+		c.addRecord(recordPos{segment: segment, offset: offset, size: size}, b.h)
+		c.head = b
+		offset += recordHeaderSize + int64(size)
+	}
+}
+
+// openIndex opens the index file of the chain if it is not open yet
+func (c *chainStore) openIndex() error {
+	if c.indexFile != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, indexName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the index: %s", err)
+	}
+	c.indexFile = f
+	return nil
+}
+
+// addRecord indexes the record of the next block of the chain; failing to
+// write the entry only means that it is rebuilt on the next load
+func (c *chainStore) addRecord(pos recordPos, hash string) {
+	height := uint64(len(c.index))
+	c.index = append(c.index, pos)
+	c.byHash[hash] = height
+
+	err := c.openIndex()
+	if err == nil {
+		_, err = c.indexFile.WriteAt(encodeIndexEntry(pos, hash), int64(height)*indexEntrySize)
+	}
+	if err != nil {
+		log.Printf("[WARN] failed to index block %s of %s: %s", hash, c.dir, err)
+	}
+}
+
+func encodeIndexEntry(pos recordPos, hash string) []byte {
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint32(entry[0:4], uint32(pos.segment))
+	binary.BigEndian.PutUint64(entry[4:12], uint64(pos.offset))
+	binary.BigEndian.PutUint32(entry[12:16], pos.size)
+	copy(entry[16:16+indexHashSize], hash)
+	binary.BigEndian.PutUint32(entry[16+indexHashSize:], crc32.ChecksumIEEE(entry[:16+indexHashSize]))
+	return entry
+}
+
+func decodeIndexEntry(entry []byte) (recordPos, string, bool) {
+	if crc32.ChecksumIEEE(entry[:16+indexHashSize]) != binary.BigEndian.Uint32(entry[16+indexHashSize:]) {
+		return recordPos{}, "", false
+	}
+	pos := recordPos{
+		segment: int(binary.BigEndian.Uint32(entry[0:4])),
+		offset:  int64(binary.BigEndian.Uint64(entry[4:12])),
+		size:    binary.BigEndian.Uint32(entry[12:16]),
+	}
+	hash := strings.TrimRight(string(entry[16:16+indexHashSize]), "\x00")
+	return pos, hash, true
+}
+
+// readRecord reads the record at a given offset of a segment; io.EOF is
+// returned when there is no record at all at that offset
+func readRecord(f *os.File, offset int64) (*Block, uint32, error) {
+	var header [recordHeaderSize]byte
+	n, err := f.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, 0, fmt.Errorf("truncated header")
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+
+	data := make([]byte, size)
+	n, _ = f.ReadAt(data, offset+recordHeaderSize)
+	if n < int(size) {
+		return nil, 0, fmt.Errorf("truncated block")
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	var b Block
+	err = json.Unmarshal(data, &b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &b, size, nil
+}
+
+// append writes a block at the end of the chain and syncs it to disk
+func (c *chainStore) append(b *Block, segmentSize int64) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	if c.current == nil || c.size >= segmentSize {
+		err := c.openSegment(c.size >= segmentSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+
+	_, err = c.current.WriteAt(record, c.size)
+	if err == nil {
+		err = c.current.Sync()
+	}
+	if err != nil {
+		// Whatever was written is not part of the chain
+		c.current.Truncate(c.size)
+		return fmt.Errorf("failed to write block %s: %s", b.h, err)
+	}
+
+	c.addRecord(recordPos{segment: c.segments - 1, offset: c.size, size: uint32(len(data))}, b.h)
+	// The caller may reuse the block
+	head := *b
+	c.head = &head
+	c.size += int64(len(record))
+	return nil
+}
+
+// openSegment opens the last segment for writing, or starts a new one
+func (c *chainStore) openSegment(next bool) error {
+	if c.current != nil {
+		c.current.Close()
+		c.current = nil
+	}
+	if next || c.segments == 0 {
+		err := os.MkdirAll(c.dir, 0700)
+		if err != nil {
+			return err
+		}
+		c.segments++
+		c.size = 0
+	}
+
+	path := segmentPath(c.dir, c.segments-1)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = syncDir(c.dir)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.current = f
+	return nil
+}
+
+// Append adds a block at the end of the chain of its namespace; the block
+// must be linked to the current head of the chain
+func (s *BlockStore) Append(b *Block) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.chain(b.namespace)
+	if err != nil {
+		return err
+	}
+
+	height := uint64(len(c.index))
+	if b.height != height {
+		return fmt.Errorf("block %s has height %d instead of %d", b.h, b.height, height)
+	}
+	if c.head != nil && b.prev != c.head.h {
+		return fmt.Errorf("block %s is not linked to the head %s of namespace %s", b.h, c.head.h, b.namespace)
+	}
+	if c.head == nil && b.prev != "" {
+		return fmt.Errorf("first block %s of namespace %s is linked to %s", b.h, b.namespace, b.prev)
+	}
+	if _, ok := c.byHash[b.h]; ok {
+		return fmt.Errorf("block %s is already in namespace %s", b.h, b.namespace)
+	}
+
+	return c.append(b, s.segmentSize)
+}
+
+// Truncate removes the blocks of the chain of a namespace from a given
+// height, e.g., to drop a fork
+func (s *BlockStore) Truncate(namespace string, height uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.chain(namespace)
+	if err != nil {
+		return err
+	}
+	if height >= uint64(len(c.index)) {
+		return nil
+	}
+	return c.truncate(height)
+}
+
+// truncate removes the blocks from a given height
+func (c *chainStore) truncate(height uint64) error {
+	pos := c.index[height]
+	if c.current != nil {
+		c.current.Close()
+		c.current = nil
+	}
+
+	// The index is truncated first so that it never has entries for blocks
+	// that were dropped
+	err := c.openIndex()
+	if err == nil {
+		err = c.indexFile.Truncate(int64(height) * indexEntrySize)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate chain: %s", err)
+	}
+	err = os.Truncate(segmentPath(c.dir, pos.segment), pos.offset)
+	if err != nil {
+		return fmt.Errorf("failed to truncate chain: %s", err)
+	}
+	for i := pos.segment + 1; i < c.segments; i++ {
+		err := os.Remove(segmentPath(c.dir, i))
+		if err != nil {
+			return fmt.Errorf("failed to truncate chain: %s", err)
+		}
+	}
+	err = syncDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to truncate chain: %s", err)
+	}
+
+	for h, ht := range c.byHash {
+		if ht >= height {
+			delete(c.byHash, h)
+		}
+	}
+	c.index = c.index[:height]
+	c.segments = pos.segment + 1
+	c.size = pos.offset
+	c.head = nil
+	if height > 0 {
+		c.head, err = c.blockAt(height - 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Head returns the last block of the chain of a namespace, nil if the chain
+// is empty
+func (s *BlockStore) Head(namespace string) (*Block, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.chain(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return c.head, nil
+}
+
+// Len returns the number of blocks in the chain of a namespace
+func (s *BlockStore) Len(namespace string) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.chain(namespace)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(c.index)), nil
+}
+
+// BlockAt returns the block at a given height of the chain of a namespace
+func (s *BlockStore) BlockAt(namespace string, height uint64) (*Block, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.chain(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if height >= uint64(len(c.index)) {
+		return nil, fmt.Errorf("no block at height %d in namespace %s", height, namespace)
+	}
+
+	b, err := c.blockAt(height)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %d of namespace %s: %s", height, namespace, err)
+	}
+	return b, nil
+}
+
+// blockAt reads the block at a given height of the chain
+func (c *chainStore) blockAt(height uint64) (*Block, error) {
+	pos := c.index[height]
+	f, err := os.Open(segmentPath(c.dir, pos.segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, _, err := readRecord(f, pos.offset)
+	return b, err
+}
+
+// BlockByHash returns a block of the chain of a namespace from its hash
+func (s *BlockStore) BlockByHash(namespace string, hash string) (*Block, error) {
+	s.lock.Lock()
+	c, err := s.chain(namespace)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	height, ok := c.byHash[hash]
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no block %s in namespace %s", hash, namespace)
+	}
+	return s.BlockAt(namespace, height)
+}
+
+/* Content-addressed storage */
+
+// ObjectPath returns the path where the content with a given SHA-256 hash is
+// stored
+func (s *BlockStore) ObjectPath(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(cache.GetDataDir(s.basedir), hash)
+	}
+	return filepath.Join(cache.GetDataDir(s.basedir), hash[:2], hash)
+}
+
+// HasObject checks whether the content with a given hash is stored
+func (s *BlockStore) HasObject(hash string) bool {
+	_, err := os.Stat(s.ObjectPath(hash))
+	return err == nil
+}
+
+// ManifestPath returns the path to the stored copy of a manifest, an empty
+// string if it is not stored; it is meant to be used as the ManifestPath
+// function of VerifyOptions
+func (s *BlockStore) ManifestPath(name string, hash string) string {
+	if !s.HasObject(hash) {
+		return ""
+	}
+	return s.ObjectPath(hash)
+}
+
+// PutObject stores some content and returns its SHA-256 hash, which is the
+// key to get it back; storing the same content twice is a no-op
+func (s *BlockStore) PutObject(r io.Reader) (string, error) {
+	dataDir := cache.GetDataDir(s.basedir)
+	tmp, err := ioutil.TempFile(dataDir, ".object-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write object: %s", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	path := s.ObjectPath(hash)
+	if s.HasObject(hash) {
+		return hash, nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %s", filepath.Dir(path), err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", fmt.Errorf("failed to store object %s: %s", hash, err)
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to store object %s: %s", hash, err)
+	}
+
+	return hash, nil
+}
+
+// PutFile stores the content of a file, see PutObject
+func (s *BlockStore) PutFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.PutObject(f)
+}
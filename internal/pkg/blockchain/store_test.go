@@ -0,0 +1,350 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// testKeyPair signs the test blocks
+var testKeyPair = func() keys.KeyPair {
+	priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	return keys.KeyPair{Public: priv.Public().(ed25519.PublicKey), Private: priv}
+}()
+
+func trustTestKey(key ed25519.PublicKey) bool {
+	return bytes.Equal(key, testKeyPair.Public)
+}
+
+// createTestBlocks creates a chain of blocks, starting with a genesis block,
+// without committing them
+func createTestBlocks(t *testing.T, namespace string, count int) []*Block {
+	return extendTestBlocks(t, nil, namespace, count)
+}
+
+// extendTestBlocks returns a copy of a chain of blocks with new blocks at the
+// end
+func extendTestBlocks(t *testing.T, chain []*Block, namespace string, count int) []*Block {
+	blocks := append([]*Block(nil), chain...)
+	for i := 0; i < count; i++ {
+		b := &Block{
+			namespace: namespace,
+			height:    uint64(len(blocks)),
+			timestamp: time.Now().UTC(),
+		}
+		if len(blocks) == 0 {
+			b.genesis = &NamespaceInfo{
+				ID:         namespace,
+				Creator:    "node0",
+				Created:    b.timestamp,
+				Consensus:  ConsensusPBFT,
+				Difficulty: defaultDifficulty,
+			}
+		} else {
+			b.prev = blocks[len(blocks)-1].h
+			b.stamps = []hashcash.Stamp{hashcash.Create("127.0.0.1")}
+		}
+		err := b.hash()
+		if err != nil {
+			t.Fatalf("failed to hash block: %s", err)
+		}
+		b.sign(testKeyPair)
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func openTestStore(t *testing.T, dir string) *BlockStore {
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	return s
+}
+
+func checkStoredChain(t *testing.T, s *BlockStore, namespace string, blocks []*Block) {
+	n, err := s.Len(namespace)
+	if err != nil || n != uint64(len(blocks)) {
+		t.Fatalf("chain has %d blocks instead of %d (%v)", n, len(blocks), err)
+	}
+	for i, expected := range blocks {
+		b, err := s.BlockAt(namespace, uint64(i))
+		if err != nil {
+			t.Fatalf("failed to get block %d: %s", i, err)
+		}
+		if b.h != expected.h || b.computeHash() != expected.h {
+			t.Fatalf("block %d does not match the stored block", i)
+		}
+		b, err = s.BlockByHash(namespace, expected.h)
+		if err != nil || b.height != uint64(i) {
+			t.Fatalf("failed to get block %d by hash: %v", i, err)
+		}
+	}
+	head, err := s.Head(namespace)
+	if err != nil {
+		t.Fatalf("failed to get head: %s", err)
+	}
+	if len(blocks) > 0 && (head == nil || head.h != blocks[len(blocks)-1].h) {
+		t.Fatalf("invalid head")
+	}
+}
+
+func TestBlockStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := openTestStore(t, dir)
+	// Every block gets its own segment
+	s.segmentSize = 1
+	blocks := createTestBlocks(t, "test", 5)
+	for _, b := range blocks {
+		err := s.Append(b)
+		if err != nil {
+			t.Fatalf("failed to append block: %s", err)
+		}
+	}
+	checkStoredChain(t, s, "test", blocks)
+
+	// Blocks must be linked to the head
+	others := createTestBlocks(t, "test", 6)
+	err = s.Append(others[5])
+	if err == nil {
+		t.Fatalf("block not linked to the head was appended")
+	}
+	err = s.Append(blocks[4])
+	if err == nil {
+		t.Fatalf("block appended twice")
+	}
+	err = s.Append(&Block{namespace: "../test"})
+	if err == nil {
+		t.Fatalf("block appended to an invalid namespace")
+	}
+
+	s.Close()
+	s = openTestStore(t, dir)
+	defer s.Close()
+	checkStoredChain(t, s, "test", blocks)
+	segments, _ := filepath.Glob(filepath.Join(cache.GetChainDir(dir, "test"), "*.seg"))
+	if len(segments) != 5 {
+		t.Fatalf("%d segments instead of 5", len(segments))
+	}
+}
+
+func TestBlockStoreRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := openTestStore(t, dir)
+	blocks := createTestBlocks(t, "test", 4)
+	for _, b := range blocks[:3] {
+		err := s.Append(b)
+		if err != nil {
+			t.Fatalf("failed to append block: %s", err)
+		}
+	}
+	s.Close()
+
+	// The node crashed while writing the fourth block
+	path := segmentPath(cache.GetChainDir(dir, "test"), 0)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("failed to open segment: %s", err)
+	}
+	f.Write([]byte{0, 0, 4, 0, 1, 2, 3, 4, '{', '"'})
+	f.Close()
+
+	s = openTestStore(t, dir)
+	checkStoredChain(t, s, "test", blocks[:3])
+	err = s.Append(blocks[3])
+	if err != nil {
+		t.Fatalf("failed to append block after recovery: %s", err)
+	}
+	s.Close()
+
+	s = openTestStore(t, dir)
+	checkStoredChain(t, s, "test", blocks)
+	s.Close()
+
+	// A corrupted last block is dropped as well
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read segment: %s", err)
+	}
+	data[len(data)-2] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatalf("failed to write segment: %s", err)
+	}
+	s = openTestStore(t, dir)
+	defer s.Close()
+	checkStoredChain(t, s, "test", blocks[:3])
+}
+
+func TestBlockStoreIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := openTestStore(t, dir)
+	s.segmentSize = 1
+	blocks := createTestBlocks(t, "test", 5)
+	for _, b := range blocks {
+		err := s.Append(b)
+		if err != nil {
+			t.Fatalf("failed to append block: %s", err)
+		}
+	}
+	s.Close()
+
+	chainDir := cache.GetChainDir(dir, "test")
+	indexPath := filepath.Join(chainDir, indexName)
+	checkIndexSize := func(count int) {
+		fi, err := os.Stat(indexPath)
+		if err != nil || fi.Size() != int64(count*indexEntrySize) {
+			t.Fatalf("index does not have %d entries (%v)", count, err)
+		}
+	}
+	checkIndexSize(5)
+
+	// Only the blocks after the last indexed one are read when the chain is
+	// loaded, a corrupted block in the middle goes unnoticed
+	path := segmentPath(chainDir, 2)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read segment: %s", err)
+	}
+	err = ioutil.WriteFile(path, append([]byte{0xff}, data[1:]...), 0600)
+	if err != nil {
+		t.Fatalf("failed to write segment: %s", err)
+	}
+	s = openTestStore(t, dir)
+	n, err := s.Len("test")
+	if err != nil || n != 5 {
+		t.Fatalf("chain has %d blocks instead of 5 (%v)", n, err)
+	}
+	s.Close()
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatalf("failed to write segment: %s", err)
+	}
+
+	// A missing or torn index is rebuilt from the segments
+	err = os.Remove(indexPath)
+	if err != nil {
+		t.Fatalf("failed to remove index: %s", err)
+	}
+	s = openTestStore(t, dir)
+	checkStoredChain(t, s, "test", blocks)
+	s.Close()
+	checkIndexSize(5)
+
+	err = os.Truncate(indexPath, 2*indexEntrySize+10)
+	if err != nil {
+		t.Fatalf("failed to truncate index: %s", err)
+	}
+	s = openTestStore(t, dir)
+	checkStoredChain(t, s, "test", blocks)
+	s.Close()
+	checkIndexSize(5)
+
+	// The index follows the truncation of the chain
+	s = openTestStore(t, dir)
+	err = s.Truncate("test", 3)
+	if err != nil {
+		t.Fatalf("failed to truncate chain: %s", err)
+	}
+	checkIndexSize(3)
+	others := extendTestBlocks(t, blocks[:3], "test", 2)
+	for _, b := range others[3:] {
+		err := s.Append(b)
+		if err != nil {
+			t.Fatalf("failed to append block: %s", err)
+		}
+	}
+	s.Close()
+	s = openTestStore(t, dir)
+	checkStoredChain(t, s, "test", others)
+	s.Close()
+
+	// An index that does not match the segments is dropped
+	stale, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatalf("failed to read index: %s", err)
+	}
+	s = openTestStore(t, dir)
+	err = s.Truncate("test", 4)
+	if err != nil {
+		t.Fatalf("failed to truncate chain: %s", err)
+	}
+	replaced := extendTestBlocks(t, others[:4], "test", 1)
+	err = s.Append(replaced[4])
+	if err != nil {
+		t.Fatalf("failed to append block: %s", err)
+	}
+	s.Close()
+	err = ioutil.WriteFile(indexPath, stale, 0600)
+	if err != nil {
+		t.Fatalf("failed to write index: %s", err)
+	}
+	s = openTestStore(t, dir)
+	defer s.Close()
+	checkStoredChain(t, s, "test", replaced)
+}
+
+func TestBlockStoreObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := openTestStore(t, dir)
+	defer s.Close()
+
+	content := "manifest content"
+	hash1, err := s.PutObject(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to store object: %s", err)
+	}
+	hash2, err := s.PutObject(bytes.NewReader([]byte(content)))
+	if err != nil {
+		t.Fatalf("failed to store object: %s", err)
+	}
+	if hash1 != hash2 || !s.HasObject(hash1) {
+		t.Fatalf("same content stored under different keys: %s %s", hash1, hash2)
+	}
+	data, err := ioutil.ReadFile(s.ObjectPath(hash1))
+	if err != nil || string(data) != content {
+		t.Fatalf("invalid object content: %q (%v)", data, err)
+	}
+	if s.HasObject(strings.Repeat("0", 64)) {
+		t.Fatalf("unknown object is stored")
+	}
+
+	entries, _ := ioutil.ReadDir(cache.GetDataDir(dir))
+	if len(entries) != 1 {
+		t.Fatalf("temporary files were left behind")
+	}
+}
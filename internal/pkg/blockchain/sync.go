@@ -0,0 +1,463 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// The synchronization protocol lets a node catch up with a peer, typically
+// the leader: the node gets the head of the chain of the peer with a
+// NSUPDATEMSG request, finds the last block both chains have in common and
+// gets the missing blocks in ranges with BLOCKSMSG requests. Blocks are
+// verified before being appended; their stamps must not be spent yet and are
+// spent once the blocks are appended. When the chains diverge, the longest
+// chain wins: the local blocks after the last common block are only dropped
+// in favor of the ones of the peer when the chain of the peer is longer, once
+// all of them are verified, and the stamps of the dropped blocks are not
+// spent anymore. A peer serving a fork that is not longer than the local chain
+// is ignored.
+
+const (
+	// BLOCKSMSG is a request for a range of blocks of a namespace
+	BLOCKSMSG = "BLKS"
+
+	// maxBlocksPerRange is the maximum number of blocks in a BLOCKSMSG
+	// response
+	maxBlocksPerRange = 64
+)
+
+func init() {
+	comm.RegisterMsgType(BLOCKSMSG)
+}
+
+// ChainStatus is the response to a NSUPDATEMSG request: the head of the
+// chain of a namespace
+type ChainStatus struct {
+	Namespace string `json:"namespace"`
+	Exists    bool   `json:"exists"`
+	Height    uint64 `json:"height"`
+	Hash      string `json:"hash"`
+	Error     string `json:"error,omitempty"`
+}
+
+// blockRange is the payload of a BLOCKSMSG request
+type blockRange struct {
+	Namespace string `json:"namespace"`
+	From      uint64 `json:"from"`
+	Count     uint64 `json:"count"`
+}
+
+// blocksResp is the response to a BLOCKSMSG request
+type blocksResp struct {
+	Blocks []*Block `json:"blocks"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// SyncServer serves the chains of a block store to the peers
+type SyncServer struct {
+	store *BlockStore
+}
+
+// NewSyncServer returns a server for the chains of a block store
+func NewSyncServer(store *BlockStore) *SyncServer {
+	return &SyncServer{
+		store: store,
+	}
+}
+
+// Register registers the handlers of the server in a mux
+func (s *SyncServer) Register(mux *comm.HandlerMux) error {
+	err := mux.Handle(NSUPDATEMSG, s.HandleNamespaceUpdate)
+	if err == nil {
+		err = mux.Handle(NSLISTMSG, s.HandleNamespaceList)
+	}
+	if err != nil {
+		return err
+	}
+	return mux.Handle(BLOCKSMSG, s.HandleBlocks)
+}
+
+// Announce sends the list of our namespaces to a peer; it is meant to be used
+// as the OnConnect function of the server of the leader
+func (s *SyncServer) Announce(peer *comm.PeerInfo) error {
+	return sendListNamespaces(peer, s.store)
+}
+
+// HandleNamespaceList handles a NSLISTMSG request from a peer, e.g., a node
+// joining the network after namespaces were created
+func (s *SyncServer) HandleNamespaceList(peer *comm.PeerInfo, msg comm.Message) {
+	descs, err := describeNamespaces(s.store)
+	if err != nil {
+		log.Printf("[ERROR] failed to get the list of namespaces: %s", err)
+		return
+	}
+	payload, err := json.Marshal(descs)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode the list of namespaces: %s", err)
+		return
+	}
+	err = peer.Reply(msg, NSLISTMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to %s: %s", peer.URL, err)
+	}
+}
+
+// HandleNamespaceUpdate handles a NSUPDATEMSG request from a peer
+func (s *SyncServer) HandleNamespaceUpdate(peer *comm.PeerInfo, msg comm.Message) {
+	status := ChainStatus{
+		Namespace: string(msg.Payload),
+	}
+	head, err := s.store.Head(status.Namespace)
+	if err != nil {
+		status.Error = err.Error()
+	} else if head != nil {
+		status.Exists = true
+		status.Height = head.height
+		status.Hash = head.h
+	}
+
+	payload, err := json.Marshal(&status)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode status of namespace %s: %s", status.Namespace, err)
+		return
+	}
+	err = peer.Reply(msg, NSUPDATEMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to %s: %s", peer.URL, err)
+	}
+}
+
+// HandleBlocks handles a BLOCKSMSG request from a peer
+func (s *SyncServer) HandleBlocks(peer *comm.PeerInfo, msg comm.Message) {
+	var resp blocksResp
+	var r blockRange
+	err := json.Unmarshal(msg.Payload, &r)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %s", err)
+	} else {
+		resp.Blocks, err = s.blocks(r)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	payload, err := json.Marshal(&resp)
+	if err != nil {
+		log.Printf("[ERROR] unable to encode blocks of namespace %s: %s", r.Namespace, err)
+		return
+	}
+	err = peer.Reply(msg, BLOCKSMSG, payload)
+	if err != nil {
+		log.Printf("[ERROR] failed to reply to %s: %s", peer.URL, err)
+	}
+}
+
+func (s *SyncServer) blocks(r blockRange) ([]*Block, error) {
+	n, err := s.store.Len(r.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if r.Count > maxBlocksPerRange {
+		r.Count = maxBlocksPerRange
+	}
+
+	var blocks []*Block
+	for h := r.From; h < n && h < r.From+r.Count; h++ {
+		b, err := s.store.BlockAt(r.Namespace, h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// reqChainStatus gets the head of the chain of a namespace from a peer
+func reqChainStatus(peer *comm.PeerInfo, namespace string) (ChainStatus, error) {
+	resp, err := peer.Request(NSUPDATEMSG, []byte(namespace), requestTimeout)
+	if err != nil {
+		return ChainStatus{}, err
+	}
+	return parseChainStatus(resp)
+}
+
+func parseChainStatus(resp comm.Message) (ChainStatus, error) {
+	var status ChainStatus
+	err := json.Unmarshal(resp.Payload, &status)
+	if err != nil {
+		return status, fmt.Errorf("%w: invalid chain status: %s", comm.ErrProtocol, err)
+	}
+	if status.Error != "" {
+		return status, fmt.Errorf("peer failed to get the status of namespace %s: %s", status.Namespace, status.Error)
+	}
+	return status, nil
+}
+
+// reqBlocks gets a range of blocks of a namespace from a peer
+func reqBlocks(peer *comm.PeerInfo, namespace string, from uint64, count uint64) ([]*Block, error) {
+	payload, err := json.Marshal(&blockRange{
+		Namespace: namespace,
+		From:      from,
+		Count:     count,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peer.Request(BLOCKSMSG, payload, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks blocksResp
+	err = json.Unmarshal(resp.Payload, &blocks)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid blocks: %s", comm.ErrProtocol, err)
+	}
+	if blocks.Error != "" {
+		return nil, fmt.Errorf("peer failed to get blocks of namespace %s: %s", namespace, blocks.Error)
+	}
+	if len(blocks.Blocks) == 0 {
+		return nil, fmt.Errorf("peer has no block from height %d in namespace %s", from, namespace)
+	}
+	return blocks.Blocks, nil
+}
+
+// commonAncestor returns the number of blocks the local chain of a namespace
+// has in common with the chain of a peer, which is remoteLen blocks long
+func commonAncestor(peer *comm.PeerInfo, store *BlockStore, namespace string, localLen uint64, remoteLen uint64) (uint64, error) {
+	top := localLen
+	if remoteLen < top {
+		top = remoteLen
+	}
+
+	for top > 0 {
+		from := uint64(0)
+		if top > maxBlocksPerRange {
+			from = top - maxBlocksPerRange
+		}
+		remote, err := reqBlocks(peer, namespace, from, top-from)
+		if err != nil {
+			return 0, err
+		}
+		for h := top; h > from; h-- {
+			if h-1-from >= uint64(len(remote)) {
+				continue
+			}
+			local, err := store.BlockAt(namespace, h-1)
+			if err != nil {
+				return 0, err
+			}
+			// The hash claimed by the peer is not trusted, the block
+			// must have the content of the local one
+			if local.h == remote[h-1-from].computeHash() {
+				return h, nil
+			}
+		}
+		top = from
+	}
+
+	if localLen > 0 {
+		return 0, fmt.Errorf("the chain of namespace %s has a different genesis block", namespace)
+	}
+	return 0, nil
+}
+
+// forkChain is the chain of a namespace as it would be after a sync: the
+// local blocks up to the last common block followed by the blocks of the peer
+type forkChain struct {
+	store     *BlockStore
+	namespace string
+	common    uint64
+	blocks    []*Block
+}
+
+func (c *forkChain) Len(namespace string) (uint64, error) {
+	return c.common + uint64(len(c.blocks)), nil
+}
+
+func (c *forkChain) BlockAt(namespace string, height uint64) (*Block, error) {
+	if height < c.common {
+		return c.store.BlockAt(namespace, height)
+	}
+	if height-c.common >= uint64(len(c.blocks)) {
+		return nil, fmt.Errorf("no block at height %d in namespace %s", height, namespace)
+	}
+	return c.blocks[height-c.common], nil
+}
+
+// syncFrom brings the local chain of a namespace up to date with the chain of
+// a peer whose head is known; it returns the number of blocks added
+func syncFrom(peer *comm.PeerInfo, store *BlockStore, status ChainStatus, opts VerifyOptions) (int, error) {
+	if !status.Exists {
+		// Nothing to get from the peer
+		return 0, cache.MarkClean(store.basedir, status.Namespace)
+	}
+	namespace := status.Namespace
+	err := opts.setDefaults(store.basedir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Local blocks cannot be committed while the chain changes under them
+	commitLock.Lock()
+	defer commitLock.Unlock()
+
+	err = cache.MarkDirty(store.basedir, namespace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark namespace %s as dirty: %s", namespace, err)
+	}
+
+	localLen, err := store.Len(namespace)
+	if err != nil {
+		return 0, err
+	}
+	remoteLen := status.Height + 1
+	common, err := commonAncestor(peer, store, namespace, localLen, remoteLen)
+	if err != nil {
+		return 0, err
+	}
+	if common == remoteLen {
+		// We have all the blocks of the peer, maybe more
+		return 0, cache.MarkClean(store.basedir, namespace)
+	}
+	// When the chains diverge, the blocks of the peer are all fetched and
+	// verified before any local block is dropped: a peer serving an invalid
+	// fork must not be able to destroy the local chain. Otherwise, blocks are
+	// appended as they are verified.
+	replace := common < localLen
+	if replace && remoteLen <= localLen {
+		return 0, fmt.Errorf("%s serves a fork of namespace %s that is not longer than the local chain (%d blocks instead of %d)", peer.URL, namespace, remoteLen, localLen)
+	}
+	fork := &forkChain{
+		store:     store,
+		namespace: namespace,
+		common:    common,
+	}
+	var prev *Block
+	if common > 0 {
+		prev, err = store.BlockAt(namespace, common-1)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// dropped are the stamps of the local blocks the fork would replace:
+	// they are spent locally but the blocks of the peer may spend them again
+	var dropped []*hashcash.Stamp
+	droppedKeys := make(map[string]bool)
+	for h := common; replace && h < localLen; h++ {
+		b, err := store.BlockAt(namespace, h)
+		if err != nil {
+			return 0, err
+		}
+		for i := range b.stamps {
+			dropped = append(dropped, &b.stamps[i])
+			droppedKeys[b.stamps[i].Serialize()] = true
+		}
+	}
+
+	added := 0
+	// spent maps the stamps of the blocks of the peer to their height
+	spent := make(map[string]uint64)
+	difficulty := newDifficultyTracker(fork, namespace)
+	for next := common; next < remoteLen; {
+		count := remoteLen - next
+		if count > maxBlocksPerRange {
+			count = maxBlocksPerRange
+		}
+		blocks, err := reqBlocks(peer, namespace, next, count)
+		if err != nil {
+			return added, err
+		}
+		if uint64(len(blocks)) > count {
+			blocks = blocks[:count]
+		}
+		for _, b := range blocks {
+			reason := verifyBlock(b, prev, next, namespace, difficulty, &opts)
+			for i := 0; reason == "" && i < len(b.stamps); i++ {
+				key := b.stamps[i].Serialize()
+				if h, ok := spent[key]; ok {
+					reason = fmt.Sprintf("stamp %d was already spent in block %d", i, h)
+					break
+				}
+				spent[key] = next
+				if droppedKeys[key] {
+					continue
+				}
+				isSpent, err := b.stamps[i].IsSpent()
+				if err != nil {
+					return added, err
+				}
+				if isSpent {
+					reason = fmt.Sprintf("stamp %d: %s", i, hashcash.HashCashSpentErr)
+				}
+			}
+			if reason != "" {
+				return added, &VerifyError{
+					Namespace: namespace,
+					Height:    next,
+					Hash:      b.h,
+					Reason:    reason,
+				}
+			}
+			fork.blocks = append(fork.blocks, b)
+			if !replace {
+				err := store.Append(b)
+				if err != nil {
+					return added, err
+				}
+				spendStamps(b.stamps)
+				added++
+			}
+			prev = b
+			next++
+		}
+	}
+	if prev == nil || prev.h != status.Hash {
+		return added, fmt.Errorf("chain of namespace %s does not end with the head %s announced by %s", namespace, status.Hash, peer.URL)
+	}
+
+	if replace {
+		log.Printf("[WARN] dropping %d blocks of namespace %s that are not in the chain of %s", localLen-common, namespace, peer.URL)
+		err := store.Truncate(namespace, common)
+		if err != nil {
+			return 0, err
+		}
+		// The stamps of the dropped blocks that are not in the fork can
+		// be submitted again
+		err = hashcash.Unspend(dropped...)
+		if err != nil {
+			log.Printf("[WARN] failed to remove the stamps of the dropped blocks from the spent database: %s", err)
+		}
+		for _, b := range fork.blocks {
+			err := store.Append(b)
+			if err != nil {
+				return added, err
+			}
+			spendStamps(b.stamps)
+			added++
+		}
+	}
+
+	return added, cache.MarkClean(store.basedir, namespace)
+}
+
+// SyncNamespace brings the local chain of a namespace up to date with the
+// chain of a peer, checking the blocks with the given options; it returns the
+// number of blocks added
+func SyncNamespace(peer *comm.PeerInfo, store *BlockStore, namespace string, opts VerifyOptions) (int, error) {
+	status, err := reqChainStatus(peer, namespace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the status of namespace %s: %w", namespace, err)
+	}
+	return syncFrom(peer, store, status, opts)
+}
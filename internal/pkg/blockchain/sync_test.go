@@ -0,0 +1,457 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/comm"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
+
+// The test stamps are not minted
+var syncTestOptions = VerifyOptions{
+	CheckStamp: func(*Block, int) error { return nil },
+	TrustedKey: trustTestKey,
+}
+
+type syncTestNodes struct {
+	leader        *testNode
+	follower      *testNode
+	leaderStore   *BlockStore
+	followerStore *BlockStore
+	peer          *comm.PeerInfo
+	restoreCache  func()
+}
+
+// createSyncTestNodes creates a leader serving its chains and a follower
+// connected to it; the cache of the follower is the local cache, where the
+// stamps of the synced blocks are spent
+func createSyncTestNodes(t *testing.T) *syncTestNodes {
+	network := comm.NewMemNetwork()
+	n := &syncTestNodes{
+		leader:   createTestNode(t, network, "leader"),
+		follower: createTestNode(t, network, "follower"),
+	}
+	prev, isSet := os.LookupEnv(cache.CacheLocalationEnvDir)
+	os.Setenv(cache.CacheLocalationEnvDir, n.follower.dir)
+	n.restoreCache = func() {
+		if isSet {
+			os.Setenv(cache.CacheLocalationEnvDir, prev)
+		} else {
+			os.Unsetenv(cache.CacheLocalationEnvDir)
+		}
+	}
+	n.leaderStore = openTestStore(t, n.leader.dir)
+	n.followerStore = openTestStore(t, n.follower.dir)
+	err := NewSyncServer(n.leaderStore).Register(n.leader.mux)
+	if err != nil {
+		t.Fatalf("failed to register sync server: %s", err)
+	}
+	n.peer, err = n.follower.pool.GetURL(context.Background(), "leader")
+	if err != nil {
+		t.Fatalf("failed to connect to leader: %s", err)
+	}
+	return n
+}
+
+func (n *syncTestNodes) cleanup() {
+	n.restoreCache()
+	n.leaderStore.Close()
+	n.followerStore.Close()
+	n.follower.cleanup()
+	n.leader.cleanup()
+}
+
+func appendTestBlocks(t *testing.T, s *BlockStore, blocks []*Block) {
+	for _, b := range blocks {
+		err := s.Append(b)
+		if err != nil {
+			t.Fatalf("failed to append block %d: %s", b.height, err)
+		}
+	}
+}
+
+func TestSyncFromEmpty(t *testing.T) {
+	n := createSyncTestNodes(t)
+	defer n.cleanup()
+
+	// More blocks than a single range
+	blocks := createTestBlocks(t, "test", 2*maxBlocksPerRange+5)
+	appendTestBlocks(t, n.leaderStore, blocks)
+
+	added, err := SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if added != len(blocks) {
+		t.Fatalf("%d blocks added instead of %d", added, len(blocks))
+	}
+	checkStoredChain(t, n.followerStore, "test", blocks)
+	if cache.IsDirty(n.follower.dir, "test") {
+		t.Fatalf("namespace is still dirty after sync")
+	}
+
+	// The follower catches up with new blocks
+	more := extendTestBlocks(t, blocks, "test", 3)
+	appendTestBlocks(t, n.leaderStore, more[len(blocks):])
+	added, err = SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil || added != 3 {
+		t.Fatalf("failed to sync new blocks: %d blocks added (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "test", more)
+
+	// Nothing to do when up to date or for unknown namespaces
+	added, err = SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil || added != 0 {
+		t.Fatalf("sync of an up to date chain added %d blocks (%v)", added, err)
+	}
+	added, err = SyncNamespace(n.peer, n.followerStore, "unknown", syncTestOptions)
+	if err != nil || added != 0 {
+		t.Fatalf("sync of an unknown namespace added %d blocks (%v)", added, err)
+	}
+}
+
+func TestSyncFork(t *testing.T) {
+	n := createSyncTestNodes(t)
+	defer n.cleanup()
+
+	common := createTestBlocks(t, "test", 5)
+	leaderChain := extendTestBlocks(t, common, "test", 4)
+	followerChain := extendTestBlocks(t, common, "test", 3)
+	appendTestBlocks(t, n.leaderStore, leaderChain)
+	appendTestBlocks(t, n.followerStore, followerChain)
+
+	// The blocks committed by the leader win
+	added, err := SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if added != 4 {
+		t.Fatalf("%d blocks added instead of 4", added)
+	}
+	checkStoredChain(t, n.followerStore, "test", leaderChain)
+
+	// A follower ahead of the leader keeps its blocks
+	ahead := extendTestBlocks(t, leaderChain, "test", 2)
+	appendTestBlocks(t, n.followerStore, ahead[len(leaderChain):])
+	added, err = SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil || added != 0 {
+		t.Fatalf("sync of a chain ahead of the leader added %d blocks (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "test", ahead)
+
+	// A shorter fork, or one of the same length, does not replace any block
+	common = createTestBlocks(t, "shorter", 3)
+	followerChain = extendTestBlocks(t, common, "shorter", 3)
+	leaderChain = extendTestBlocks(t, common, "shorter", 2)
+	appendTestBlocks(t, n.leaderStore, leaderChain)
+	appendTestBlocks(t, n.followerStore, followerChain)
+	added, err = SyncNamespace(n.peer, n.followerStore, "shorter", syncTestOptions)
+	if err == nil || added != 0 {
+		t.Fatalf("shorter fork was synced: %d blocks added (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "shorter", followerChain)
+	appendTestBlocks(t, n.leaderStore, extendTestBlocks(t, leaderChain, "shorter", 1)[len(leaderChain):])
+	added, err = SyncNamespace(n.peer, n.followerStore, "shorter", syncTestOptions)
+	if err == nil || added != 0 {
+		t.Fatalf("fork of the same length was synced: %d blocks added (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "shorter", followerChain)
+
+	// Chains without a common genesis block are not merged
+	appendTestBlocks(t, n.leaderStore, createTestBlocks(t, "other", 3))
+	appendTestBlocks(t, n.followerStore, createTestBlocks(t, "other", 2))
+	_, err = SyncNamespace(n.peer, n.followerStore, "other", syncTestOptions)
+	if err == nil {
+		t.Fatalf("chains with different genesis blocks were merged")
+	}
+
+	// An invalid fork does not replace any block: the first block after the
+	// common ones has a forged Merkle root
+	common = createTestBlocks(t, "forged", 5)
+	followerChain = extendTestBlocks(t, common, "forged", 3)
+	forged := *extendTestBlocks(t, common, "forged", 1)[5]
+	forged.merkleRoot = MerkleRoot([]string{"forged=0"})
+	forged.h = forged.computeHash()
+	appendTestBlocks(t, n.leaderStore, extendTestBlocks(t, append(common[:5:5], &forged), "forged", 4))
+	appendTestBlocks(t, n.followerStore, followerChain)
+	added, err = SyncNamespace(n.peer, n.followerStore, "forged", syncTestOptions)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 5 || added != 0 {
+		t.Fatalf("invalid fork was not rejected: %d blocks added (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "forged", followerChain)
+}
+
+func TestSyncInvalidBlock(t *testing.T) {
+	n := createSyncTestNodes(t)
+	defer n.cleanup()
+
+	blocks := createTestBlocks(t, "test", 6)
+	// The leader serves a block whose Merkle root does not match its stamp
+	tampered := *blocks[3]
+	tampered.merkleRoot = MerkleRoot([]string{"forged=0"})
+	tampered.h = tampered.computeHash()
+	blocks = extendTestBlocks(t, append(blocks[:3], &tampered), "test", 2)
+	appendTestBlocks(t, n.leaderStore, blocks)
+
+	added, err := SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 3 {
+		t.Fatalf("invalid block was not rejected: %v", err)
+	}
+	if added != 3 {
+		t.Fatalf("%d blocks added instead of 3", added)
+	}
+	checkStoredChain(t, n.followerStore, "test", blocks[:3])
+	if !cache.IsDirty(n.follower.dir, "test") {
+		t.Fatalf("namespace is not dirty after a failed sync")
+	}
+}
+
+// rehashTestBlock hashes and signs a test block again after a change
+func rehashTestBlock(t *testing.T, b *Block) {
+	err := b.hash()
+	if err != nil {
+		t.Fatalf("failed to hash block: %s", err)
+	}
+	b.sign(testKeyPair)
+}
+
+func TestSyncSpentStamps(t *testing.T) {
+	n := createSyncTestNodes(t)
+	defer n.cleanup()
+
+	// The stamps of the synced blocks are spent
+	blocks := createTestBlocks(t, "test", 4)
+	appendTestBlocks(t, n.leaderStore, blocks)
+	added, err := SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	if err != nil || added != 4 {
+		t.Fatalf("failed to sync: %d blocks added (%v)", added, err)
+	}
+	for _, b := range blocks[1:] {
+		spent, err := b.stamps[0].IsSpent()
+		if err != nil || !spent {
+			t.Fatalf("stamp of block %d is not spent (%v)", b.height, err)
+		}
+	}
+
+	// A block of the peer cannot spend a stamp spent locally
+	reused := extendTestBlocks(t, blocks, "test", 1)[4]
+	reused.stamps = blocks[2].stamps
+	rehashTestBlock(t, reused)
+	appendTestBlocks(t, n.leaderStore, []*Block{reused})
+	added, err = SyncNamespace(n.peer, n.followerStore, "test", syncTestOptions)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 4 || !strings.Contains(verr.Reason, hashcash.HashCashSpentErr.Error()) || added != 0 {
+		t.Fatalf("block with a spent stamp was not rejected: %d blocks added (%v)", added, err)
+	}
+
+	// The stamps of the blocks dropped for a fork are not spent anymore,
+	// unless the fork spends them again
+	common := createTestBlocks(t, "fork", 3)
+	followerChain := extendTestBlocks(t, common, "fork", 2)
+	leaderChain := extendTestBlocks(t, common, "fork", 3)
+	appendTestBlocks(t, n.followerStore, followerChain)
+	for _, b := range followerChain[1:] {
+		err := b.stamps[0].Spend()
+		if err != nil {
+			t.Fatalf("failed to spend stamp: %s", err)
+		}
+	}
+	kept := *leaderChain[4]
+	kept.stamps = followerChain[4].stamps
+	rehashTestBlock(t, &kept)
+	leaderChain = extendTestBlocks(t, append(leaderChain[:4:4], &kept), "fork", 1)
+	appendTestBlocks(t, n.leaderStore, leaderChain)
+	added, err = SyncNamespace(n.peer, n.followerStore, "fork", syncTestOptions)
+	if err != nil || added != 3 {
+		t.Fatalf("failed to sync fork: %d blocks added (%v)", added, err)
+	}
+	checkStoredChain(t, n.followerStore, "fork", leaderChain)
+	spent, err := followerChain[3].stamps[0].IsSpent()
+	if err != nil || spent {
+		t.Fatalf("stamp of a dropped block is still spent (%v)", err)
+	}
+	for _, b := range leaderChain[1:] {
+		spent, err := b.stamps[0].IsSpent()
+		if err != nil || !spent {
+			t.Fatalf("stamp of block %d of the fork is not spent (%v)", b.height, err)
+		}
+	}
+}
+
+// startTestLeader starts a leader serving the chains of a store and
+// announcing its namespaces to the nodes connecting to it
+func startTestLeader(t *testing.T, network *comm.MemNetwork, store *BlockStore) *comm.Server {
+	s := NewSyncServer(store)
+	mux := comm.NewHandlerMux()
+	err := s.Register(mux)
+	if err != nil {
+		t.Fatalf("failed to register sync server: %s", err)
+	}
+	info := comm.PeerInfo{
+		URL:       "leader",
+		Transport: network.Transport("leader"),
+		Handler:   mux.ServeMsg,
+		OnConnect: s.Announce,
+	}
+	server, err := info.Listen()
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	go server.Serve()
+	return server
+}
+
+func TestNamespaceList(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "leader-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(leaderDir)
+	nodeDir, err := ioutil.TempDir("", "node-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(nodeDir)
+
+	store := openTestStore(t, leaderDir)
+	defer store.Close()
+	appendTestBlocks(t, store, createTestBlocks(t, "mpi-openmpi", 3))
+	appendTestBlocks(t, store, createTestBlocks(t, "site-lab", 1))
+	// Namespaces without a chain are not announced
+	err = cache.AddNamespaces(leaderDir, []string{"mpi-mpich"})
+	if err != nil {
+		t.Fatalf("failed to add namespace: %s", err)
+	}
+
+	network := comm.NewMemNetwork()
+	server := startTestLeader(t, network, store)
+	defer server.Close()
+
+	expected := []NamespaceDescriptor{
+		{Hash: namespaceHash("mpi-openmpi"), ID: "mpi-openmpi", Height: 2},
+		{Hash: namespaceHash("site-lab"), ID: "site-lab", Height: 0},
+	}
+	// Receiving the list again does not change the cache
+	for i := 0; i < 2; i++ {
+		peer := comm.PeerInfo{
+			URL:       "leader",
+			Transport: network.Transport("node"),
+		}
+		err := peer.Connect()
+		if err != nil {
+			t.Fatalf("failed to connect to leader: %s", err)
+		}
+		descs, err := recvListNamespaces(nodeDir, &peer)
+		peer.Close()
+		if err != nil {
+			t.Fatalf("failed to receive namespaces: %s", err)
+		}
+		if !reflect.DeepEqual(descs, expected) {
+			t.Fatalf("received %v instead of %v", descs, expected)
+		}
+		namespaces, err := cache.LoadNamespaces(nodeDir)
+		if err != nil || !reflect.DeepEqual(namespaces, []string{"mpi-openmpi", "site-lab"}) {
+			t.Fatalf("invalid namespaces in cache: %v (%v)", namespaces, err)
+		}
+	}
+
+	// Forged descriptors are rejected
+	for _, d := range []NamespaceDescriptor{
+		{Hash: namespaceHash("mpi-openmpi"), ID: "mpi-mpich"},
+		{Hash: namespaceHash("../x"), ID: "../x"},
+	} {
+		payload, _ := json.Marshal([]NamespaceDescriptor{d})
+		info := comm.PeerInfo{
+			URL:       "forger",
+			Transport: network.Transport("forger"),
+			OnConnect: func(p *comm.PeerInfo) error {
+				return p.SendMsg(NSLISTMSG, payload)
+			},
+		}
+		forger, err := info.Listen()
+		if err != nil {
+			t.Fatalf("failed to create server: %s", err)
+		}
+		go forger.Serve()
+		peer := comm.PeerInfo{
+			URL:       "forger",
+			Transport: network.Transport("node"),
+		}
+		err = peer.Connect()
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+		_, err = recvListNamespaces(nodeDir, &peer)
+		peer.Close()
+		forger.Close()
+		if !errors.Is(err, comm.ErrProtocol) {
+			t.Fatalf("forged descriptor %+v was accepted: %v", d, err)
+		}
+	}
+}
+
+func TestNodeInit(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "leader-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(leaderDir)
+	nodeDir, err := ioutil.TempDir("", "node-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(nodeDir)
+
+	store := openTestStore(t, leaderDir)
+	defer store.Close()
+	blocks := createTestBlocks(t, "mpi-openmpi", 10)
+	appendTestBlocks(t, store, blocks)
+
+	network := comm.NewMemNetwork()
+	server := startTestLeader(t, network, store)
+	defer server.Close()
+
+	// The node starts from an empty cache
+	l := &Leader{
+		PeerInfo: comm.PeerInfo{
+			URL:       "leader",
+			Transport: network.Transport("node"),
+		},
+		Verify: syncTestOptions,
+	}
+	err = l.NodeInit(nodeDir)
+	if err != nil {
+		t.Fatalf("failed to initialize node: %s", err)
+	}
+	defer l.PeerInfo.Close()
+
+	// The chain is synchronized in the background
+	nodeStore, err := sharedBlockStore(nodeDir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for cache.IsDirty(nodeDir, "mpi-openmpi") {
+		if time.Now().After(deadline) {
+			t.Fatalf("namespace was not synchronized")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkStoredChain(t, nodeStore, "mpi-openmpi", blocks)
+}
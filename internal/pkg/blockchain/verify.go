@@ -0,0 +1,299 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hash"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// ChainReader gives access to the blocks of the chains of namespaces
+type ChainReader interface {
+	// Len returns the number of blocks in the chain of a namespace
+	Len(namespace string) (uint64, error)
+
+	// BlockAt returns the block at a given height of the chain of a namespace
+	BlockAt(namespace string, height uint64) (*Block, error)
+}
+
+// VerifyOptions tunes the verification of a chain
+type VerifyOptions struct {
+	// CheckStamp checks the stamps of a block against the difficulty of the
+	// namespace at the height of the block; by default, the proof of work is
+	// checked as of the time the block was committed
+	CheckStamp func(b *Block, difficulty int) error
+
+	// TrustedKey checks whether blocks and stamps signed by a key are
+	// accepted; by default, the keys of the keyring of the local cache are
+	TrustedKey func(key ed25519.PublicKey) bool
+
+	// ManifestPath returns the path to the stored copy of a manifest, or an
+	// empty string if there is none; manifests are not checked when nil
+	ManifestPath func(name string, hash string) string
+}
+
+// VerifyError describes the first broken link of a chain
+type VerifyError struct {
+	Namespace string
+	Height    uint64
+	Hash      string
+	Reason    string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("namespace %s: block %d (%s): %s", e.Namespace, e.Height, e.Hash, e.Reason)
+}
+
+func checkStamp(b *Block, difficulty int, trusted func(key ed25519.PublicKey) bool) error {
+	for i := range b.stamps {
+		err := b.stamps[i].ValidAt(b.timestamp, difficulty)
+		if err != nil {
+			return fmt.Errorf("stamp %d: %w", i, err)
+		}
+		signer, err := b.stamps[i].VerifySignature()
+		if err != nil {
+			return fmt.Errorf("stamp %d: %w", i, err)
+		}
+		if !trusted(signer) {
+			return fmt.Errorf("stamp %d: %w: %s", i, hashcash.HashCashUntrustedErr, keys.Fingerprint(signer))
+		}
+	}
+	return nil
+}
+
+// setDefaults sets the options that are not set, trusting the keys of the
+// keyring of a cache
+func (opts *VerifyOptions) setDefaults(basedir string) error {
+	if opts.TrustedKey == nil {
+		kr, err := keys.LoadKeyring(basedir)
+		if err != nil {
+			return fmt.Errorf("unable to load the trusted keys: %w", err)
+		}
+		opts.TrustedKey = kr.Contains
+	}
+	if opts.CheckStamp == nil {
+		trusted := opts.TrustedKey
+		opts.CheckStamp = func(b *Block, difficulty int) error {
+			return checkStamp(b, difficulty, trusted)
+		}
+	}
+	return nil
+}
+
+// verifyBlock checks a block on its own and its link to the previous one,
+// which is nil for the first block of the chain; the difficulty of the
+// namespace is followed by a tracker. It returns the reason why the block is
+// invalid, if it is.
+func verifyBlock(b *Block, prev *Block, height uint64, namespace string, difficulty *difficultyTracker, opts *VerifyOptions) string {
+	if b.namespace != namespace {
+		return fmt.Sprintf("block belongs to namespace %s", b.namespace)
+	}
+	if b.height != height {
+		return fmt.Sprintf("block claims height %d", b.height)
+	}
+	if prev == nil {
+		if b.prev != "" {
+			return fmt.Sprintf("first block is linked to %s", b.prev)
+		}
+		if b.genesis == nil || b.genesis.ID != namespace {
+			return "first block is not the genesis block of the namespace"
+		}
+	}
+	if prev != nil && b.genesis != nil {
+		return "genesis block in the middle of the chain"
+	}
+	if prev != nil {
+		if b.prev != prev.h {
+			return fmt.Sprintf("previous hash %s does not match the hash %s of block %d", b.prev, prev.h, prev.height)
+		}
+		if b.timestamp.Before(prev.timestamp) {
+			return fmt.Sprintf("block was committed at %s, before the previous block (%s)", b.timestamp, prev.timestamp)
+		}
+	}
+
+	if b.genesis != nil && len(b.stamps) != 0 {
+		return "genesis block carries stamps"
+	}
+	if b.genesis == nil && len(b.stamps) == 0 {
+		return "block has no stamp"
+	}
+	stamps := make(map[string]bool)
+	for i := range b.stamps {
+		key := b.stamps[i].Serialize()
+		if stamps[key] {
+			return fmt.Sprintf("stamp %d appears twice in the block", i)
+		}
+		stamps[key] = true
+	}
+
+	root := MerkleRoot(b.entries())
+	if b.merkleRoot != root {
+		return fmt.Sprintf("Merkle root %s does not match the manifests of the stamps (%s)", b.merkleRoot, root)
+	}
+	h := b.computeHash()
+	if b.h != h {
+		return fmt.Sprintf("hash does not match the content of the block (%s)", h)
+	}
+
+	err := b.verifySignature()
+	if err != nil {
+		return err.Error()
+	}
+	if !opts.TrustedKey(b.signer) {
+		return fmt.Sprintf("block is signed by the untrusted key %s", keys.Fingerprint(b.signer))
+	}
+
+	if b.genesis != nil {
+		// The genesis block has no stamp
+		return ""
+	}
+	d, err := difficulty.at(height)
+	if err != nil {
+		return fmt.Sprintf("unable to get the difficulty: %s", err)
+	}
+	err = opts.CheckStamp(b, d)
+	if err != nil {
+		return fmt.Sprintf("invalid stamps: %s", err)
+	}
+
+	manifests, err := b.stampManifests()
+	if err != nil {
+		return fmt.Sprintf("invalid manifests: %s", err)
+	}
+	if opts.ManifestPath == nil {
+		return ""
+	}
+	for _, m := range manifests {
+		path := opts.ManifestPath(m.Name, m.SHA256)
+		if path == "" {
+			return fmt.Sprintf("manifest %s is not stored", m.Name)
+		}
+		actual := hash.HashFile(path)
+		if actual != m.SHA256 {
+			return fmt.Sprintf("manifest %s (%s) has hash %s instead of %s", m.Name, path, actual, m.SHA256)
+		}
+	}
+
+	return ""
+}
+
+// Verify walks the chain of a namespace from its first block, recomputing
+// the hash and Merkle root of every block, and checking stamps and manifests;
+// a stamp can only be spent once in the chain. A *VerifyError is returned for
+// the first invalid block.
+func Verify(r ChainReader, namespace string, opts VerifyOptions) error {
+	err := opts.setDefaults(cache.GetBasedir())
+	if err != nil {
+		return err
+	}
+
+	n, err := r.Len(namespace)
+	if err != nil {
+		return fmt.Errorf("unable to get the length of the chain of %s: %w", namespace, err)
+	}
+
+	var prev *Block
+	difficulty := newDifficultyTracker(r, namespace)
+	// spent maps the stamps of the blocks already walked to their height
+	spent := make(map[string]uint64)
+	for height := uint64(0); height < n; height++ {
+		b, err := r.BlockAt(namespace, height)
+		if err != nil {
+			return &VerifyError{
+				Namespace: namespace,
+				Height:    height,
+				Reason:    fmt.Sprintf("unable to read block: %s", err),
+			}
+		}
+
+		reason := verifyBlock(b, prev, height, namespace, difficulty, &opts)
+		for i := 0; reason == "" && i < len(b.stamps); i++ {
+			key := b.stamps[i].Serialize()
+			if h, ok := spent[key]; ok {
+				reason = fmt.Sprintf("stamp %d was already spent in block %d", i, h)
+			}
+			spent[key] = height
+		}
+		if reason != "" {
+			return &VerifyError{
+				Namespace: namespace,
+				Height:    height,
+				Hash:      b.h,
+				Reason:    reason,
+			}
+		}
+		prev = b
+	}
+
+	return nil
+}
+
+// MemChain is a ChainReader keeping blocks in memory, e.g., the blocks of a
+// chain exported to a file
+type MemChain struct {
+	blocks map[string][]*Block
+}
+
+// NewMemChain returns an empty in-memory chain
+func NewMemChain() *MemChain {
+	return &MemChain{
+		blocks: make(map[string][]*Block),
+	}
+}
+
+// ReadChain reads a stream of JSON-encoded blocks, in the order of the chain
+func ReadChain(r io.Reader) (*MemChain, error) {
+	c := NewMemChain()
+	dec := json.NewDecoder(r)
+	for {
+		var b Block
+		err := dec.Decode(&b)
+		if err == io.EOF {
+			return c, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode block: %w", err)
+		}
+		c.Append(&b)
+	}
+}
+
+// Append adds a block at the end of the chain of its namespace, the block is
+// not checked
+func (c *MemChain) Append(b *Block) {
+	c.blocks[b.namespace] = append(c.blocks[b.namespace], b)
+}
+
+// Namespaces returns the namespaces with a chain
+func (c *MemChain) Namespaces() []string {
+	var namespaces []string
+	for ns := range c.blocks {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Len returns the number of blocks in the chain of a namespace
+func (c *MemChain) Len(namespace string) (uint64, error) {
+	return uint64(len(c.blocks[namespace])), nil
+}
+
+// BlockAt returns the block at a given height of the chain of a namespace
+func (c *MemChain) BlockAt(namespace string, height uint64) (*Block, error) {
+	if height >= uint64(len(c.blocks[namespace])) {
+		return nil, fmt.Errorf("no block at height %d in namespace %s", height, namespace)
+	}
+	return c.blocks[namespace][height], nil
+}
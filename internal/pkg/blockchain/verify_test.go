@@ -0,0 +1,425 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// createTestChain publishes blocks in a namespace and returns their
+// encoding along with the directory where their manifests are stored
+func createTestChain(t *testing.T, namespace string, count int) ([]byte, string) {
+	dir, err := ioutil.TempDir("", "verify-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	_, err = CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	s, err := LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+	genesis, err := s.BlockAt(namespace, 0)
+	if err != nil {
+		t.Fatalf("failed to get genesis block: %s", err)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err = enc.Encode(genesis)
+	if err != nil {
+		t.Fatalf("failed to encode block: %s", err)
+	}
+	for i := 0; i < count; i++ {
+		stamp := hashcash.Create("127.0.0.1")
+		for _, m := range []string{"openmpi", "mpich"} {
+			path := filepath.Join(dir, m+".MANIFEST")
+			err := ioutil.WriteFile(path, []byte("results of "+m), 0644)
+			if err != nil {
+				t.Fatalf("failed to create manifest: %s", err)
+			}
+			err = stamp.AddManifest(path, hashcash.KindResult)
+			if err != nil {
+				t.Fatalf("failed to add manifest: %s", err)
+			}
+		}
+		b, err := IsolatedCreate(namespace, stamp)
+		if err != nil {
+			t.Fatalf("failed to create block: %s", err)
+		}
+		err = b.Publish(nil)
+		if err != nil {
+			t.Fatalf("failed to publish block: %s", err)
+		}
+		err = enc.Encode(&b)
+		if err != nil {
+			t.Fatalf("failed to encode block: %s", err)
+		}
+	}
+
+	return buf.Bytes(), dir
+}
+
+func TestVerify(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-verify"
+	data, dir := createTestChain(t, namespace, 4)
+	defer os.RemoveAll(dir)
+
+	opts := VerifyOptions{
+		// Stamps are not minted, their proof of work is not checked
+		CheckStamp: func(*Block, int) error { return nil },
+		ManifestPath: func(name string, hash string) string {
+			return filepath.Join(dir, name+".MANIFEST")
+		},
+	}
+
+	// tamper alters the encoding of the block at a given height
+	tamper := func(height int, fn func(bj map[string]interface{})) *MemChain {
+		var out bytes.Buffer
+		for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if i == height {
+				var bj map[string]interface{}
+				err := json.Unmarshal([]byte(line), &bj)
+				if err != nil {
+					t.Fatalf("failed to decode block: %s", err)
+				}
+				fn(bj)
+				b, _ := json.Marshal(bj)
+				line = string(b)
+			}
+			out.WriteString(line + "\n")
+		}
+		c, err := ReadChain(&out)
+		if err != nil {
+			t.Fatalf("failed to read chain: %s", err)
+		}
+		return c
+	}
+
+	c, err := ReadChain(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read chain: %s", err)
+	}
+	if len(c.Namespaces()) != 1 || c.Namespaces()[0] != namespace {
+		t.Fatalf("unexpected namespaces %v", c.Namespaces())
+	}
+	err = Verify(c, namespace, opts)
+	if err != nil {
+		t.Fatalf("valid chain failed verification: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		height int
+		fn     func(bj map[string]interface{})
+		reason string
+	}{
+		{
+			name:   "height",
+			height: 2,
+			fn:     func(bj map[string]interface{}) { bj["height"] = 7 },
+			reason: "claims height 7",
+		},
+		{
+			name:   "previous hash",
+			height: 1,
+			fn:     func(bj map[string]interface{}) { bj["prev"] = strings.Repeat("0", 64) },
+			reason: "previous hash",
+		},
+		{
+			name:   "Merkle root",
+			height: 3,
+			fn:     func(bj map[string]interface{}) { bj["merkle_root"] = MerkleRoot(nil) },
+			reason: "Merkle root",
+		},
+		{
+			name:   "genesis",
+			height: 0,
+			fn: func(bj map[string]interface{}) {
+				bj["genesis"].(map[string]interface{})["difficulty"] = 1
+			},
+			reason: "hash does not match",
+		},
+		{
+			name:   "stamps",
+			height: 2,
+			fn: func(bj map[string]interface{}) {
+				delete(bj, "stamps")
+			},
+			reason: "no stamp",
+		},
+		{
+			name:   "content",
+			height: 4,
+			fn: func(bj map[string]interface{}) {
+				stamps := bj["stamps"].([]interface{})
+				stamps[0] = strings.Replace(stamps[0].(string), "127.0.0.1", "10.0.0.1", 1)
+			},
+			reason: "hash does not match",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tamper(tt.height, tt.fn)
+			err := Verify(c, namespace, opts)
+			var verr *VerifyError
+			if !errors.As(err, &verr) {
+				t.Fatalf("tampered chain passed verification: %v", err)
+			}
+			if verr.Height != uint64(tt.height) || !strings.Contains(verr.Reason, tt.reason) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	// A modified manifest is detected
+	err = ioutil.WriteFile(filepath.Join(dir, "mpich.MANIFEST"), []byte("forged results"), 0644)
+	if err != nil {
+		t.Fatalf("failed to modify manifest: %s", err)
+	}
+	err = Verify(c, namespace, opts)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 1 || !strings.Contains(verr.Reason, "manifest mpich") {
+		t.Fatalf("modified manifest was not detected: %v", err)
+	}
+}
+
+func TestVerifyMintedStamps(t *testing.T) {
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	namespace := "test-minted"
+
+	_, err := CreateNamespace(namespace)
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		t.Fatalf("failed to get key pair: %s", err)
+	}
+	stamp := createTestStamp(t, "openmpi-4.0.2")
+	stamp.Sign(kp.Private)
+	err = stamp.Mint(context.Background(), defaultDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	b, err := IsolatedCreate(namespace, stamp)
+	if err == nil {
+		err = b.Publish(nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to commit block: %s", err)
+	}
+	s, err := LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+
+	// The proof of work and the signature are checked by default
+	err = Verify(s, namespace, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("chain with minted stamps is invalid: %s", err)
+	}
+	err = Verify(s, namespace, VerifyOptions{
+		CheckStamp: func(b *Block, difficulty int) error {
+			return checkStamp(b, difficulty, trustTestKey)
+		},
+	})
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 1 || !strings.Contains(verr.Reason, "untrusted") {
+		t.Fatalf("stamp signed by an untrusted key was accepted: %v", err)
+	}
+	b, err = IsolatedCreate(namespace, createTestStamp(t, "mpich-3.3"))
+	if err == nil {
+		err = b.Publish(nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to commit block: %s", err)
+	}
+	err = Verify(s, namespace, VerifyOptions{})
+	if !errors.As(err, &verr) || verr.Height != 2 || !strings.Contains(verr.Reason, "invalid stamps") {
+		t.Fatalf("stamp without proof of work was accepted: %v", err)
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	blocks := createTestBlocks(t, "test", 4)
+	c := NewMemChain()
+	for _, b := range blocks {
+		c.Append(b)
+	}
+	opts := VerifyOptions{
+		CheckStamp: func(*Block, int) error { return nil },
+		TrustedKey: trustTestKey,
+	}
+	err := Verify(c, "test", opts)
+	if err != nil {
+		t.Fatalf("failed to verify chain: %s", err)
+	}
+
+	// Blocks must be signed by a trusted key; by default, only the key of
+	// the local node is trusted
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	err = Verify(c, "test", VerifyOptions{CheckStamp: opts.CheckStamp})
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Height != 0 || !strings.Contains(verr.Reason, "untrusted") {
+		t.Fatalf("block signed by an untrusted key was accepted: %v", err)
+	}
+	err = keys.Trust(cache.GetBasedir(), "test", testKeyPair.Public)
+	if err != nil {
+		t.Fatalf("failed to trust test key: %s", err)
+	}
+	err = Verify(c, "test", VerifyOptions{CheckStamp: opts.CheckStamp})
+	if err != nil {
+		t.Fatalf("block signed by a trusted key was rejected: %s", err)
+	}
+
+	// The signature survives the exchange of the block and covers its hash
+	data, err := json.Marshal(blocks[2])
+	if err != nil {
+		t.Fatalf("failed to encode block: %s", err)
+	}
+	var b Block
+	err = json.Unmarshal(data, &b)
+	if err != nil {
+		t.Fatalf("failed to decode block: %s", err)
+	}
+	if !bytes.Equal(b.Signer(), testKeyPair.Public) || b.verifySignature() != nil {
+		t.Fatalf("block signature was lost")
+	}
+	for name, tamper := range map[string]func(b *Block){
+		"unsigned":  func(b *Block) { b.signature = nil },
+		"signature": func(b *Block) { b.signature[0] ^= 1 },
+		"signer":    func(b *Block) { b.signer = b.signature[:ed25519.PublicKeySize] },
+	} {
+		forged := b
+		forged.signature = append([]byte(nil), b.signature...)
+		tamper(&forged)
+		chain := NewMemChain()
+		for _, block := range blocks[:2] {
+			chain.Append(block)
+		}
+		chain.Append(&forged)
+		err = Verify(chain, "test", opts)
+		if !errors.As(err, &verr) || verr.Height != 2 {
+			t.Fatalf("%s: forged block was accepted: %v", name, err)
+		}
+	}
+
+	// A stamp created for the identity of a key must be signed by that key
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	// The stamps of the test blocks are not minted
+	opts.CheckStamp = func(b *Block, difficulty int) error {
+		if b.height < 2 {
+			return nil
+		}
+		return checkStamp(b, 8, trustTestKey)
+	}
+	for _, key := range []ed25519.PublicKey{testKeyPair.Public, other} {
+		stamp := hashcash.Create(keys.Resource(key))
+		stamp.Sign(testKeyPair.Private)
+		err = stamp.Mint(context.Background(), 8)
+		if err != nil {
+			t.Fatalf("failed to mint stamp: %s", err)
+		}
+		chain := NewMemChain()
+		for _, block := range blocks[:2] {
+			chain.Append(block)
+		}
+		chain.Append(linkTestBlock(t, blocks[:2], stamp))
+		err = Verify(chain, "test", opts)
+		if bytes.Equal(key, testKeyPair.Public) && err != nil {
+			t.Fatalf("stamp signed by the key of its resource was rejected: %s", err)
+		}
+		if !bytes.Equal(key, testKeyPair.Public) && (!errors.As(err, &verr) || verr.Height != 2 || !strings.Contains(verr.Reason, hashcash.HashCashResourceErr.Error())) {
+			t.Fatalf("stamp signed by another key than the one of its resource was accepted: %v", err)
+		}
+	}
+}
+
+// linkTestBlock returns a block carrying given stamps at the end of a chain
+func linkTestBlock(t *testing.T, chain []*Block, stamps ...hashcash.Stamp) *Block {
+	prev := chain[len(chain)-1]
+	b := &Block{
+		namespace: prev.namespace,
+		height:    prev.height + 1,
+		timestamp: time.Now().UTC(),
+		prev:      prev.h,
+		stamps:    stamps,
+	}
+	err := b.hash()
+	if err != nil {
+		t.Fatalf("failed to hash block: %s", err)
+	}
+	b.sign(testKeyPair)
+	return b
+}
+
+func TestVerifyDuplicateStamps(t *testing.T) {
+	blocks := createTestBlocks(t, "test", 3)
+	stamp := blocks[1].stamps[0]
+	tests := []struct {
+		name   string
+		block  *Block
+		reason string
+	}{
+		{name: "spent", block: linkTestBlock(t, blocks, hashcash.Create("127.0.0.1"), stamp), reason: "stamp 1 was already spent in block 1"},
+		{name: "twice", block: linkTestBlock(t, blocks, stamp, stamp), reason: "stamp 1 appears twice"},
+	}
+	for _, tt := range tests {
+		c := NewMemChain()
+		for _, b := range append(blocks, tt.block) {
+			c.Append(b)
+		}
+		err := Verify(c, "test", syncTestOptions)
+		var verr *VerifyError
+		if !errors.As(err, &verr) || verr.Height != 3 || !strings.Contains(verr.Reason, tt.reason) {
+			t.Fatalf("%s: duplicate stamp was accepted: %v", tt.name, err)
+		}
+	}
+
+	// Committed blocks cannot spend a stamp again either
+	cleanup := setTestCacheDir(t)
+	defer cleanup()
+	s := openTestStore(t, cache.GetBasedir())
+	defer s.Close()
+	n := &Node{store: s, cfg: NodeConfig{Verify: syncTestOptions}}
+	for _, b := range blocks {
+		err := n.appendBlock(b)
+		if err != nil {
+			t.Fatalf("failed to append block %d: %s", b.height, err)
+		}
+	}
+	err := n.appendBlock(linkTestBlock(t, blocks, stamp))
+	var verr *VerifyError
+	if !errors.As(err, &verr) || !strings.Contains(verr.Reason, hashcash.HashCashSpentErr.Error()) {
+		t.Fatalf("block spending a stamp again was appended: %v", err)
+	}
+	checkStoredChain(t, s, "test", blocks)
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import "path/filepath"
+
+const (
+	defaultConsensusDirName = "consensus"
+)
+
+// GetConsensusDir returns the path to the directory where the consensus
+// algorithm persists the state the node must not forget across restarts
+func GetConsensusDir(basedir string) string {
+	return filepath.Join(basedir, defaultConsensusDirName)
+}
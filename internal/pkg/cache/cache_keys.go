@@ -0,0 +1,25 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import "path/filepath"
+
+const (
+	defaultKeysDirName    = "keys"
+	defaultTrustedDirName = "trusted"
+)
+
+// GetKeysDir returns the directory where the key pair of the local node is
+// stored
+func GetKeysDir(basedir string) string {
+	return filepath.Join(basedir, defaultKeysDirName)
+}
+
+// GetTrustedKeysDir returns the directory where the public keys of the
+// trusted peers are stored
+func GetTrustedKeysDir(basedir string) string {
+	return filepath.Join(GetKeysDir(basedir), defaultTrustedDirName)
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -23,9 +24,12 @@ const (
 	defaultCacheDirName     = ".syblockfs"
 	defaultNamespaceDirName = "ns"
 	defaultDataDirName      = "data"
+	defaultSpentDBName      = "spent.db"
 )
 
-func getBasedir() string {
+// GetBasedir returns the base directory of the cache, which can be set with
+// the SY_BLOCKFS_DIR environment variable
+func GetBasedir() string {
 	if os.Getenv(CacheLocalationEnvDir) != "" {
 		return os.Getenv(CacheLocalationEnvDir)
 	} else {
@@ -37,41 +41,99 @@ func getNamespaceDir(basedir string) string {
 	return filepath.Join(basedir, defaultNamespaceDirName)
 }
 
+// GetChainDir returns the directory where the blocks of the chain of a
+// namespace are stored
+func GetChainDir(basedir string, namespace string) string {
+	return filepath.Join(getNamespaceDir(basedir), namespace)
+}
+
+// GetDataDir returns the directory where the content referenced by blocks,
+// e.g., manifests, is stored
+func GetDataDir(basedir string) string {
+	return filepath.Join(basedir, defaultDataDirName)
+}
+
+// CheckNamespace makes sure a namespace can be used as a directory name
+func CheckNamespace(namespace string) error {
+	if namespace == "" || namespace == "." || namespace == ".." || strings.ContainsAny(namespace, "/\\") {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return nil
+}
+
+// GetSpentDBPath returns the path to the database of spent stamps
+func GetSpentDBPath(basedir string) string {
+	return filepath.Join(basedir, defaultSpentDBName)
+}
+
 // AddNamespaces add a list of namespaces to the local cache
 // It is okay if the namespace is already in the cache.
 func AddNamespaces(basedir string, namespaces []string) error {
-	dir := getNamespaceDir(basedir)
-	entries, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return fmt.Errorf("failed to read %s: %s", dir, err)
+	for _, ns := range namespaces {
+		err := CheckNamespace(ns)
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, ns := range namespaces {
-		for _, e := range entries {
-			if ns != e.Name() {
-				newNSDir := filepath.Join(dir, ns)
-				err := os.MkdirAll(newNSDir, 0700)
-				if err != nil {
-					return fmt.Errorf("failed to create %s: %s", newNSDir, err)
-				}
-			}
+		dir := GetChainDir(basedir, ns)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", dir, err)
 		}
 	}
 
 	return nil
 }
 
+// LoadNamespaces returns the namespaces of the local cache, sorted by name
 func LoadNamespaces(basedir string) ([]string, error) {
 	dir := getNamespaceDir(basedir)
 	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %s: %s", dir, err)
 	}
 
 	var namespaces []string
 	for _, e := range entries {
-		namespaces = append(namespaces, e.Name())
+		if e.IsDir() {
+			namespaces = append(namespaces, e.Name())
+		}
 	}
 
 	return namespaces, nil
 }
+
+// dirtyMarker is the file marking the chain of a namespace as being updated
+const dirtyMarker = ".dirty"
+
+// MarkDirty marks the chain of a namespace as being updated, e.g., while it is
+// synchronized with a peer; a chain still dirty after a restart needs to be
+// synchronized again
+func MarkDirty(basedir string, namespace string) error {
+	dir := GetChainDir(basedir, namespace)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, dirtyMarker), nil, 0600)
+}
+
+// MarkClean marks the chain of a namespace as up to date
+func MarkClean(basedir string, namespace string) error {
+	err := os.Remove(filepath.Join(GetChainDir(basedir, namespace), dirtyMarker))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IsDirty checks whether the chain of a namespace is being updated
+func IsDirty(basedir string, namespace string) bool {
+	_, err := os.Stat(filepath.Join(GetChainDir(basedir, namespace), dirtyMarker))
+	return err == nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAddNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	namespaces, err := LoadNamespaces(dir)
+	if err != nil || len(namespaces) != 0 {
+		t.Fatalf("empty cache has namespaces: %v (%v)", namespaces, err)
+	}
+
+	// Namespaces are added to an empty cache, adding them again is a no-op
+	for i := 0; i < 2; i++ {
+		err = AddNamespaces(dir, []string{"mpi-openmpi", "site-lab"})
+		if err != nil {
+			t.Fatalf("failed to add namespaces: %s", err)
+		}
+	}
+	err = AddNamespaces(dir, []string{"mpi-mpich", "site-lab"})
+	if err != nil {
+		t.Fatalf("failed to add namespaces: %s", err)
+	}
+	namespaces, err = LoadNamespaces(dir)
+	expected := []string{"mpi-mpich", "mpi-openmpi", "site-lab"}
+	if err != nil || !reflect.DeepEqual(namespaces, expected) {
+		t.Fatalf("cache has namespaces %v instead of %v (%v)", namespaces, expected, err)
+	}
+
+	for _, ns := range []string{"", "..", "a/b", string([]byte{0x12, '/', 0x34})} {
+		if AddNamespaces(dir, []string{"valid", ns}) == nil {
+			t.Fatalf("invalid namespace %q added", ns)
+		}
+	}
+	namespaces, _ = LoadNamespaces(dir)
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Fatalf("failed addition changed the cache: %v", namespaces)
+	}
+}
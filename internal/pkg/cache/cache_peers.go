@@ -0,0 +1,18 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cache
+
+import "path/filepath"
+
+const (
+	defaultPeersFileName = "peers.json"
+)
+
+// GetPeersFile returns the path to the file where the registry of known
+// peers is persisted
+func GetPeersFile(basedir string) string {
+	return filepath.Join(basedir, defaultPeersFileName)
+}
@@ -6,12 +6,13 @@
 package comm
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
-
-	"github.com/gvallee/syserror/pkg/syserror"
 )
 
 // Messages types
@@ -26,386 +27,579 @@ const (
 	CONNACK = "CACK"
 	// DATAMSG represents a data msg
 	DATAMSG = "DATA"
+	// PINGMSG is a heartbeat request
+	PINGMSG = "PING"
+	// PONGMSG is the response to a heartbeat request
+	PONGMSG = "PONG"
 )
 
+var msgTypesLock sync.RWMutex
+var msgTypes = map[string]struct{}{
+	DATAMSG: {},
+	PINGMSG: {},
+	PONGMSG: {},
+}
+
+// Handler is the function invoked for every message received from a peer
+// that is not a response to one of our requests
+type Handler func(p *PeerInfo, msg Message)
+
 // Structure to store server information (host we connect to)
 type PeerInfo struct {
-	conn    net.Conn
-	timeout int
+	conn net.Conn
+
+	// state is shared by all the copies of the structure referring to the
+	// same connection
+	state *connState
 
 	// URL is the IP/port to use to connect to the peer
 	URL string
+
+	// Transport is the mechanism used to connect to the peer, TCP is used
+	// when not set
+	Transport Transport
+
+	// DialOptions specifies how to connect to the peer; the default
+	// options are used when not set
+	DialOptions *DialOptions
+
+	// ConnOptions specifies the deadlines and heartbeat of the connection;
+	// the default options are used when not set. A server passes its
+	// options to all its new peers.
+	ConnOptions *ConnOptions
+
+	// Handler, when set, is used by the read loop of the connection to
+	// handle incoming messages; a server passes it to all its new peers
+	Handler Handler
+
+	// OnConnect, when set, is invoked by a server right after the handshake
+	// with a new peer, before any message from the peer is handled, e.g., to
+	// send the peer the data it needs first; the connection is closed when
+	// it fails. A server passes it to all its new peers.
+	OnConnect func(p *PeerInfo) error
+
+	// Logger is used to report events related to the peer; the logger of
+	// the package is used when not set
+	Logger Logger
 }
 
-// Receive and parse a message header (4 character)
-func (p *PeerInfo) GetHeader() (string, syserror.SysError) {
-	if p.conn == nil {
-		return INVALID, syserror.ErrNotAvailable
-	}
+func (p *PeerInfo) setConn(conn net.Conn) {
+	p.conn = conn
+	p.state = newConnState()
+}
 
-	hdr := make([]byte, 4)
-	if hdr == nil {
-		return INVALID, syserror.ErrOutOfRes
+func (p *PeerInfo) logger() Logger {
+	if p.Logger == nil {
+		return getLogger()
 	}
+	return p.Logger
+}
 
-	/* read the msg type */
-	s, err := p.conn.Read(hdr)
-	if err != nil {
-		log.Println("ERROR:", err.Error())
-		return INVALID, syserror.ErrFatal
+func (p *PeerInfo) transport() Transport {
+	if p.Transport == nil {
+		return TCPTransport{}
 	}
-	// Connection is closed
-	if s == 0 {
-		log.Println("Connection closed")
-		return TERMMSG, syserror.NoErr
+	return p.Transport
+}
+
+func (p *PeerInfo) connOptions() ConnOptions {
+	if p.ConnOptions == nil {
+		return DefaultConnOptions()
 	}
-	// Read returns an error (we test this only as a second test since s=0 means socket closed,
-	// which returns also EOF as an error but we want to handle it as normal termination, not an error case
-	if err != nil {
-		log.Println("ERROR:", err.Error())
-		return INVALID, syserror.ErrFatal
+	return *p.ConnOptions
+}
+
+func (p *PeerInfo) dialOptions() DialOptions {
+	if p.DialOptions == nil {
+		return DefaultDialOptions()
 	}
+	return *p.DialOptions
+}
+
+// Message is a message exchanged with a peer
+type Message struct {
+	// Type is the 4 character type of the message
+	Type string
+
+	// ID identifies the request the message belongs to; 0 for messages
+	// that do not expect a response
+	ID uint64
+
+	// Reply is set to true when the message is the response to a request
+	Reply bool
+
+	// Payload is the data associated to the message, if any
+	Payload []byte
+}
+
+const (
+	hdrSize = 4
+	// The header of every message is | type (4) | request ID (8) | payload size (8) |
+	frameHdrSize = hdrSize + 8 + 8
+
+	// replyFlag is the bit of the request ID used to mark responses
+	replyFlag = uint64(1) << 63
+)
 
-	if s > 0 && s != 4 {
-		log.Println("ERROR Cannot recv header")
-		return INVALID, syserror.NoErr
+func isKnownMsgType(msgType string) bool {
+	msgTypesLock.RLock()
+	defer msgTypesLock.RUnlock()
+	_, ok := msgTypes[msgType]
+	return ok
+}
+
+// RegisterMsgType makes a new message type known to the comm layer so that
+// packages building a protocol on top of comm can define their own messages
+func RegisterMsgType(msgType string) error {
+	if len(msgType) != hdrSize {
+		return fmt.Errorf("invalid message type %q: must be %d characters", msgType, hdrSize)
 	}
 
-	// Disconnect request
-	if string(hdr[:s]) == TERMMSG {
-		log.Println("Recv'd disconnect request")
-		return TERMMSG, syserror.NoErr
+	msgTypesLock.Lock()
+	defer msgTypesLock.Unlock()
+	msgTypes[msgType] = struct{}{}
+
+	return nil
+}
+
+// readError converts an error from a read or write operation on the
+// connection into one of our sentinel errors
+func readError(op string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%s: %w", op, ErrClosed)
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return fmt.Errorf("%s: %w: %s", op, ErrTimeout, err)
 	}
+	return fmt.Errorf("%s: %w: %s", op, ErrClosed, err)
+}
 
-	if string(hdr[:s]) == CONNREQ {
-		log.Println("Recv'd connection request")
-		return CONNREQ, syserror.NoErr
+// Receive and parse a message header (4 character)
+func (p *PeerInfo) GetHeader() (string, error) {
+	if p.conn == nil {
+		return INVALID, ErrNotConnected
 	}
 
-	if string(hdr[:s]) == CONNACK {
-		log.Println("Recv'd connection ACK")
-		return CONNACK, syserror.NoErr
+	hdr := make([]byte, hdrSize)
+
+	/* read the msg type */
+	_, err := io.ReadFull(p.conn, hdr)
+	if err != nil {
+		return INVALID, readError("failed to read message header", err)
+	}
+
+	msgType := string(hdr)
+	switch msgType {
+	case TERMMSG:
+		p.logger().Printf("Recv'd disconnect request")
+	case CONNREQ:
+		p.logger().Printf("Recv'd connection request")
+	case CONNACK:
+		p.logger().Printf("Recv'd connection ACK")
+	default:
+		if !isKnownMsgType(msgType) {
+			return INVALID, fmt.Errorf("%w: invalid message header %q", ErrProtocol, msgType)
+		}
 	}
 
-	log.Println("Invalid msg header")
-	return INVALID, syserror.ErrFatal
+	return msgType, nil
 }
 
-func (p *PeerInfo) getPayloadSize() (uint64, syserror.SysError) {
+func (p *PeerInfo) getUint64() (uint64, error) {
 	if p == nil || p.conn == nil {
-		return 0, syserror.ErrNotAvailable
+		return 0, ErrNotConnected
 	}
 
-	ps := make([]byte, 8) // Payload size is always 8 bytes
-	s, myerr := p.conn.Read(ps)
-	if s != 8 || myerr != nil {
-		log.Println("ERROR: expecting 8 bytes but received", s)
-		return 0, syserror.ErrFatal
+	buff := make([]byte, 8)
+	_, err := io.ReadFull(p.conn, buff)
+	if err != nil {
+		return 0, readError("failed to read 8 bytes", err)
 	}
 
-	return binary.LittleEndian.Uint64(ps), syserror.NoErr
+	return binary.LittleEndian.Uint64(buff), nil
 }
 
-func (p *PeerInfo) getPayload(size uint64) ([]byte, syserror.SysError) {
-	if p == nil || p.conn == nil {
-		return nil, syserror.ErrNotAvailable
+func (p *PeerInfo) getPayloadSize() (uint64, error) {
+	// Payload size is always 8 bytes
+	size, err := p.getUint64()
+	if err != nil {
+		return 0, err
 	}
 
-	payload := make([]byte, size)
-	s, myerr := p.conn.Read(payload)
-	if uint64(s) != size || myerr != nil {
-		log.Println("ERROR: expecting ", size, "but received", s)
-		return nil, syserror.ErrFatal
+	if size > MaxPayloadSize {
+		return 0, fmt.Errorf("%w: payload of %d bytes", ErrOversize, size)
 	}
 
-	return payload, syserror.NoErr
+	return size, nil
 }
 
-func (p *PeerInfo) handleConnReq(size uint64, payload []byte) syserror.SysError {
-	if p == nil {
-		log.Println("ERROR: local server is not initialized")
-		return syserror.ErrFatal
+func (p *PeerInfo) getPayload(size uint64) ([]byte, error) {
+	if p == nil || p.conn == nil {
+		return nil, ErrNotConnected
 	}
 
-	// Send CONNACK with the payload
-	log.Println("Sending CONNACK...")
-	err := p.SendMsg(CONNACK, payload)
-	if err != syserror.NoErr {
-		return err
+	payload := make([]byte, size)
+	_, err := io.ReadFull(p.conn, payload)
+	if err != nil {
+		return nil, readError(fmt.Sprintf("failed to read payload of %d bytes", size), err)
 	}
 
-	return syserror.NoErr
+	return payload, nil
 }
 
-// HandleHandshake receives and handles a CONNREQ message, i.e., a client trying to connect
-func (p *PeerInfo) HandleHandshake() syserror.SysError {
-	/* Handle the CONNREQ message */
-	msgtype, payload_size, payload, err := p.RecvMsg()
-	if err != syserror.NoErr {
-		return syserror.ErrFatal
-	}
+// readMsg reads a complete message from the connection. It must not be
+// called concurrently, which is guaranteed by the read loop once started.
+func (p *PeerInfo) readMsg() (Message, error) {
+	var msg Message
+	opts := p.connOptions()
 
-	if msgtype == CONNREQ {
-		err := p.handleConnReq(payload_size, payload)
-		if err != syserror.NoErr {
-			return err
-		}
-	} else {
-		return syserror.NoErr // We did not get the expected CONNREQ msg
+	// We may wait for the next message for as long as the connection is
+	// allowed to be idle but once it started, it must be received in time
+	p.conn.SetReadDeadline(deadline(opts.IdleTimeout))
+	msgtype, err := p.GetHeader()
+	msg.Type = msgtype
+	if err != nil {
+		return msg, err
 	}
+	// Messages without payload
+	if msgtype == TERMMSG {
+		return msg, fmt.Errorf("received termination message: %w", ErrClosed)
+	}
+	p.conn.SetReadDeadline(deadline(opts.IOTimeout))
 
-	return syserror.NoErr
-}
+	id, err := p.getUint64()
+	if err != nil {
+		return msg, err
+	}
+	msg.ID = id &^ replyFlag
+	msg.Reply = id&replyFlag != 0
 
-func (p *PeerInfo) sendMsgType(msgType string) syserror.SysError {
-	if p.conn == nil {
-		return syserror.ErrFatal
+	// Get the payload size
+	payloadSize, err := p.getPayloadSize()
+	if err != nil {
+		return msg, err
+	}
+	if payloadSize == 0 {
+		return msg, nil
 	}
 
-	s, err := p.conn.Write([]byte(msgType))
-	if s == 0 || err != nil {
-		return syserror.ErrFatal
+	// Get the payload
+	msg.Payload, err = p.getPayload(payloadSize)
+	return msg, err
+}
+
+func (p *PeerInfo) handleConnReq(size uint64, payload []byte) error {
+	if p == nil {
+		return fmt.Errorf("local server is not initialized")
 	}
 
-	return syserror.NoErr
+	// Send CONNACK with the payload
+	p.logger().Printf("Sending CONNACK...")
+	return p.SendMsg(CONNACK, payload)
 }
 
-// SendMsg sends a basic message
-func (p *PeerInfo) SendMsg(msgType string, payload []byte) syserror.SysError {
-	if p.conn == nil {
-		return syserror.ErrFatal
+// HandleHandshake receives and handles a CONNREQ message, i.e., a client trying to connect
+func (p *PeerInfo) HandleHandshake() error {
+	/* Handle the CONNREQ message */
+	msgtype, payloadSize, payload, err := p.RecvMsg()
+	if err != nil {
+		return fmt.Errorf("failed to receive connection request: %w", err)
 	}
 
-	hdrerr := p.sendMsgType(msgType)
-	if hdrerr != syserror.NoErr {
-		return hdrerr
+	if msgtype != CONNREQ {
+		return fmt.Errorf("%w: expected connection request but received %s", ErrProtocol, msgtype)
 	}
 
-	if payload != nil {
-		syserr := p.sendUint64(uint64(len(payload)))
-		if syserr != syserror.NoErr {
-			return syserr
-		}
-		s, err := p.conn.Write(payload)
-		if s != len(payload) || err != nil {
-			log.Println("[ERROR] write operation failed")
-			return syserror.ErrFatal
-		}
-	} else {
-		syserr := p.sendUint64(uint64(0))
-		if syserr != syserror.NoErr {
-			return syserr
-		}
+	err = p.handleConnReq(payloadSize, payload)
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge connection request: %w", err)
 	}
 
-	return syserror.NoErr
+	return nil
 }
 
-func (p *PeerInfo) sendUint64(value uint64) syserror.SysError {
-	if p == nil || p.conn == nil {
-		return syserror.ErrFatal
+// writeMsg sends a complete message as a single write so that concurrent
+// senders never interleave their data on the connection
+func (p *PeerInfo) writeMsg(msg Message) error {
+	if p == nil || p.conn == nil || p.state == nil {
+		return ErrNotConnected
 	}
 
-	buff := make([]byte, 8)
-	if buff == nil {
-		return syserror.ErrOutOfRes
+	if len(msg.Type) != hdrSize {
+		return fmt.Errorf("%w: invalid message type %q", ErrProtocol, msg.Type)
 	}
 
-	binary.LittleEndian.PutUint64(buff, value)
-	s, myerr := p.conn.Write(buff)
-	if myerr != nil {
-		log.Println(myerr.Error())
+	if uint64(len(msg.Payload)) > MaxPayloadSize {
+		return fmt.Errorf("%w: payload of %d bytes", ErrOversize, len(msg.Payload))
 	}
-	if myerr == nil && s != 8 {
-		log.Println("Received ", s, "bytes, instead of 8")
+
+	id := msg.ID
+	if msg.Reply {
+		id |= replyFlag
 	}
-	if s != 8 || myerr != nil {
-		return syserror.ErrFatal
+
+	buff := make([]byte, frameHdrSize+len(msg.Payload))
+	copy(buff, msg.Type)
+	binary.LittleEndian.PutUint64(buff[hdrSize:], id)
+	binary.LittleEndian.PutUint64(buff[hdrSize+8:], uint64(len(msg.Payload)))
+	copy(buff[frameHdrSize:], msg.Payload)
+
+	p.state.wlock.Lock()
+	defer p.state.wlock.Unlock()
+	p.conn.SetWriteDeadline(deadline(p.connOptions().IOTimeout))
+	_, err := p.conn.Write(buff)
+	if err != nil {
+		// A partial write leaves the stream in an unknown state
+		go p.Close()
+		return readError("write operation failed", err)
 	}
 
-	return syserror.NoErr
+	return nil
+}
+
+// SendMsg sends a basic message
+func (p *PeerInfo) SendMsg(msgType string, payload []byte) error {
+	return p.writeMsg(Message{Type: msgType, Payload: payload})
 }
 
 // RecvMsg receives a basic message
-func (p *PeerInfo) RecvMsg() (string, uint64, []byte, syserror.SysError) {
-	if p == nil || p.conn == nil {
-		return "", 0, nil, syserror.ErrFatal
+func (p *PeerInfo) RecvMsg() (string, uint64, []byte, error) {
+	msg, err := p.Recv()
+	if err != nil {
+		return msg.Type, 0, nil, err
 	}
 
-	msgtype, err := p.GetHeader()
-	// Messages without payload
-	if msgtype == "TERM" || msgtype == "INVA" || err != syserror.NoErr {
-		return msgtype, 0, nil, syserror.ErrFatal
-	}
+	return msg.Type, uint64(len(msg.Payload)), msg.Payload, nil
+}
 
-	// Get the payload size
-	payload_size, err := p.getPayloadSize()
-	if err != syserror.NoErr {
-		return msgtype, 0, nil, syserror.ErrFatal
-	}
-	if payload_size == 0 {
-		return msgtype, 0, nil, syserror.NoErr
+// Recv receives the next message that is not a response to a request. If
+// the read loop of the connection is running, the message is taken from
+// the queue of incoming messages; otherwise it is directly read from the
+// connection.
+func (p *PeerInfo) Recv() (Message, error) {
+	if p == nil || p.conn == nil || p.state == nil {
+		return Message{Type: INVALID}, ErrNotConnected
 	}
 
-	// Get the payload
-	buff, err := p.getPayload(payload_size)
-	if err != syserror.NoErr {
-		return msgtype, payload_size, buff, syserror.NoErr
+	if p.state.readLoopStarted() {
+		msg, ok := <-p.state.incoming
+		if !ok {
+			return Message{Type: TERMMSG}, ErrClosed
+		}
+		return msg, nil
 	}
 
-	return msgtype, payload_size, buff, syserror.NoErr
+	return p.readMsg()
 }
 
 // ConnectHandshake initiates a connection handshake
-func (p *PeerInfo) ConnectHandshake() syserror.SysError {
+func (p *PeerInfo) ConnectHandshake() error {
 	err := p.SendMsg(CONNREQ, nil)
-	if err != syserror.NoErr {
-		return err
+	if err != nil {
+		return fmt.Errorf("failed to send connection request: %w", err)
 	}
 
-	// Receive the CONNACK, the payload is the block_sizw
-	msgtype, size, _, recverr := p.RecvMsg()
-	if recverr != syserror.NoErr || msgtype != CONNACK || size < 0 {
-		return syserror.ErrFatal
+	// Receive the CONNACK
+	msgtype, _, _, err := p.RecvMsg()
+	if err != nil {
+		return fmt.Errorf("failed to receive connection ack: %w", err)
+	}
+	if msgtype != CONNACK {
+		return fmt.Errorf("%w: expected connection ack but received %s", ErrProtocol, msgtype)
 	}
 	// todo: handle payload
 
-	return syserror.NoErr
+	return nil
 }
 
-func (p *PeerInfo) connectHandshake() syserror.SysError {
-	err := p.SendMsg(CONNREQ, nil)
-	if err != syserror.NoErr {
-		return err
-	}
-
-	// Receive the CONNACK, the payload is the block_sizw
-	msgtype, s, _, err := p.RecvMsg()
-	if err != syserror.NoErr || msgtype != CONNACK || s < 0 {
-		return syserror.ErrFatal
-	}
-
-	return syserror.NoErr
+// Connect connects to the peer and performs the connection handshake
+func (p *PeerInfo) Connect() error {
+	return p.ConnectContext(context.Background())
 }
 
-func (p *PeerInfo) Connect() syserror.SysError {
-	retry := 0
+// ConnectContext connects to the peer, retrying with an exponential backoff
+// until the connection succeeds, the number of retries is exhausted or the
+// context is canceled
+func (p *PeerInfo) ConnectContext(ctx context.Context) error {
 	if p == nil {
-		return syserror.ErrFatal
+		return fmt.Errorf("invalid parameter(s)")
 	}
 
+	opts := p.dialOptions()
+	transport := p.transport()
+	var conn net.Conn
 	var err error
-Retry:
-	p.conn, err = net.Dial("tcp", p.URL)
-	if err != nil {
-		log.Printf("Dial failed: %s", err.Error())
-		if retry < 5 {
-			retry++
-			log.Printf("Retrying after %d seconds\n", retry)
-			time.Sleep(time.Duration(retry) * time.Second)
-			goto Retry
+	for retry := 0; ; retry++ {
+		conn, err = transport.Dial(ctx, p.URL)
+		if err == nil {
+			break
+		}
+		p.logger().Printf("Dial failed: %s", err)
+		if retry >= opts.MaxRetries || ctx.Err() != nil {
+			return fmt.Errorf("failed to connect to %s after %d attempt(s): %w", p.URL, retry+1, err)
+		}
+
+		wait := opts.backoff(retry)
+		p.logger().Printf("Retrying after %s", wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("failed to connect to %s: %w", p.URL, ctx.Err())
 		}
-		return syserror.ErrOutOfRes
 	}
+	p.setConn(conn)
 
-	syserr := p.connectHandshake()
-	if syserr != syserror.NoErr {
-		return syserror.ErrFatal
+	err = p.ConnectHandshake()
+	if err != nil {
+		p.Close()
+		return fmt.Errorf("handshake with %s failed: %w", p.URL, err)
 	}
 
-	return syserror.NoErr
+	return nil
 }
 
-func (info *PeerInfo) doServer() syserror.SysError {
-	done := 0
-
-	syserr := info.HandleHandshake()
-	if syserr != syserror.NoErr {
-		log.Printf("[ERROR] handshake with client failed: %s", syserr.Error())
+func (info *PeerInfo) doServer() {
+	err := info.HandleHandshake()
+	if err != nil {
+		info.logger().Printf("[ERROR] handshake with client failed: %s", err)
+		info.Close()
+		return
 	}
-	for done != 1 {
-		// Handle the message header
-		msgtype, syserr := info.GetHeader()
-		if syserr != syserror.NoErr {
-			done = 1
-		}
-		if msgtype == "INVA" || msgtype == "TERM" {
-			done = 1
-		}
 
-		//  Handle the paylaod size
-		payload_size, pserr := info.getPayloadSize()
-		if pserr != syserror.NoErr {
-			done = 1
+	if info.OnConnect != nil {
+		err := info.OnConnect(info)
+		if err != nil {
+			info.logger().Printf("[ERROR] failed to set up connection with client: %s", err)
+			info.Close()
+			return
 		}
+	}
 
-		// Handle the payload when necessary
-		var payload []byte = nil
-		if payload_size != 0 {
-			payload, syserr = info.getPayload(payload_size)
-		}
-		if payload_size != 0 && payload != nil {
-			return syserror.ErrFatal
+	// Without handler, we simply drain the connection until termination
+	if info.Handler == nil {
+		for {
+			_, err := info.readMsg()
+			if err != nil {
+				break
+			}
 		}
+		info.Close()
+	} else {
+		info.StartReadLoop()
+		<-info.state.closed
 	}
 
-	info.conn.Close()
-	log.Printf("Go routine for peer %s done\n", info.URL)
+	info.logger().Printf("Go routine for peer %s done", info.URL)
+}
 
-	return syserror.NoErr
+// Server accepts connections from peers and handles each of them in a
+// dedicated Go routine
+type Server struct {
+	info     PeerInfo
+	listener net.Listener
+	lock     sync.Mutex
+	closed   bool
 }
 
-func (info *PeerInfo) CreateEmbeddedServer() syserror.SysError {
+// Listen creates a server listening on the URL of the peer
+func (info *PeerInfo) Listen() (*Server, error) {
 	if info == nil {
-		return syserror.ErrFatal
+		return nil, fmt.Errorf("invalid parameter(s)")
 	}
 
-	log.Println("Creating embedded server...")
-	listener, err := net.Listen("tcp", info.URL)
+	listener, err := info.transport().Listen(info.URL)
 	if err != nil {
-		return syserror.ErrFatal
+		return nil, fmt.Errorf("failed to listen on %s: %w", info.URL, err)
 	}
+	info.logger().Printf("Server created on %s", info.URL)
 
-	log.Println("Server created on", info.URL)
+	s := &Server{
+		info:     *info,
+		listener: listener,
+	}
+	return s, nil
+}
 
-	var conn net.Conn
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Serve accepts and handles connections until the server is closed
+func (s *Server) Serve() error {
 	for {
-		conn, err = listener.Accept()
-		log.Println("Connection accepted")
-		var newPeer PeerInfo
-		newPeer.conn = conn
+		conn, err := s.listener.Accept()
 		if err != nil {
-			log.Println("[ERROR] ", err.Error())
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		s.info.logger().Printf("Connection accepted")
+		newPeer := PeerInfo{
+			URL:         conn.RemoteAddr().String(),
+			Handler:     s.info.Handler,
+			OnConnect:   s.info.OnConnect,
+			Transport:   s.info.Transport,
+			ConnOptions: s.info.ConnOptions,
+			Logger:      s.info.Logger,
 		}
+		newPeer.setConn(conn)
 
-		log.Println("Creating new Go routine for new peer...")
 		go newPeer.doServer()
 	}
+}
+
+// Close stops accepting new connections
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.listener.Close()
+}
+
+// CreateEmbeddedServer creates a server and handles all incoming connections
+func (info *PeerInfo) CreateEmbeddedServer() error {
+	server, err := info.Listen()
+	if err != nil {
+		return err
+	}
 
-	// todo: fix termination
-	//return syserror.NoErr
+	return server.Serve()
 }
 
-func (info *PeerInfo) CreateServer() (PeerInfo, syserror.SysError) {
+// CreateServer waits for a single peer to connect and returns it
+func (info *PeerInfo) CreateServer() (PeerInfo, error) {
 	var newPeer PeerInfo
 	if info == nil {
-		return newPeer, syserror.ErrFatal
+		return newPeer, fmt.Errorf("invalid parameter(s)")
 	}
 
-	listener, err := net.Listen("tcp", info.URL)
+	listener, err := info.transport().Listen(info.URL)
 	if err != nil {
-		log.Printf("failed to listen on socket: %s", err)
-		return newPeer, syserror.ErrFatal
+		return newPeer, fmt.Errorf("failed to listen on %s: %w", info.URL, err)
 	}
+	defer listener.Close()
 
-	if info.timeout > 0 {
-		listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Duration(info.timeout) * time.Second))
+	opts := info.connOptions()
+	if d, ok := listener.(interface{ SetDeadline(time.Time) error }); ok && opts.AcceptTimeout > 0 {
+		d.SetDeadline(deadline(opts.AcceptTimeout))
 	}
 
-	newPeer.conn, err = listener.Accept()
+	conn, err := listener.Accept()
 	if err != nil {
-		return newPeer, syserror.ErrFatal
+		return newPeer, fmt.Errorf("failed to accept connection: %w", err)
 	}
+	newPeer.setConn(conn)
+	newPeer.Handler = info.Handler
+	newPeer.Transport = info.Transport
+	newPeer.ConnOptions = info.ConnOptions
+	newPeer.Logger = info.Logger
 
-	return newPeer, syserror.NoErr
+	return newPeer, nil
 }
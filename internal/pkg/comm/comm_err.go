@@ -0,0 +1,26 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package comm
+
+import "errors"
+
+// MaxPayloadSize is the maximum size of the payload of a message
+const MaxPayloadSize = 64 * 1024 * 1024
+
+// ErrClosed is returned when the connection has been closed, by the peer or locally
+var ErrClosed = errors.New("connection closed")
+
+// ErrNotConnected is returned when trying to use a peer without connection
+var ErrNotConnected = errors.New("not connected")
+
+// ErrProtocol is returned when the peer does not follow the protocol
+var ErrProtocol = errors.New("protocol violation")
+
+// ErrTimeout is returned when an operation did not complete in time
+var ErrTimeout = errors.New("timeout")
+
+// ErrOversize is returned when a message is larger than MaxPayloadSize
+var ErrOversize = errors.New("message too large")
@@ -0,0 +1,48 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package comm
+
+import (
+	"log"
+	"sync"
+)
+
+// Logger is the interface used by the package to report events
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger forwards everything to the standard logger
+type stdLogger struct{}
+
+func (l stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// nopLogger drops everything
+type nopLogger struct{}
+
+func (l nopLogger) Printf(format string, v ...interface{}) {}
+
+var loggerLock sync.RWMutex
+var logger Logger = stdLogger{}
+
+// SetLogger sets the logger used by the package for all the peers that do
+// not have their own; nil disables logging
+func SetLogger(l Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+func getLogger() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
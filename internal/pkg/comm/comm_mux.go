@@ -0,0 +1,356 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// incomingQueueSize is the number of messages that are not responses
+	// and that can be queued before the read loop blocks
+	incomingQueueSize = 64
+)
+
+// connState gathers all the data required to multiplex requests and
+// responses over a single connection
+type connState struct {
+	// wlock serializes the write operations on the connection
+	wlock sync.Mutex
+
+	// lock protects all the fields below
+	lock     sync.Mutex
+	nextID   uint64
+	pending  map[uint64]*Call
+	running  bool
+	incoming chan Message
+	closed   chan struct{}
+	isClosed bool
+	// err is the error that terminated the read loop, if any
+	err error
+}
+
+// Call represents an active request to a peer
+type Call struct {
+	// Request is the message sent to the peer
+	Request Message
+
+	// Response is the message received from the peer, valid only if Err
+	// is nil
+	Response Message
+
+	// Err is the status of the call once completed
+	Err error
+
+	// Done receives the call once completed
+	Done chan *Call
+
+	timer *time.Timer
+}
+
+func newConnState() *connState {
+	s := new(connState)
+	s.pending = make(map[uint64]*Call)
+	s.incoming = make(chan Message, incomingQueueSize)
+	s.closed = make(chan struct{})
+	return s
+}
+
+func (s *connState) readLoopStarted() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running
+}
+
+func (c *Call) done() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	// Done is buffered so this never blocks
+	c.Done <- c
+}
+
+// complete removes a call from the list of pending calls and returns it
+func (s *connState) complete(id uint64) *Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, id)
+	return c
+}
+
+// StartReadLoop starts a Go routine that reads all the messages from the
+// connection: responses are delivered to the pending calls, other messages
+// are passed to the handler of the peer or, if no handler is set, queued
+// so they can be received with Recv(). Once the read loop is started, Recv()
+// must not directly read from the connection anymore.
+func (p *PeerInfo) StartReadLoop() error {
+	if p == nil || p.conn == nil || p.state == nil {
+		return ErrNotConnected
+	}
+
+	p.state.lock.Lock()
+	if p.state.isClosed {
+		p.state.lock.Unlock()
+		return ErrClosed
+	}
+	if p.state.running {
+		p.state.lock.Unlock()
+		return nil
+	}
+	p.state.running = true
+	p.state.lock.Unlock()
+
+	go p.readLoop()
+	if p.connOptions().HeartbeatInterval > 0 {
+		go p.heartbeat()
+	}
+
+	return nil
+}
+
+func (p *PeerInfo) readLoop() {
+	for {
+		msg, err := p.readMsg()
+		if err != nil {
+			p.state.lock.Lock()
+			p.state.err = err
+			p.state.lock.Unlock()
+			break
+		}
+
+		if msg.Reply {
+			c := p.state.complete(msg.ID)
+			if c == nil {
+				p.logger().Printf("[WARN] dropping response to unknown request %d", msg.ID)
+				continue
+			}
+			c.Response = msg
+			c.Err = nil
+			c.done()
+			continue
+		}
+
+		// Heartbeats are handled by the comm layer itself
+		if msg.Type == PINGMSG {
+			if p.Reply(msg, PONGMSG, nil) != nil {
+				break
+			}
+			continue
+		}
+
+		if p.Handler != nil {
+			// Handlers may issue requests on the same connection so
+			// they cannot run in the context of the read loop
+			go p.Handler(p, msg)
+			continue
+		}
+
+		select {
+		case p.state.incoming <- msg:
+		case <-p.state.closed:
+		}
+	}
+
+	p.Close()
+	// Only the read loop sends to the queue so only it can close it
+	close(p.state.incoming)
+}
+
+// heartbeat periodically pings the peer and closes the connection when
+// the peer does not answer in time
+func (p *PeerInfo) heartbeat() {
+	opts := p.connOptions()
+	ticker := time.NewTicker(opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := p.Request(PINGMSG, nil, opts.HeartbeatTimeout)
+			if err != nil {
+				p.logger().Printf("[WARN] peer %s did not answer heartbeat, closing connection: %s", p.URL, err)
+				p.Close()
+				return
+			}
+		case <-p.state.closed:
+			return
+		}
+	}
+}
+
+// Go asynchronously sends a request to the peer. The call is completed
+// when the response is received, when the timeout expires or when the
+// connection is closed. A timeout of 0 means no timeout.
+func (p *PeerInfo) Go(msgType string, payload []byte, timeout time.Duration) *Call {
+	c := &Call{
+		Done: make(chan *Call, 1),
+	}
+
+	if p == nil || p.state == nil {
+		c.Err = ErrNotConnected
+		c.done()
+		return c
+	}
+
+	err := p.StartReadLoop()
+	if err != nil {
+		c.Err = err
+		c.done()
+		return c
+	}
+
+	s := p.state
+	s.lock.Lock()
+	if s.isClosed {
+		s.lock.Unlock()
+		// closeError() acquires the lock
+		c.Err = s.closeError()
+		c.done()
+		return c
+	}
+	s.nextID++
+	// 0 is reserved for messages that do not expect a response
+	if s.nextID&^replyFlag == 0 {
+		s.nextID = 1
+	}
+	id := s.nextID
+	c.Request = Message{Type: msgType, ID: id, Payload: payload}
+	s.pending[id] = c
+	if timeout > 0 {
+		c.timer = time.AfterFunc(timeout, func() {
+			if s.complete(id) != nil {
+				c.Err = fmt.Errorf("request %d (%s) not answered after %s: %w", id, msgType, timeout, ErrTimeout)
+				c.Done <- c
+			}
+		})
+	}
+	s.lock.Unlock()
+
+	err = p.writeMsg(c.Request)
+	if err != nil {
+		if s.complete(id) != nil {
+			c.Err = err
+			c.done()
+		}
+	}
+
+	return c
+}
+
+// Request sends a request to the peer and waits for the response
+func (p *PeerInfo) Request(msgType string, payload []byte, timeout time.Duration) (Message, error) {
+	c := <-p.Go(msgType, payload, timeout).Done
+	return c.Response, c.Err
+}
+
+// Reply sends the response to a request received from the peer
+func (p *PeerInfo) Reply(req Message, msgType string, payload []byte) error {
+	if req.ID == 0 {
+		return fmt.Errorf("%w: message %s is not a request", ErrProtocol, req.Type)
+	}
+
+	return p.writeMsg(Message{Type: msgType, ID: req.ID, Reply: true, Payload: payload})
+}
+
+// Close closes the connection with the peer; all pending calls fail
+func (p *PeerInfo) Close() error {
+	if p == nil || p.conn == nil || p.state == nil {
+		return ErrNotConnected
+	}
+
+	s := p.state
+	s.lock.Lock()
+	if s.isClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.isClosed = true
+	pending := s.pending
+	s.pending = make(map[uint64]*Call)
+	s.lock.Unlock()
+
+	err := p.conn.Close()
+	cerr := s.closeError()
+	for _, c := range pending {
+		c.Err = cerr
+		c.done()
+	}
+	close(s.closed)
+
+	return err
+}
+
+// closeError returns the error reported to the calls that cannot complete
+// because the connection is closed
+func (s *connState) closeError() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil && errors.Is(s.err, ErrClosed) {
+		return s.err
+	}
+	if s.err != nil {
+		return fmt.Errorf("%w: %s", ErrClosed, s.err)
+	}
+	return ErrClosed
+}
+
+// Closed returns a channel that is closed when the connection is closed
+func (p *PeerInfo) Closed() <-chan struct{} {
+	if p == nil || p.state == nil {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return p.state.closed
+}
+
+// HandlerMux dispatches incoming messages to handlers based on the type
+// of the messages, which lets multiple protocols share a connection
+type HandlerMux struct {
+	lock     sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewHandlerMux creates a new, empty, multiplexer
+func NewHandlerMux() *HandlerMux {
+	return &HandlerMux{
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for a given type of message; the message type
+// is also registered with the comm layer
+func (m *HandlerMux) Handle(msgType string, h Handler) error {
+	err := RegisterMsgType(msgType)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.handlers[msgType] = h
+	return nil
+}
+
+// ServeMsg dispatches a message to the registered handler; it is meant to
+// be used as the handler of peers
+func (m *HandlerMux) ServeMsg(p *PeerInfo, msg Message) {
+	m.lock.RLock()
+	h, ok := m.handlers[msg.Type]
+	m.lock.RUnlock()
+	if !ok {
+		p.logger().Printf("[WARN] no handler for message of type %s", msg.Type)
+		return
+	}
+	h(p, msg)
+}
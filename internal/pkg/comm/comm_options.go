@@ -0,0 +1,109 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package comm
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMaxRetries     = 5
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultMultiplier     = 2.0
+	defaultJitter         = 0.2
+	defaultIOTimeout      = 30 * time.Second
+)
+
+// DialOptions specifies how we try to connect to a peer
+type DialOptions struct {
+	// MaxRetries is the number of times we retry after a failed attempt
+	// to connect
+	MaxRetries int
+
+	// InitialBackoff is the time we wait before the first retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum time we wait between two attempts
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor applied to the backoff after each failure
+	Multiplier float64
+
+	// Jitter is the fraction of the backoff, between 0 and 1, that is
+	// randomized to prevent peers from retrying all at the same time
+	Jitter float64
+}
+
+// ConnOptions specifies the behavior of an established connection.
+// A duration of 0 disables the associated mechanism.
+type ConnOptions struct {
+	// IdleTimeout is the maximum time we wait for a new message before
+	// considering the connection as dead
+	IdleTimeout time.Duration
+
+	// IOTimeout is the maximum time a single read or write operation of
+	// a message, once started, can take
+	IOTimeout time.Duration
+
+	// AcceptTimeout is the maximum time a server waits for a new peer
+	AcceptTimeout time.Duration
+
+	// HeartbeatInterval is the time between two ping messages sent to the
+	// peer once the read loop of the connection is running
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTimeout is the maximum time we wait for the response to a
+	// ping before closing the connection
+	HeartbeatTimeout time.Duration
+}
+
+// DefaultDialOptions returns the options used to connect to a peer when
+// none are specified
+func DefaultDialOptions() DialOptions {
+	return DialOptions{
+		MaxRetries:     defaultMaxRetries,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		Multiplier:     defaultMultiplier,
+		Jitter:         defaultJitter,
+	}
+}
+
+// DefaultConnOptions returns the options of a connection when none are
+// specified
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		IOTimeout: defaultIOTimeout,
+	}
+}
+
+// backoff returns the time to wait before the given retry (starting at 0)
+func (o *DialOptions) backoff(retry int) time.Duration {
+	b := float64(o.InitialBackoff)
+	for i := 0; i < retry; i++ {
+		b *= o.Multiplier
+		if o.MaxBackoff > 0 && b > float64(o.MaxBackoff) {
+			b = float64(o.MaxBackoff)
+			break
+		}
+	}
+
+	if o.Jitter > 0 {
+		// Spread the backoff uniformly in [b*(1-jitter), b*(1+jitter)]
+		b += b * o.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(b)
+}
+
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
@@ -6,92 +6,488 @@
 package comm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
-
-	"github.com/gvallee/syserror/pkg/syserror"
-)
-
-const (
-	namespace1 = "namespace_test1"
-	namespace2 = "namespace2"
 )
 
 func sendFiniMsg(peer *PeerInfo, t *testing.T) {
 	myerr := peer.SendMsg(TERMMSG, nil)
-	if myerr != syserror.NoErr {
+	if myerr != nil {
 		t.Fatal("SendMsg() failed")
 	}
-
-	time.Sleep(5 * time.Second) // Give a chance for the msg to arrive before we exit which could close the connection before the test completes
 }
 
 func TestServerCreation(t *testing.T) {
 	t.Log("Testing creation of a valid server ")
 
-	// Create a server asynchronously
+	network := NewMemNetwork()
 	server := PeerInfo{
-		URL: "127.0.0.1:8888",
+		URL:       "server",
+		Transport: network.Transport("server"),
 	}
-
-	go server.CreateEmbeddedServer()
+	s, err := server.Listen()
+	if err != nil {
+		t.Fatal("cannot create server")
+	}
+	defer s.Close()
+	go s.Serve()
 
 	// Create a simple client that will just terminate everything
-	syserr := server.Connect()
-	if server.conn == nil || syserr != syserror.NoErr {
+	client := PeerInfo{
+		URL:       "server",
+		Transport: network.Transport("client"),
+	}
+	err = client.Connect()
+	if client.conn == nil || err != nil {
 		t.Fatal("cannot connect to server")
 	}
 	t.Log("Sending termination msg...")
-	sendFiniMsg(&server, t)
+	sendFiniMsg(&client, t)
+	client.Close()
 }
 
-func (info *PeerInfo) runServer(t *testing.T) {
-	t.Log("Actually creating the server...")
-	newPeer, mysyserr := info.CreateServer()
-	if mysyserr != syserror.NoErr {
-		t.Fatal("cannot create new server")
+func (info *PeerInfo) runServer(ready chan struct{}) error {
+	// Give the server the opportunity to wait for the client
+	info.ConnOptions = &ConnOptions{AcceptTimeout: 5 * time.Second}
+	close(ready)
+	newPeer, err := info.CreateServer()
+	if err != nil {
+		return fmt.Errorf("cannot create new server")
 	}
+	defer newPeer.Close()
 
 	// At this point, we have a socket-level connection with a new peer
-	done := 0
-	t.Log("Waiting for connection handshake...")
-	syserr := newPeer.HandleHandshake()
-	if syserr != syserror.NoErr {
-		t.Fatalf("unable to handle handshake: %s", syserr.Error())
-	}
-	for done != 1 {
-		t.Log("Receiving data...")
-
-		/* Wait for the termination message */
-		t.Log("Waiting for the termination message...")
-		msgtype, _, _, _ := newPeer.RecvMsg()
-		if msgtype != TERMMSG {
-			t.Fatal("received wrong type of msg")
-		}
-
-		done = 1
+	err = newPeer.HandleHandshake()
+	if err != nil {
+		return fmt.Errorf("unable to handle handshake: %s", err)
 	}
-}
 
-func TestSendRecv(t *testing.T) {
-	fmt.Print("Testing data send/recv ")
-	info := PeerInfo{
-		URL: "127.0.0.1:9889",
+	/* Wait for the termination message */
+	msgtype, _, _, _ := newPeer.RecvMsg()
+	if msgtype != TERMMSG {
+		return fmt.Errorf("received wrong type of msg")
 	}
 
+	return nil
+}
+
+func testSendRecv(t *testing.T, server PeerInfo, client PeerInfo) {
 	// Create a server asynchronously
 	t.Log("Creating server...")
-	go info.runServer(t)
+	ready := make(chan struct{})
+	res := make(chan error)
+	go func() {
+		res <- server.runServer(ready)
+	}()
+	<-ready
 
-	// Once we know the server is up, we connect to it
+	// Once we know the server is up, we connect to it; the server may not
+	// be listening yet so we rely on the retry mechanism
 	t.Log("Server up, conencting...")
-	syserr := info.Connect()
-	if info.conn == nil || syserr != syserror.NoErr {
+	client.DialOptions = &DialOptions{
+		MaxRetries:     20,
+		InitialBackoff: 10 * time.Millisecond,
+		Multiplier:     1,
+	}
+	err := client.Connect()
+	if client.conn == nil || err != nil {
 		t.Fatal("Client error: Cannot connect to server")
 	}
 	t.Log("Successfully connected to server")
 	t.Log("Test completed, sending termination msg...")
 
-	sendFiniMsg(&info, t)
+	sendFiniMsg(&client, t)
+	err = <-res
+	if err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+	client.Close()
+}
+
+func TestSendRecv(t *testing.T) {
+	network := NewMemNetwork()
+	server := PeerInfo{
+		URL:       "server",
+		Transport: network.Transport("server"),
+	}
+	client := PeerInfo{
+		URL:       "server",
+		Transport: network.Transport("client"),
+	}
+	testSendRecv(t, server, client)
+}
+
+func TestOnConnect(t *testing.T) {
+	network := NewMemNetwork()
+	server := PeerInfo{
+		URL:       "server",
+		Transport: network.Transport("server"),
+		OnConnect: func(p *PeerInfo) error {
+			return p.SendMsg(DATAMSG, []byte("welcome"))
+		},
+	}
+	s, err := server.Listen()
+	if err != nil {
+		t.Fatalf("cannot create server: %s", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	// The first message after the handshake comes from the server
+	client := PeerInfo{
+		URL:       "server",
+		Transport: network.Transport("client"),
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatalf("cannot connect to server: %s", err)
+	}
+	defer client.Close()
+	msgType, _, payload, err := client.RecvMsg()
+	if err != nil || msgType != DATAMSG || string(payload) != "welcome" {
+		t.Fatalf("did not receive the message sent on connection: %s %q (%v)", msgType, payload, err)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sock")
+	server := PeerInfo{
+		URL:       path,
+		Transport: UnixTransport{},
+	}
+	client := PeerInfo{
+		URL:       path,
+		Transport: UnixTransport{},
+	}
+	testSendRecv(t, server, client)
+}
+
+// connectMemPeers creates a server on a node of the network that answers
+// all requests and connects another node to it
+func connectMemPeers(t *testing.T, network *MemNetwork, serverNode string, clientNode string) (*Server, PeerInfo) {
+	server := PeerInfo{
+		URL:       serverNode,
+		Transport: network.Transport(serverNode),
+		Handler: func(p *PeerInfo, msg Message) {
+			p.Reply(msg, DATAMSG, msg.Payload)
+		},
+	}
+	s, err := server.Listen()
+	if err != nil {
+		t.Fatal("cannot create server")
+	}
+	go s.Serve()
+
+	client := PeerInfo{
+		URL:       serverNode,
+		Transport: network.Transport(clientNode),
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatal("cannot connect to server")
+	}
+
+	return s, client
+}
+
+func TestMemNetworkLatency(t *testing.T) {
+	network := NewMemNetwork()
+	s, client := connectMemPeers(t, network, "server", "client")
+	defer s.Close()
+	defer client.Close()
+
+	network.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	_, err := client.Request(DATAMSG, []byte("hello"), 5*time.Second)
+	if err != nil {
+		t.Fatal("request failed")
+	}
+	// The request and its response are both delayed
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("latency was not applied (%s)", time.Since(start))
+	}
+}
+
+func TestMemNetworkDrops(t *testing.T) {
+	network := NewMemNetwork()
+	s, client := connectMemPeers(t, network, "server", "client")
+	defer s.Close()
+	defer client.Close()
+
+	network.SetDropRate(1)
+	_, err := client.Request(DATAMSG, []byte("hello"), 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("request succeeded even if all messages are dropped")
+	}
+
+	network.SetDropRate(0)
+	_, err = client.Request(DATAMSG, []byte("hello"), 5*time.Second)
+	if err != nil {
+		t.Fatal("request failed after messages stopped being dropped")
+	}
+}
+
+func TestMemNetworkPartition(t *testing.T) {
+	network := NewMemNetwork()
+	s, client := connectMemPeers(t, network, "node1", "node2")
+	defer s.Close()
+	defer client.Close()
+
+	network.Partition([]string{"node1"}, []string{"node2", "node3"})
+	_, err := client.Request(DATAMSG, []byte("hello"), 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("request succeeded across partitions")
+	}
+
+	node3 := PeerInfo{
+		URL:         "node1",
+		Transport:   network.Transport("node3"),
+		DialOptions: &DialOptions{},
+	}
+	if node3.Connect() == nil {
+		t.Fatal("connection succeeded across partitions")
+	}
+
+	network.Heal()
+	_, err = client.Request(DATAMSG, []byte("hello"), 5*time.Second)
+	if err != nil {
+		t.Fatal("request failed after the partition was healed")
+	}
+}
+
+func createPipePeers() (PeerInfo, PeerInfo) {
+	c1, c2 := net.Pipe()
+	var p1, p2 PeerInfo
+	p1.setConn(c1)
+	p2.setConn(c2)
+	return p1, p2
+}
+
+func TestRequestMultiplexing(t *testing.T) {
+	client, server := createPipePeers()
+	defer client.Close()
+
+	// The server answers requests in the reverse order of their arrival
+	// to make sure responses are correctly matched with requests
+	const nReqs = 10
+	reqs := make(chan Message, nReqs)
+	server.Handler = func(p *PeerInfo, msg Message) {
+		reqs <- msg
+	}
+	server.StartReadLoop()
+	go func() {
+		var received []Message
+		for i := 0; i < nReqs; i++ {
+			received = append(received, <-reqs)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			server.Reply(received[i], DATAMSG, received[i].Payload)
+		}
+	}()
+
+	var calls []*Call
+	for i := 0; i < nReqs; i++ {
+		calls = append(calls, client.Go(DATAMSG, []byte(fmt.Sprintf("req%d", i)), 5*time.Second))
+	}
+
+	for i, c := range calls {
+		<-c.Done
+		if c.Err != nil {
+			t.Fatalf("request %d failed: %s", i, c.Err)
+		}
+		expected := fmt.Sprintf("req%d", i)
+		if string(c.Response.Payload) != expected {
+			t.Fatalf("response does not match request: %s vs. %s", string(c.Response.Payload), expected)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	client, server := createPipePeers()
+	defer client.Close()
+
+	// The server never answers
+	server.Handler = func(p *PeerInfo, msg Message) {}
+	server.StartReadLoop()
+
+	_, err := client.Request(DATAMSG, []byte("hello"), 100*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("request did not time out even if the server never answered: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	opts := DialOptions{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, e := range expected {
+		b := opts.backoff(i)
+		if b != e {
+			t.Fatalf("backoff for retry %d is %s instead of %s", i, b, e)
+		}
+	}
+
+	opts.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		b := opts.backoff(0)
+		if b < 50*time.Millisecond || b > 150*time.Millisecond {
+			t.Fatalf("backoff with jitter is out of range: %s", b)
+		}
+	}
+}
+
+func TestConnectCancel(t *testing.T) {
+	// Nobody is listening on that port so all attempts fail
+	peer := PeerInfo{
+		URL: "127.0.0.1:1",
+		DialOptions: &DialOptions{
+			MaxRetries:     100,
+			InitialBackoff: time.Hour,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := peer.ConnectContext(ctx)
+	if err == nil {
+		t.Fatal("connection succeeded without server")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("cancellation of the context did not interrupt the connection")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	opts := &ConnOptions{
+		IOTimeout:         100 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	}
+
+	// A live peer answers the heartbeats so the connection stays up
+	client, server := createPipePeers()
+	client.ConnOptions = opts
+	server.StartReadLoop()
+	client.StartReadLoop()
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-client.state.closed:
+		t.Fatal("connection with a live peer was closed")
+	default:
+	}
+	client.Close()
+
+	// A dead peer never reads anything so the heartbeat fails
+	dead, _ := createPipePeers()
+	dead.ConnOptions = opts
+	dead.StartReadLoop()
+	select {
+	case <-dead.state.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead peer was not detected")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client, server := createPipePeers()
+	defer client.Close()
+	server.ConnOptions = &ConnOptions{
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	server.StartReadLoop()
+
+	select {
+	case <-server.state.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	// Pending requests fail when the peer closes the connection
+	client, server := createPipePeers()
+	server.Handler = func(p *PeerInfo, msg Message) {
+		p.Close()
+	}
+	server.StartReadLoop()
+	_, err := client.Request(DATAMSG, nil, 5*time.Second)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected closed connection but got: %v", err)
+	}
+
+	// Messages larger than the maximum size are rejected before being sent
+	sender, _ := createPipePeers()
+	err = sender.SendMsg(DATAMSG, make([]byte, MaxPayloadSize+1))
+	if !errors.Is(err, ErrOversize) {
+		t.Fatalf("expected oversized message but got: %v", err)
+	}
+	sender.Close()
+
+	// Unknown messages are protocol violations
+	c1, c2 := net.Pipe()
+	var peer PeerInfo
+	peer.setConn(c2)
+	go c1.Write([]byte("XXXX"))
+	_, err = peer.Recv()
+	if !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected protocol violation but got: %v", err)
+	}
+	peer.Close()
+	c1.Close()
+
+	// Using a peer that is not connected
+	var unconnected PeerInfo
+	err = unconnected.SendMsg(DATAMSG, nil)
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected not connected but got: %v", err)
+	}
+}
+
+type recordLogger struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	l := new(recordLogger)
+	peer := PeerInfo{
+		URL:         "nowhere",
+		Transport:   NewMemNetwork().Transport("client"),
+		DialOptions: &DialOptions{},
+		Logger:      l,
+	}
+	if peer.Connect() == nil {
+		t.Fatal("connection succeeded without server")
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.msgs) == 0 {
+		t.Fatal("the logger of the peer was not used")
+	}
 }
@@ -0,0 +1,396 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package comm
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport is the mechanism used to establish connections between peers
+type Transport interface {
+	// Dial connects to the peer listening on the given address
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+
+	// Listen creates a listener for incoming connections on the given address
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCPTransport is a transport based on TCP sockets, addresses are of the
+// form host:port
+type TCPTransport struct{}
+
+// UnixTransport is a transport based on Unix domain sockets, addresses
+// are paths to the socket files
+type UnixTransport struct{}
+
+// Dial connects to a peer over TCP
+func (t TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Listen creates a TCP listener
+func (t TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial connects to a peer over a Unix domain socket
+func (t UnixTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
+
+// Listen creates a Unix domain socket listener
+func (t UnixTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("unix", addr)
+}
+
+// MemNetwork is a simulated network where all the connections are
+// in-memory. It is mainly used to deterministically test protocols over
+// multiple nodes without relying on the host's network. Latency, message
+// drops and partitions can be injected; since the comm layer writes each
+// message with a single write operation, a dropped write is a dropped
+// message.
+type MemNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memListener
+	latency   time.Duration
+	dropRate  float64
+	groups    map[string]int
+	rand      *rand.Rand
+}
+
+// NewMemNetwork creates a new, empty, in-memory network
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetLatency sets the delay applied to every message sent on the network
+func (n *MemNetwork) SetLatency(d time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.latency = d
+}
+
+// SetDropRate sets the probability, between 0 and 1, for a message to be lost
+func (n *MemNetwork) SetDropRate(rate float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.dropRate = rate
+}
+
+// Partition splits the network: nodes can only communicate with nodes of
+// the same group. Nodes that are not part of any group are isolated.
+func (n *MemNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, node := range g {
+			n.groups[node] = i
+		}
+	}
+}
+
+// Heal removes all partitions
+func (n *MemNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = nil
+}
+
+// Transport returns the transport to be used by a given node of the network
+func (n *MemNetwork) Transport(node string) Transport {
+	return &memTransport{
+		network: n,
+		node:    node,
+	}
+}
+
+func (n *MemNetwork) reachable(from, to string) bool {
+	if n.groups == nil {
+		return true
+	}
+	g1, ok1 := n.groups[from]
+	g2, ok2 := n.groups[to]
+	return ok1 && ok2 && g1 == g2
+}
+
+// deliver returns whether a message from a node to another should be
+// delivered and after what delay
+func (n *MemNetwork) deliver(from, to string) (bool, time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.reachable(from, to) {
+		return false, 0
+	}
+	if n.dropRate > 0 && n.rand.Float64() < n.dropRate {
+		return false, 0
+	}
+	return true, n.latency
+}
+
+type memTransport struct {
+	network *MemNetwork
+	node    string
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+// Dial connects to a node of the in-memory network
+func (t *memTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t.network.lock.Lock()
+	l, ok := t.network.listeners[addr]
+	reachable := t.network.reachable(t.node, l.nodeName())
+	t.network.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("connection refused: nobody listening on %s", addr)
+	}
+	if !reachable {
+		return nil, fmt.Errorf("%s is unreachable from %s", addr, t.node)
+	}
+
+	c1, c2 := net.Pipe()
+	local := newMemConn(c1, t.network, t.node, l.node, memAddr(t.node), memAddr(addr))
+	remote := newMemConn(c2, t.network, l.node, t.node, memAddr(addr), memAddr(t.node))
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("connection refused: %s is closed", addr)
+	case <-ctx.Done():
+		local.Close()
+		remote.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Listen creates a listener on the in-memory network
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if _, ok := t.network.listeners[addr]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	l := &memListener{
+		network: t.network,
+		node:    t.node,
+		addr:    addr,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[addr] = l
+	return l, nil
+}
+
+type memListener struct {
+	network  *MemNetwork
+	node     string
+	addr     string
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+	lock     sync.Mutex
+	deadline time.Time
+}
+
+func (l *memListener) nodeName() string {
+	if l == nil {
+		return ""
+	}
+	return l.node
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	d := l.deadline
+	l.lock.Unlock()
+	var timeout <-chan time.Time
+	if !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener %s closed", l.addr)
+	case <-timeout:
+		return nil, fmt.Errorf("accept on %s timed out", l.addr)
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.network.lock.Lock()
+		delete(l.network.listeners, l.addr)
+		l.network.lock.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
+
+func (l *memListener) SetDeadline(t time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.deadline = t
+	return nil
+}
+
+const (
+	// memFlushTimeout is the time given to a peer to read the data still
+	// in flight when a connection is closed
+	memFlushTimeout = time.Second
+)
+
+type memPacket struct {
+	data []byte
+	at   time.Time
+}
+
+// memConn is one end of an in-memory connection. Writes are queued and
+// delivered in order by a dedicated Go routine so that latency can be
+// simulated without blocking the writer.
+type memConn struct {
+	net.Conn
+	network    *MemNetwork
+	from       string
+	to         string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []memPacket
+	closed bool
+}
+
+func newMemConn(c net.Conn, n *MemNetwork, from, to string, local, remote net.Addr) *memConn {
+	mc := &memConn{
+		Conn:       c,
+		network:    n,
+		from:       from,
+		to:         to,
+		localAddr:  local,
+		remoteAddr: remote,
+	}
+	mc.cond = sync.NewCond(&mc.lock)
+	go mc.pump()
+	return mc
+}
+
+func (c *memConn) pump() {
+	for {
+		c.lock.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			// Closed and everything has been delivered
+			c.lock.Unlock()
+			c.Conn.Close()
+			return
+		}
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+		closed := c.closed
+		c.lock.Unlock()
+
+		time.Sleep(time.Until(p.at))
+		if closed {
+			// Do not wait forever for a peer that does not read anymore
+			c.Conn.SetWriteDeadline(time.Now().Add(memFlushTimeout))
+		}
+		_, err := c.Conn.Write(p.data)
+		if err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, fmt.Errorf("write on closed connection")
+	}
+
+	ok, latency := c.network.deliver(c.from, c.to)
+	if ok {
+		data := make([]byte, len(b))
+		copy(data, b)
+		c.queue = append(c.queue, memPacket{data: data, at: time.Now().Add(latency)})
+		c.cond.Signal()
+	}
+
+	return len(b), nil
+}
+
+// Close closes the connection; the data already written is still delivered
+// to the peer, like a socket would do
+func (c *memConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cond.Signal()
+
+	// Wake up any pending read
+	return c.Conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// SetWriteDeadline is a no-op since writes never block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
@@ -5,13 +5,19 @@
 
 package connected
 
-import "github.com/sylabs/syvalidate/internal/pkg/hashcash"
+import (
+	"errors"
 
-func CreateBlock(stamp hashcash.Stamp) error {
-	// Because we combine a blockchain and a file system, we need to:
-	// 1. get a new block through consensus (distributed operation)
-	// 2. populate the block
-	// 3. save the data into the FS (distributed file system)
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+)
 
-	return nil
+// ErrNotSupported is returned when a block is created directly in connected
+// mode: the leader creates the blocks out of the stamps submitted to the
+// network, see blockchain.SubmitStamp
+var ErrNotSupported = errors.New("blocks cannot be created directly in connected mode, stamps must be submitted to the network")
+
+// CreateBlock is the function creating blocks in leader mode; blocks only go
+// through consensus so it always fails with ErrNotSupported
+func CreateBlock(stamp hashcash.Stamp, manifests []string) error {
+	return ErrNotSupported
 }
@@ -0,0 +1,91 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The fields of a stamp cannot include the separators of the format, i.e.,
+// ':' and, in the extension, ';', '=' and ','. Such characters, as well as
+// '%', spaces and non-printable characters, are percent-encoded with
+// uppercase hexadecimal digits. Only the characters that must be escaped are,
+// so that each string has a single escaped form.
+
+const (
+	resourceReserved = ":"
+	extReserved      = ":;=,"
+	upperHex         = "0123456789ABCDEF"
+)
+
+func mustEscape(c byte, reserved string) bool {
+	return c <= ' ' || c >= 0x7f || c == '%' || strings.IndexByte(reserved, c) >= 0
+}
+
+func escapeField(str string, reserved string) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if mustEscape(c, reserved) {
+			b.WriteByte('%')
+			b.WriteByte(upperHex[c>>4])
+			b.WriteByte(upperHex[c&0xf])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	i := strings.IndexByte(upperHex, c)
+	if i < 0 {
+		return 0, false
+	}
+	return byte(i), true
+}
+
+func unescapeField(str string, reserved string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c != '%' {
+			if mustEscape(c, reserved) {
+				return "", fmt.Errorf("unescaped character %q in %s", c, str)
+			}
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+2 >= len(str) {
+			return "", fmt.Errorf("truncated escape sequence in %s", str)
+		}
+		hi, ok1 := unhex(str[i+1])
+		lo, ok2 := unhex(str[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("invalid escape sequence %s in %s", str[i:i+3], str)
+		}
+		c = hi<<4 | lo
+		if !mustEscape(c, reserved) {
+			return "", fmt.Errorf("unnecessary escape sequence %s in %s", str[i:i+3], str)
+		}
+		b.WriteByte(c)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// EscapeExt escapes a name or a value of the extension of a stamp
+func EscapeExt(str string) string {
+	return escapeField(str, extReserved)
+}
+
+// UnescapeExt returns the original form of a name or a value escaped with
+// EscapeExt
+func UnescapeExt(str string) (string, error) {
+	return unescapeField(str, extReserved)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestEscapeExt(t *testing.T) {
+	tests := []struct {
+		str     string
+		escaped string
+	}{
+		{str: "", escaped: ""},
+		{str: "dummy1", escaped: "dummy1"},
+		{str: "a:b;c=d,e", escaped: "a%3Ab%3Bc%3Dd%2Ce"},
+		{str: "100% done", escaped: "100%25%20done"},
+		{str: "\x00\xff", escaped: "%00%FF"},
+	}
+	for _, tt := range tests {
+		if e := EscapeExt(tt.str); e != tt.escaped {
+			t.Fatalf("%q escaped as %s instead of %s", tt.str, e, tt.escaped)
+		}
+	}
+
+	roundTrip := func(str string) bool {
+		e := EscapeExt(str)
+		if strings.ContainsAny(e, extReserved) {
+			return false
+		}
+		u, err := UnescapeExt(e)
+		return err == nil && u == str
+	}
+	err := quick.Check(roundTrip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each string has a single escaped form
+	canonical := func(str string) bool {
+		u, err := UnescapeExt(str)
+		return err != nil || EscapeExt(u) == str
+	}
+	err = quick.Check(canonical, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{"%3a", "%41", "%3", "a b", "a;b"} {
+		if _, err := UnescapeExt(e); err == nil {
+			t.Fatalf("invalid escaped string %q was unescaped", e)
+		}
+	}
+}
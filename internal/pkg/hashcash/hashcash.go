@@ -6,205 +6,331 @@
 package hashcash
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
-	"encoding/hex"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/sylabs/syvalidate/internal/pkg/hash"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
 )
 
 const (
-	Version = "1.01"
+	// Version is the version of the hashcash format of the stamps
+	Version = "1"
+
+	// DefaultDifficulty is the number of leading bits equal to zero of the
+	// hash of a stamp that is required unless stated otherwise, e.g., by the
+	// namespace of the stamp
+	DefaultDifficulty = 20
+
+	// expiryDays is the number of days a stamp is valid: 28 days plus 2
+	// days for clock skew
+	expiryDays = 28 + 2
 )
 
 type Stamp struct {
-	version   string
-	bits      int
-	date      time.Time // Must be of the following format: yyyy-MM-dd'T'HH:mm:ssZ
-	resource  string    // IP address
-	ext       string    // Key/value pair of format [name1[=val1[,val2...]];[name2[=val1[,val2...]]...]]
-	rand      string
-	counter   string
-	signature string // The string representation of the stamp
-}
-
-// AddManifest adds an existing manifest to 'ext' since the list of manifests corresponding to the work done
-// defines the SoW
-func (s *Stamp) AddManifest(path string) error {
-	/* A manifest is always a file that we can hash */
-
-	// Add the hash of the file to ext
-	name := filepath.Base(path)
-	name = strings.TrimRight(name, ".MANIFEST")
-	hash := hash.HashFile(path)
-	extStr := name + "=" + hash
-	if s.ext == "" {
-		s.ext = extStr
-	} else {
-		s.ext += ";" + extStr
-	}
+	version  string
+	bits     int
+	date     time.Time // Serialized in UTC as YYMMDD[hhmm[ss]]
+	dateLen  int       // Number of digits of the serialized date
+	resource string    // Identity of the node that did the work
+	ext      string    // Key/value pair of format [name1[=val1[,val2...]];[name2[=val1[,val2...]]...]], with escaped names and values
+	rand     string
+	counter  string
+}
 
-	return nil
+// Ext returns the extension of the stamp, i.e., the list of manifests
+// defining the work that was done; names and values are escaped with
+// EscapeExt
+func (s *Stamp) Ext() string {
+	return s.ext
+}
+
+// Resource returns the resource the stamp was created for, i.e., the identity
+// of the node that did the work: its node ID, interface address, hostname or
+// key fingerprint
+func (s *Stamp) Resource() string {
+	return s.resource
+}
+
+// Bits returns the number of leading bits equal to zero the stamp claims to
+// have, i.e., the difficulty it was minted for
+func (s *Stamp) Bits() int {
+	return s.bits
+}
+
+// Date returns the date at which the stamp was created
+func (s *Stamp) Date() time.Time {
+	return s.date
 }
 
 func getRandomBase64String() string {
-	rand.Seed(time.Now().UnixNano())
-	digits := "0123456789"
-	specials := "~=+%^*/()[]{}/!@#$?|"
-	all := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" + digits + specials
-	length := 16
-	buf := make([]byte, length)
-	buf[0] = digits[rand.Intn(len(digits))]
-	buf[1] = specials[rand.Intn(len(specials))]
-	for i := 2; i < length; i++ {
-		buf[i] = all[rand.Intn(len(all))]
+	buf := make([]byte, 12)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(fmt.Sprintf("unable to read random data: %s", err))
 	}
-	rand.Shuffle(len(buf), func(i, j int) {
-		buf[i], buf[j] = buf[j], buf[i]
-	})
-
-	return string(buf)
+	return base64.StdEncoding.EncodeToString(buf)
 }
 
-func Create(ip string) Stamp {
+// Create returns a new stamp for a resource, the identity of the node creating
+// it, see the identity package
+func Create(resource string) Stamp {
 	var s Stamp
 	s.version = Version
-	s.bits = 20
-	s.date = time.Now()
-	s.resource = ip
+	s.bits = DefaultDifficulty // set by Mint
+	s.date = time.Now().UTC().Truncate(time.Second)
+	s.dateLen = len(dateLayouts[len(dateLayouts)-1])
+	s.resource = resource
 	s.ext = ""
 	s.rand = getRandomBase64String()
-	s.counter = "" // todo: properly implement counter with a binary counter, encoded in base-64 format.
+	s.counter = "" // set by Mint
 	return s
 }
 
-func serializeTime(t time.Time) string {
-	return fmt.Sprintf("%04d-%02d-%02dT%02d%02d%02d-%s", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Location())
+// dateLayouts are the layouts of the dates of the stamps, from the least to
+// the most precise: YYMMDD[hhmm[ss]], always in UTC
+var dateLayouts = []string{"060102", "0601021504", "060102150405"}
+
+func dateLayout(n int) (string, bool) {
+	for _, layout := range dateLayouts {
+		if len(layout) == n {
+			return layout, true
+		}
+	}
+	return "", false
+}
+
+func serializeTime(t time.Time, n int) string {
+	layout, ok := dateLayout(n)
+	if !ok {
+		layout = dateLayouts[len(dateLayouts)-1]
+	}
+	return t.UTC().Format(layout)
 }
 
 // Serialize creates the unique string associated to a stamp (e.g., 1:20:040806:foo::65f460d0726f420d:13a6b8)
 func (s *Stamp) Serialize() string {
-	return s.version + ":" + strconv.Itoa(s.bits) + ":" + serializeTime(s.date) + ":" + s.resource + ":" + s.ext + ":" + s.rand + ":" + s.counter
+	return strings.Join([]string{
+		s.version,
+		strconv.Itoa(s.bits),
+		serializeTime(s.date, s.dateLen),
+		escapeField(s.resource, resourceReserved),
+		s.ext,
+		s.rand,
+		s.counter,
+	}, ":")
 }
 
 func parseTime(t string) (time.Time, error) {
-	// The string we get as input looks like 2019-12-16T221815-Local which we need to transform into 2019-12-16T22:18:15-Local
-	newT := t[:13]
-	newT += ":"
-	newT += t[13:15]
-	newT += ":"
-	newT += t[15:22]
+	layout, ok := dateLayout(len(t))
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid date %s", t)
+	}
+	for i := 0; i < len(t); i++ {
+		if t[i] < '0' || t[i] > '9' {
+			return time.Time{}, fmt.Errorf("invalid date %s", t)
+		}
+	}
+	return time.ParseInLocation(layout, t, time.UTC)
+}
 
-	dateFormat := "yyyy-MM-ddTHHmmssZ"
-	return time.Parse(dateFormat, newT)
+// parseBits parses the number of bits of a stamp, which must be written
+// without sign or leading zeros
+func parseBits(str string) (int, error) {
+	bits, err := strconv.Atoi(str)
+	if err != nil || strconv.Itoa(bits) != str || bits < 0 || bits > sha1.Size*8 {
+		return 0, fmt.Errorf("invalid number of bits %s", str)
+	}
+	return bits, nil
 }
 
-func Parse(signature string) (Stamp, error) {
+// checkExt checks that all the names and values of an extension are
+// correctly escaped
+func checkExt(ext string) error {
+	for _, entry := range strings.Split(ext, ";") {
+		tokens := strings.SplitN(entry, "=", 2)
+		fields := []string{tokens[0]}
+		if len(tokens) == 2 {
+			fields = append(fields, strings.Split(tokens[1], ",")...)
+		}
+		for _, f := range fields {
+			_, err := UnescapeExt(f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkBase64 checks that a string only includes characters of the base-64
+// alphabet
+func checkBase64(str string) error {
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '=') {
+			return fmt.Errorf("invalid character %q in %s", c, str)
+		}
+	}
+	return nil
+}
+
+// Parse parses a stamp in the hashcash v1 format. Only the canonical form of
+// a stamp is accepted, so that Parse(str).Serialize() == str.
+func Parse(str string) (Stamp, error) {
 	var s Stamp
 	var err error
 
-	tokens := strings.Split(signature, ":")
+	tokens := strings.Split(str, ":")
 	if len(tokens) != 7 {
-		return s, HashCashWrongFormatErr
+		return Stamp{}, HashCashWrongFormatErr
 	}
 	s.version = tokens[0]
-	s.bits, err = strconv.Atoi(tokens[1])
+	if s.version != Version {
+		return Stamp{}, fmt.Errorf("%w: unsupported version %s", HashCashWrongFormatErr, s.version)
+	}
+	s.bits, err = parseBits(tokens[1])
 	if err != nil {
-		return s, HashCashWrongFormatErr
+		return Stamp{}, fmt.Errorf("%w: %s", HashCashWrongFormatErr, err)
 	}
 	s.date, err = parseTime(tokens[2])
 	if err != nil {
-		log.Printf("Error while parsing date: %s", err)
-		return s, HashCashWrongFormatErr
+		return Stamp{}, fmt.Errorf("%w: %s", HashCashWrongFormatErr, err)
+	}
+	s.dateLen = len(tokens[2])
+	s.resource, err = unescapeField(tokens[3], resourceReserved)
+	if err != nil {
+		return Stamp{}, fmt.Errorf("%w: invalid resource: %s", HashCashWrongFormatErr, err)
 	}
-	s.resource = tokens[3]
 	s.ext = tokens[4]
+	err = checkExt(s.ext)
+	if err != nil {
+		return Stamp{}, fmt.Errorf("%w: invalid extension: %s", HashCashWrongFormatErr, err)
+	}
 	s.rand = tokens[5]
 	s.counter = tokens[6]
-	s.signature = signature
+	if s.rand == "" {
+		return Stamp{}, fmt.Errorf("%w: missing random string", HashCashWrongFormatErr)
+	}
+	for _, t := range []string{s.rand, s.counter} {
+		err = checkBase64(t)
+		if err != nil {
+			return Stamp{}, fmt.Errorf("%w: %s", HashCashWrongFormatErr, err)
+		}
+	}
 
 	return s, nil
 }
 
-func inSpentDatabase(s *Stamp) bool {
-	return true
-}
-
-func countZeroBits(hash string) int {
-	return 0
+func inSpentDatabase(s *Stamp) (bool, error) {
+	db, err := localSpentDB()
+	if err != nil {
+		return false, err
+	}
+	return db.Contains(s), nil
 }
 
-func (s *Stamp) IsValid() error {
-	today := time.Now()
-
+// ValidAt checks a stamp as of a given time: it must not be expired and its
+// hash must have at least difficulty leading bits equal to zero
+func (s *Stamp) ValidAt(t time.Time, difficulty int) error {
 	// IF stamp.date > today + 2days THEN
 	//   RETURN futuristic
-	if s.date.After(today.AddDate(0, 0, 2)) {
+	if s.date.After(t.AddDate(0, 0, 2)) {
 		return HashCashFuturisticErr
 	}
 
 	// IF stamp.date < today - 28days - 2days THEN
 	//   RETURN expired
-	if s.date.Before(today.AddDate(0, 0, -30)) {
+	if t.After(expiresAt(s.date)) {
 		return HashCashExpiredErr
 	}
 
-	// IF count_zero_bits( SHA1( stamp ) ) < 20 THEN
+	// IF count_zero_bits( SHA1( stamp ) ) < difficulty THEN
 	//   RETURN insufficient
+	// The stamp must also have the number of bits it claims
 	h := sha1.New()
-	_, err := io.WriteString(h, s.signature)
+	_, err := io.WriteString(h, s.Serialize())
 	if err != nil {
 		return HashCashWrongFormatErr
 	}
-	hash := hex.EncodeToString(h.Sum(nil))
-	if countZeroBits(hash) < 20 {
+	zeros := countZeroBits(h.Sum(nil))
+	if s.bits < difficulty || zeros < s.bits {
 		return HashCashInsufficientErr
 	}
 
+	return nil
+}
+
+// checkSigner checks that the stamp is signed by a key trusted by the local
+// node
+func (s *Stamp) checkSigner() error {
+	pub, err := s.VerifySignature()
+	if err != nil {
+		return err
+	}
+	kr, err := keys.LoadKeyring(cache.GetBasedir())
+	if err != nil {
+		return fmt.Errorf("unable to load the trusted keys: %w", err)
+	}
+	if !kr.Contains(pub) {
+		return fmt.Errorf("%w: %s", HashCashUntrustedErr, keys.Fingerprint(pub))
+	}
+	return nil
+}
+
+// IsValid checks a stamp that is received now with ValidAt, checks that it is
+// signed by a trusted node and that it was not spent yet
+func (s *Stamp) IsValid(difficulty int) error {
+	err := s.ValidAt(time.Now(), difficulty)
+	if err != nil {
+		return err
+	}
+	err = s.checkSigner()
+	if err != nil {
+		return err
+	}
+
 	// IF in_spent_database( stamp ) THEN
 	//   RETURN spent
-	if inSpentDatabase(s) {
+	spent, err := inSpentDatabase(s)
+	if err != nil {
+		return fmt.Errorf("unable to check the spent database: %w", err)
+	}
+	if spent {
 		return HashCashSpentErr
 	}
 
 	return nil
 }
 
-func (s *Stamp) addToSpentDatabase() error {
-	return nil
+// Spend records the stamp in the spent database of the local cache so that
+// it cannot be used again; HashCashSpentErr is returned if it already was
+func (s *Stamp) Spend() error {
+	db, err := localSpentDB()
+	if err != nil {
+		return err
+	}
+	return db.Spend(s)
 }
 
-func (s *Stamp) ValidHashCash(ip string) bool {
-	/*
-	   WHILE stamp = get_next_x_hashcash_header()
-	     IF stamp.email == myemail THEN
-	        IF valid_stamp( stamp ) THEN
-	           add_to_spent_database( stamp )
-	           RETURN true
-	        END
-	     END
-	   END
-	   RETURN false
-	*/
-
-	// In our case, we get a single header/stamp at a time
-	if s.resource == ip {
-		if s.IsValid() == nil {
-			// we add the stamp to the database to avoid handling multiple times the same stamp
-			err := s.addToSpentDatabase()
-			if err != nil {
-				return false
-			}
-			return true
-		}
+// Unspend removes stamps from the spent database of the local cache so that
+// they can be spent again
+func Unspend(stamps ...*Stamp) error {
+	db, err := localSpentDB()
+	if err != nil {
+		return err
 	}
+	return db.Unspend(stamps...)
+}
 
-	return false
+// IsSpent checks whether the stamp is recorded in the spent database of the
+// local cache
+func (s *Stamp) IsSpent() (bool, error) {
+	return inSpentDatabase(s)
 }
@@ -12,3 +12,9 @@ var HashCashExpiredErr = errors.New("stamp expired")
 var HashCashWrongFormatErr = errors.New("stamp has the wrong format")
 var HashCashInsufficientErr = errors.New("stamp does not have enough significant bits equal to zero")
 var HashCashSpentErr = errors.New("stamp spent")
+var HashCashUnsignedErr = errors.New("stamp is not signed")
+var HashCashSignatureErr = errors.New("stamp has an invalid signature")
+var HashCashUntrustedErr = errors.New("stamp is signed by an untrusted key")
+var HashCashResourceErr = errors.New("stamp is not signed by the key of its resource")
+var HashCashManifestErr = errors.New("stamp has an invalid manifest entry")
+var HashCashDuplicateManifestErr = errors.New("stamp lists the same manifest twice")
@@ -6,10 +6,17 @@
 package hashcash
 
 import (
+	"crypto/sha1"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/sylabs/syvalidate/internal/pkg/hash"
 )
@@ -50,15 +57,16 @@ func TestAddManifest(t *testing.T) {
 		t.Fatal("ext is not empty right after creation of new stamp")
 	}
 
-	path2, cleanup2 := createDummyManifest(t, "dummy2")
+	// The names of the manifests may end with letters of the suffix
+	path2, cleanup2 := createDummyManifest(t, "test")
 	defer cleanup2()
 
-	err := stamp.AddManifest(path1)
+	err := stamp.AddManifest(path1, KindPlatform)
 	if err != nil {
 		t.Fatalf("failed to add manifest %s: %s", path1, err)
 	}
 
-	err = stamp.AddManifest(path2)
+	err = stamp.AddManifest(path2, KindResult)
 	if err != nil {
 		t.Fatalf("failed to add manifest %s: %s", path2, err)
 	}
@@ -66,10 +74,27 @@ func TestAddManifest(t *testing.T) {
 	hash1 := hash.HashFile(path1)
 	hash2 := hash.HashFile(path2)
 
-	expectedExt := "dummy1=" + hash1 + ";dummy2=" + hash2
+	expectedExt := "dummy1=" + hash1 + ",13,platform;test=" + hash2 + ",13,result"
 	if stamp.ext != expectedExt {
 		t.Fatalf("ext does not match expectation: %s vs. %s", stamp.ext, expectedExt)
 	}
+
+	manifests, err := stamp.Manifests()
+	if err != nil {
+		t.Fatalf("failed to get manifests: %s", err)
+	}
+	expected := []Manifest{
+		{Name: "dummy1", SHA256: hash1, Size: 13, Kind: KindPlatform},
+		{Name: "test", SHA256: hash2, Size: 13, Kind: KindResult},
+	}
+	if !reflect.DeepEqual(manifests, expected) {
+		t.Fatalf("manifests are %+v instead of %+v", manifests, expected)
+	}
+
+	err = stamp.AddManifest(path2, KindResult)
+	if !errors.Is(err, HashCashDuplicateManifestErr) {
+		t.Fatalf("manifest %s added twice: %v", path2, err)
+	}
 }
 
 func TestCreate(t *testing.T) {
@@ -79,8 +104,8 @@ func TestCreate(t *testing.T) {
 		t.Fatalf("version does not match expectation: %s vs. %s", stamp.version, Version)
 	}
 
-	if stamp.bits != 20 {
-		t.Fatalf("bits is %d instead of 20", stamp.bits)
+	if stamp.bits != DefaultDifficulty {
+		t.Fatalf("bits is %d instead of %d", stamp.bits, DefaultDifficulty)
 	}
 
 	if stamp.resource != dummyIP {
@@ -100,6 +125,64 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+// Generate creates random stamps for the property-based tests
+func (Stamp) Generate(r *rand.Rand, size int) reflect.Value {
+	s := Stamp{
+		version:  Version,
+		bits:     r.Intn(sha1.Size*8 + 1),
+		resource: randomString(r, size),
+		rand:     randomBase64(r, 1+r.Intn(size+1)),
+		counter:  randomBase64(r, r.Intn(size+1)),
+	}
+
+	// The two-digit years of the format cover 1969 to 2068
+	layout := dateLayouts[r.Intn(len(dateLayouts))]
+	date := time.Date(1969+r.Intn(100), time.January, 1, 0, 0, 0, 0, time.UTC)
+	date = date.Add(time.Duration(r.Int63n(int64(365 * 24 * time.Hour))))
+	s.date, _ = time.ParseInLocation(layout, date.Format(layout), time.UTC)
+	s.dateLen = len(layout)
+
+	var entries []string
+	for i := r.Intn(4); i > 0; i-- {
+		entry := EscapeExt(randomString(r, size))
+		if r.Intn(2) == 0 {
+			var values []string
+			for j := 1 + r.Intn(3); j > 0; j-- {
+				values = append(values, EscapeExt(randomString(r, size)))
+			}
+			entry += "=" + strings.Join(values, ",")
+		}
+		entries = append(entries, entry)
+	}
+	s.ext = strings.Join(entries, ";")
+
+	return reflect.ValueOf(s)
+}
+
+// randomString returns a string of random bytes, biased toward the characters
+// that must be escaped
+func randomString(r *rand.Rand, size int) string {
+	const special = ":;=,% \x00\xff"
+	buf := make([]byte, r.Intn(size+1))
+	for i := range buf {
+		if r.Intn(4) == 0 {
+			buf[i] = special[r.Intn(len(special))]
+		} else {
+			buf[i] = byte(r.Intn(256))
+		}
+	}
+	return string(buf)
+}
+
+func randomBase64(r *rand.Rand, n int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(buf)
+}
+
 func TestSerializeParse(t *testing.T) {
 	stamp1 := Create(dummyIP)
 	str := stamp1.Serialize()
@@ -117,6 +200,10 @@ func TestSerializeParse(t *testing.T) {
 		t.Fatalf("bits mismatch: %d vs %d", stamp1.bits, stamp2.bits)
 	}
 
+	if !stamp1.date.Equal(stamp2.date) {
+		t.Fatalf("date mismatch: %s vs %s", stamp1.date, stamp2.date)
+	}
+
 	if stamp1.resource != stamp2.resource {
 		t.Fatalf("resource mismatch: %s vs %s", stamp1.resource, stamp2.resource)
 	}
@@ -132,14 +219,107 @@ func TestSerializeParse(t *testing.T) {
 	if stamp1.counter != stamp2.counter {
 		t.Fatalf("counter mismatch: %s vs %s", stamp1.counter, stamp2.counter)
 	}
+
+	if stamp1 != stamp2 {
+		t.Fatalf("parsed stamp differs from the original stamp")
+	}
 }
 
-/*
-func TestIsValid(t *testing.T) {
+func TestSerializeParseProperty(t *testing.T) {
+	roundTrip := func(s Stamp) bool {
+		parsed, err := Parse(s.Serialize())
+		if err != nil {
+			t.Logf("failed to parse %q: %s", s.Serialize(), err)
+			return false
+		}
+		return parsed == s
+	}
+	err := quick.Check(roundTrip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	// Only canonical stamps are accepted: whatever is parsed is serialized
+	// back to the same string
+	canonical := func(s Stamp, pos uint, c byte) bool {
+		str := []byte(s.Serialize())
+		str[pos%uint(len(str))] = c
+		parsed, err := Parse(string(str))
+		return err != nil || parsed.Serialize() == string(str)
+	}
+	err = quick.Check(canonical, &quick.Config{MaxCount: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestValidHashCash(t *testing.T) {
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		stamp string
+		valid bool
+	}{
+		{name: "short date", stamp: "1:20:040806:foo::65f460d0726f420d:13a6b8", valid: true},
+		{name: "minutes", stamp: "1:20:1303030600:adam@cypherspace.org::McMybZIhxKXu57jd:ckvi", valid: true},
+		{name: "seconds", stamp: "1:20:191216221815:192.1.23.2:dummy=abc;other:McMybZIhxKXu57jd:", valid: true},
+		{name: "escaped", stamp: "1:20:191216221815:%3A%3A1:a%3Bb=c%2Cd,e:McMybZIhxKXu57jd:ckvi", valid: true},
+		{name: "version", stamp: "0:20:040806:foo::65f460d0726f420d:13a6b8"},
+		{name: "leading zero", stamp: "1:020:040806:foo::65f460d0726f420d:13a6b8"},
+		{name: "too many bits", stamp: "1:161:040806:foo::65f460d0726f420d:13a6b8"},
+		{name: "date length", stamp: "1:20:0408061:foo::65f460d0726f420d:13a6b8"},
+		{name: "month", stamp: "1:20:041306:foo::65f460d0726f420d:13a6b8"},
+		{name: "old date", stamp: "1:20:2019-12-16T221815-Local:foo::65f460d0726f420d:13a6b8"},
+		{name: "lowercase escape", stamp: "1:20:040806:%3a1::65f460d0726f420d:13a6b8"},
+		{name: "useless escape", stamp: "1:20:040806:%41::65f460d0726f420d:13a6b8"},
+		{name: "truncated escape", stamp: "1:20:040806:foo:bar%3:65f460d0726f420d:13a6b8"},
+		{name: "unescaped space", stamp: "1:20:040806:foo:b r:65f460d0726f420d:13a6b8"},
+		{name: "rand", stamp: "1:20:040806:foo::!65f460d0726f420d:13a6b8"},
+		{name: "no rand", stamp: "1:20:040806:foo:::13a6b8"},
+		{name: "fields", stamp: "1:20:040806:foo::65f460d0726f420d"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.stamp)
+		if tt.valid {
+			if err != nil {
+				t.Fatalf("%s: failed to parse %s: %s", tt.name, tt.stamp, err)
+			}
+			if s.Serialize() != tt.stamp {
+				t.Fatalf("%s: %s serialized as %s", tt.name, tt.stamp, s.Serialize())
+			}
+		} else if !errors.Is(err, HashCashWrongFormatErr) {
+			t.Fatalf("%s: %s parsed with %v", tt.name, tt.stamp, err)
+		}
+	}
 
+	s, err := Parse("1:20:040806:foo::65f460d0726f420d:13a6b8")
+	if err != nil {
+		t.Fatalf("failed to parse stamp: %s", err)
+	}
+	expected := time.Date(2004, time.August, 6, 0, 0, 0, 0, time.UTC)
+	if !s.Date().Equal(expected) {
+		t.Fatalf("date is %s instead of %s", s.Date(), expected)
+	}
+}
+
+func TestAddManifestEscape(t *testing.T) {
+	path, cleanup := createDummyManifest(t, "a:b;c=d,e")
+	defer cleanup()
+
+	stamp := Create(dummyIP)
+	err := stamp.AddManifest(path, KindResult)
+	if err != nil {
+		t.Fatalf("failed to add manifest %s: %s", path, err)
+	}
+	parsed, err := Parse(stamp.Serialize())
+	if err != nil {
+		t.Fatalf("failed to parse stamp: %s", err)
+	}
+	manifests, err := parsed.Manifests()
+	if err != nil || len(manifests) != 1 {
+		t.Fatalf("failed to get manifests of %s: %v", parsed.Ext(), err)
+	}
+	name := manifests[0].Name
+	if name != "a:b;c=d,e" {
+		t.Fatalf("manifest name is %s instead of a:b;c=d,e", name)
+	}
 }
-*/
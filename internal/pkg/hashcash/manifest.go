@@ -0,0 +1,202 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sylabs/syvalidate/internal/pkg/hash"
+)
+
+// Every manifest of the work done is an entry of the extension of a stamp:
+// <name>=<sha256>,<size>,<kind>, with the name and kind escaped with
+// EscapeExt, the SHA-256 hash of the manifest in lowercase hex and its size
+// in bytes. The order of the entries is the order in which the manifests
+// were added and a name appears only once.
+
+// manifestSuffix is the suffix of the files of the manifests, which is not
+// part of their name
+const manifestSuffix = ".MANIFEST"
+
+// ManifestKind describes what a manifest is about
+type ManifestKind string
+
+const (
+	// KindPlatform is a manifest describing the platform, e.g., its CPUs
+	KindPlatform ManifestKind = "platform"
+
+	// KindTool is a manifest of the tool that did the work
+	KindTool ManifestKind = "tool"
+
+	// KindResult is a manifest of the results of the work
+	KindResult ManifestKind = "result"
+
+	// KindFile is a file written to a namespace, its name is its path
+	KindFile ManifestKind = "file"
+)
+
+// Manifest is a manifest listed in a stamp
+type Manifest struct {
+	Name   string       `json:"name"`
+	SHA256 string       `json:"sha256"`
+	Size   int64        `json:"size"`
+	Kind   ManifestKind `json:"kind"`
+}
+
+// NewManifest returns the entry of an existing manifest; its name is the
+// name of the file without the .MANIFEST suffix
+func NewManifest(path string, kind ManifestKind) (Manifest, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to get the size of %s: %s", path, err)
+	}
+	m := Manifest{
+		Name: strings.TrimSuffix(filepath.Base(path), manifestSuffix),
+		Size: fi.Size(),
+		Kind: kind,
+	}
+	m.SHA256 = hash.HashFile(path)
+	if m.SHA256 == "" {
+		return Manifest{}, fmt.Errorf("unable to hash %s", path)
+	}
+	return m, m.check()
+}
+
+// check makes sure the entry of a manifest can be encoded
+func (m *Manifest) check() error {
+	if m.Name == "" {
+		return fmt.Errorf("manifest without name")
+	}
+	if EscapeExt(m.Name) == signatureExt {
+		return fmt.Errorf("%w: %s is the name of the signature", HashCashManifestErr, m.Name)
+	}
+	if m.Kind == "" {
+		return fmt.Errorf("manifest %s has no kind", m.Name)
+	}
+	if len(m.SHA256) != hex.EncodedLen(32) || strings.ToLower(m.SHA256) != m.SHA256 {
+		return fmt.Errorf("manifest %s has an invalid hash %s", m.Name, m.SHA256)
+	}
+	if _, err := hex.DecodeString(m.SHA256); err != nil {
+		return fmt.Errorf("manifest %s has an invalid hash %s", m.Name, m.SHA256)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("manifest %s has a negative size", m.Name)
+	}
+	return nil
+}
+
+// encode returns the entry of the manifest in the extension of a stamp
+func (m *Manifest) encode() string {
+	return EscapeExt(m.Name) + "=" + strings.Join([]string{
+		m.SHA256,
+		strconv.FormatInt(m.Size, 10),
+		EscapeExt(string(m.Kind)),
+	}, ",")
+}
+
+// parseManifest parses the entry of a manifest in the extension of a stamp;
+// only the canonical form of an entry is accepted
+func parseManifest(entry string) (Manifest, error) {
+	tokens := strings.SplitN(entry, "=", 2)
+	if len(tokens) != 2 {
+		return Manifest{}, fmt.Errorf("manifest entry %s has no value", entry)
+	}
+	values := strings.Split(tokens[1], ",")
+	if len(values) != 3 {
+		return Manifest{}, fmt.Errorf("manifest entry %s does not have 3 values", entry)
+	}
+
+	var m Manifest
+	var err error
+	m.Name, err = UnescapeExt(tokens[0])
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.SHA256 = values[0]
+	m.Size, err = strconv.ParseInt(values[1], 10, 64)
+	if err != nil || strconv.FormatInt(m.Size, 10) != values[1] {
+		return Manifest{}, fmt.Errorf("manifest entry %s has an invalid size", entry)
+	}
+	kind, err := UnescapeExt(values[2])
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.Kind = ManifestKind(kind)
+	err = m.check()
+	if err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// AddManifest adds an existing manifest to the extension of the stamp since
+// the list of manifests corresponding to the work done defines the SoW
+func (s *Stamp) AddManifest(path string, kind ManifestKind) error {
+	m, err := NewManifest(path, kind)
+	if err != nil {
+		return err
+	}
+	return s.AddManifestEntry(m)
+}
+
+// AddManifestEntry adds the entry of a manifest to the extension of the
+// stamp; a stamp cannot list two manifests with the same name
+func (s *Stamp) AddManifestEntry(m Manifest) error {
+	err := m.check()
+	if err != nil {
+		return err
+	}
+	manifests, err := s.Manifests()
+	if err != nil {
+		return err
+	}
+	for _, prev := range manifests {
+		if prev.Name == m.Name {
+			return fmt.Errorf("%w: %s", HashCashDuplicateManifestErr, m.Name)
+		}
+	}
+
+	// The signature, if any, stays last; it must be renewed anyway
+	entries, sig := s.splitExt()
+	entries = append(entries, m.encode())
+	if sig != "" {
+		entries = append(entries, sig)
+	}
+	s.ext = strings.Join(entries, ";")
+	return nil
+}
+
+// ManifestEntries returns the entries of the extension of the stamp that
+// list the manifests, as encoded in the stamp, i.e., all the entries but the
+// signature
+func (s *Stamp) ManifestEntries() []string {
+	entries, _ := s.splitExt()
+	return entries
+}
+
+// Manifests returns the manifests listed in the stamp, in the order in which
+// they were added
+func (s *Stamp) Manifests() ([]Manifest, error) {
+	var manifests []Manifest
+	names := make(map[string]bool)
+	for _, e := range s.ManifestEntries() {
+		m, err := parseManifest(e)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", HashCashManifestErr, err)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("%w: %s", HashCashDuplicateManifestErr, m.Name)
+		}
+		names[m.Name] = true
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
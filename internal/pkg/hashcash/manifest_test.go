@@ -0,0 +1,73 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestParseManifest(t *testing.T) {
+	m := Manifest{Name: "openmpi-4.0.2", SHA256: testSHA256, Size: 42, Kind: "a,b"}
+	entry := m.encode()
+	if entry != "openmpi-4.0.2="+testSHA256+",42,a%2Cb" {
+		t.Fatalf("manifest is encoded as %s", entry)
+	}
+	parsed, err := parseManifest(entry)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %s", entry, err)
+	}
+	if parsed != m {
+		t.Fatalf("manifest %+v parsed as %+v", m, parsed)
+	}
+
+	tests := []string{
+		"openmpi",
+		"openmpi=" + testSHA256,
+		"openmpi=" + testSHA256 + ",42",
+		"openmpi=" + testSHA256 + ",42,result,x",
+		"=" + testSHA256 + ",42,result",
+		"openmpi=" + testSHA256 + ",42,",
+		"openmpi=" + strings.ToUpper(testSHA256) + ",42,result",
+		"openmpi=" + testSHA256[1:] + ",42,result",
+		"openmpi=" + testSHA256 + ",042,result",
+		"openmpi=" + testSHA256 + ",-1,result",
+		"open%3ampi=" + testSHA256 + ",42,result",
+	}
+	for _, e := range tests {
+		if _, err := parseManifest(e); err == nil {
+			t.Fatalf("invalid manifest entry %s was parsed", e)
+		}
+	}
+}
+
+func TestParsedManifests(t *testing.T) {
+	entry := "openmpi=" + testSHA256 + ",42,result"
+	tests := []struct {
+		ext      string
+		expected error
+	}{
+		{ext: entry + ";mpich=" + testSHA256 + ",42,result", expected: nil},
+		{ext: entry + ";" + entry, expected: HashCashDuplicateManifestErr},
+		{ext: entry + ";mpich=" + testSHA256, expected: HashCashManifestErr},
+	}
+	for _, tt := range tests {
+		s, err := Parse("1:20:040806:" + dummyIP + ":" + tt.ext + ":bm9uY2U=:AAA")
+		if err != nil {
+			t.Fatalf("failed to parse stamp with extension %s: %s", tt.ext, err)
+		}
+		manifests, err := s.Manifests()
+		if !errors.Is(err, tt.expected) || tt.expected != nil && manifests != nil {
+			t.Fatalf("manifests of extension %s: %v instead of %v", tt.ext, err, tt.expected)
+		}
+		if tt.expected == nil && len(manifests) != 2 {
+			t.Fatalf("extension %s lists %d manifests instead of 2", tt.ext, len(manifests))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+// mintCheckInterval is the number of counters a worker tries between two
+// checks of the cancellation of the search
+const mintCheckInterval = 4096
+
+// countZeroBits returns the number of leading bits equal to zero of a hash
+func countZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// encodeCounter returns the base-64 encoding of the big-endian binary
+// representation of a counter, without leading zero bytes
+func encodeCounter(c uint64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], c)
+	i := 0
+	for i < len(buf)-1 && buf[i] == 0 {
+		i++
+	}
+	return base64.RawStdEncoding.EncodeToString(buf[i:])
+}
+
+// Mint searches for a counter such that the SHA-1 hash of the serialized stamp
+// has at least difficulty leading bits equal to zero; the search runs on all
+// the CPUs until it succeeds or the context is canceled
+func (s *Stamp) Mint(ctx context.Context, difficulty int) error {
+	if difficulty < 0 || difficulty > sha1.Size*8 {
+		return fmt.Errorf("invalid difficulty %d", difficulty)
+	}
+	s.bits = difficulty
+	s.counter = ""
+
+	// All the candidates share the serialized stamp without the counter so
+	// the workers start from the state of the hash after that prefix
+	prefix := s.Serialize()
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("unable to save hash state: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := runtime.NumCPU()
+	found := make(chan string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			h := sha1.New()
+			u := h.(encoding.BinaryUnmarshaler)
+			var sum []byte
+			for c := first; ; c += uint64(workers) {
+				if (c/uint64(workers))%mintCheckInterval == 0 && ctx.Err() != nil {
+					return
+				}
+				counter := encodeCounter(c)
+				u.UnmarshalBinary(state)
+				h.Write([]byte(counter))
+				sum = h.Sum(sum[:0])
+				if countZeroBits(sum) >= difficulty {
+					found <- counter
+					cancel()
+					return
+				}
+			}
+		}(uint64(w))
+	}
+	wg.Wait()
+
+	select {
+	case counter := <-found:
+		s.counter = counter
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
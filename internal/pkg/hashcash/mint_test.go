@@ -0,0 +1,133 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCountZeroBits(t *testing.T) {
+	tests := []struct {
+		sum      []byte
+		expected int
+	}{
+		{sum: []byte{0x80, 0x00}, expected: 0},
+		{sum: []byte{0x01, 0x00}, expected: 7},
+		{sum: []byte{0x00, 0x10}, expected: 11},
+		{sum: []byte{0x00, 0x00, 0xff}, expected: 16},
+		{sum: []byte{0x00, 0x00}, expected: 16},
+	}
+	for _, tt := range tests {
+		if n := countZeroBits(tt.sum); n != tt.expected {
+			t.Fatalf("%x has %d leading zero bits instead of %d", tt.sum, n, tt.expected)
+		}
+	}
+}
+
+func TestMint(t *testing.T) {
+	stamp := Create(dummyIP)
+	if !errors.Is(stamp.ValidAt(time.Now(), DefaultDifficulty), HashCashInsufficientErr) {
+		t.Fatalf("stamp is valid before minting")
+	}
+
+	err := stamp.Mint(context.Background(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	if stamp.counter == "" {
+		t.Fatalf("minted stamp has no counter")
+	}
+	sum := sha1.Sum([]byte(stamp.Serialize()))
+	if countZeroBits(sum[:]) < DefaultDifficulty {
+		t.Fatalf("hash of minted stamp %x has less than %d leading zero bits", sum, DefaultDifficulty)
+	}
+	err = stamp.ValidAt(time.Now(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("minted stamp is invalid: %s", err)
+	}
+
+	// The proof of work survives the exchange of the stamp
+	parsed, err := Parse(stamp.Serialize())
+	if err != nil {
+		t.Fatalf("failed to parse stamp: %s", err)
+	}
+	err = parsed.ValidAt(time.Now(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("parsed stamp is invalid: %s", err)
+	}
+
+	// Changing the stamp invalidates the proof of work
+	tampered := stamp
+	tampered.resource = "10.0.0.1"
+	if !errors.Is(tampered.ValidAt(time.Now(), DefaultDifficulty), HashCashInsufficientErr) {
+		t.Fatalf("tampered stamp is valid")
+	}
+
+	// Stamps are only valid for difficulties up to the one they were minted
+	// for
+	weak := Create(dummyIP)
+	err = weak.Mint(context.Background(), 8)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	if weak.Bits() != 8 {
+		t.Fatalf("stamp minted for 8 bits claims %d bits", weak.Bits())
+	}
+	if !errors.Is(weak.ValidAt(time.Now(), DefaultDifficulty), HashCashInsufficientErr) {
+		t.Fatalf("stamp with 8 bits is valid for %d bits", DefaultDifficulty)
+	}
+	for _, difficulty := range []int{0, 4, 8} {
+		err = weak.ValidAt(time.Now(), difficulty)
+		if err != nil {
+			t.Fatalf("stamp with 8 bits is invalid for %d bits: %s", difficulty, err)
+		}
+	}
+
+	if weak.Mint(context.Background(), -1) == nil || weak.Mint(context.Background(), 161) == nil {
+		t.Fatalf("stamp minted with an invalid difficulty")
+	}
+}
+
+func TestMintCancel(t *testing.T) {
+	// Nobody can find 160 leading zero bits
+	stamp := Create(dummyIP)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := stamp.Mint(ctx, 160)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled minting returned %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = stamp.Mint(ctx, 160)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("minting past the deadline returned %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("minting did not stop at the deadline")
+	}
+}
+
+func BenchmarkMint(b *testing.B) {
+	for _, difficulty := range []int{8, 12, 16, 20} {
+		b.Run(fmt.Sprintf("bits-%d", difficulty), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				stamp := Create(dummyIP)
+				err := stamp.Mint(context.Background(), difficulty)
+				if err != nil {
+					b.Fatalf("failed to mint stamp: %s", err)
+				}
+			}
+		})
+	}
+}
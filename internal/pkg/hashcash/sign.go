@@ -0,0 +1,112 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// A stamp is signed by the node that created it with an entry of its
+// extension: sig/ed25519=<public key>,<signature>, both hex-encoded. The name
+// of the entry is reserved, manifests named after paths like files could
+// otherwise take it. The signature covers the stamp without its signature,
+// number of bits and counter, so a stamp is signed before it is minted and the
+// proof of work covers the signature.
+
+const signatureExt = "sig/ed25519"
+
+// splitExt returns the entries of the extension of the stamp but the
+// signature, and the signature entry, if any
+func (s *Stamp) splitExt() ([]string, string) {
+	var entries []string
+	var sig string
+	for _, e := range strings.Split(s.ext, ";") {
+		if e == "" {
+			continue
+		}
+		if strings.HasPrefix(e, signatureExt+"=") {
+			sig = e
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sig
+}
+
+// signedData returns the part of the stamp that is signed
+func (s *Stamp) signedData() []byte {
+	entries, _ := s.splitExt()
+	return []byte(strings.Join([]string{
+		s.version,
+		serializeTime(s.date, s.dateLen),
+		escapeField(s.resource, resourceReserved),
+		strings.Join(entries, ";"),
+		s.rand,
+	}, ":"))
+}
+
+// Sign signs the stamp with the private key of the node creating it; it must
+// be called once all the manifests are added and before the stamp is minted
+func (s *Stamp) Sign(key ed25519.PrivateKey) {
+	entries, _ := s.splitExt()
+	pub := key.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(key, s.signedData())
+	entries = append(entries, signatureExt+"="+hex.EncodeToString(pub)+","+hex.EncodeToString(sig))
+	s.ext = strings.Join(entries, ";")
+	s.counter = ""
+}
+
+// Signer returns the public key of the node that signed the stamp, nil if
+// the stamp is not signed; the signature is not checked
+func (s *Stamp) Signer() ed25519.PublicKey {
+	pub, _, err := s.signature()
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+func (s *Stamp) signature() (ed25519.PublicKey, []byte, error) {
+	_, entry := s.splitExt()
+	if entry == "" {
+		return nil, nil, HashCashUnsignedErr
+	}
+	values := strings.Split(strings.TrimPrefix(entry, signatureExt+"="), ",")
+	if len(values) != 2 {
+		return nil, nil, fmt.Errorf("%w: malformed signature", HashCashSignatureErr)
+	}
+	pub, err := hex.DecodeString(values[0])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("%w: malformed public key", HashCashSignatureErr)
+	}
+	sig, err := hex.DecodeString(values[1])
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, nil, fmt.Errorf("%w: malformed signature", HashCashSignatureErr)
+	}
+	return ed25519.PublicKey(pub), sig, nil
+}
+
+// VerifySignature checks the signature of the stamp and returns the public
+// key of its signer; a stamp created for the identity of a key, see
+// keys.Resource, must be signed by that key
+func (s *Stamp) VerifySignature() (ed25519.PublicKey, error) {
+	pub, sig, err := s.signature()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, s.signedData(), sig) {
+		return nil, HashCashSignatureErr
+	}
+	if strings.HasPrefix(s.resource, keys.ResourcePrefix) && s.resource != keys.Resource(pub) {
+		return nil, fmt.Errorf("%w: %s signed by %s", HashCashResourceErr, s.resource, keys.Fingerprint(pub))
+	}
+	return pub, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+func TestSign(t *testing.T) {
+	path, cleanup := createDummyManifest(t, "dummy1")
+	defer cleanup()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	stamp := Create(dummyIP)
+	err = stamp.AddManifest(path, KindResult)
+	if err != nil {
+		t.Fatalf("failed to add manifest %s: %s", path, err)
+	}
+	manifests := stamp.ManifestEntries()
+	if _, err := stamp.VerifySignature(); !errors.Is(err, HashCashUnsignedErr) || stamp.Signer() != nil {
+		t.Fatalf("stamp is signed before signing: %v", err)
+	}
+
+	// The stamp is signed before it is minted
+	stamp.Sign(priv)
+	err = stamp.Mint(context.Background(), 8)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	parsed, err := Parse(stamp.Serialize())
+	if err != nil {
+		t.Fatalf("failed to parse signed stamp: %s", err)
+	}
+	signer, err := parsed.VerifySignature()
+	if err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	if !bytes.Equal(signer, pub) || !bytes.Equal(parsed.Signer(), pub) {
+		t.Fatalf("stamp signed by another key")
+	}
+	if err := parsed.ValidAt(time.Now(), 8); err != nil {
+		t.Fatalf("signature broke the proof of work: %s", err)
+	}
+	if strings.Join(parsed.ManifestEntries(), ";") != strings.Join(manifests, ";") {
+		t.Fatalf("manifests %v changed to %v by the signature", manifests, parsed.ManifestEntries())
+	}
+
+	// No manifest can pass for the signature
+	err = stamp.AddManifestEntry(Manifest{Name: signatureExt, SHA256: strings.Repeat("0", 64), Kind: KindFile})
+	if !errors.Is(err, HashCashManifestErr) {
+		t.Fatalf("manifest named after the signature was added: %v", err)
+	}
+
+	// Signing again replaces the signature
+	stamp.Sign(priv)
+	if len(stamp.ManifestEntries()) != 1 || strings.Count(stamp.Ext(), signatureExt) != 1 || stamp.counter != "" {
+		t.Fatalf("invalid stamp signed twice: %s", stamp.Serialize())
+	}
+
+	// The signature covers the content of the stamp
+	tampered := parsed
+	tampered.resource = "10.0.0.1"
+	if _, err := tampered.VerifySignature(); !errors.Is(err, HashCashSignatureErr) {
+		t.Fatalf("stamp for another resource has a valid signature: %v", err)
+	}
+	tampered = parsed
+	tampered.ext = strings.Replace(tampered.ext, "dummy1", "dummy2", 1)
+	if _, err := tampered.VerifySignature(); !errors.Is(err, HashCashSignatureErr) {
+		t.Fatalf("stamp with other manifests has a valid signature: %v", err)
+	}
+	tampered = parsed
+	tampered.ext += "1"
+	if _, err := tampered.VerifySignature(); !errors.Is(err, HashCashSignatureErr) {
+		t.Fatalf("stamp with a malformed signature has a valid signature: %v", err)
+	}
+
+	// A stamp created for the identity of a key must be signed by that key
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	stamp = Create(keys.Resource(pub))
+	stamp.Sign(other)
+	if _, err := stamp.VerifySignature(); !errors.Is(err, HashCashResourceErr) {
+		t.Fatalf("stamp signed by another key than the one of its resource is valid: %v", err)
+	}
+	stamp.Sign(priv)
+	if _, err := stamp.VerifySignature(); err != nil {
+		t.Fatalf("stamp signed by the key of its resource is invalid: %s", err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+// The spent database records the stamps that were already used so that a
+// stamp cannot be spent twice. It is a log of "<hash> <date>" lines, the hash
+// being the SHA-1 hash of the serialized stamp and the date the Unix time of
+// the creation of the stamp. Stamps older than the validity window are
+// rejected by ValidAt anyway, so they are pruned from the database.
+
+// SpentDB is a persistent set of spent stamps
+type SpentDB struct {
+	lock  sync.Mutex
+	path  string
+	f     *os.File
+	spent map[string]time.Time
+
+	// expired is the number of records of the log that expired since it
+	// was last rewritten
+	expired int
+	// spends is the number of stamps spent since the database was last
+	// pruned
+	spends int
+}
+
+// pruneInterval is the number of stamps spent between two prunings of a
+// database, so that a long-running node does not keep expired stamps
+const pruneInterval = 1024
+
+var (
+	spentDBsLock sync.Mutex
+	spentDBs     = make(map[string]*SpentDB)
+)
+
+// stampHash returns the key of a stamp in the spent database
+func stampHash(s *Stamp) string {
+	h := sha1.Sum([]byte(s.Serialize()))
+	return hex.EncodeToString(h[:])
+}
+
+// expiresAt returns the time after which a stamp created at a given date is
+// not valid anymore
+func expiresAt(date time.Time) time.Time {
+	return date.AddDate(0, 0, expiryDays)
+}
+
+// OpenSpentDB opens the spent database stored in a file, which is created if
+// it does not exist; expired records are pruned
+func OpenSpentDB(path string) (*SpentDB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", filepath.Dir(path), err)
+	}
+
+	db := &SpentDB{
+		path:  path,
+		spent: make(map[string]time.Time),
+	}
+	err = db.load()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Prune(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if db.f == nil {
+		db.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", path, err)
+		}
+	}
+	return db, nil
+}
+
+// localSpentDB returns the spent database of the local cache, which is opened
+// only once
+func localSpentDB() (*SpentDB, error) {
+	path := cache.GetSpentDBPath(cache.GetBasedir())
+	spentDBsLock.Lock()
+	defer spentDBsLock.Unlock()
+	db, ok := spentDBs[path]
+	if ok {
+		return db, nil
+	}
+	db, err := OpenSpentDB(path)
+	if err != nil {
+		return nil, err
+	}
+	spentDBs[path] = db
+	return db, nil
+}
+
+func (db *SpentDB) load() error {
+	f, err := os.Open(db.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", db.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) != 2 {
+			// Typically the last record, when we crashed while writing it
+			log.Printf("[WARN] ignoring invalid record at line %d of %s", line, db.path)
+			continue
+		}
+		date, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			log.Printf("[WARN] ignoring invalid record at line %d of %s", line, db.path)
+			continue
+		}
+		db.spent[tokens[0]] = time.Unix(date, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %s", db.path, err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (db *SpentDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Close()
+	db.f = nil
+	return err
+}
+
+// Len returns the number of spent stamps in the database
+func (db *SpentDB) Len() int {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return len(db.spent)
+}
+
+// Contains checks whether a stamp was spent
+func (db *SpentDB) Contains(s *Stamp) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, ok := db.spent[stampHash(s)]
+	return ok
+}
+
+// Spend records a stamp as spent; HashCashSpentErr is returned if it already
+// was. The database is pruned every pruneInterval stamps.
+func (db *SpentDB) Spend(s *Stamp) error {
+	key := stampHash(s)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.f == nil {
+		return fmt.Errorf("spent database %s is closed", db.path)
+	}
+	if _, ok := db.spent[key]; ok {
+		return HashCashSpentErr
+	}
+
+	_, err := fmt.Fprintf(db.f, "%s %d\n", key, s.date.Unix())
+	if err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", db.path, err)
+	}
+	db.spent[key] = s.date
+
+	db.spends++
+	if db.spends >= pruneInterval {
+		// The stamp is recorded, failing to prune only delays it
+		err := db.prune(time.Now())
+		if err != nil {
+			log.Printf("[WARN] failed to prune %s: %s", db.path, err)
+		}
+	}
+	return nil
+}
+
+// Prune removes the stamps that expired as of a given time; the log is
+// rewritten once enough of its records expired
+func (db *SpentDB) Prune(now time.Time) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.prune(now)
+}
+
+func (db *SpentDB) prune(now time.Time) error {
+	db.spends = 0
+	for key, date := range db.spent {
+		if now.After(expiresAt(date)) {
+			delete(db.spent, key)
+			db.expired++
+		}
+	}
+	if db.expired == 0 || db.expired < len(db.spent) {
+		return nil
+	}
+	return db.rewrite()
+}
+
+// Unspend removes stamps from the database, e.g., when the blocks they were
+// spent in are dropped from the chain; the log is rewritten
+func (db *SpentDB) Unspend(stamps ...*Stamp) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.f == nil {
+		return fmt.Errorf("spent database %s is closed", db.path)
+	}
+	removed := 0
+	for _, s := range stamps {
+		key := stampHash(s)
+		if _, ok := db.spent[key]; ok {
+			delete(db.spent, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	return db.rewrite()
+}
+
+// rewrite writes the live records to a new log that replaces the current one
+func (db *SpentDB) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for key, date := range db.spent {
+		fmt.Fprintf(w, "%s %d\n", key, date.Unix())
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rewrite %s: %s", db.path, err)
+	}
+
+	if db.f != nil {
+		db.f.Close()
+	}
+	tmp.Close()
+	db.f, err = os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		db.f = nil
+		return fmt.Errorf("failed to open %s: %s", db.path, err)
+	}
+	db.expired = 0
+	return nil
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package hashcash
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+func openTestSpentDB(t *testing.T, path string) *SpentDB {
+	db, err := OpenSpentDB(path)
+	if err != nil {
+		t.Fatalf("failed to open spent database: %s", err)
+	}
+	return db
+}
+
+// restartLocalSpentDB closes the spent database of the local cache, as if the
+// process was restarted
+func restartLocalSpentDB() {
+	spentDBsLock.Lock()
+	defer spentDBsLock.Unlock()
+	for path, db := range spentDBs {
+		db.Close()
+		delete(spentDBs, path)
+	}
+}
+
+func TestSpentDBRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spent-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spent.db")
+
+	stamp := Create(dummyIP)
+	other := Create(dummyIP)
+	db := openTestSpentDB(t, path)
+	err = db.Spend(&stamp)
+	if err != nil {
+		t.Fatalf("failed to spend stamp: %s", err)
+	}
+	if !errors.Is(db.Spend(&stamp), HashCashSpentErr) {
+		t.Fatalf("stamp spent twice")
+	}
+	db.Close()
+
+	// A record was partially written when the process stopped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	f.WriteString("0123abcd")
+	f.Close()
+
+	db = openTestSpentDB(t, path)
+	defer db.Close()
+	if !db.Contains(&stamp) || db.Contains(&other) || db.Len() != 1 {
+		t.Fatalf("spent stamps were not reloaded")
+	}
+	if !errors.Is(db.Spend(&stamp), HashCashSpentErr) {
+		t.Fatalf("stamp spent again after a restart")
+	}
+	err = db.Spend(&other)
+	if err != nil {
+		t.Fatalf("failed to spend stamp: %s", err)
+	}
+}
+
+func TestSpentDBPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spent-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spent.db")
+
+	old := Create(dummyIP)
+	old.date = time.Now().AddDate(0, 0, -expiryDays-1)
+	stamp := Create(dummyIP)
+	db := openTestSpentDB(t, path)
+	for _, s := range []*Stamp{&old, &stamp} {
+		err := db.Spend(s)
+		if err != nil {
+			t.Fatalf("failed to spend stamp: %s", err)
+		}
+	}
+
+	// Expired stamps are forgotten; ValidAt rejects them anyway
+	if !errors.Is(old.ValidAt(time.Now(), DefaultDifficulty), HashCashExpiredErr) {
+		t.Fatalf("stamp older than the validity window is not expired")
+	}
+	err = db.Prune(time.Now())
+	if err != nil {
+		t.Fatalf("failed to prune database: %s", err)
+	}
+	if db.Contains(&old) || !db.Contains(&stamp) {
+		t.Fatalf("invalid database after pruning")
+	}
+	db.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", path, err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("database has %d records after pruning instead of 1", lines)
+	}
+	db = openTestSpentDB(t, path)
+	defer db.Close()
+	if db.Len() != 1 || !db.Contains(&stamp) {
+		t.Fatalf("pruned database was not reloaded")
+	}
+
+	// A long-running process prunes the database as it spends stamps
+	err = db.Spend(&old)
+	if err != nil {
+		t.Fatalf("failed to spend stamp: %s", err)
+	}
+	for i := 0; i < pruneInterval; i++ {
+		s := Create(dummyIP)
+		err := db.Spend(&s)
+		if err != nil {
+			t.Fatalf("failed to spend stamp: %s", err)
+		}
+	}
+	if db.Contains(&old) || !db.Contains(&stamp) {
+		t.Fatalf("database was not pruned while spending stamps")
+	}
+}
+
+func TestSpentDBUnspend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spent-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spent.db")
+
+	stamps := []Stamp{Create(dummyIP), Create(dummyIP), Create(dummyIP)}
+	db := openTestSpentDB(t, path)
+	for i := range stamps {
+		err := db.Spend(&stamps[i])
+		if err != nil {
+			t.Fatalf("failed to spend stamp: %s", err)
+		}
+	}
+	other := Create(dummyIP)
+	err = db.Unspend(&stamps[0], &stamps[2], &other)
+	if err != nil {
+		t.Fatalf("failed to unspend stamps: %s", err)
+	}
+	if db.Contains(&stamps[0]) || !db.Contains(&stamps[1]) || db.Contains(&stamps[2]) {
+		t.Fatalf("invalid database after unspending stamps")
+	}
+	// An unspent stamp can be spent again, including after a restart
+	err = db.Spend(&stamps[0])
+	if err != nil {
+		t.Fatalf("failed to spend stamp again: %s", err)
+	}
+	db.Close()
+
+	db = openTestSpentDB(t, path)
+	defer db.Close()
+	if db.Len() != 2 || !db.Contains(&stamps[0]) || !db.Contains(&stamps[1]) {
+		t.Fatalf("database was not reloaded after unspending stamps")
+	}
+}
+
+func TestSpentDBConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spent-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	db := openTestSpentDB(t, filepath.Join(dir, "spent.db"))
+	defer db.Close()
+
+	stamp := Create(dummyIP)
+	const n = 16
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := stamp
+			errs <- db.Spend(&s)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	spent := 0
+	for err := range errs {
+		if err == nil {
+			spent++
+		} else if !errors.Is(err, HashCashSpentErr) {
+			t.Fatalf("failed to spend stamp: %s", err)
+		}
+	}
+	if spent != 1 {
+		t.Fatalf("stamp spent %d times", spent)
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	prev, isSet := os.LookupEnv(cache.CacheLocalationEnvDir)
+	os.Setenv(cache.CacheLocalationEnvDir, dir)
+	defer func() {
+		restartLocalSpentDB()
+		if isSet {
+			os.Setenv(cache.CacheLocalationEnvDir, prev)
+		} else {
+			os.Unsetenv(cache.CacheLocalationEnvDir)
+		}
+	}()
+
+	kp, err := keys.LoadOrGenerate(dir)
+	if err != nil {
+		t.Fatalf("failed to generate key pair: %s", err)
+	}
+	_, untrusted, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	// Only the stamps signed by trusted nodes are valid
+	stamp := Create(dummyIP)
+	err = stamp.Mint(context.Background(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	if !errors.Is(stamp.IsValid(DefaultDifficulty), HashCashUnsignedErr) {
+		t.Fatalf("unsigned stamp is valid")
+	}
+	stamp.Sign(untrusted)
+	err = stamp.Mint(context.Background(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	if !errors.Is(stamp.IsValid(DefaultDifficulty), HashCashUntrustedErr) {
+		t.Fatalf("stamp signed by an untrusted key is valid")
+	}
+
+	stamp.Sign(kp.Private)
+	err = stamp.Mint(context.Background(), DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("failed to mint stamp: %s", err)
+	}
+	err = stamp.IsValid(DefaultDifficulty)
+	if err != nil {
+		t.Fatalf("new stamp is invalid: %s", err)
+	}
+	err = stamp.Spend()
+	if err != nil {
+		t.Fatalf("failed to spend valid stamp: %s", err)
+	}
+
+	// The stamp cannot be replayed, even after a restart
+	for i := 0; i < 2; i++ {
+		if !errors.Is(stamp.IsValid(DefaultDifficulty), HashCashSpentErr) {
+			t.Fatalf("spent stamp is still valid")
+		}
+		if !errors.Is(stamp.Spend(), HashCashSpentErr) {
+			t.Fatalf("stamp was spent twice")
+		}
+		restartLocalSpentDB()
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package identity
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// The identity of a node is the resource of the stamps it creates. It is,
+// by order of preference:
+// - the node ID set in the configuration,
+// - the address of the network interface set in the configuration, e.g., the
+//   interface used by Intel MPI on hosts with several interfaces,
+// - the hostname,
+// - the fingerprint of the public key of the node.
+
+const (
+	// NodeIDEnv is the name of the environment variable that can be used
+	// to set the ID of the node
+	NodeIDEnv = "SY_NODE_ID"
+
+	// IfnetEnv is the name of the environment variable that can be used to
+	// set the network interface identifying the node
+	IfnetEnv = "SY_NODE_IFNET"
+)
+
+// Source describes how the identity of a node was determined
+type Source string
+
+const (
+	// SourceConfig is a node ID set in the configuration
+	SourceConfig Source = "config"
+
+	// SourceInterface is the address of a network interface
+	SourceInterface Source = "interface"
+
+	// SourceHostname is the hostname
+	SourceHostname Source = "hostname"
+
+	// SourceKey is the fingerprint of the public key of the node
+	SourceKey Source = "key"
+)
+
+// Config are the settings identifying a node; the identity falls back to
+// the hostname when none is set
+type Config struct {
+	// NodeID is used as is when set
+	NodeID string
+
+	// Ifnet is the network interface whose address identifies the node
+	Ifnet string
+
+	// Basedir is the cache with the key pair of the node, the default cache
+	// when not set
+	Basedir string
+}
+
+// Identity is the identity of a node
+type Identity struct {
+	Resource string `json:"resource"`
+	Source   Source `json:"source"`
+}
+
+// hostname returns the name of the host; it can be replaced by the tests
+var hostname = os.Hostname
+
+// ConfigFromEnv returns the configuration set with the SY_NODE_ID and
+// SY_NODE_IFNET environment variables
+func ConfigFromEnv() Config {
+	return Config{
+		NodeID: os.Getenv(NodeIDEnv),
+		Ifnet:  os.Getenv(IfnetEnv),
+	}
+}
+
+// checkNodeID makes sure a node ID is a single printable word
+func checkNodeID(id string) error {
+	if id == "" {
+		return fmt.Errorf("empty node ID")
+	}
+	for _, r := range id {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return fmt.Errorf("invalid node ID %q", id)
+		}
+	}
+	return nil
+}
+
+// interfaceAddress returns the address of a network interface, an IPv4
+// address if it has one
+func interfaceAddress(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown network interface %s: %s", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("unable to get the addresses of %s: %s", name, err)
+	}
+
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return "", fmt.Errorf("network interface %s has no address", name)
+	}
+	return ipv6.String(), nil
+}
+
+// Resolve determines the identity of a node
+func Resolve(cfg Config) (Identity, error) {
+	if cfg.NodeID != "" {
+		err := checkNodeID(cfg.NodeID)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Resource: cfg.NodeID, Source: SourceConfig}, nil
+	}
+
+	if cfg.Ifnet != "" {
+		addr, err := interfaceAddress(cfg.Ifnet)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Resource: addr, Source: SourceInterface}, nil
+	}
+
+	name, err := hostname()
+	if err == nil && name != "" && name != "localhost" && checkNodeID(name) == nil {
+		return Identity{Resource: strings.ToLower(name), Source: SourceHostname}, nil
+	}
+
+	basedir := cfg.Basedir
+	if basedir == "" {
+		basedir = cache.GetBasedir()
+	}
+	kp, err := keys.LoadOrGenerate(basedir)
+	if err != nil {
+		return Identity{}, fmt.Errorf("unable to get the key pair of the node: %s", err)
+	}
+	return Identity{Resource: keys.Resource(kp.Public), Source: SourceKey}, nil
+}
+
+// Local returns the identity of the local node, as configured with the
+// environment
+func Local() (Identity, error) {
+	return Resolve(ConfigFromEnv())
+}
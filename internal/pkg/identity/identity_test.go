@@ -0,0 +1,107 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package identity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+func setTestHostname(name string, err error) func() {
+	prev := hostname
+	hostname = func() (string, error) {
+		return name, err
+	}
+	return func() {
+		hostname = prev
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	restore := setTestHostname("Node1.example.org", nil)
+	defer restore()
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected Identity
+	}{
+		{name: "node ID", cfg: Config{NodeID: "node-42", Ifnet: "ib0"}, expected: Identity{Resource: "node-42", Source: SourceConfig}},
+		{name: "hostname", cfg: Config{}, expected: Identity{Resource: "node1.example.org", Source: SourceHostname}},
+	}
+	for _, tt := range tests {
+		id, err := Resolve(tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: failed to resolve identity: %s", tt.name, err)
+		}
+		if id != tt.expected {
+			t.Fatalf("%s: identity is %+v instead of %+v", tt.name, id, tt.expected)
+		}
+	}
+	if _, err := Resolve(Config{NodeID: "node 42"}); err == nil {
+		t.Fatalf("node ID with a space was accepted")
+	}
+
+	// The identity is stable without hostname
+	restore()
+	restore = setTestHostname("", fmt.Errorf("no hostname"))
+	id, err := Resolve(Config{Basedir: dir})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s", err)
+	}
+	kp, err := keys.Load(dir)
+	if err != nil {
+		t.Fatalf("key pair was not created: %s", err)
+	}
+	if id.Source != SourceKey || id.Resource != "key-"+keys.Fingerprint(kp.Public) {
+		t.Fatalf("identity is %+v instead of the fingerprint of the key", id)
+	}
+	again, err := Resolve(Config{Basedir: dir})
+	if err != nil || again != id {
+		t.Fatalf("identity changed from %+v to %+v (%v)", id, again, err)
+	}
+}
+
+func TestResolveInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list network interfaces: %s", err)
+	}
+	var lo string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			lo = iface.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("no loopback interface")
+	}
+
+	id, err := Resolve(Config{Ifnet: lo})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s", err)
+	}
+	ip := net.ParseIP(id.Resource)
+	if id.Source != SourceInterface || ip == nil || !ip.IsLoopback() {
+		t.Fatalf("identity of interface %s is %+v", lo, id)
+	}
+
+	_, err = Resolve(Config{Ifnet: "does-not-exist0"})
+	if err == nil {
+		t.Fatalf("identity resolved from an unknown interface")
+	}
+}
@@ -6,39 +6,82 @@
 package isolated
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
 	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
 )
 
-func new() error {
+// In isolated mode, a single node does all the work: it mints the stamps,
+// creates the blocks, chains them and persists them in the local cache.
 
+// Init creates the namespace the blocks are added to, unless it already
+// exists in the local cache
+func Init(namespace string) error {
+	_, err := blockchain.LoadNamespace(namespace)
+	if err == nil {
+		return nil
+	}
+	_, err = blockchain.CreateNamespace(namespace)
+	if err != nil {
+		return fmt.Errorf("failed to create namespace %s: %s", namespace, err)
+	}
 	return nil
 }
 
-func chain(b blockchain.Block) error {
-
-	return nil
+// mint mints a signed stamp for the current difficulty of a namespace,
+// unless it is already minted for it
+func mint(namespace string, stamp *hashcash.Stamp) error {
+	difficulty, err := blockchain.CurrentDifficulty(namespace)
+	if err != nil {
+		return err
+	}
+	if stamp.ValidAt(time.Now(), difficulty) == nil {
+		return nil
+	}
+	return stamp.Mint(context.Background(), difficulty)
 }
 
-func CreateBlock(stamp hashcash.Stamp) error {
+// CreateBlock creates a block of a namespace from a signed stamp, chains it
+// and persists it along with the local copies of the manifests of the stamp
+func CreateBlock(namespace string, stamp hashcash.Stamp, manifests []string) error {
 	// Because we combine a blockchain and a file system, we need to:
 	// 1. actually create a new block
 	// 2. chain it to the previous block, which automatically saves the data into the FS
 
-	block, err := blockchain.Create(stamp)
+	err := mint(namespace, &stamp)
+	if err != nil {
+		return fmt.Errorf("failed to mint stamp: %s", err)
+	}
+	block, err := blockchain.IsolatedCreate(namespace, stamp)
 	if err != nil {
 		return fmt.Errorf("failed to create block from stamp: %s", err)
 	}
+	for _, m := range manifests {
+		block.AttachManifest(m)
+	}
 
 	// By the time the chain operation completes, the block is part of
 	// the block chain. We are in isolated mode so it is still a simple
 	// operation but guarantee persistency (i.e., it is in a block "cache")
-	err := block.Publish()
+	err = block.Publish(nil)
 	if err != nil {
 		return fmt.Errorf("failed to chain block: %s", err)
 	}
 
 	return nil
 }
+
+// Verify checks the chain of a namespace of the local cache, including the
+// stored copies of the manifests
+func Verify(namespace string) error {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return err
+	}
+	return blockchain.Verify(s, namespace, blockchain.VerifyOptions{
+		ManifestPath: s.ManifestPath,
+	})
+}
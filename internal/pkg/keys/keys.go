@@ -0,0 +1,240 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+// Every node has an Ed25519 key pair, stored in the cache, to sign the stamps
+// and blocks it creates. The private key is stored as the hexadecimal encoding
+// of its seed, the public keys as their hexadecimal encoding. The public keys
+// of the peers whose signatures are accepted are stored in the directory of
+// trusted keys, one file per peer.
+
+const (
+	privateKeyFileName = "node.key"
+	publicKeyFileName  = "node.pub"
+	publicKeySuffix    = ".pub"
+)
+
+// ErrNoKey is returned when the local node has no key pair
+var ErrNoKey = errors.New("no key pair")
+
+// ErrKeyExists is returned when a key pair would overwrite the existing one
+var ErrKeyExists = errors.New("key pair already exists")
+
+// ResourcePrefix starts the identity of the nodes identified by their key,
+// see Resource
+const ResourcePrefix = "key-"
+
+// KeyPair is the key pair of a node
+type KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// TrustedKey is a public key of a peer trusted by the local node
+type TrustedKey struct {
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// EncodePublicKey returns the hexadecimal encoding of a public key
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
+}
+
+// ParsePublicKey parses the hexadecimal encoding of a public key
+func ParsePublicKey(str string) (ed25519.PublicKey, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(str))
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", str)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// Fingerprint returns a short identifier of a public key, e.g., to compare
+// keys out of band
+func Fingerprint(key ed25519.PublicKey) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+// Resource returns the identity of a node that is identified by its key,
+// i.e., the resource of the stamps it creates
+func Resource(key ed25519.PublicKey) string {
+	return ResourcePrefix + Fingerprint(key)
+}
+
+// Generate creates a new key pair for the local node; the existing key pair
+// is only replaced when force is set
+func Generate(basedir string, force bool) (KeyPair, error) {
+	dir := cache.GetKeysDir(basedir)
+	path := filepath.Join(dir, privateKeyFileName)
+	if _, err := os.Stat(path); err == nil && !force {
+		return KeyPair{}, fmt.Errorf("%w: %s", ErrKeyExists, path)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("failed to generate key pair: %s", err)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+	err = writeFile(path, hex.EncodeToString(priv.Seed()), 0600)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	err = writeFile(filepath.Join(dir, publicKeyFileName), EncodePublicKey(pub), 0644)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	return KeyPair{Public: pub, Private: priv}, nil
+}
+
+// writeFile atomically replaces the content of a file
+func writeFile(path string, content string, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(content+"\n"), perm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// Load returns the key pair of the local node
+func Load(basedir string) (KeyPair, error) {
+	path := filepath.Join(cache.GetKeysDir(basedir), privateKeyFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return KeyPair{}, fmt.Errorf("%w: %s does not exist", ErrNoKey, path)
+	}
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return KeyPair{}, fmt.Errorf("invalid private key in %s", path)
+	}
+
+	priv := ed25519.NewKeyFromSeed(seed)
+	return KeyPair{Public: priv.Public().(ed25519.PublicKey), Private: priv}, nil
+}
+
+// LoadOrGenerate returns the key pair of the local node, which is created
+// the first time
+func LoadOrGenerate(basedir string) (KeyPair, error) {
+	kp, err := Load(basedir)
+	if errors.Is(err, ErrNoKey) {
+		kp, err = Generate(basedir, false)
+		if errors.Is(err, ErrKeyExists) {
+			// Created by someone else in the meantime
+			kp, err = Load(basedir)
+		}
+	}
+	return kp, err
+}
+
+// Trust adds the public key of a peer to the trusted keys, under a name
+// identifying the peer
+func Trust(basedir string, name string, key ed25519.PublicKey) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	dir := cache.GetTrustedKeysDir(basedir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+	return writeFile(filepath.Join(dir, name+publicKeySuffix), EncodePublicKey(key), 0644)
+}
+
+// ListTrusted returns the trusted public keys of the peers, sorted by name
+func ListTrusted(basedir string) ([]TrustedKey, error) {
+	dir := cache.GetTrustedKeysDir(basedir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", dir, err)
+	}
+
+	var trusted []TrustedKey
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), publicKeySuffix) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", path, err)
+		}
+		key, err := ParsePublicKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		trusted = append(trusted, TrustedKey{
+			Name:        strings.TrimSuffix(e.Name(), publicKeySuffix),
+			Key:         EncodePublicKey(key),
+			Fingerprint: Fingerprint(key),
+		})
+	}
+	sort.Slice(trusted, func(i, j int) bool {
+		return trusted[i].Name < trusted[j].Name
+	})
+	return trusted, nil
+}
+
+// Keyring is the set of the public keys whose signatures the local node
+// accepts: its own key and the trusted keys of its peers
+type Keyring map[string]bool
+
+// LoadKeyring returns the keyring of the local node
+func LoadKeyring(basedir string) (Keyring, error) {
+	kr := make(Keyring)
+	kp, err := Load(basedir)
+	if err == nil {
+		kr[EncodePublicKey(kp.Public)] = true
+	} else if !errors.Is(err, ErrNoKey) {
+		return nil, err
+	}
+
+	trusted, err := ListTrusted(basedir)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trusted {
+		kr[t.Key] = true
+	}
+	return kr, nil
+}
+
+// Contains checks whether a public key is in the keyring
+func (kr Keyring) Contains(key ed25519.PublicKey) bool {
+	return kr[EncodePublicKey(key)]
+}
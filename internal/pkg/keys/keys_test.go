@@ -0,0 +1,117 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package keys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func createTestBasedir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keys-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGenerateLoad(t *testing.T) {
+	basedir, cleanup := createTestBasedir(t)
+	defer cleanup()
+
+	_, err := Load(basedir)
+	if !errors.Is(err, ErrNoKey) {
+		t.Fatalf("loaded a key pair that does not exist: %v", err)
+	}
+	kp, err := LoadOrGenerate(basedir)
+	if err != nil {
+		t.Fatalf("failed to generate key pair: %s", err)
+	}
+	loaded, err := Load(basedir)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %s", err)
+	}
+	if !bytes.Equal(loaded.Public, kp.Public) || !bytes.Equal(loaded.Private, kp.Private) {
+		t.Fatalf("loaded key pair differs from the generated one")
+	}
+	sig := ed25519.Sign(loaded.Private, []byte("data"))
+	if !ed25519.Verify(kp.Public, []byte("data"), sig) {
+		t.Fatalf("loaded private key does not match the public key")
+	}
+
+	// The key pair is only replaced on purpose
+	_, err = Generate(basedir, false)
+	if !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("existing key pair was replaced: %v", err)
+	}
+	again, err := LoadOrGenerate(basedir)
+	if err != nil || !bytes.Equal(again.Public, kp.Public) {
+		t.Fatalf("existing key pair was not loaded: %v", err)
+	}
+	replaced, err := Generate(basedir, true)
+	if err != nil {
+		t.Fatalf("failed to replace key pair: %s", err)
+	}
+	if bytes.Equal(replaced.Public, kp.Public) {
+		t.Fatalf("new key pair is the previous one")
+	}
+}
+
+func TestTrust(t *testing.T) {
+	basedir, cleanup := createTestBasedir(t)
+	defer cleanup()
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	kr, err := LoadKeyring(basedir)
+	if err != nil || len(kr) != 0 {
+		t.Fatalf("keyring of an empty cache is not empty: %v (%v)", kr, err)
+	}
+	if Trust(basedir, "../peer", pub) == nil {
+		t.Fatalf("key trusted with an invalid name")
+	}
+	err = Trust(basedir, "peer1", pub)
+	if err != nil {
+		t.Fatalf("failed to trust key: %s", err)
+	}
+	kp, err := Generate(basedir, false)
+	if err != nil {
+		t.Fatalf("failed to generate key pair: %s", err)
+	}
+
+	trusted, err := ListTrusted(basedir)
+	if err != nil {
+		t.Fatalf("failed to list trusted keys: %s", err)
+	}
+	if len(trusted) != 1 || trusted[0].Name != "peer1" || trusted[0].Key != EncodePublicKey(pub) || trusted[0].Fingerprint != Fingerprint(pub) {
+		t.Fatalf("invalid trusted keys: %v", trusted)
+	}
+	parsed, err := ParsePublicKey(trusted[0].Key)
+	if err != nil || !bytes.Equal(parsed, pub) {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+
+	kr, err = LoadKeyring(basedir)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %s", err)
+	}
+	if !kr.Contains(pub) || !kr.Contains(kp.Public) || kr.Contains(other) {
+		t.Fatalf("invalid keyring: %v", kr)
+	}
+}
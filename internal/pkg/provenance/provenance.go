@@ -12,6 +12,10 @@ import (
 	"path/filepath"
 
 	"github.com/sylabs/singularity-mpi/pkg/manifest"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
 	"github.com/sylabs/syvalidate/internal/pkg/sys"
 	"github.com/sylabs/syvalidate/pkg/syblockchainfs"
 )
@@ -38,6 +42,7 @@ func Init() (Provenance, error) {
 	// Init the blockchain file system
 	fsInfo := syblockchainfs.Info{
 		Connected: false, // todo: do not hardcode that, must be a configuration thingy
+		Identity:  identity.ConfigFromEnv(),
 	}
 	p.fs, err = syblockchainfs.Init(&fsInfo)
 	if err != nil {
@@ -73,15 +78,19 @@ func (p *Provenance) Commit() error {
 	// Calculate the final hashes for the manifests themselves that did not have one yet
 
 	// Generate stamp and publish it to create the blockchain
-	myip := "toto"
-	stamp := p.fs.CreateStamp(myip)
+	stamp := p.fs.CreateStamp(p.fs.Resource())
 	for _, m := range p.manifests {
-		err := stamp.AddManifest(m)
+		err := stamp.AddManifest(m, hashcash.KindResult)
 		if err != nil {
 			return fmt.Errorf("failed to add manifest %s to stamp: %s", m, err)
 		}
 	}
-	err := p.fs.CreateBlock(stamp)
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		return fmt.Errorf("failed to get the key to sign the stamp: %s", err)
+	}
+	stamp.Sign(kp.Private)
+	err = p.fs.CreateBlock(stamp, p.manifests)
 	if err != nil {
 		return fmt.Errorf("failed to create block: %s", err)
 	}
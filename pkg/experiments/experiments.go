@@ -214,8 +214,7 @@ func Run(exp Config, sysCfg *sys.Config, syConfig *sy.MPIToolConfig) (bool, resu
 		return false, expRes, execRes
 	}
 
-	/* Capture the hardware/system configuration in order to capture provence of the experiment */
-	SOMETHING
+	/* TODO: capture the hardware/system configuration in order to capture the provenance of the experiment */
 
 	/* Install MPI on the host */
 	execRes = b.InstallOnHost(&myHostMPICfg.Implem, &myHostMPICfg.Buildenv, sysCfg)
@@ -0,0 +1,257 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syblockchainfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/isolated"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+// The functions of this file give access to the chains of the local cache as
+// a file system. Every write of a file is a block whose stamp lists the file
+// as a manifest named after its path; the content of the file is stored by
+// its hash. A file has a version for every block listing it, the chain is
+// its history. Manifests of other kinds, e.g., the results of experiments,
+// are files as well.
+
+// ErrNotExist is returned when a file is not part of a chain
+var ErrNotExist = errors.New("file does not exist")
+
+// FileInfo describes a version of a file
+type FileInfo struct {
+	// Path is the path of the file in its namespace
+	Path string `json:"path"`
+
+	// Version is the number of the version, starting at 1
+	Version int `json:"version"`
+
+	SHA256 string                `json:"sha256"`
+	Size   int64                 `json:"size"`
+	Kind   hashcash.ManifestKind `json:"kind"`
+
+	// ModTime is the time the block of the version was committed
+	ModTime time.Time `json:"modtime"`
+
+	// Block and Height identify the block of the version
+	Block  string `json:"block"`
+	Height uint64 `json:"height"`
+
+	// Resource is the identity of the node that wrote the version
+	Resource string `json:"resource"`
+}
+
+// cleanPath returns the canonical form of the path of a file, without
+// leading slash
+func cleanPath(p string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if clean == "" {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return clean, nil
+}
+
+// Put writes a file to a namespace, which is created if it does not exist
+// yet; only isolated mode is supported for now
+func (fs *SyBlockchainFS) Put(namespace string, p string, r io.Reader) (FileInfo, error) {
+	if fs.info.Connected {
+		return FileInfo{}, fmt.Errorf("writing files is not supported in connected mode")
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	err = isolated.Init(namespace)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	h, err := s.PutObject(r)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to store %s: %s", p, err)
+	}
+	object := s.ObjectPath(h)
+	fi, err := os.Stat(object)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		return FileInfo{}, err
+	}
+	stamp := hashcash.Create(fs.Resource())
+	err = stamp.AddManifestEntry(hashcash.Manifest{
+		Name:   p,
+		SHA256: h,
+		Size:   fi.Size(),
+		Kind:   hashcash.KindFile,
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	stamp.Sign(kp.Private)
+
+	// The content is already stored, the copy attached to the block is the
+	// stored object itself
+	err = isolated.CreateBlock(namespace, stamp, []string{object})
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to write %s: %s", p, err)
+	}
+	return Stat(namespace, p)
+}
+
+// files returns the versions of the files of a namespace, in the order of
+// the chain; only the files selected by a filter on their path are returned
+func files(namespace string, match func(p string) bool) ([]FileInfo, error) {
+	blocks, err := ListBlocks(namespace, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []FileInfo
+	count := make(map[string]int)
+	for _, b := range blocks {
+		for _, stamp := range b.Stamps() {
+			manifests, err := stamp.Manifests()
+			if err != nil {
+				return nil, fmt.Errorf("block %s: %s", b.Hash(), err)
+			}
+			for _, m := range manifests {
+				if !match(m.Name) {
+					continue
+				}
+				count[m.Name]++
+				versions = append(versions, FileInfo{
+					Path:     m.Name,
+					Version:  count[m.Name],
+					SHA256:   m.SHA256,
+					Size:     m.Size,
+					Kind:     m.Kind,
+					ModTime:  b.Timestamp(),
+					Block:    b.Hash(),
+					Height:   b.Height(),
+					Resource: stamp.Resource(),
+				})
+			}
+		}
+	}
+	return versions, nil
+}
+
+// History returns all the versions of a file, the oldest first
+func History(namespace string, p string) ([]FileInfo, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := files(namespace, func(name string) bool { return name == p })
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, p)
+	}
+	return versions, nil
+}
+
+// StatVersion describes a version of a file
+func StatVersion(namespace string, p string, version int) (FileInfo, error) {
+	versions, err := History(namespace, p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if version < 1 || version > len(versions) {
+		return FileInfo{}, fmt.Errorf("%w: %s has no version %d", ErrNotExist, p, version)
+	}
+	return versions[version-1], nil
+}
+
+// Stat describes the latest version of a file
+func Stat(namespace string, p string) (FileInfo, error) {
+	versions, err := History(namespace, p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// List describes the latest version of the files of a namespace under a
+// directory, sorted by path; all the files are listed when dir is empty
+func List(namespace string, dir string) ([]FileInfo, error) {
+	prefix := ""
+	if dir != "" {
+		clean, err := cleanPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		prefix = clean + "/"
+	}
+	versions, err := files(namespace, func(name string) bool { return strings.HasPrefix(name, prefix) })
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]FileInfo)
+	var paths []string
+	for _, v := range versions {
+		if _, ok := latest[v.Path]; !ok {
+			paths = append(paths, v.Path)
+		}
+		latest[v.Path] = v
+	}
+	sort.Strings(paths)
+	list := make([]FileInfo, 0, len(paths))
+	for _, p := range paths {
+		list = append(list, latest[p])
+	}
+	return list, nil
+}
+
+// open opens the stored content of a version of a file
+func open(fi FileInfo) (io.ReadCloser, error) {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	if !s.HasObject(fi.SHA256) {
+		return nil, fmt.Errorf("content of %s (version %d) is not stored locally", fi.Path, fi.Version)
+	}
+	return os.Open(s.ObjectPath(fi.SHA256))
+}
+
+// Get opens the latest version of a file
+func Get(namespace string, p string) (io.ReadCloser, error) {
+	fi, err := Stat(namespace, p)
+	if err != nil {
+		return nil, err
+	}
+	return open(fi)
+}
+
+// GetVersion opens a given version of a file
+func GetVersion(namespace string, p string, version int) (io.ReadCloser, error) {
+	fi, err := StatVersion(namespace, p, version)
+	if err != nil {
+		return nil, err
+	}
+	return open(fi)
+}
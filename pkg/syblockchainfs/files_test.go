@@ -0,0 +1,137 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syblockchainfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+)
+
+func readFile(t *testing.T, namespace string, p string, version int) string {
+	r, err := GetVersion(namespace, p, version)
+	if err != nil {
+		t.Fatalf("failed to open version %d of %s: %s", version, p, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read version %d of %s: %s", version, p, err)
+	}
+	return string(data)
+}
+
+func TestFiles(t *testing.T) {
+	_, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	// A low difficulty keeps the minting of the stamps fast
+	namespace := "test-files"
+	_, err := blockchain.CreateNamespaceWithConfig(namespace, blockchain.NamespaceConfig{Difficulty: 8})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	fs, err := Init(&Info{Namespace: namespace, Identity: identity.Config{NodeID: "node0"}})
+	if err != nil {
+		t.Fatalf("failed to initialize in isolated mode: %s", err)
+	}
+
+	writes := []struct {
+		path    string
+		content string
+	}{
+		{path: "/results/openmpi-4.0.2/output.txt", content: "first run"},
+		{path: "results/mpich-3.3/output.txt", content: "mpich run"},
+		{path: "results/openmpi-4.0.2/../openmpi-4.0.2/output.txt", content: "second run"},
+		{path: "platform.txt", content: "x86_64"},
+	}
+	for _, w := range writes {
+		_, err := fs.Put(namespace, w.path, strings.NewReader(w.content))
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", w.path, err)
+		}
+	}
+	_, err = fs.Put(namespace, "/", strings.NewReader("root"))
+	if err == nil {
+		t.Fatalf("file written at the root")
+	}
+	// The path of the file would be taken for the signature of the stamp
+	_, err = fs.Put(namespace, "/sig/../sig/ed25519", strings.NewReader("key"))
+	if !errors.Is(err, hashcash.HashCashManifestErr) {
+		t.Fatalf("file written at the name of the signature: %v", err)
+	}
+
+	p := "results/openmpi-4.0.2/output.txt"
+	fi, err := Stat(namespace, p)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", p, err)
+	}
+	if fi.Version != 2 || fi.Size != int64(len("second run")) || fi.Kind != hashcash.KindFile || fi.Resource != "node0" || fi.Height != 3 {
+		t.Fatalf("invalid description of %s: %+v", p, fi)
+	}
+	history, err := History(namespace, "/"+p)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("%s has %d versions instead of 2 (%v)", p, len(history), err)
+	}
+	if history[0].Block == history[1].Block || history[0].SHA256 == history[1].SHA256 {
+		t.Fatalf("versions of %s are not distinct: %+v", p, history)
+	}
+	if readFile(t, namespace, p, 1) != "first run" || readFile(t, namespace, p, 2) != "second run" {
+		t.Fatalf("invalid content of the versions of %s", p)
+	}
+	r, err := Get(namespace, p)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", p, err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "second run" {
+		t.Fatalf("latest version of %s is %q", p, data)
+	}
+
+	_, err = Stat(namespace, "results/missing.txt")
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("missing file has a description: %v", err)
+	}
+	_, err = GetVersion(namespace, p, 3)
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("missing version can be opened: %v", err)
+	}
+
+	tests := []struct {
+		dir      string
+		expected []string
+	}{
+		{dir: "", expected: []string{"platform.txt", "results/mpich-3.3/output.txt", p}},
+		{dir: "/results", expected: []string{"results/mpich-3.3/output.txt", p}},
+		{dir: "results/openmpi-4.0.2/", expected: []string{p}},
+		{dir: "result", expected: nil},
+	}
+	for _, tt := range tests {
+		list, err := List(namespace, tt.dir)
+		if err != nil {
+			t.Fatalf("failed to list %s: %s", tt.dir, err)
+		}
+		var paths []string
+		for _, fi := range list {
+			paths = append(paths, fi.Path)
+		}
+		if strings.Join(paths, " ") != strings.Join(tt.expected, " ") {
+			t.Fatalf("%q lists %v instead of %v", tt.dir, paths, tt.expected)
+		}
+	}
+
+	// The writes are regular blocks
+	err = fs.Verify()
+	if err != nil {
+		t.Fatalf("invalid chain: %s", err)
+	}
+}
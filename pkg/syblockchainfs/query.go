@@ -0,0 +1,76 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syblockchainfs
+
+import (
+	"fmt"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+)
+
+// The functions of this file query the chains of the local cache, e.g., to
+// find the blocks including the manifest of a given build of MPI.
+
+// Namespaces returns the namespaces of the local cache
+func Namespaces() ([]string, error) {
+	return cache.LoadNamespaces(cache.GetBasedir())
+}
+
+// GetBlock returns the block of a namespace with a given hash
+func GetBlock(namespace string, hash string) (*blockchain.Block, error) {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.BlockByHash(namespace, hash)
+}
+
+// GetBlockAt returns the block at a given height of the chain of a namespace
+func GetBlockAt(namespace string, height uint64) (*blockchain.Block, error) {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.BlockAt(namespace, height)
+}
+
+// ListBlocks returns at most count blocks of a namespace, starting at a given
+// height; all the remaining blocks are returned when count is 0
+func ListBlocks(namespace string, from uint64, count uint64) ([]*blockchain.Block, error) {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.Blocks(s, namespace, from, count)
+}
+
+// FindBlocks returns the blocks matching a query, in the order of the chains;
+// all the namespaces are searched when namespace is empty
+func FindBlocks(namespace string, q blockchain.Query) ([]*blockchain.Block, error) {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{namespace}
+	if namespace == "" {
+		namespaces, err = Namespaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var blocks []*blockchain.Block
+	for _, ns := range namespaces {
+		found, err := blockchain.Find(s, ns, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search namespace %s: %s", ns, err)
+		}
+		blocks = append(blocks, found...)
+	}
+	return blocks, nil
+}
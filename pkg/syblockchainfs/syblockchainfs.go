@@ -9,8 +9,10 @@ import (
 	"fmt"
 
 	"github.com/sylabs/singularity-mpi/pkg/sys"
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
 	"github.com/sylabs/syvalidate/internal/pkg/connected"
 	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
 	"github.com/sylabs/syvalidate/internal/pkg/isolated"
 )
 
@@ -18,25 +20,33 @@ type Mode int
 
 const (
 	LeaderMode   Mode = 0
-	PeerMode          = 1
+	PeerMode     Mode = 1
 	IsolatedMode Mode = 2
 )
 
+// DefaultNamespace is the namespace of the blocks when none is configured
+const DefaultNamespace = "syvalidate"
+
 // CreateStamp is the function pointer to create a new stamp
 type CreateStampFn func(string) hashcash.Stamp
 
-// CreateBlockFn is the function pointer to create a new block
-type CreateBlockFn func(hashcash.Stamp) error
+// CreateBlockFn is the function pointer to create a new block from a signed
+// stamp and the local copies of its manifests
+type CreateBlockFn func(hashcash.Stamp, []string) error
 
 type SyBlockchainFS struct {
 	info Info
 
+	// id is the identity of the node, the resource of the stamps it creates
+	id identity.Identity
+
 	sysCfg *sys.Config
 
 	// CreateStamp is the function that creates a new stamp
 	CreateStamp CreateStampFn
 
-	// CreateBlock is the function that create a new block from a stamp
+	// CreateBlock is the function that create a new block from a stamp and
+	// the local copies of its manifests
 	CreateBlock CreateBlockFn
 }
 
@@ -50,13 +60,35 @@ type Info struct {
 	// IsLeader specifies if we are currently in the context of a leader
 	// while in connected mode
 	IsLeader bool
+
+	// Consensus is the consensus algorithm used by the nodes in connected
+	// mode: blockchain.ConsensusPBFT (default) when some nodes may not be
+	// trusted, blockchain.ConsensusRaft for trusted clusters
+	Consensus blockchain.ConsensusType
+
+	// Namespace is the namespace of the chain the blocks are added to,
+	// DefaultNamespace when not set
+	Namespace string
+
+	// Identity is the configuration of the identity of the node, see
+	// identity.ConfigFromEnv
+	Identity identity.Config
 }
 
 func initIsolatedMode(i *Info) (SyBlockchainFS, error) {
 	var syBCFS SyBlockchainFS
 
+	err := isolated.Init(i.Namespace)
+	if err != nil {
+		return syBCFS, err
+	}
+
+	// The namespace is captured by value, the caller may reuse its Info
+	namespace := i.Namespace
 	syBCFS.CreateStamp = hashcash.Create
-	syBCFS.CreateBlock = isolated.CreateBlock
+	syBCFS.CreateBlock = func(stamp hashcash.Stamp, manifests []string) error {
+		return isolated.CreateBlock(namespace, stamp, manifests)
+	}
 
 	return syBCFS, nil
 }
@@ -83,7 +115,9 @@ func (fs *SyBlockchainFS) Switch(m Mode) error {
 	case IsolatedMode:
 		return fmt.Errorf("cannot switch from isolated mode to connected mode without restart and configuration change")
 	case LeaderMode:
-		// A leader is not supposed to create stamps; it can only create blocks (and submit them) from stamps
+		// A leader is not supposed to create stamps; it creates blocks out
+		// of the stamps submitted to the network, which go through
+		// consensus, so they cannot be created directly either
 		fs.CreateStamp = nil
 		fs.CreateBlock = connected.CreateBlock
 		fs.info.IsLeader = true
@@ -105,19 +139,59 @@ func Init(i *Info) (SyBlockchainFS, error) {
 	var fs SyBlockchainFS
 	var err error
 
+	i.Consensus, err = blockchain.ParseConsensusType(string(i.Consensus))
+	if err != nil {
+		return fs, fmt.Errorf("invalid configuration: %s", err)
+	}
+	if i.Namespace == "" {
+		i.Namespace = DefaultNamespace
+	}
+
 	if i.Connected {
-		fs, err = initIsolatedMode(i)
+		fs, err = initConnectedMode(i)
 		if err != nil {
-			return fs, fmt.Errorf("failed to initialize in isolated mode: %s", err)
+			return fs, fmt.Errorf("failed to initialize in connected mode: %s", err)
 		}
 	} else {
-		fs, err = initConnectedMode(i)
+		fs, err = initIsolatedMode(i)
 		if err != nil {
-			return fs, fmt.Errorf("failed to initialize in connected mode: %s", err)
+			return fs, fmt.Errorf("failed to initialize in isolated mode: %s", err)
 		}
 	}
 
+	fs.id, err = identity.Resolve(i.Identity)
+	if err != nil {
+		return fs, fmt.Errorf("failed to get the identity of the node: %s", err)
+	}
 	fs.info = *i
 
 	return fs, nil
 }
+
+// Consensus returns the consensus algorithm selected for the network
+func (fs *SyBlockchainFS) Consensus() blockchain.ConsensusType {
+	return fs.info.Consensus
+}
+
+// Resource returns the identity of the node, i.e., the resource of the stamps
+// it creates and the one it expects in the stamps it receives
+func (fs *SyBlockchainFS) Resource() string {
+	return fs.id.Resource
+}
+
+// Namespace returns the namespace of the chain the blocks are added to
+func (fs *SyBlockchainFS) Namespace() string {
+	return fs.info.Namespace
+}
+
+// Verify checks the chain the blocks are added to, as stored in the local
+// cache, in isolated and connected mode alike
+func (fs *SyBlockchainFS) Verify() error {
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		return err
+	}
+	return blockchain.Verify(s, fs.info.Namespace, blockchain.VerifyOptions{
+		ManifestPath: s.ManifestPath,
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package syblockchainfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sylabs/syvalidate/internal/pkg/blockchain"
+	"github.com/sylabs/syvalidate/internal/pkg/cache"
+	"github.com/sylabs/syvalidate/internal/pkg/connected"
+	"github.com/sylabs/syvalidate/internal/pkg/hash"
+	"github.com/sylabs/syvalidate/internal/pkg/hashcash"
+	"github.com/sylabs/syvalidate/internal/pkg/identity"
+	"github.com/sylabs/syvalidate/internal/pkg/keys"
+)
+
+func setTestCacheDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "syblockchainfs-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	prev, isSet := os.LookupEnv(cache.CacheLocalationEnvDir)
+	os.Setenv(cache.CacheLocalationEnvDir, dir)
+
+	return dir, func() {
+		if isSet {
+			os.Setenv(cache.CacheLocalationEnvDir, prev)
+		} else {
+			os.Unsetenv(cache.CacheLocalationEnvDir)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIsolatedMode(t *testing.T) {
+	dir, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	// A low difficulty keeps the minting of the stamps fast
+	namespace := "test-isolated"
+	_, err := blockchain.CreateNamespaceWithConfig(namespace, blockchain.NamespaceConfig{Difficulty: 8})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %s", err)
+	}
+	info := &Info{
+		Connected: false,
+		Namespace: namespace,
+		Identity:  identity.Config{NodeID: "node0"},
+	}
+	fs, err := Init(info)
+	if err != nil {
+		t.Fatalf("failed to initialize in isolated mode: %s", err)
+	}
+	// The file system does not depend on the configuration it was created
+	// from anymore
+	info.Namespace = "test-other"
+	if fs.CreateStamp == nil || fs.CreateBlock == nil || fs.Namespace() != namespace || fs.Resource() != "node0" {
+		t.Fatalf("invalid file system in isolated mode: %+v", fs.info)
+	}
+	kp, err := keys.LoadOrGenerate(cache.GetBasedir())
+	if err != nil {
+		t.Fatalf("failed to get the key of the node: %s", err)
+	}
+
+	var manifests []string
+	for _, name := range []string{"openmpi-4.0.2", "mpich-3.3"} {
+		path := filepath.Join(dir, name+".MANIFEST")
+		err := ioutil.WriteFile(path, []byte("results of "+name), 0644)
+		if err != nil {
+			t.Fatalf("failed to create manifest: %s", err)
+		}
+		manifests = append(manifests, path)
+
+		stamp := fs.CreateStamp(fs.Resource())
+		err = stamp.AddManifest(path, hashcash.KindResult)
+		if err != nil {
+			t.Fatalf("failed to add manifest: %s", err)
+		}
+		stamp.Sign(kp.Private)
+		err = fs.CreateBlock(stamp, []string{path})
+		if err != nil {
+			t.Fatalf("failed to create block: %s", err)
+		}
+	}
+
+	blocks, err := ListBlocks(namespace, 0, 0)
+	if err != nil || len(blocks) != 3 {
+		t.Fatalf("chain has %d blocks instead of 3 (%v)", len(blocks), err)
+	}
+	for _, b := range blocks[1:] {
+		if len(b.Stamps()) != 1 || b.Stamps()[0].Resource() != "node0" {
+			t.Fatalf("block %s does not have a stamp of node0", b.Hash())
+		}
+	}
+	err = fs.Verify()
+	if err != nil {
+		t.Fatalf("invalid chain: %s", err)
+	}
+
+	// The chain is still valid once reloaded
+	reloaded, err := Init(&Info{Namespace: namespace, Identity: identity.Config{NodeID: "node0"}})
+	if err != nil {
+		t.Fatalf("failed to initialize again: %s", err)
+	}
+	err = reloaded.Verify()
+	if err != nil {
+		t.Fatalf("invalid chain after reloading: %s", err)
+	}
+	peer, err := Init(&Info{Connected: true, Namespace: namespace, Identity: identity.Config{NodeID: "node0"}})
+	if err != nil {
+		t.Fatalf("failed to initialize in connected mode: %s", err)
+	}
+	err = peer.Verify()
+	if err != nil {
+		t.Fatalf("invalid chain in connected mode: %s", err)
+	}
+
+	// Changing a stored manifest breaks the chain
+	s, err := blockchain.LocalBlockStore()
+	if err != nil {
+		t.Fatalf("failed to open the local store: %s", err)
+	}
+	err = ioutil.WriteFile(s.ObjectPath(hash.HashFile(manifests[1])), []byte("tampered"), 0600)
+	if err != nil {
+		t.Fatalf("failed to tamper with manifest: %s", err)
+	}
+	err = fs.Verify()
+	if verr, ok := err.(*blockchain.VerifyError); !ok || verr.Height != 2 {
+		t.Fatalf("chain with a tampered manifest is valid: %v", err)
+	}
+}
+
+func TestInitDefaultNamespace(t *testing.T) {
+	_, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	fs, err := Init(&Info{Identity: identity.Config{NodeID: "node0"}})
+	if err != nil {
+		t.Fatalf("failed to initialize in isolated mode: %s", err)
+	}
+	if fs.Namespace() != DefaultNamespace {
+		t.Fatalf("namespace is %s instead of %s", fs.Namespace(), DefaultNamespace)
+	}
+	namespaces, err := Namespaces()
+	if err != nil || len(namespaces) != 1 || namespaces[0] != DefaultNamespace {
+		t.Fatalf("namespaces are %v instead of %s (%v)", namespaces, DefaultNamespace, err)
+	}
+}
+
+func TestSwitchMode(t *testing.T) {
+	_, cleanup := setTestCacheDir(t)
+	defer cleanup()
+
+	fs, err := Init(&Info{Connected: true, Identity: identity.Config{NodeID: "node0"}})
+	if err != nil {
+		t.Fatalf("failed to initialize in connected mode: %s", err)
+	}
+	if fs.CreateStamp == nil || fs.CreateBlock != nil {
+		t.Fatalf("a peer creates blocks")
+	}
+
+	// Blocks of a leader only go through consensus
+	err = fs.Switch(LeaderMode)
+	if err != nil {
+		t.Fatalf("failed to switch to leader mode: %s", err)
+	}
+	err = fs.CreateBlock(hashcash.Create(fs.Resource()), nil)
+	if !errors.Is(err, connected.ErrNotSupported) {
+		t.Fatalf("block created directly in leader mode: %v", err)
+	}
+	if fs.Switch(IsolatedMode) == nil {
+		t.Fatalf("switched from connected mode to isolated mode")
+	}
+}